@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/validator"
+)
+
+type createAPIKeyInput struct {
+	Name        string     `json:"name"`
+	Permissions []string   `json:"permissions"`
+	Expiry      *time.Time `json:"expiry"`
+}
+
+// createAPIKeyHandler creates an API key limited to some of the user's permissions.
+// The response is the only time the key itself is shown; we only store its hash.
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input createAPIKeyInput
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.apiKeyPermissions(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidOrganizationHeader):
+			app.badRequestResponse(w, r, err)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notAMemberResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	key := &data.APIKey{
+		UserID:      user.ID,
+		Name:        input.Name,
+		Permissions: input.Permissions,
+		Expiry:      input.Expiry,
+	}
+
+	v := validator.New()
+
+	if data.ValidateAPIKey(v, key, permissions); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := key.Generate(); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.models.APIKeys.Insert(r.Context(), key); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusCreated, envelope{"api_key": key}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// apiKeyPermissions returns the permissions a key created by the request may be
+// given: the user's own, which requirePermission checks, and those they have within
+// the request's organization, which requireOrganizationPermission checks. Without
+// an X-Organization header, a user who isn't a member of any organization just has
+// their own. Wherever a key is used, it's checked against the user's permissions
+// there, so it never grants more than the user has.
+func (app *application) apiKeyPermissions(r *http.Request) (data.Permissions, error) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	organizationID, err := app.requestOrganizationID(r)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return permissions, nil
+		}
+		return nil, err
+	}
+
+	memberPermissions, err := app.models.Permissions.GetAllForMember(r.Context(), organizationID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(permissions, memberPermissions...), nil
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.models.APIKeys.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"api_keys": keys}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAPIKeyHandler revokes one of the user's API keys. Other users' keys are
+// reported as not found.
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if err := app.models.APIKeys.Delete(r.Context(), id, user.ID); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"message": "API key successfully revoked"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
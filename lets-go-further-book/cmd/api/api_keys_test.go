@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/data"
+)
+
+type apiKeyResponse struct {
+	APIKey struct {
+		ID          int64    `json:"id"`
+		Key         string   `json:"key"`
+		Prefix      string   `json:"prefix"`
+		Permissions []string `json:"permissions"`
+	} `json:"api_key"`
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := newTestUser(t, app, "alice@example.com", "movies:read", "movies:write")
+
+	tests := []struct {
+		name      string
+		body      map[string]any
+		wantCode  int
+		wantError string
+	}{
+		{"Valid", map[string]any{"name": "CI", "permissions": []string{"movies:read"}}, http.StatusCreated, ""},
+		{"Valid with expiry", map[string]any{"name": "CI", "permissions": []string{"movies:read"}, "expiry": time.Now().Add(time.Hour)}, http.StatusCreated, ""},
+		{"Missing name", map[string]any{"permissions": []string{"movies:read"}}, http.StatusUnprocessableEntity, "name"},
+		{"No permissions", map[string]any{"name": "CI", "permissions": []string{}}, http.StatusUnprocessableEntity, "permissions"},
+		{"Permission the user lacks", map[string]any{"name": "CI", "permissions": []string{"webhooks:manage"}}, http.StatusUnprocessableEntity, "permissions"},
+		{"Expiry in the past", map[string]any{"name": "CI", "permissions": []string{"movies:read"}, "expiry": time.Now().Add(-time.Hour)}, http.StatusUnprocessableEntity, "expiry"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp struct {
+				apiKeyResponse
+				Error map[string]string `json:"error"`
+			}
+
+			code, _ := ts.do(t, http.MethodPost, "/v1/api-keys", token, tt.body, &resp)
+			assert.Equal(t, code, tt.wantCode)
+
+			if tt.wantError != "" {
+				assert.Equal(t, resp.Error[tt.wantError] != "", true)
+				return
+			}
+
+			assert.StringContains(t, resp.APIKey.Key, data.APIKeyPrefix)
+			assert.Equal(t, resp.APIKey.Key[:len(resp.APIKey.Prefix)], resp.APIKey.Prefix)
+		})
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := newTestUser(t, app, "alice@example.com", "movies:read", "movies:write")
+
+	var created apiKeyResponse
+	code, _ := ts.do(t, http.MethodPost, "/v1/api-keys", token, map[string]any{"name": "Reader", "permissions": []string{"movies:read"}}, &created)
+	assert.Equal(t, code, http.StatusCreated)
+	key := created.APIKey.Key
+
+	movie := map[string]any{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+
+	tests := []struct {
+		name     string
+		method   string
+		urlPath  string
+		key      string
+		body     any
+		wantCode int
+	}{
+		{"Read with key", http.MethodGet, "/v1/movies", key, nil, http.StatusOK},
+		{"Write beyond the key's permissions", http.MethodPost, "/v1/movies", key, movie, http.StatusForbidden},
+		{"Unknown key", http.MethodGet, "/v1/movies", data.APIKeyPrefix + "abcdefghijklmnopqrstuvwxyz234567", nil, http.StatusUnauthorized},
+		{"Malformed key", http.MethodGet, "/v1/movies", data.APIKeyPrefix + "short", nil, http.StatusUnauthorized},
+		{"Manage the account with a key", http.MethodGet, "/v1/users/me", key, nil, http.StatusForbidden},
+		{"Create a key with a key", http.MethodPost, "/v1/api-keys", key, map[string]any{"name": "Another", "permissions": []string{"movies:read"}}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := ts.do(t, tt.method, tt.urlPath, tt.key, tt.body, nil)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+
+	t.Run("Deleted with its owner", func(t *testing.T) {
+		bob := newTestUser(t, app, "bob@example.com", "movies:read")
+
+		var bobKey apiKeyResponse
+		ts.do(t, http.MethodPost, "/v1/api-keys", bob, map[string]any{"name": "Reader", "permissions": []string{"movies:read"}}, &bobKey)
+		ts.do(t, http.MethodDelete, "/v1/users/me", bob, nil, nil)
+
+		code, _ := ts.do(t, http.MethodGet, "/v1/movies", bobKey.APIKey.Key, nil, nil)
+		assert.Equal(t, code, http.StatusUnauthorized)
+	})
+}
+
+func TestListAndRevokeAPIKeys(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	alice := newTestUser(t, app, "alice@example.com", "movies:read")
+	bob := newTestUser(t, app, "bob@example.com", "movies:read")
+
+	var created apiKeyResponse
+	ts.do(t, http.MethodPost, "/v1/api-keys", alice, map[string]any{"name": "CI", "permissions": []string{"movies:read"}}, &created)
+
+	var listed struct {
+		APIKeys []map[string]any `json:"api_keys"`
+	}
+	code, _ := ts.do(t, http.MethodGet, "/v1/api-keys", alice, nil, &listed)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(listed.APIKeys), 1)
+	assert.Equal(t, listed.APIKeys[0]["name"], any("CI"))
+	assert.Equal(t, listed.APIKeys[0]["prefix"], any(created.APIKey.Prefix))
+	assert.Equal(t, listed.APIKeys[0]["last_used_at"], nil)
+
+	// The key itself is only shown when it's created.
+	_, shown := listed.APIKeys[0]["key"]
+	assert.Equal(t, shown, false)
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/api-keys", bob, nil, &listed)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(listed.APIKeys), 0)
+
+	urlPath := fmt.Sprintf("/v1/api-keys/%d", created.APIKey.ID)
+
+	code, _ = ts.do(t, http.MethodDelete, urlPath, bob, nil, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/movies", created.APIKey.Key, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = ts.do(t, http.MethodDelete, urlPath, alice, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/movies", created.APIKey.Key, nil, nil)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	code, _ = ts.do(t, http.MethodDelete, urlPath, alice, nil, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+}
+
+func TestCreateAPIKeyInOrganization(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	// Bob's only permissions are those of his role in the organization he creates.
+	bob := newTestUser(t, app, "bob@example.com")
+	acme := newTestOrganization(t, ts, bob, "Acme")
+
+	writer := map[string]any{"name": "Writer", "permissions": []string{"movies:write"}}
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		wantCode int
+	}{
+		{"Permission of the role in the organization", xOrganization(acme), http.StatusCreated},
+		{"Permission lacked in the default organization", nil, http.StatusUnprocessableEntity},
+		{"Organization not a member of", xOrganization(acme + 1), http.StatusForbidden},
+		{"Invalid organization", http.Header{"X-Organization": {"acme"}}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := ts.doWithHeader(t, http.MethodPost, "/v1/api-keys", bob, tt.header, writer, nil)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+
+	t.Run("Used where the user has the permission", func(t *testing.T) {
+		var created apiKeyResponse
+		code, _ := ts.doWithHeader(t, http.MethodPost, "/v1/api-keys", bob, xOrganization(acme), writer, &created)
+		assert.Equal(t, code, http.StatusCreated)
+
+		movie := map[string]any{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+
+		code, _ = ts.doWithHeader(t, http.MethodPost, "/v1/movies", created.APIKey.Key, xOrganization(acme), movie, nil)
+		assert.Equal(t, code, http.StatusCreated)
+
+		code, _ = ts.doWithHeader(t, http.MethodPost, "/v1/movies", created.APIKey.Key, xOrganization(defaultOrganizationID), movie, nil)
+		assert.Equal(t, code, http.StatusForbidden)
+	})
+
+	waitForBackgroundTasks(t, app)
+}
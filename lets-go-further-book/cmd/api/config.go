@@ -0,0 +1,451 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"greenlight.bagerbach.com/internal/toml"
+	"greenlight.bagerbach.com/internal/validator"
+)
+
+type config struct {
+	port int
+	env  string
+	db   struct {
+		dsn          string
+		maxOpenConns int
+		maxIdleConns int
+		maxIdleTime  time.Duration
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+		// Optional replica for movie and permission reads
+		replicaDSN           string
+		readYourWritesWindow time.Duration
+	}
+	limiter struct {
+		rps     float64
+		burst   int
+		enabled bool
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+	cors struct {
+		trustedOrigins listFlag
+	}
+	storage struct {
+		dir string
+	}
+	posters struct {
+		maxSize       int64
+		maxConcurrent int
+	}
+	graphql struct {
+		maxDepth      int
+		maxRootFields int
+		maxComplexity int
+	}
+	idempotency struct {
+		lockTimeout   time.Duration
+		purgeInterval time.Duration
+	}
+	webhooks struct {
+		timeout     time.Duration
+		maxAttempts int
+		backoff     time.Duration
+	}
+	healthcheck struct {
+		timeout time.Duration
+		smtp    bool
+	}
+	tracing struct {
+		exporter string
+		endpoint string
+		file     string
+	}
+	migrate struct {
+		onStart bool
+	}
+	shutdown struct {
+		stopDelay         time.Duration
+		httpTimeout       time.Duration
+		backgroundTimeout time.Duration
+	}
+	users struct {
+		defaultRole         string
+		defaultOrganization int64
+	}
+	tls tlsConfig
+}
+
+// registerFlags defines a flag for every setting, holding its default value.
+// applyConfigSources fills in the ones not given on the command line.
+func (cfg *config) registerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&cfg.port, "port", 4000, "Server port to listen on")
+	fs.StringVar(&cfg.env, "env", "development", "Application environment (development|staging|production)")
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "Maximum number of open connections to the database")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "Maximum number of idle connections to the database")
+	fs.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "Maximum idle time for a connection to the database")
+	fs.DurationVar(&cfg.db.readTimeout, "db-read-timeout", 3*time.Second, "Maximum duration of a database query that only reads")
+	fs.DurationVar(&cfg.db.writeTimeout, "db-write-timeout", 3*time.Second, "Maximum duration of a database write, or of the transaction it's part of")
+	fs.StringVar(&cfg.db.replicaDSN, "db-replica-dsn", "", "PostgreSQL DSN of a read replica for movie and permission reads (optional)")
+	fs.DurationVar(&cfg.db.readYourWritesWindow, "db-read-your-writes-window", 5*time.Second, "How long a user's reads go to the primary after they write, so they see their own changes despite replica lag")
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limit to apply to requests per second")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Burst limit to apply to requests")
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiting")
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "", "SMTP host")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	fs.StringVar(&cfg.smtp.sender, "smtp-sender", "", "SMTP sender")
+
+	fs.StringVar(&cfg.storage.dir, "storage-dir", "uploads", "Directory uploaded files, such as movie posters, are stored in")
+	fs.Int64Var(&cfg.posters.maxSize, "posters-max-size", 10<<20, "Largest poster image accepted, in bytes")
+	fs.IntVar(&cfg.posters.maxConcurrent, "posters-max-concurrent", 4, "How many uploaded posters are decoded and resized at once; others wait their turn")
+
+	fs.IntVar(&cfg.graphql.maxDepth, "graphql-max-depth", 5, "How deeply fields can be nested in a GraphQL query")
+	fs.IntVar(&cfg.graphql.maxRootFields, "graphql-max-root-fields", 10, "How many top-level fields a GraphQL query can select, counting each alias separately")
+	fs.IntVar(&cfg.graphql.maxComplexity, "graphql-max-complexity", 1000, "Highest cost of a GraphQL query, where every field selected costs 1 for each item it can return, and 20 more if it's read from the database")
+
+	fs.DurationVar(&cfg.idempotency.lockTimeout, "idempotency-lock-timeout", time.Minute, "How long a request holds its Idempotency-Key before a retry may assume it crashed and run again")
+	fs.DurationVar(&cfg.idempotency.purgeInterval, "idempotency-purge-interval", time.Hour, "How often expired idempotency keys are deleted")
+
+	fs.DurationVar(&cfg.webhooks.timeout, "webhook-timeout", 10*time.Second, "Timeout for a single webhook delivery attempt")
+	fs.IntVar(&cfg.webhooks.maxAttempts, "webhook-max-attempts", 5, "Maximum number of attempts to deliver a webhook event")
+	fs.DurationVar(&cfg.webhooks.backoff, "webhook-backoff", time.Second, "Delay before retrying a webhook delivery, doubled after every attempt")
+
+	fs.DurationVar(&cfg.healthcheck.timeout, "healthcheck-timeout", 2*time.Second, "Timeout for the dependency checks of the readiness healthcheck")
+	fs.BoolVar(&cfg.healthcheck.smtp, "healthcheck-smtp", false, "Check that the SMTP server is reachable in the readiness healthcheck")
+
+	fs.StringVar(&cfg.tracing.exporter, "trace-exporter", "none", "Where to export traces to (none|otlp|stdout|file)")
+	fs.StringVar(&cfg.tracing.endpoint, "trace-otlp-endpoint", "http://localhost:4318/v1/traces", "OTLP/HTTP traces endpoint of the collector")
+	fs.StringVar(&cfg.tracing.file, "trace-file", "traces.jsonl", "File to append traces to when using the file exporter")
+
+	fs.StringVar(&cfg.tls.certFile, "tls-cert-file", "", "TLS certificate (PEM); serves HTTPS and HTTP/2 when set together with -tls-key-file")
+	fs.StringVar(&cfg.tls.keyFile, "tls-key-file", "", "TLS private key (PEM)")
+	fs.StringVar(&cfg.tls.minVersion, "tls-min-version", "1.2", "Minimum TLS version (1.2|1.3)")
+	fs.StringVar(&cfg.tls.clientCAFile, "tls-client-ca-file", "", "CA certificates (PEM) that client certificates are verified against")
+	fs.StringVar(&cfg.tls.clientAuth, "tls-client-auth", "none", "Client certificate authentication (none|optional|require)")
+	fs.BoolVar(&cfg.tls.clientCommonName, "tls-client-common-name", false, "Identify the users of client certificates without an email SAN by their subject's common name")
+	fs.DurationVar(&cfg.tls.reloadInterval, "tls-reload-interval", 30*time.Second, "How often to check the TLS files for changes (0 to only reload on SIGHUP)")
+
+	fs.BoolVar(&cfg.migrate.onStart, "migrate-on-start", false, "Apply pending database migrations before starting the server")
+
+	fs.DurationVar(&cfg.shutdown.stopDelay, "shutdown-stop-delay", 0, "How long to keep accepting requests after the readiness check starts failing, so load balancers can stop sending them")
+	fs.DurationVar(&cfg.shutdown.httpTimeout, "shutdown-http-timeout", 30*time.Second, "How long to wait for in-flight requests before closing their connections")
+	fs.DurationVar(&cfg.shutdown.backgroundTimeout, "shutdown-background-timeout", 30*time.Second, "How long to wait for background tasks before exiting without them")
+
+	fs.StringVar(&cfg.users.defaultRole, "users-default-role", "viewer", "Role newly registered users get in the default organization")
+	fs.Int64Var(&cfg.users.defaultOrganization, "users-default-organization", 1, "ID of the organization newly registered users join, with the default role (0 for none)")
+
+	fs.Var(&cfg.cors.trustedOrigins, "cors-trusted-origins", "Trusted CORS origins (space separated)")
+}
+
+// listFlag is a flag holding a space separated list.
+type listFlag []string
+
+func (l *listFlag) Set(s string) error {
+	*l = strings.Fields(s)
+	return nil
+}
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Get() any {
+	return []string(*l)
+}
+
+// commandLineOnly lists the flags that aren't settings, so can't be set from the
+// environment or the config file.
+var commandLineOnly = []string{"config", "version", "print-config"}
+
+// envVarNames holds the environment variables that aren't named after their flag in
+// the usual way (db-max-open-conns is read from DB_MAX_OPEN_CONNS).
+var envVarNames = map[string]string{
+	"db-dsn":              "DATABASE_URL",
+	"trace-otlp-endpoint": "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+}
+
+func envVarName(flagName string) string {
+	if name, ok := envVarNames[flagName]; ok {
+		return name
+	}
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// settingName is the config file key of a flag: the first word of the flag is the
+// table, so db-max-open-conns is max_open_conns in the [db] table.
+func settingName(flagName string) string {
+	table, key, ok := strings.Cut(flagName, "-")
+	if !ok {
+		return flagName
+	}
+	return table + "." + strings.ReplaceAll(key, "-", "_")
+}
+
+// applyConfigSources sets the flags that weren't given on the command line from
+// the environment or, failing that, the config file (if configFile isn't empty).
+// Values go through flag.Set, so they are parsed exactly like command line flags,
+// and every malformed value or unknown setting is reported.
+func applyConfigSources(fs *flag.FlagSet, configFile string, lookupEnv func(string) (string, bool)) error {
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+
+	var errs []error
+
+	if configFile != "" {
+		settings, err := toml.ParseFile(configFile)
+		if err != nil {
+			return err
+		}
+
+		flags := make(map[string]*flag.Flag)
+		fs.VisitAll(func(f *flag.Flag) {
+			if !slices.Contains(commandLineOnly, f.Name) {
+				flags[settingName(f.Name)] = f
+			}
+		})
+
+		for _, key := range slices.Sorted(maps.Keys(settings)) {
+			f, ok := flags[key]
+			switch {
+			case !ok:
+				errs = append(errs, fmt.Errorf("%s: unknown setting %s", configFile, key))
+			case onCommandLine[f.Name]:
+			default:
+				if err := f.Value.Set(settingValue(settings[key])); err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid value for %s: %w", configFile, key, err))
+				}
+			}
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if onCommandLine[f.Name] || slices.Contains(commandLineOnly, f.Name) {
+			return
+		}
+
+		name := envVarName(f.Name)
+		if value, ok := lookupEnv(name); ok {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for environment variable %s: %w", value, name, err))
+			}
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// settingValue formats a value from the config file the way its flag expects.
+// Lists become space separated.
+func settingValue(value any) string {
+	if list, ok := value.([]any); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, " ")
+	}
+
+	return fmt.Sprint(value)
+}
+
+// validate checks the settings make sense together, so we fail at startup rather
+// than the first time a bad one is used.
+func (cfg config) validate() error {
+	v := validator.New()
+
+	v.Check(cfg.port >= 1 && cfg.port <= 65535, "port", "must be between 1 and 65535")
+	v.Check(validator.PermittedValue(cfg.env, "development", "staging", "production"), "env", "must be one of development, staging or production")
+
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+	v.Check(cfg.db.maxOpenConns >= 0, "db-max-open-conns", "must not be negative")
+	v.Check(cfg.db.maxIdleConns >= 0, "db-max-idle-conns", "must not be negative")
+	v.Check(cfg.db.maxIdleTime > 0, "db-max-idle-time", "must be greater than zero")
+	v.Check(cfg.db.readTimeout > 0, "db-read-timeout", "must be greater than zero")
+	v.Check(cfg.db.writeTimeout > 0, "db-write-timeout", "must be greater than zero")
+	v.Check(cfg.db.readYourWritesWindow >= 0, "db-read-your-writes-window", "must not be negative")
+
+	if cfg.limiter.enabled {
+		v.Check(cfg.limiter.rps > 0, "limiter-rps", "must be greater than zero")
+		v.Check(cfg.limiter.burst >= 1, "limiter-burst", "must be at least 1")
+	}
+
+	v.Check(cfg.smtp.port >= 1 && cfg.smtp.port <= 65535, "smtp-port", "must be between 1 and 65535")
+	if cfg.smtp.sender != "" {
+		_, err := mail.ParseAddress(cfg.smtp.sender)
+		v.Check(err == nil, "smtp-sender", "must be a valid email address, e.g. Greenlight <no-reply@greenlight.example>")
+	}
+
+	for _, origin := range cfg.cors.trustedOrigins {
+		v.Check(isHTTPURL(origin), "cors-trusted-origins", fmt.Sprintf("%q is not an http or https origin", origin))
+	}
+
+	v.Check(cfg.storage.dir != "", "storage-dir", "must be provided")
+	v.Check(cfg.posters.maxSize > 0, "posters-max-size", "must be greater than zero")
+	v.Check(cfg.posters.maxConcurrent > 0, "posters-max-concurrent", "must be greater than zero")
+	v.Check(cfg.graphql.maxDepth > 0, "graphql-max-depth", "must be greater than zero")
+	v.Check(cfg.graphql.maxRootFields > 0, "graphql-max-root-fields", "must be greater than zero")
+	v.Check(cfg.graphql.maxComplexity > 0, "graphql-max-complexity", "must be greater than zero")
+
+	v.Check(cfg.idempotency.lockTimeout > 0, "idempotency-lock-timeout", "must be greater than zero")
+	v.Check(cfg.idempotency.purgeInterval > 0, "idempotency-purge-interval", "must be greater than zero")
+
+	v.Check(cfg.webhooks.timeout > 0, "webhook-timeout", "must be greater than zero")
+	v.Check(cfg.webhooks.maxAttempts >= 1, "webhook-max-attempts", "must be at least 1")
+	v.Check(cfg.webhooks.backoff >= 0, "webhook-backoff", "must not be negative")
+
+	v.Check(cfg.healthcheck.timeout > 0, "healthcheck-timeout", "must be greater than zero")
+
+	v.Check(validator.PermittedValue(cfg.tracing.exporter, "none", "otlp", "stdout", "file"), "trace-exporter", "must be one of none, otlp, stdout or file")
+	if cfg.tracing.exporter == "otlp" {
+		v.Check(isHTTPURL(cfg.tracing.endpoint), "trace-otlp-endpoint", "must be an http or https URL")
+	}
+	if cfg.tracing.exporter == "file" {
+		v.Check(cfg.tracing.file != "", "trace-file", "must be provided")
+	}
+
+	v.Check((cfg.tls.certFile == "") == (cfg.tls.keyFile == ""), "tls-cert-file", "must be set together with tls-key-file")
+	v.Check(tlsVersions[cfg.tls.minVersion] != 0, "tls-min-version", "must be 1.2 or 1.3")
+	_, ok := tlsClientAuthTypes[cfg.tls.clientAuth]
+	v.Check(ok, "tls-client-auth", "must be one of none, optional or require")
+	if cfg.tls.clientAuth != "none" {
+		v.Check(cfg.tls.certFile != "", "tls-client-auth", "requires TLS to be enabled")
+		v.Check(cfg.tls.clientCAFile != "", "tls-client-ca-file", "must be provided when client certificates are used")
+	}
+	if cfg.tls.clientCommonName {
+		v.Check(cfg.tls.clientAuth != "none", "tls-client-common-name", "requires client certificates to be used")
+	}
+	v.Check(cfg.tls.reloadInterval >= 0, "tls-reload-interval", "must not be negative")
+
+	v.Check(cfg.shutdown.stopDelay >= 0, "shutdown-stop-delay", "must not be negative")
+	v.Check(cfg.shutdown.httpTimeout > 0, "shutdown-http-timeout", "must be greater than zero")
+	v.Check(cfg.shutdown.backgroundTimeout > 0, "shutdown-background-timeout", "must be greater than zero")
+
+	v.Check(cfg.users.defaultRole != "", "users-default-role", "must be provided")
+	v.Check(cfg.users.defaultOrganization >= 0, "users-default-organization", "must not be negative")
+
+	if v.Valid() {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("invalid configuration:")
+	for _, key := range slices.Sorted(maps.Keys(v.Errors)) {
+		fmt.Fprintf(&b, "\n  %s: %s", key, v.Errors[key])
+	}
+
+	return errors.New(b.String())
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// printConfig writes the effective settings in config file format, with secrets
+// redacted.
+func printConfig(w io.Writer, fs *flag.FlagSet) {
+	tables := make(map[string][]string)
+	var order []string
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(commandLineOnly, f.Name) {
+			return
+		}
+
+		table, key, _ := strings.Cut(settingName(f.Name), ".")
+		if key == "" {
+			table, key = "", table
+		}
+
+		if _, ok := tables[table]; !ok {
+			order = append(order, table)
+		}
+		tables[table] = append(tables[table], fmt.Sprintf("%s = %s", key, settingLiteral(f)))
+	})
+
+	// Keys outside of a table have to come first.
+	slices.Sort(order)
+
+	for i, table := range order {
+		if table != "" {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "[%s]\n", table)
+		}
+		for _, line := range tables[table] {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// settingLiteral formats the value of f as a config file value.
+func settingLiteral(f *flag.Flag) string {
+	switch f.Name {
+	case "smtp-password":
+		if f.Value.String() != "" {
+			return strconv.Quote("REDACTED")
+		}
+	case "db-dsn", "db-replica-dsn":
+		return strconv.Quote(redactDSN(f.Value.String()))
+	}
+
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return strconv.Quote(f.Value.String())
+	}
+
+	// time.Duration is an int64, so it has to be matched before the integers.
+	switch value := getter.Get().(type) {
+	case time.Duration:
+		return strconv.Quote(value.String())
+	case bool, int, int64, uint, uint64, float64:
+		return fmt.Sprint(value)
+	case []string:
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = strconv.Quote(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	default:
+		return strconv.Quote(f.Value.String())
+	}
+}
+
+var dsnPasswordRX = regexp.MustCompile(`password=('[^']*'|\S+)`)
+
+// redactDSN hides the password in both URL and key=value style DSNs.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		}
+		dsn = u.String()
+	}
+
+	return dsnPasswordRX.ReplaceAllString(dsn, "password=REDACTED")
+}
@@ -9,7 +9,12 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey         = contextKey("user")
+	requestIDContextKey    = contextKey("request_id")
+	apiKeyContextKey       = contextKey("api_key")
+	organizationContextKey = contextKey("organization")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -24,3 +29,44 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the API key the request was authenticated with, or nil
+// if it wasn't authenticated with one.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+func (app *application) contextSetOrganizationID(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), organizationContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetOrganizationID returns the organization resolved by
+// requireOrganizationPermission, which every handler of the organization's data
+// must be wrapped in.
+func (app *application) contextGetOrganizationID(r *http.Request) int64 {
+	id, ok := r.Context().Value(organizationContextKey).(int64)
+	if !ok {
+		panic("missing organization value in request context")
+	}
+
+	return id
+}
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// Unlike contextGetUser this doesn't panic when the value is missing, as errors
+// can be written for requests that never passed through the requestID middleware.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"greenlight.bagerbach.com/internal/msgpack"
+)
+
+// errNotEncodable is returned by an encoder when the envelope can't be represented
+// in its format, e.g. CSV for anything but a list of resources.
+var errNotEncodable = errors.New("response cannot be represented in the requested format")
+
+type responseEncoder struct {
+	contentType string
+	aliases     []string
+	encode      func(data envelope) ([]byte, error)
+	listsOnly   bool // Can only encode envelopes holding a list, see holdsList
+}
+
+func (e responseEncoder) matches(mediaType string) bool {
+	if mediaType == "*/*" || mediaType == e.contentType || slices.Contains(e.aliases, mediaType) {
+		return true
+	}
+
+	major, _, _ := strings.Cut(e.contentType, "/")
+	return mediaType == major+"/*"
+}
+
+// MessagePack has no single registered media type, so we accept the common ones
+// for request bodies and respond with the first.
+var messagePackMediaTypes = []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}
+
+// The registry of formats we can respond with, in order of preference. The first
+// entry is used when the client doesn't send an Accept header or accepts anything.
+var responseEncoders = []responseEncoder{
+	{contentType: "application/json", encode: encodeJSON},
+	{contentType: messagePackMediaTypes[0], aliases: messagePackMediaTypes[1:], encode: encodeMessagePack},
+	{contentType: "text/csv", encode: encodeCSV, listsOnly: true},
+}
+
+// holdsList reports whether an envelope, as described in operations, holds a list
+// of resources, which is what CSV needs.
+func holdsList(env envelope) bool {
+	for _, value := range env {
+		if reflect.TypeOf(value).Kind() == reflect.Slice {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeJSON(data envelope) ([]byte, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(js, '\n'), nil
+}
+
+func encodeMessagePack(data envelope) ([]byte, error) {
+	return msgpack.Marshal(data)
+}
+
+// encodeCSV writes the single list in the envelope (e.g. "movies") as CSV with a
+// header row of the resources' keys. Other envelope values, such
+// as pagination metadata, have no place in a CSV document and are left out.
+func encodeCSV(data envelope) ([]byte, error) {
+	var list []json.RawMessage
+
+	for _, value := range data {
+		js, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+
+		var items []json.RawMessage
+		if err := json.Unmarshal(js, &items); err != nil {
+			continue
+		}
+
+		if list != nil {
+			return nil, errNotEncodable
+		}
+		list = items
+	}
+
+	if list == nil {
+		return nil, errNotEncodable
+	}
+
+	// Fields tagged omitempty can be missing from some resources, so the columns are
+	// every key seen in the list, in order of first appearance.
+	var columns []string
+	for _, item := range list {
+		keys, err := objectKeys(item)
+		if err != nil {
+			return nil, errNotEncodable
+		}
+		for _, key := range keys {
+			if !slices.Contains(columns, key) {
+				columns = append(columns, key)
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	cw := csv.NewWriter(buf)
+
+	if err := cw.Write(columns); err != nil {
+		return nil, err
+	}
+
+	for _, item := range list {
+		var resource map[string]json.RawMessage
+		if err := json.Unmarshal(item, &resource); err != nil {
+			return nil, errNotEncodable
+		}
+
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = csvValue(resource[column])
+		}
+
+		if err := cw.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// objectKeys returns the keys of a JSON object in the order they appear, so CSV
+// columns follow the struct field order rather than alphabetical map order.
+func objectKeys(js json.RawMessage) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errNotEncodable
+	}
+
+	var keys []string
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, t.(string))
+
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// csvValue flattens a JSON value into a CSV cell: strings lose their quotes, lists
+// of strings are joined with commas, and everything else keeps its JSON form.
+// Text from the resources is made safe to open in a spreadsheet first.
+func csvValue(js json.RawMessage) string {
+	if js == nil || string(js) == "null" {
+		return ""
+	}
+
+	var s string
+	if err := json.Unmarshal(js, &s); err == nil {
+		return csvText(s)
+	}
+
+	var list []string
+	if err := json.Unmarshal(js, &list); err == nil {
+		return csvText(strings.Join(list, ","))
+	}
+
+	return string(js)
+}
+
+// csvText stops spreadsheets from treating text as a formula, which a title like
+// "=HYPERLINK(...)" would otherwise become when the file is opened, by prefixing
+// text starting with a formula character with a quote. Numbers and other JSON
+// values are left alone, so -1 stays a number.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+type acceptedType struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns the media ranges of an Accept header ordered by preference:
+// highest quality first, then more specific ranges before wildcards. An empty
+// header accepts anything.
+func parseAccept(header string) []acceptedType {
+	if strings.TrimSpace(header) == "" {
+		return []acceptedType{{mediaType: "*/*", q: 1}}
+	}
+
+	var accepted []acceptedType
+
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(s, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		accepted = append(accepted, acceptedType{mediaType: mediaType, q: q})
+	}
+
+	sort.SliceStable(accepted, func(i, j int) bool {
+		if accepted[i].q != accepted[j].q {
+			return accepted[i].q > accepted[j].q
+		}
+		return strings.Count(accepted[i].mediaType, "*") < strings.Count(accepted[j].mediaType, "*")
+	})
+
+	return accepted
+}
+
+// acceptableEncoders lists the registered encoders the client accepts, most
+// preferred first. Types the client explicitly refuses with q=0 are never picked,
+// even when a wildcard would otherwise match them.
+func acceptableEncoders(r *http.Request) []responseEncoder {
+	accepted := parseAccept(r.Header.Get("Accept"))
+
+	refused := func(e responseEncoder) bool {
+		for _, a := range accepted {
+			if a.q == 0 && (a.mediaType == e.contentType || slices.Contains(e.aliases, a.mediaType)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var encoders []responseEncoder
+
+	for _, a := range accepted {
+		if a.q <= 0 {
+			continue
+		}
+
+		for _, e := range responseEncoders {
+			if e.matches(a.mediaType) && !refused(e) && !slices.ContainsFunc(encoders, func(added responseEncoder) bool {
+				return added.contentType == e.contentType
+			}) {
+				encoders = append(encoders, e)
+			}
+		}
+	}
+
+	return encoders
+}
+
+// prefersProblemDetails reports whether the client would rather have errors as
+// application/problem+json than in one of the regular response formats.
+func prefersProblemDetails(r *http.Request) bool {
+	for _, a := range parseAccept(r.Header.Get("Accept")) {
+		if a.q <= 0 {
+			continue
+		}
+		if a.mediaType == "application/problem+json" {
+			return true
+		}
+		for _, e := range responseEncoders {
+			if e.matches(a.mediaType) {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// acceptable reports whether the client accepts the operation's response in a
+// format it can actually be written in. Responses that aren't enveloped must match
+// one of their content types, and the others need an encoder that can represent
+// them: CSV only works for lists.
+func (op operation) acceptable(r *http.Request) bool {
+	if op.raw != nil {
+		for _, a := range parseAccept(r.Header.Get("Accept")) {
+			if a.q <= 0 {
+				continue
+			}
+			for contentType := range op.raw {
+				if mediaRangesOverlap(a.mediaType, contentType) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	lists := holdsList(op.response)
+	for _, env := range op.otherResponses {
+		lists = lists || holdsList(env)
+	}
+
+	return slices.ContainsFunc(acceptableEncoders(r), func(e responseEncoder) bool {
+		return !e.listsOnly || lists
+	})
+}
+
+// mediaRangesOverlap reports whether two media types, either of which may be a
+// range like image/* or */*, have a type in common.
+func mediaRangesOverlap(a, b string) bool {
+	aMajor, aMinor, _ := strings.Cut(a, "/")
+	bMajor, bMinor, _ := strings.Cut(b, "/")
+
+	return (aMajor == "*" || bMajor == "*" || aMajor == bMajor) &&
+		(aMinor == "*" || bMinor == "*" || aMinor == bMinor)
+}
+
+// encodeResponse encodes data with the most preferred encoder that can represent
+// it, returning the content type used. ok is false when none of them can.
+func encodeResponse(r *http.Request, data envelope) (body []byte, contentType string, ok bool, err error) {
+	for _, e := range acceptableEncoders(r) {
+		body, err := e.encode(data)
+		if errors.Is(err, errNotEncodable) {
+			continue
+		}
+		if err != nil {
+			return nil, "", false, fmt.Errorf("encoding %s response: %w", e.contentType, err)
+		}
+
+		return body, e.contentType, true, nil
+	}
+
+	return nil, "", false, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/data"
+)
+
+func TestContentNegotiation(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := newTestUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	movie := map[string]any{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+
+	code, _ := ts.do(t, http.MethodPost, "/v1/movies", token, movie, nil)
+	assert.Equal(t, code, http.StatusCreated)
+
+	tests := []struct {
+		name            string
+		method          string
+		path            string
+		accept          string
+		wantCode        int
+		wantContentType string
+	}{
+		{"List as CSV", http.MethodGet, "/v1/movies", "text/csv", http.StatusOK, "text/csv"},
+		{"List as MessagePack", http.MethodGet, "/v1/movies", "application/x-msgpack", http.StatusOK, "application/msgpack"},
+		{"Single resource as CSV", http.MethodGet, "/v1/movies/1", "text/csv", http.StatusNotAcceptable, "application/json"},
+		{"Single resource falls back from CSV", http.MethodGet, "/v1/movies/1", "text/csv, application/json;q=0.5", http.StatusOK, "application/json"},
+		{"Unknown format", http.MethodGet, "/v1/movies", "application/xml", http.StatusNotAcceptable, "application/json"},
+		{"Refused format", http.MethodGet, "/v1/movies", "application/json;q=0, */*", http.StatusOK, "application/msgpack"},
+		{"Event stream", http.MethodGet, "/v1/movies/events", "application/json", http.StatusNotAcceptable, "application/json"},
+		{"Poster as JSON", http.MethodGet, "/v1/movies/1/poster", "application/json", http.StatusNotAcceptable, "application/json"},
+		{"Poster as an image", http.MethodGet, "/v1/movies/1/poster", "image/webp", http.StatusNotFound, "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, header := ts.doWithHeader(t, tt.method, tt.path, token, http.Header{"Accept": {tt.accept}}, nil, nil)
+			assert.Equal(t, code, tt.wantCode)
+			assert.Equal(t, header.Get("Content-Type"), tt.wantContentType)
+		})
+	}
+
+	t.Run("Rejected before the handler runs", func(t *testing.T) {
+		code, _ := ts.doWithHeader(t, http.MethodPost, "/v1/movies", token, http.Header{"Accept": {"text/csv"}}, movie, nil)
+		assert.Equal(t, code, http.StatusNotAcceptable)
+
+		var list struct {
+			Metadata data.Metadata `json:"metadata"`
+		}
+		code, _ = ts.do(t, http.MethodGet, "/v1/movies", token, nil, &list)
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, list.Metadata.TotalRecords, 1)
+	})
+
+	waitForBackgroundTasks(t, app)
+}
+
+func TestEncodeCSV(t *testing.T) {
+	movies := []map[string]any{
+		{"id": 1, "title": "=HYPERLINK(\"http://example.com\")", "genres": []string{"@SUM(A1)", "drama"}},
+		{"id": 2, "title": "+1", "genres": []string{"-2"}},
+		{"id": 3, "title": "Moana", "genres": []string{"animation"}, "year": -1},
+	}
+
+	js, err := encodeCSV(envelope{"movies": movies})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys of a map are encoded in sorted order.
+	want := "genres,id,title,year\n" +
+		"\"'@SUM(A1),drama\",1,\"'=HYPERLINK(\"\"http://example.com\"\")\",\n" +
+		"'-2,2,'+1,\n" +
+		"animation,3,Moana,-1\n"
+	assert.Equal(t, string(js), want)
+}
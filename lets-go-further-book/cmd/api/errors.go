@@ -3,69 +3,192 @@ package main
 import (
 	"fmt"
 	"net/http"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+// Machine-readable error codes, sent alongside every error message so clients don't
+// have to match on the message text. They're part of the API contract: add new
+// codes as needed, but never change the value of an existing one.
+const (
+	errCodeServerError            = "server_error"
+	errCodeNotFound               = "not_found"
+	errCodeMethodNotAllowed       = "method_not_allowed"
+	errCodeNotAcceptable          = "not_acceptable"
+	errCodeBadRequest             = "bad_request"
+	errCodeFailedValidation       = "failed_validation"
+	errCodeEditConflict           = "edit_conflict"
+	errCodeRateLimited            = "rate_limited"
+	errCodeInvalidCredentials     = "invalid_credentials"
+	errCodeInvalidToken           = "invalid_token"
+	errCodeAuthenticationRequired = "authentication_required"
+	errCodeInactiveAccount        = "inactive_account"
+	errCodePermissionDenied       = "permission_denied"
+	errCodeIdempotencyKeyInUse    = "idempotency_key_in_use"
+	errCodeIdempotencyKeyMismatch = "idempotency_key_mismatch"
+	errCodeBatchFailed            = "batch_failed"
+	errCodeInvalidAPIKey          = "invalid_api_key"
+	errCodeAPIKeyNotAllowed       = "api_key_not_allowed"
+	errCodeRequestCancelled       = "request_cancelled"
+	errCodeTimeout                = "timeout"
+	errCodeNotAMember             = "not_a_member"
+	errCodeContentTooLarge        = "content_too_large"
+	errCodeUnsupportedMediaType   = "unsupported_media_type"
+	errCodeInvalidQuery           = "invalid_query"
+	errCodeQueryTooComplex        = "query_too_complex"
 )
 
+// statusClientClosedRequest is the non-standard status nginx uses for requests the
+// client gave up on. Nobody is left to read the response, but the status shows up
+// in the request log and the metrics.
+const statusClientClosedRequest = 499
+
+// problemTypeBase prefixes the error code to form the "type" URI of an RFC 9457
+// problem details object.
+const problemTypeBase = "https://greenlight.bagerbach.com/problems/"
+
 func (app *application) logError(r *http.Request, err error) {
 	var (
 		method = r.Method
 		uri    = r.URL.RequestURI()
 	)
 
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.logger.ErrorContext(r.Context(), err.Error(), "method", method, "uri", uri)
 }
 
-// Generic helper to send JSON-formatted error responses
+// Generic helper to send error responses. By default they're envelopes like
+// {"error": message, "code": code, "request_id": id}, in whichever format the
+// Accept header asks for (JSON if it can't be honoured). Clients that prefer
+// application/problem+json get RFC 9457 problem details instead.
 // Uses any to get more flexibility with the message parameter
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	env := envelope{"error": message}
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code string, message any) {
+	requestID := app.contextGetRequestID(r)
+
+	if prefersProblemDetails(r) {
+		problem := envelope{
+			"type":       problemTypeBase + code,
+			"title":      http.StatusText(status),
+			"status":     status,
+			"code":       code,
+			"instance":   r.URL.Path,
+			"request_id": requestID,
+		}
+
+		switch message := message.(type) {
+		case map[string]string:
+			problem["detail"] = "one or more fields failed validation"
+			problem["errors"] = message
+		default:
+			problem["detail"] = fmt.Sprint(message)
+		}
+
+		body, err := encodeJSON(problem)
+		if err != nil {
+			app.logError(r, err)
+			w.WriteHeader(500)
+			return
+		}
+
+		app.write(w, status, "application/problem+json", body, nil)
+		return
+	}
+
+	env := envelope{"error": message, "code": code, "request_id": requestID}
+
+	// Errors honour the Accept header where they can, but fall back to JSON rather
+	// than hiding the real error behind a 406.
+	body, contentType, ok, err := encodeResponse(r, env)
+	if err == nil && !ok {
+		body, err = encodeJSON(env)
+		contentType = "application/json"
+	}
 
-	if err := app.writeJSON(w, status, env, nil); err != nil {
+	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
+		return
 	}
+
+	app.write(w, status, contentType, body, nil)
 }
 
 // Used when our app encounters an unexpected problem at runtime
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if data.Interrupted(err) {
+		app.interruptedResponse(w, r, err)
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "The server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	app.errorResponse(w, r, http.StatusInternalServerError, errCodeServerError, message)
+}
+
+// interruptedResponse is sent instead of a 500 when a query was stopped before it
+// finished: with a 499 if it was because the client went away, and a 504 if the
+// query ran out of time.
+func (app *application) interruptedResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		app.logger.InfoContext(r.Context(), "request cancelled by the client", "method", r.Method, "uri", r.URL.RequestURI(), "error", err.Error())
+
+		message := "the request was cancelled before it finished"
+		app.errorResponse(w, r, statusClientClosedRequest, errCodeRequestCancelled, message)
+		return
+	}
+
+	app.logger.WarnContext(r.Context(), "query timed out", "method", r.Method, "uri", r.URL.RequestURI(), "error", err.Error())
+
+	message := "the request took too long to process, please try again later"
+	app.errorResponse(w, r, http.StatusGatewayTimeout, errCodeTimeout, message)
 }
 
 // For 404s
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "The requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, errCodeNotFound, message)
 }
 
 // For 405s
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("The %s method is not allowed for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, message)
+}
+
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the requested resource is not available in any of the formats listed in the Accept header"
+	app.errorResponse(w, r, http.StatusNotAcceptable, errCodeNotAcceptable, message)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponse(w, r, http.StatusBadRequest, errCodeBadRequest, err.Error())
+}
+
+func (app *application) contentTooLargeResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, errCodeContentTooLarge, err.Error())
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, err.Error())
 }
 
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, errCodeFailedValidation, errors)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, errCodeEditConflict, message)
 }
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	app.errorResponse(w, r, http.StatusTooManyRequests, errCodeRateLimited, message)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, errCodeInvalidCredentials, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
@@ -73,20 +196,47 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, errCodeInvalidToken, message)
+}
+
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid, expired or revoked API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, errCodeInvalidAPIKey, message)
+}
+
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "API keys can't be used to manage an account, authenticate with a token instead"
+	app.errorResponse(w, r, http.StatusForbidden, errCodeAPIKeyNotAllowed, message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, errCodeAuthenticationRequired, message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, errCodeInactiveAccount, message)
 }
 
 func (app *application) nonPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your account does not have the necessary permissions to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, errCodePermissionDenied, message)
+}
+
+func (app *application) notAMemberResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your account is not a member of the organization"
+	app.errorResponse(w, r, http.StatusForbidden, errCodeNotAMember, message)
+}
+
+func (app *application) idempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this idempotency key is still being processed, please try again later"
+	app.errorResponse(w, r, http.StatusConflict, errCodeIdempotencyKeyInUse, message)
+}
+
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this idempotency key has already been used with a different request body"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, errCodeIdempotencyKeyMismatch, message)
 }
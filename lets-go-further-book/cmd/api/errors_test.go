@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lib/pq"
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+func TestServerErrorResponseForInterruptedQueries(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name          string
+		err           error
+		clientGone    bool
+		wantCode      int
+		wantErrorCode string
+	}{
+		{"Other error", errors.New("boom"), false, http.StatusInternalServerError, errCodeServerError},
+		{"Timeout", fmt.Errorf("get movie: %w", context.DeadlineExceeded), false, http.StatusGatewayTimeout, errCodeTimeout},
+		{"Query cancelled by PostgreSQL", &pq.Error{Code: "57014"}, false, http.StatusGatewayTimeout, errCodeTimeout},
+		{"Client gone", &pq.Error{Code: "57014"}, true, statusClientClosedRequest, errCodeRequestCancelled},
+		{"Client gone before the query", context.Canceled, true, statusClientClosedRequest, errCodeRequestCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			if tt.clientGone {
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+				r = r.WithContext(ctx)
+			}
+
+			rr := httptest.NewRecorder()
+			app.serverErrorResponse(rr, r, tt.err)
+
+			var resp struct {
+				Code string `json:"code"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, rr.Code, tt.wantCode)
+			assert.Equal(t, resp.Code, tt.wantErrorCode)
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.bagerbach.com/internal/data"
+)
+
+// movieEventBroker fans PostgreSQL notifications about new movie events out to the
+// open event streams. Subscribers are only told that something happened; each one
+// then reads the events it hasn't seen yet from the movie_events log, so a slow
+// stream never blocks the others or misses an event.
+type movieEventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+	closed      bool
+	listener    *pq.Listener
+}
+
+// newMovieEventBroker opens a dedicated connection that LISTENs for movie events.
+// The listener reconnects on its own if the connection is lost.
+func newMovieEventBroker(dsn string, logger *slog.Logger) (*movieEventBroker, error) {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Error("movie events listener", "event", event, "error", err)
+		}
+	})
+
+	if err := listener.Listen(data.MovieEventsChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	b := &movieEventBroker{
+		subscribers: make(map[chan struct{}]struct{}),
+		listener:    listener,
+	}
+
+	go b.run(listener.NotificationChannel())
+
+	return b, nil
+}
+
+func (b *movieEventBroker) run(notifications <-chan *pq.Notification) {
+	// A nil notification is sent after the listener reconnects, when notifications
+	// may have been missed, which is handled the same way: by waking every stream.
+	for range notifications {
+		b.mu.Lock()
+		for ch := range b.subscribers {
+			select {
+			case ch <- struct{}{}:
+			default:
+				// Already signalled and not yet caught up; one signal is enough.
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// subscribe returns a channel that receives a signal whenever new events may be
+// available. It's closed when the broker shuts down.
+func (b *movieEventBroker) subscribe() chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *movieEventBroker) unsubscribe(ch chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// close ends every open stream and stops listening for notifications. It's called
+// as soon as the server starts shutting down, since http.Server.Shutdown would
+// otherwise wait for the never-ending stream requests.
+func (b *movieEventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+
+	b.listener.Close()
+}
+
+// movieEventsHandler streams movie changes as server-sent events. Clients that
+// reconnect with a Last-Event-ID header get the events they missed, as long as
+// they're still in the movie_events log; otherwise they're sent a "reset" event
+// telling them to reload their copy of the catalogue.
+func (app *application) movieEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if app.movieEvents == nil {
+		app.serverErrorResponse(w, r, fmt.Errorf("movie event broker is not running"))
+		return
+	}
+
+	var lastID int64 = -1
+
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 0 {
+			app.badRequestResponse(w, r, fmt.Errorf("Last-Event-ID header must be a non-negative integer"))
+			return
+		}
+		lastID = id
+	}
+
+	// Event IDs are shared by all organizations, but only this organization's
+	// events are sent. They're the ones that become visible in ID order, so a new
+	// stream starts after the organization's newest event, not the log's.
+	organizationID := app.contextGetOrganizationID(r)
+
+	// Subscribe before reading the log, so nothing committed in between is missed.
+	signal := app.movieEvents.subscribe()
+	defer app.movieEvents.unsubscribe(signal)
+
+	oldest, latest, err := app.models.MovieEvents.Bounds(r.Context(), organizationID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	reset := false
+	switch {
+	case lastID < 0:
+		lastID = latest
+	case lastID > latest || (oldest > 0 && lastID < oldest-1):
+		reset = true
+		lastID = latest
+	}
+
+	rc := http.NewResponseController(w)
+
+	// The server's WriteTimeout would otherwise cut every stream off after a few seconds.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 5000\n\n")
+
+	if reset {
+		fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", lastID)
+	}
+
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		// Catch up on everything after lastID, a page at a time.
+		for {
+			events, err := app.models.MovieEvents.GetAfter(r.Context(), organizationID, lastID, 100)
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			for _, event := range events {
+				payload, err := json.Marshal(envelope{"movie": event.Movie})
+				if err != nil {
+					app.logError(r, err)
+					return
+				}
+
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, payload)
+				lastID = event.ID
+			}
+
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+			if len(events) < 100 {
+				break
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case _, ok := <-signal:
+			if !ok {
+				// The server is shutting down.
+				return
+			}
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/graphql"
+	"greenlight.bagerbach.com/internal/validator"
+)
+
+// graphqlInput is a GraphQL request, in the JSON form clients send over HTTP.
+type graphqlInput struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// graphqlHandler executes a GraphQL query, so clients can fetch the current user
+// and movies in a single round trip. Each field checks the permission its REST
+// endpoint needs as it's resolved: those the user can't see are null, with an
+// error, and the others are returned all the same. Queries over the depth, root
+// field or complexity limit are rejected before anything is fetched, so a request
+// can't do the work of many behind the rate limiter's back.
+func (app *application) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	// Movies are read from the organization in the X-Organization header.
+	w.Header().Add("Vary", "X-Organization")
+
+	var input graphqlInput
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Query != "", "query", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	result := app.graphqlSchema(r).Execute(r.Context(), graphql.Request{
+		Query:         input.Query,
+		OperationName: input.OperationName,
+		Variables:     input.Variables,
+	})
+
+	// The query couldn't be executed at all, so there's no data to send.
+	if result.Data == nil {
+		for _, err := range result.Errors {
+			code := errCodeInvalidQuery
+			if errors.Is(err, graphql.ErrTooComplex) {
+				code = errCodeQueryTooComplex
+			}
+			err.Extensions = map[string]any{"code": code}
+		}
+
+		if err := app.writeResponse(w, r, http.StatusBadRequest, envelope{"errors": result.Errors}, nil); err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"data": result.Data}
+	if len(result.Errors) > 0 {
+		env["errors"] = result.Errors
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// graphqlSchema returns the types graphqlHandler's queries select from, with
+// resolvers for the request r. Their fields are named like the JSON keys of the
+// REST endpoints.
+func (app *application) graphqlSchema(r *http.Request) *graphql.Schema {
+	res := &graphqlResolver{app: app, r: r}
+
+	movie := &graphql.Object{
+		Name: "Movie",
+		Fields: map[string]*graphql.Field{
+			"id":                {},
+			"title":             {},
+			"year":              {},
+			"runtime":           {},
+			"genres":            {},
+			"version":           {},
+			"poster_updated_at": {},
+		},
+	}
+
+	metadata := &graphql.Object{
+		Name: "Metadata",
+		Fields: map[string]*graphql.Field{
+			"current_page":  {},
+			"page_size":     {},
+			"first_page":    {},
+			"last_page":     {},
+			"total_records": {},
+		},
+	}
+
+	moviePage := &graphql.Object{
+		Name: "MoviePage",
+		Fields: map[string]*graphql.Field{
+			"movies":   {Type: movie, List: true},
+			"metadata": {Type: metadata},
+		},
+	}
+
+	organization := &graphql.Object{
+		Name: "Organization",
+		Fields: map[string]*graphql.Field{
+			"id":         {},
+			"created_at": {},
+			"name":       {},
+			"role":       {},
+		},
+	}
+
+	user := &graphql.Object{
+		Name: "User",
+		Fields: map[string]*graphql.Field{
+			"id":            {},
+			"created_at":    {},
+			"name":          {},
+			"email":         {},
+			"activated":     {},
+			"pending_email": {},
+			"organizations": {Type: organization, List: true, Resolve: res.organizations, Complexity: resolverComplexity},
+		},
+	}
+
+	return &graphql.Schema{
+		Query: &graphql.Object{
+			Name: "Query",
+			Fields: map[string]*graphql.Field{
+				"me": {Type: user, Resolve: res.me},
+				"movie": {
+					Type:       movie,
+					Args:       map[string]string{"id": "Int!"},
+					Resolve:    res.movie,
+					Complexity: resolverComplexity,
+				},
+				"movies": {
+					Type: moviePage,
+					Args: map[string]string{
+						"title":     "String",
+						"genres":    "[String!]",
+						"sort":      "String",
+						"page":      "Int",
+						"page_size": "Int",
+					},
+					Resolve:    res.movies,
+					Complexity: moviesComplexity,
+				},
+			},
+		},
+		MaxDepth:      app.config.graphql.maxDepth,
+		MaxRootFields: app.config.graphql.maxRootFields,
+		MaxComplexity: app.config.graphql.maxComplexity,
+	}
+}
+
+// resolverCost is the cost of a field whose resolver queries the database, on top
+// of the fields selected from it. Fields that only read their value from the
+// object they belong to cost 1.
+const resolverCost = 20
+
+func resolverComplexity(args map[string]any, childComplexity int) int {
+	return resolverCost + childComplexity
+}
+
+// moviesComplexity counts the fields selected from the movie list once for every
+// movie on the page. The metadata is counted that many times too, which errs on
+// the safe side.
+func moviesComplexity(args map[string]any, childComplexity int) int {
+	pageSize := int64(20)
+	if n, ok := args["page_size"].(int64); ok {
+		// Larger pages fail validation, without fetching anything.
+		pageSize = min(max(n, 1), 100)
+	}
+
+	return resolverCost + int(pageSize)*childComplexity
+}
+
+// graphqlResolver resolves the fields of a GraphQL request, using the request
+// for the user, their API key and the organization.
+type graphqlResolver struct {
+	app *application
+	r   *http.Request
+
+	// The organization movies are read from, and the user's permissions in it,
+	// are looked up the first time a field needs them.
+	organizationLoaded bool
+	organizationID     int64
+	permissions        data.Permissions
+	organizationErr    error
+}
+
+func graphqlError(code, message string) *graphql.Error {
+	return &graphql.Error{Message: message, Extensions: map[string]any{"code": code}}
+}
+
+// serverError is the field-level equivalent of serverErrorResponse.
+func (res *graphqlResolver) serverError(err error) error {
+	if data.Interrupted(err) {
+		if res.r.Context().Err() != nil {
+			return graphqlError(errCodeRequestCancelled, "the request was cancelled before it finished")
+		}
+
+		res.app.logger.WarnContext(res.r.Context(), "query timed out", "method", res.r.Method, "uri", res.r.URL.RequestURI(), "error", err.Error())
+		return graphqlError(errCodeTimeout, "the request took too long to process, please try again later")
+	}
+
+	res.app.logError(res.r, err)
+	return graphqlError(errCodeServerError, "The server encountered a problem and could not process your request")
+}
+
+// requireOrganizationPermission is the field-level equivalent of the middleware
+// of the same name. It returns the movie model of the organization.
+func (res *graphqlResolver) requireOrganizationPermission(ctx context.Context, code string) (data.MovieModelInterface, error) {
+	if !res.organizationLoaded {
+		res.organizationLoaded = true
+		res.organizationErr = res.loadOrganization(ctx)
+	}
+
+	if res.organizationErr != nil {
+		return nil, res.organizationErr
+	}
+
+	if !res.app.permitted(res.r, res.permissions, code) {
+		return nil, graphqlError(errCodePermissionDenied, "your account does not have the necessary permissions to access this field")
+	}
+
+	return res.app.models.Movies.ForOrganization(res.organizationID), nil
+}
+
+func (res *graphqlResolver) loadOrganization(ctx context.Context) error {
+	organizationID, err := res.app.requestOrganizationID(res.r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidOrganizationHeader):
+			return graphqlError(errCodeBadRequest, err.Error())
+		case errors.Is(err, data.ErrRecordNotFound):
+			return graphqlError(errCodeNotAMember, "your account is not a member of the organization")
+		default:
+			return res.serverError(err)
+		}
+	}
+
+	user := res.app.contextGetUser(res.r)
+
+	permissions, err := res.app.models.Permissions.GetAllForMember(ctx, organizationID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return graphqlError(errCodeNotAMember, "your account is not a member of the organization")
+		default:
+			return res.serverError(err)
+		}
+	}
+
+	res.organizationID = organizationID
+	res.permissions = permissions
+	return nil
+}
+
+// me is the user's own account which, like /v1/users/me, can't be read with an
+// API key.
+func (res *graphqlResolver) me(ctx context.Context, source any, args map[string]any) (any, error) {
+	if res.app.contextGetAPIKey(res.r) != nil {
+		return nil, graphqlError(errCodeAPIKeyNotAllowed, "API keys can't be used to read an account, authenticate with a token instead")
+	}
+
+	return res.app.contextGetUser(res.r), nil
+}
+
+func (res *graphqlResolver) organizations(ctx context.Context, source any, args map[string]any) (any, error) {
+	user := source.(*data.User)
+
+	organizations, err := res.app.models.Organizations.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, res.serverError(err)
+	}
+
+	return organizations, nil
+}
+
+func (res *graphqlResolver) movie(ctx context.Context, source any, args map[string]any) (any, error) {
+	movies, err := res.requireOrganizationPermission(ctx, "movies:read")
+	if err != nil {
+		return nil, err
+	}
+
+	movie, err := movies.Get(ctx, args["id"].(int64))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, graphqlError(errCodeNotFound, "The requested resource could not be found")
+		default:
+			return nil, res.serverError(err)
+		}
+	}
+
+	return movie, nil
+}
+
+// movies takes the same arguments, with the same defaults, as the query string
+// of listMoviesHandler.
+func (res *graphqlResolver) movies(ctx context.Context, source any, args map[string]any) (any, error) {
+	movies, err := res.requireOrganizationPermission(ctx, "movies:read")
+	if err != nil {
+		return nil, err
+	}
+
+	title, _ := args["title"].(string)
+
+	genres := []string{}
+	if list, ok := args["genres"].([]any); ok {
+		for _, genre := range list {
+			genres = append(genres, genre.(string))
+		}
+	}
+
+	filters := data.Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: data.MovieSortSafelist}
+	if page, ok := args["page"].(int64); ok {
+		filters.Page = int(page)
+	}
+	if pageSize, ok := args["page_size"].(int64); ok {
+		filters.PageSize = int(pageSize)
+	}
+	if sort, ok := args["sort"].(string); ok {
+		filters.Sort = sort
+	}
+
+	v := validator.New()
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		err := graphqlError(errCodeFailedValidation, "one or more arguments failed validation")
+		err.Extensions["errors"] = v.Errors
+		return nil, err
+	}
+
+	list, metadata, err := movies.GetAll(ctx, title, genres, filters)
+	if err != nil {
+		return nil, res.serverError(err)
+	}
+
+	return map[string]any{"movies": list, "metadata": metadata}, nil
+}
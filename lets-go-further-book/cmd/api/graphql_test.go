@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+type graphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string         `json:"message"`
+		Path       []any          `json:"path"`
+		Extensions map[string]any `json:"extensions"`
+	} `json:"errors"`
+}
+
+// errorCodes returns the code of each error, with its path.
+func (resp graphqlResponse) errorCodes() string {
+	var codes []string
+	for _, err := range resp.Errors {
+		codes = append(codes, fmt.Sprintf("%v:%v", err.Path, err.Extensions["code"]))
+	}
+	return fmt.Sprint(codes)
+}
+
+func TestGraphQL(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	alice := newTestUser(t, app, "alice@example.com", "movies:read", "movies:write")
+	bob := newTestUser(t, app, "bob@example.com")
+
+	for _, movie := range []map[string]any{
+		{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation", "adventure"}},
+		{"title": "Black Panther", "year": 2018, "runtime": "134 mins", "genres": []string{"action"}},
+		{"title": "Akira", "year": 1988, "runtime": "124 mins", "genres": []string{"animation"}},
+	} {
+		code, _ := ts.do(t, http.MethodPost, "/v1/movies", alice, movie, nil)
+		assert.Equal(t, code, http.StatusCreated)
+	}
+
+	var created apiKeyResponse
+	code, _ := ts.do(t, http.MethodPost, "/v1/api-keys", alice, map[string]any{"name": "Reader", "permissions": []string{"movies:read"}}, &created)
+	assert.Equal(t, code, http.StatusCreated)
+	key := created.APIKey.Key
+
+	acme := newTestOrganization(t, ts, bob, "Acme")
+
+	tests := []struct {
+		name      string
+		token     string
+		header    http.Header
+		query     string
+		variables map[string]any
+		wantCode  int
+		wantData  string
+		wantError string
+	}{
+		{
+			name:     "User and movies in one round trip",
+			token:    alice,
+			query:    `{ me { email organizations { name } } movies(genres: ["animation"], sort: "-year") { movies { title genres runtime } metadata { total_records } } }`,
+			wantCode: http.StatusOK,
+			wantData: `{"me":{"email":"alice@example.com","organizations":[{"name":"Default"}]},"movies":{"movies":[{"title":"Moana","genres":["animation","adventure"],"runtime":"107 mins"},{"title":"Akira","genres":["animation"],"runtime":"124 mins"}],"metadata":{"total_records":2}}}`,
+		},
+		{
+			name:      "Variables",
+			token:     alice,
+			query:     `query Movie($id: Int!) { movie(id: $id) { id title } missing: movie(id: 99) { id } }`,
+			variables: map[string]any{"id": 3},
+			wantCode:  http.StatusOK,
+			wantData:  `{"movie":{"id":3,"title":"Akira"},"missing":null}`,
+			wantError: "[[missing]:not_found]",
+		},
+		{
+			name:      "Fields without permission",
+			token:     bob,
+			header:    xOrganization(defaultOrganizationID),
+			query:     `{ me { email } movies { metadata { total_records } } }`,
+			wantCode:  http.StatusOK,
+			wantData:  `{"me":{"email":"bob@example.com"},"movies":null}`,
+			wantError: "[[movies]:permission_denied]",
+		},
+		{
+			name:      "Organization the user isn't a member of",
+			token:     alice,
+			header:    xOrganization(acme),
+			query:     `{ movie(id: 1) { title } }`,
+			wantCode:  http.StatusOK,
+			wantData:  `{"movie":null}`,
+			wantError: "[[movie]:not_a_member]",
+		},
+		{
+			name:      "API key",
+			token:     key,
+			query:     `{ me { email } movies(page_size: 1) { movies { title } } }`,
+			wantCode:  http.StatusOK,
+			wantData:  `{"me":null,"movies":{"movies":[{"title":"Moana"}]}}`,
+			wantError: "[[me]:api_key_not_allowed]",
+		},
+		{
+			name:      "Invalid arguments",
+			token:     alice,
+			query:     `{ movies(page_size: 1000) { movies { title } } }`,
+			wantCode:  http.StatusOK,
+			wantData:  `{"movies":null}`,
+			wantError: "[[movies]:failed_validation]",
+		},
+		{
+			name:      "Syntax error",
+			token:     alice,
+			query:     `{ movies { movies { title } }`,
+			wantCode:  http.StatusBadRequest,
+			wantError: "[[]:invalid_query]",
+		},
+		{
+			name:      "Unknown field",
+			token:     alice,
+			query:     `{ me { password } }`,
+			wantCode:  http.StatusBadRequest,
+			wantError: "[[]:invalid_query]",
+		},
+		{
+			name:      "Too complex",
+			token:     alice,
+			query:     `{ a: movies(page_size: 100) { movies { id title year runtime genres version } } b: movies(page_size: 100) { movies { id title year runtime genres version } } }`,
+			wantCode:  http.StatusBadRequest,
+			wantError: "[[]:query_too_complex]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp graphqlResponse
+			body := map[string]any{"query": tt.query, "variables": tt.variables}
+			code, _ := ts.doWithHeader(t, http.MethodPost, "/v1/graphql", tt.token, tt.header, body, &resp)
+			assert.Equal(t, code, tt.wantCode)
+
+			if tt.wantData != "" {
+				assert.Equal(t, string(resp.Data), tt.wantData)
+			}
+			if tt.wantError != "" {
+				assert.Equal(t, resp.errorCodes(), tt.wantError)
+			} else {
+				assert.Equal(t, len(resp.Errors), 0)
+			}
+		})
+	}
+
+	t.Run("Too deep", func(t *testing.T) {
+		app.config.graphql.maxDepth = 2
+		defer func() { app.config.graphql.maxDepth = 5 }()
+
+		var resp graphqlResponse
+		code, _ := ts.do(t, http.MethodPost, "/v1/graphql", alice, map[string]any{"query": `{ me { organizations { name } } }`}, &resp)
+		assert.Equal(t, code, http.StatusBadRequest)
+		assert.Equal(t, resp.errorCodes(), "[[]:query_too_complex]")
+	})
+
+	t.Run("Many aliases", func(t *testing.T) {
+		// aliases selects the same movie n times over, each under its own alias.
+		aliases := func(n int) string {
+			var b strings.Builder
+			b.WriteString("{")
+			for i := range n {
+				fmt.Fprintf(&b, " m%d: movie(id: 1) { id }", i)
+			}
+			b.WriteString(" }")
+			return b.String()
+		}
+
+		var resp graphqlResponse
+		code, _ := ts.do(t, http.MethodPost, "/v1/graphql", alice, map[string]any{"query": aliases(10)}, &resp)
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, len(resp.Errors), 0)
+
+		resp = graphqlResponse{}
+		code, _ = ts.do(t, http.MethodPost, "/v1/graphql", alice, map[string]any{"query": aliases(11)}, &resp)
+		assert.Equal(t, code, http.StatusBadRequest)
+		assert.Equal(t, resp.errorCodes(), "[[]:query_too_complex]")
+
+		// Each lookup costs as much as a query, so even without the root field
+		// limit far fewer fit than the 500 selecting just their fields would allow.
+		app.config.graphql.maxRootFields = 500
+		defer func() { app.config.graphql.maxRootFields = 10 }()
+
+		resp = graphqlResponse{}
+		code, _ = ts.do(t, http.MethodPost, "/v1/graphql", alice, map[string]any{"query": aliases(50)}, &resp)
+		assert.Equal(t, code, http.StatusBadRequest)
+		assert.Equal(t, resp.errorCodes(), "[[]:query_too_complex]")
+		assert.StringContains(t, resp.Errors[0].Message, "complexity of")
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		code, _ := ts.do(t, http.MethodPost, "/v1/graphql", "", map[string]any{"query": `{ me { email } }`}, nil)
+		assert.Equal(t, code, http.StatusUnauthorized)
+	})
+
+	t.Run("Missing query", func(t *testing.T) {
+		code, _ := ts.do(t, http.MethodPost, "/v1/graphql", alice, map[string]any{}, nil)
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+	})
+}
@@ -1,19 +1,143 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"net/http"
+	"sync"
+	"time"
 )
 
-func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+// liveHealthcheckHandler reports that the process is up and serving requests. It
+// doesn't look at any dependencies, so an orchestrator won't restart us just
+// because the database is briefly unreachable.
+func (app *application) liveHealthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	data := envelope{
-		"status": "available",
-		"system_info": map[string]string{
-			"environment": app.config.env,
-			"version":     version,
-		},
+		"status":      "available",
+		"system_info": app.systemInfo(),
 	}
 
-	if err := app.writeJSON(w, http.StatusOK, data, nil); err != nil {
+	if err := app.writeResponse(w, r, http.StatusOK, data, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// healthCheck is the result of checking a single dependency.
+type healthCheck struct {
+	Status   string     `json:"status"` // "up" or "down"
+	Duration string     `json:"duration"`
+	Error    string     `json:"error,omitempty"`
+	Pool     *poolStats `json:"pool,omitempty"`
+}
+
+// poolStats summarises sql.DBStats. Saturation is the share of the maximum number
+// of open connections currently in use; a value of 1 with a growing wait count means
+// requests are queueing for a connection.
+type poolStats struct {
+	OpenConnections    int     `json:"open_connections"`
+	InUse              int     `json:"in_use"`
+	Idle               int     `json:"idle"`
+	MaxOpenConnections int     `json:"max_open_connections"`
+	Saturation         float64 `json:"saturation"`
+	WaitCount          int64   `json:"wait_count"`
+	WaitDuration       string  `json:"wait_duration"`
+}
+
+func newPoolStats(stats sql.DBStats) *poolStats {
+	ps := &poolStats{
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		MaxOpenConnections: stats.MaxOpenConnections,
+		WaitCount:          stats.WaitCount,
+		WaitDuration:       stats.WaitDuration.String(),
+	}
+	if stats.MaxOpenConnections > 0 {
+		ps.Saturation = float64(stats.InUse) / float64(stats.MaxOpenConnections)
+	}
+
+	return ps
+}
+
+// readyHealthcheckHandler reports whether we can serve traffic: the database (and
+// its replica, if there is one) has to answer a ping, the SMTP server has to accept
+// a connection if that check is enabled, and the server must not be shutting down.
+// Otherwise it responds 503 so load balancers stop sending us requests.
+func (app *application) readyHealthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), app.config.healthcheck.timeout)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		checks = map[string]healthCheck{}
+	)
+
+	// The endpoint is public, so a failed check only says which dependency is
+	// unavailable; the error itself, which may name hosts and users, is logged.
+	check := func(name, unavailable string, fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			start := time.Now()
+			result := healthCheck{Status: "up"}
+			if err := fn(); err != nil {
+				app.logger.ErrorContext(r.Context(), "readiness check failed", "check", name, "error", err)
+				result.Status = "down"
+				result.Error = unavailable
+			}
+			result.Duration = time.Since(start).String()
+
+			mu.Lock()
+			checks[name] = result
+			mu.Unlock()
+		}()
+	}
+
+	check("database", "database unavailable", func() error { return app.models.Ping(ctx) })
+	if app.models.HasReplica() {
+		check("database_replica", "database replica unavailable", func() error { return app.models.PingReplica(ctx) })
+	}
+	if app.config.healthcheck.smtp {
+		check("smtp", "SMTP server unavailable", func() error { return app.mailer.Check(ctx) })
+	}
+	wg.Wait()
+
+	database := checks["database"]
+	database.Pool = newPoolStats(app.models.Stats())
+	checks["database"] = database
+
+	if app.models.HasReplica() {
+		replica := checks["database_replica"]
+		replica.Pool = newPoolStats(app.models.ReplicaStats())
+		checks["database_replica"] = replica
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, c := range checks {
+		if c.Status != "up" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	if app.shuttingDown.Load() {
+		status, code = "shutting_down", http.StatusServiceUnavailable
+	}
+
+	data := envelope{
+		"status":      status,
+		"checks":      checks,
+		"system_info": app.systemInfo(),
+	}
+
+	if err := app.writeResponse(w, r, code, data, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) systemInfo() map[string]string {
+	return map[string]string{
+		"environment": app.config.env,
+		"version":     version,
+	}
+}
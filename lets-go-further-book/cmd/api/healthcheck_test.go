@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/data"
+)
+
+func TestLiveHealthcheck(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	for _, path := range []string{"/v1/healthcheck/live", "/v1/healthcheck"} {
+		t.Run(path, func(t *testing.T) {
+			var resp struct {
+				Status string `json:"status"`
+			}
+			code, _ := ts.do(t, http.MethodGet, path, "", nil, &resp)
+			assert.Equal(t, code, http.StatusOK)
+			assert.Equal(t, resp.Status, "available")
+		})
+	}
+}
+
+func TestReadyHealthcheck(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.healthcheck.timeout = 5 * time.Second
+	ts := newTestServer(t, app.routes())
+
+	type readyResponse struct {
+		Status string                 `json:"status"`
+		Checks map[string]healthCheck `json:"checks"`
+	}
+
+	var resp readyResponse
+	code, _ := ts.do(t, http.MethodGet, "/v1/healthcheck/ready", "", nil, &resp)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, resp.Status, "ready")
+	assert.Equal(t, resp.Checks["database"].Status, "up")
+
+	t.Run("Database down", func(t *testing.T) {
+		// Nothing listens on port 1, so the ping fails, with an error naming the host.
+		db, err := sql.Open("postgres", "postgres://greenlight@127.0.0.1:1/greenlight?sslmode=disable&connect_timeout=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		app.models = data.NewModels(db, nil, data.Timeouts{})
+
+		var resp readyResponse
+		code, _ := ts.do(t, http.MethodGet, "/v1/healthcheck/ready", "", nil, &resp)
+		assert.Equal(t, code, http.StatusServiceUnavailable)
+		assert.Equal(t, resp.Status, "unavailable")
+		assert.Equal(t, resp.Checks["database"].Status, "down")
+		assert.Equal(t, resp.Checks["database"].Error, "database unavailable")
+	})
+}
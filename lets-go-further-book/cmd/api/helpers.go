@@ -1,26 +1,39 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"mime"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.bagerbach.com/internal/msgpack"
+	"greenlight.bagerbach.com/internal/tracing"
 	"greenlight.bagerbach.com/internal/validator"
 )
 
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readInt64Param(r, "id")
+}
+
+func (app *application) readInt64Param(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	i, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil {
 		return 0, err
 	}
-	return id, nil
+	return i, nil
 }
 
 // Not strictly necessary, but there are some benefits to using envelopes.
@@ -35,29 +48,108 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 type envelope map[string]interface{}
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	js, err := json.Marshal(data)
+	js, err := encodeJSON(data)
 	if err != nil {
 		return err
 	}
 
-	js = append(js, '\n')
+	app.write(w, status, "application/json", js, headers)
+	return nil
+}
+
+// writeResponse is like writeJSON, but picks the response format from the
+// request's Accept header using the responseEncoders registry. The router has
+// already checked that the route's response can be written in one of them, so
+// the 406 sent when none of the accepted formats can represent data is a last
+// resort.
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	body, contentType, ok, err := encodeResponse(r, data)
+	if err != nil {
+		return err
+	}
 
+	if !ok {
+		app.notAcceptableResponse(w, r)
+		return nil
+	}
+
+	app.write(w, status, contentType, body, headers)
+	return nil
+}
+
+func (app *application) write(w http.ResponseWriter, status int, contentType string, body []byte, headers http.Header) {
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
 	w.WriteHeader(status)
-	w.Write(js)
+	w.Write(body)
+}
 
-	return nil
+// selectFields trims a resource, or a slice of resources, down to the given JSON
+// keys. Going through encoding/json means custom marshalers like data.Runtime
+// still apply. With no fields requested, the value is returned unchanged.
+func (app *application) selectFields(value any, fields []string) (any, error) {
+	if len(fields) == 0 {
+		return value, nil
+	}
+
+	js, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	pick := func(resource map[string]json.RawMessage) map[string]json.RawMessage {
+		selected := make(map[string]json.RawMessage, len(fields))
+		for _, field := range fields {
+			if v, ok := resource[field]; ok {
+				selected[field] = v
+			}
+		}
+		return selected
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(js), []byte("[")) {
+		var resources []map[string]json.RawMessage
+		if err := json.Unmarshal(js, &resources); err != nil {
+			return nil, err
+		}
+
+		selected := make([]map[string]json.RawMessage, len(resources))
+		for i, resource := range resources {
+			selected[i] = pick(resource)
+		}
+		return selected, nil
+	}
+
+	var resource map[string]json.RawMessage
+	if err := json.Unmarshal(js, &resource); err != nil {
+		return nil, err
+	}
+
+	return pick(resource), nil
 }
 
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
 	maxBytes := 1_048_576 // 1MB
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
-	dec := json.NewDecoder(r.Body)
+	var body io.Reader = r.Body
+
+	// MessagePack bodies are converted to JSON up front, so they're decoded into dst
+	// with exactly the same rules and error messages as JSON ones. The size limit
+	// above applies to the MessagePack body as it was sent.
+	if isMessagePack(r.Header.Get("Content-Type")) {
+		js, err := app.readMessagePack(r)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(js)
+	}
+
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields() // This will return an error if the JSON contains fields that are not in the target destination struct.
 
 	if err := dec.Decode(dst); err != nil {
@@ -103,6 +195,42 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	return nil
 }
 
+func isMessagePack(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(messagePackMediaTypes, mediaType)
+}
+
+func (app *application) readMessagePack(r *http.Request) ([]byte, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return nil, fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+		}
+		return nil, err
+	}
+
+	if len(b) == 0 {
+		return nil, errors.New("body must not be empty")
+	}
+
+	js, err := msgpack.ToJSON(b)
+	if err != nil {
+		switch {
+		case errors.Is(err, msgpack.ErrTrailingData):
+			return nil, errors.New("body must only contain a single MessagePack value")
+		default:
+			return nil, errors.New("body contains badly-formed MessagePack")
+		}
+	}
+
+	return js, nil
+}
+
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
 	s := qs.Get(key)
 	if s == "" {
@@ -132,19 +260,177 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-func (app *application) background(fn func()) {
-	app.wg.Add(1)
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+	return b
+}
+
+// background runs fn in a goroutine, recovering from any panic. Graceful shutdown
+// waits for it to finish, and names it in the log if it doesn't finish in time.
+func (app *application) background(name string, fn func()) {
+	id := app.tasks.add(name)
 
 	// Launch the background goroutine
 	go func() {
-		defer app.wg.Done()
+		defer app.tasks.done(id)
 
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.Error(fmt.Sprintf("%v", err))
+				app.logger.Error(fmt.Sprintf("%v", err), "task", name)
 			}
 		}()
 
 		fn()
 	}()
 }
+
+// backgroundTasks keeps track of the goroutines started by background. The zero
+// value is ready to use.
+type backgroundTasks struct {
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	nextID  int
+	running map[int]backgroundTask
+
+	// stopping is cancelled by stop. It's created the first time it's needed.
+	stopping context.Context
+	cancel   context.CancelFunc
+}
+
+type backgroundTask struct {
+	name    string
+	started time.Time
+}
+
+func (bt *backgroundTasks) add(name string) int {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	if bt.running == nil {
+		bt.running = make(map[int]backgroundTask)
+	}
+
+	bt.nextID++
+	bt.running[bt.nextID] = backgroundTask{name: name, started: time.Now()}
+	bt.wg.Add(1)
+
+	return bt.nextID
+}
+
+func (bt *backgroundTasks) done(id int) {
+	bt.mu.Lock()
+	delete(bt.running, id)
+	bt.mu.Unlock()
+
+	bt.wg.Done()
+}
+
+// context returns a context that carries the span from ctx, like tracing.Detach,
+// and is cancelled once the tasks are stopped. Tasks that can give up early, like
+// a webhook delivery waiting to retry, use it so they don't hold up shutdown.
+func (bt *backgroundTasks) context(ctx context.Context) context.Context {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	if bt.stopping == nil {
+		bt.stopping, bt.cancel = context.WithCancel(context.Background())
+	}
+
+	return tracing.ContextWithSpan(bt.stopping, tracing.SpanFromContext(ctx))
+}
+
+// stop cancels the contexts returned by context.
+func (bt *backgroundTasks) stop() {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	if bt.cancel != nil {
+		bt.cancel()
+	}
+}
+
+// wait blocks until every task has finished or the timeout has passed, reporting
+// whether they all finished.
+func (bt *backgroundTasks) wait(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		bt.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// list returns the tasks still running, oldest first.
+func (bt *backgroundTasks) list() []backgroundTask {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	tasks := slices.Collect(maps.Values(bt.running))
+	slices.SortFunc(tasks, func(a, b backgroundTask) int {
+		return a.started.Compare(b.started)
+	})
+
+	return tasks
+}
+
+// recentWrites remembers when users last made a request that may have written to
+// the database, so their reads can go to the primary until the replica has caught
+// up. See readYourWrites.
+type recentWrites struct {
+	mu        sync.Mutex
+	last      map[int64]time.Time
+	lastSweep time.Time
+}
+
+// add records a write by the user. Users whose last write was longer than window
+// ago are forgotten by within, or by a sweep of the whole map at most once per
+// window for those who don't come back.
+func (rw *recentWrites) add(userID int64, window time.Duration) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.last == nil {
+		rw.last = make(map[int64]time.Time)
+	}
+
+	now := time.Now()
+
+	if now.Sub(rw.lastSweep) > window {
+		for id, t := range rw.last {
+			if now.Sub(t) > window {
+				delete(rw.last, id)
+			}
+		}
+		rw.lastSweep = now
+	}
+
+	rw.last[userID] = now
+}
+
+// within reports whether the user's last write was at most window ago.
+func (rw *recentWrites) within(userID int64, window time.Duration) bool {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	t, ok := rw.last[userID]
+	if ok && time.Since(t) > window {
+		delete(rw.last, userID)
+		return false
+	}
+	return ok
+}
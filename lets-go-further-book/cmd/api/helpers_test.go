@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+func TestRecentWrites(t *testing.T) {
+	var rw recentWrites
+	window := 50 * time.Millisecond
+
+	assert.Equal(t, rw.within(1, window), false)
+
+	rw.add(1, window)
+	rw.add(2, window)
+	assert.Equal(t, rw.within(1, window), true)
+
+	time.Sleep(2 * window)
+
+	// User 1 is forgotten when their reads are routed, and user 2, who doesn't come
+	// back, by the sweep made when user 3 writes.
+	assert.Equal(t, rw.within(1, window), false)
+	rw.add(3, window)
+
+	assert.Equal(t, len(rw.last), 1)
+	assert.Equal(t, rw.within(3, window), true)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"greenlight.bagerbach.com/internal/tracing"
+)
+
+// contextHandler wraps a slog.Handler, adding the request ID and trace from the
+// context to every record logged with one of the *Context methods, so all of the
+// log lines for a request can be found together.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIDContextKey).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+
+	if span := tracing.SpanFromContext(ctx); span != nil {
+		sc := span.SpanContext()
+		record.AddAttrs(slog.String("trace_id", sc.TraceID.String()), slog.String("span_id", sc.SpanID.String()))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -9,14 +9,17 @@ import (
 	"log/slog"
 	"os"
 	"runtime"
-	"strconv"
-	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"greenlight.bagerbach.com/internal/data"
 	"greenlight.bagerbach.com/internal/mailer"
+	"greenlight.bagerbach.com/internal/migrate"
+	"greenlight.bagerbach.com/internal/storage"
+	"greenlight.bagerbach.com/internal/tracing"
 	"greenlight.bagerbach.com/internal/vcs"
+	"greenlight.bagerbach.com/internal/webhook"
+	"greenlight.bagerbach.com/migrations"
 
 	// Import the pq driver - it needs to register itself with the database/sql package
 	_ "github.com/lib/pq"
@@ -26,38 +29,23 @@ var (
 	version = vcs.Version()
 )
 
-type config struct {
-	port int
-	env  string
-	db   struct {
-		dsn          string
-		maxOpenConns int
-		maxIdleConns int
-		maxIdleTime  time.Duration
-	}
-	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
-	}
-	smtp struct {
-		host     string
-		port     int
-		username string
-		password string
-		sender   string
-	}
-	cors struct {
-		trustedOrigins []string
-	}
-}
-
 type application struct {
-	config config
-	logger *slog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config      config
+	logger      *slog.Logger
+	models      data.Models
+	mailer      mailer.MailerInterface
+	webhooks    webhook.Client
+	storage     storage.Storage
+	movieEvents *movieEventBroker
+	tracer      *tracing.Tracer
+	// shuttingDown is set as soon as graceful shutdown starts, making the readiness
+	// check fail.
+	shuttingDown atomic.Bool
+	tasks        backgroundTasks
+	recentWrites recentWrites
+	// posterSlots holds a value for every poster being rendered, up to
+	// posters.maxConcurrent. See renderPoster.
+	posterSlots chan struct{}
 }
 
 func main() {
@@ -65,27 +53,11 @@ func main() {
 
 	version = getEnvAsString("VERSION", version)
 
-	flag.IntVar(&cfg.port, "port", getEnvAsInt("PORT", 4000), "Server port to listen on")
-	flag.StringVar(&cfg.env, "env", getEnvAsString("ENV", "development"), "Application environment (development|staging|production)")
-	flag.StringVar(&cfg.db.dsn, "db-dsn", getEnvAsString("DATABASE_URL", ""), "PostgreSQL DSN")
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", getEnvAsInt("DB_MAX_OPEN_CONNS", 25), "Maximum number of open connections to the database")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", getEnvAsInt("DB_MAX_IDLE_CONNS", 25), "Maximum number of idle connections to the database")
-	flag.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", getEnvAsDuration("DB_MAX_IDLE_TIME", 15*time.Minute), "Maximum idle time for a connection to the database")
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", getEnvAsFloat64("LIMITER_RPS", 2), "Rate limit to apply to requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", getEnvAsInt("LIMITER_BURST", 4), "Burst limit to apply to requests")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", getEnvAsBool("LIMITER_ENABLED", true), "Enable rate limiting")
-	flag.StringVar(&cfg.smtp.host, "smtp-host", getEnvAsString("SMTP_HOST", ""), "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", getEnvAsInt("SMTP_PORT", 25), "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", getEnvAsString("SMTP_USERNAME", ""), "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", getEnvAsString("SMTP_PASSWORD", ""), "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", getEnvAsString("SMTP_SENDER", ""), "SMTP sender")
-
-	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(s string) error {
-		cfg.cors.trustedOrigins = strings.Fields(s)
-		return nil
-	})
+	cfg.registerFlags(flag.CommandLine)
 
+	configFile := flag.String("config", getEnvAsString("CONFIG_FILE", ""), "Path to a TOML configuration file")
 	displayVersion := flag.Bool("version", false, "Display version and exit")
+	displayConfig := flag.Bool("print-config", false, "Display the effective configuration, with secrets redacted, and exit")
 
 	flag.Parse()
 
@@ -94,9 +66,30 @@ func main() {
 		os.Exit(0)
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	// Settings missing from the command line are taken from the environment, then
+	// from the config file. Anything malformed or invalid stops us from starting.
+	err := applyConfigSources(flag.CommandLine, *configFile, os.LookupEnv)
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *displayConfig {
+		printConfig(os.Stdout, flag.CommandLine)
+		os.Exit(0)
+	}
+
+	if flag.NArg() > 0 && flag.Arg(0) != "migrate" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		os.Exit(2)
+	}
+
+	logger := slog.New(contextHandler{slog.NewTextHandler(os.Stdout, nil)})
 
-	db, err := openDB(cfg)
+	db, err := openDB(cfg, cfg.db.dsn)
 	if err != nil {
 		logger.Error("error opening db", "error", err)
 		os.Exit(1)
@@ -105,6 +98,43 @@ func main() {
 
 	logger.Info("database connection pool established")
 
+	var replica *sql.DB
+	if cfg.db.replicaDSN != "" {
+		replica, err = openDB(cfg, cfg.db.replicaDSN)
+		if err != nil {
+			logger.Error("error opening replica db", "error", err)
+			os.Exit(1)
+		}
+		defer replica.Close()
+
+		logger.Info("replica database connection pool established")
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrateCommand(db, logger, flag.Args()[1:]); err != nil {
+			logger.Error("error running migrations", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.migrate.onStart {
+		migrator, err := migrate.New(db, migrations.FS)
+		if err == nil {
+			err = migrateUp(context.Background(), migrator, logger)
+		}
+		if err != nil {
+			logger.Error("error running migrations", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	tracer, err := newTracer(cfg, logger)
+	if err != nil {
+		logger.Error("error setting up tracing", "error", err)
+		os.Exit(1)
+	}
+
 	expvar.NewString("version").Set(version)
 	expvar.Publish("goroutines", expvar.Func(func() any {
 		return runtime.NumGoroutine()
@@ -112,25 +142,62 @@ func main() {
 	expvar.Publish("database", expvar.Func(func() any {
 		return db.Stats()
 	}))
+	if replica != nil {
+		expvar.Publish("database_replica", expvar.Func(func() any {
+			return replica.Stats()
+		}))
+	}
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
 
+	files, err := storage.NewLocal(cfg.storage.dir)
+	if err != nil {
+		logger.Error("error opening file storage", "error", err)
+		os.Exit(1)
+	}
+
+	movieEvents, err := newMovieEventBroker(cfg.db.dsn, logger)
+	if err != nil {
+		logger.Error("error listening for movie events", "error", err)
+		os.Exit(1)
+	}
+
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:      cfg,
+		logger:      logger,
+		models:      data.NewModels(db, replica, data.Timeouts{Read: cfg.db.readTimeout, Write: cfg.db.writeTimeout}),
+		mailer:      mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		webhooks:    webhook.New(cfg.webhooks.timeout, cfg.webhooks.maxAttempts, cfg.webhooks.backoff),
+		storage:     files,
+		movieEvents: movieEvents,
+		tracer:      tracer,
+		posterSlots: make(chan struct{}, cfg.posters.maxConcurrent),
+	}
+
+	// Registration would fail for every user if the default role didn't exist.
+	if _, err := app.models.Roles.Get(context.Background(), cfg.users.defaultRole); err != nil {
+		logger.Error("error looking up the default role", "role", cfg.users.defaultRole, "error", err)
+		os.Exit(1)
+	}
+
+	if cfg.users.defaultOrganization != 0 {
+		if _, err := app.models.Organizations.Get(context.Background(), cfg.users.defaultOrganization); err != nil {
+			logger.Error("error looking up the default organization", "organization", cfg.users.defaultOrganization, "error", err)
+			os.Exit(1)
+		}
 	}
 
 	if err := app.serve(); err != nil {
-		logger.Error("error starting server", "error", err)
+		logger.Error("error running server", "error", err)
 		os.Exit(1)
 	}
 }
 
-func openDB(cfg config) (*sql.DB, error) {
-	db, err := sql.Open("postgres", cfg.db.dsn)
+// openDB opens a connection pool to dsn, which is either the primary or the
+// replica; both pools share the same settings.
+func openDB(cfg config, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -151,45 +218,36 @@ func openDB(cfg config) (*sql.DB, error) {
 	return db, nil
 }
 
-func getEnvAsString(key string, fallback string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
-	}
-	return fallback
-}
-
-func getEnvAsInt(key string, fallback int) int {
-	if value, exists := os.LookupEnv(key); exists {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+// newTracer sets up the exporter chosen by cfg.tracing.exporter. With "none" it
+// returns a nil Tracer, which leaves tracing switched off.
+func newTracer(cfg config, logger *slog.Logger) (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+
+	switch cfg.tracing.exporter {
+	case "none":
+		return nil, nil
+	case "otlp":
+		exporter = tracing.NewOTLPExporter(cfg.tracing.endpoint, "greenlight", 10*time.Second)
+	case "stdout":
+		exporter = tracing.NewWriterExporter(os.Stdout)
+	case "file":
+		f, err := os.OpenFile(cfg.tracing.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
 		}
+		exporter = tracing.NewWriterExporter(f)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.tracing.exporter)
 	}
-	return fallback
-}
 
-func getEnvAsFloat64(key string, fallback float64) float64 {
-	if value, exists := os.LookupEnv(key); exists {
-		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
-			return floatValue
-		}
-	}
-	return fallback
+	return tracing.New(exporter, func(err error) {
+		logger.Error("failed to export traces", "error", err)
+	}), nil
 }
 
-func getEnvAsBool(key string, fallback bool) bool {
+func getEnvAsString(key string, fallback string) string {
 	if value, exists := os.LookupEnv(key); exists {
-		if boolValue, err := strconv.ParseBool(value); err == nil {
-			return boolValue
-		}
+		return value
 	}
 	return fallback
 }
-
-func getEnvAsDuration(key string, fallback time.Duration) time.Duration {
-	if value, exists := os.LookupEnv(key); exists {
-		if duration, err := time.ParseDuration(value); err == nil {
-			return duration
-		}
-	}
-	return fallback
-}
\ No newline at end of file
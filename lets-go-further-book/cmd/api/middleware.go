@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"net/http"
 	"slices"
 	"strconv"
@@ -14,9 +20,99 @@ import (
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/tracing"
 	"greenlight.bagerbach.com/internal/validator"
 )
 
+// requestID gives every request an identifier, which is echoed in the X-Request-ID
+// header and included in error responses and log lines so the two can be matched
+// up. An ID sent by the client (or a proxy in front of us) is kept if it looks
+// sane, otherwise a random one is generated.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if !validRequestID(id) {
+			randomBytes := make([]byte, 16)
+			if _, err := rand.Read(randomBytes); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(randomBytes)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		r = app.contextSetRequestID(r, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID only accepts IDs made of printable ASCII, so a client can't use
+// them to inject anything odd into our logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// trace starts a server span for every request, continuing the caller's trace
+// when it sent a traceparent header. The router renames the span after the
+// matched route.
+func (app *application) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if sc, ok := tracing.Extract(r.Header); ok {
+			ctx = tracing.ContextWithRemoteSpanContext(ctx, sc)
+		}
+
+		ctx, span := app.tracer.Start(ctx, r.Method)
+		defer span.End()
+		span.SetKind(tracing.KindServer)
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("request_id", app.contextGetRequestID(r))
+
+		mrw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mrw, r.WithContext(ctx))
+
+		span.SetAttribute("http.response.status_code", mrw.statusCode)
+		if mrw.statusCode >= 500 {
+			span.RecordError(errors.New(http.StatusText(mrw.statusCode)))
+		}
+	})
+}
+
+// logRequest writes one access log line per request once the response is done.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		mrw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mrw, r)
+
+		app.logger.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+			"proto", r.Proto,
+			"remote_addr", r.RemoteAddr,
+			"status", mrw.statusCode,
+			"bytes", mrw.bytesWritten,
+			"duration", time.Since(start),
+		)
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// This is a deferred function. It will always be run in the event of a panic as Go
@@ -106,13 +202,17 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		authorizationHeader := r.Header.Get("Authorization")
 		if authorizationHeader == "" {
-			app.contextSetUser(r, data.AnonymousUser)
-			next.ServeHTTP(w, r)
+			app.authenticateClientCertificate(w, r, next)
 			return
 		}
 
-		// We expect the value in the Authorization header to be in the format of "Bearer <token>".
+		// We expect the value in the Authorization header to be in the format of
+		// "Bearer <token>", or "ApiKey <key>" for machine clients.
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, headerParts[1], next)
+			return
+		}
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -128,7 +228,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		// Get user associated with authentication token
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -144,6 +244,93 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// authenticateAPIKey authenticates the request as the owner of the API key, which
+// requirePermission then limits to the key's permissions.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, plaintext string, next http.Handler) {
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, user, err := app.models.APIKeys.GetForKey(r.Context(), plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateClientCertificate authenticates requests without an Authorization
+// header as the user whose email is in their verified TLS client certificate, if
+// there is one. Otherwise the request is anonymous.
+func (app *application) authenticateClientCertificate(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	email, ok := clientCertificateEmail(r, app.config.tls.clientCommonName)
+	if !ok {
+		r = app.contextSetUser(r, data.AnonymousUser)
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	next.ServeHTTP(w, r)
+}
+
+// readYourWrites sends the reads of users who made a write in the last
+// db-read-your-writes-window to the primary database, as the replica might not
+// have their changes yet. Any request other than GET, HEAD or OPTIONS may write,
+// and reads everything from the primary too: it may read a record before changing
+// it, e.g. to check its version. Only those that succeed start the window, though,
+// as a request that failed shouldn't have changed anything.
+func (app *application) readYourWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if !app.models.HasReplica() || user.IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		window := app.config.db.readYourWritesWindow
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if app.recentWrites.within(user.ID, window) {
+				r = r.WithContext(data.UsePrimary(r.Context()))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mrw := newMetricsResponseWriter(w)
+
+		next.ServeHTTP(mrw, r.WithContext(data.UsePrimary(r.Context())))
+
+		// The window starts once the write has been committed.
+		if mrw.statusCode >= 200 && mrw.statusCode < 300 {
+			app.recentWrites.add(user.ID, window)
+		}
+	})
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -173,17 +360,32 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireAccountAccess is for the endpoints that manage a user's account, which
+// need the user's own credentials rather than an API key.
+func (app *application) requireAccountAccess(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireActivatedUser(fn)
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 
-		if !permissions.Include(code) {
+		if !app.permitted(r, permissions, code) {
 			app.nonPermittedResponse(w, r)
 			return
 		}
@@ -194,6 +396,268 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// requireOrganizationPermission is requirePermission for an organization's data.
+// The organization is the one in the X-Organization header or, without one, the
+// first the user joined, and its ID is added to the request context. The user
+// must have the permission within it.
+func (app *application) requireOrganizationPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// The same request gets a different response for each organization.
+		w.Header().Add("Vary", "X-Organization")
+
+		organizationID, err := app.requestOrganizationID(r)
+		if err != nil {
+			switch {
+			case errors.Is(err, errInvalidOrganizationHeader):
+				app.badRequestResponse(w, r, err)
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notAMemberResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !app.checkOrganizationPermission(w, r, organizationID, code) {
+			return
+		}
+
+		r = app.contextSetOrganizationID(r, organizationID)
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireActivatedUser(fn)
+}
+
+var errInvalidOrganizationHeader = errors.New("X-Organization header must be a positive integer")
+
+// requestOrganizationID returns the ID of the organization in the X-Organization
+// header or, without one, of the first organization the user joined. It returns
+// data.ErrRecordNotFound if the user isn't a member of any.
+func (app *application) requestOrganizationID(r *http.Request) (int64, error) {
+	if s := r.Header.Get("X-Organization"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 1 {
+			return 0, errInvalidOrganizationHeader
+		}
+		return id, nil
+	}
+
+	organizations, err := app.models.Organizations.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		return 0, err
+	}
+	if len(organizations) == 0 {
+		return 0, data.ErrRecordNotFound
+	}
+
+	return organizations[0].ID, nil
+}
+
+// checkOrganizationPermission reports whether the user has the permission within
+// the organization, sending an error response if they don't, including when
+// they aren't a member of it.
+func (app *application) checkOrganizationPermission(w http.ResponseWriter, r *http.Request, organizationID int64, code string) bool {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForMember(r.Context(), organizationID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notAMemberResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	if !app.permitted(r, permissions, code) {
+		app.nonPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// permitted reports whether permissions include code. A request made with an API
+// key only has the permissions that both the key and its owner still have.
+func (app *application) permitted(r *http.Request, permissions data.Permissions, code string) bool {
+	if key := app.contextGetAPIKey(r); key != nil && !key.Permissions.Include(code) {
+		return false
+	}
+
+	return permissions.Include(code)
+}
+
+type idempotencyResponseWriter struct {
+	wrapped    http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (irw *idempotencyResponseWriter) Header() http.Header {
+	return irw.wrapped.Header()
+}
+
+func (irw *idempotencyResponseWriter) WriteHeader(statusCode int) {
+	if irw.statusCode == 0 {
+		irw.statusCode = statusCode
+	}
+	irw.wrapped.WriteHeader(statusCode)
+}
+
+func (irw *idempotencyResponseWriter) Write(b []byte) (int, error) {
+	if irw.statusCode == 0 {
+		irw.statusCode = http.StatusOK
+	}
+	irw.body.Write(b)
+	return irw.wrapped.Write(b)
+}
+
+func (irw *idempotencyResponseWriter) Unwrap() http.ResponseWriter {
+	return irw.wrapped
+}
+
+// idempotent lets clients safely retry a POST by sending an Idempotency-Key header.
+// The first response for a key is stored for 24 hours along with a fingerprint of
+// the request body, and replayed for retries with the same body. A retry that
+// arrives while the first request is still running gets a 409 (or runs, if the
+// first request has held the key for longer than the lock timeout and so has
+// presumably crashed), and reusing a key with a different body gets a 422. Keys
+// are scoped to the user, method and path.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := validator.New()
+		if v.Check(len(key) <= 255, "idempotency_key", "must not be more than 255 bytes long"); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		// Read the whole body to fingerprint it, then put it back for the handler.
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit))
+				return
+			}
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := sha256.Sum256(body)
+
+		// Keys are kept apart per organization, as the same request creates
+		// something different in each. Routes outside organizations have none.
+		organizationID, _ := r.Context().Value(organizationContextKey).(int64)
+
+		record := &data.IdempotencyRecord{
+			Key:            key,
+			UserID:         app.contextGetUser(r).ID,
+			OrganizationID: organizationID,
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			Fingerprint:    fingerprint[:],
+			Expiry:         time.Now().Add(24 * time.Hour),
+		}
+
+		reserved, err := app.models.Idempotency.Reserve(r.Context(), record, app.config.idempotency.lockTimeout)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.idempotencyKeyInUseResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !reserved {
+			switch {
+			case !bytes.Equal(record.Fingerprint, fingerprint[:]):
+				app.idempotencyKeyMismatchResponse(w, r)
+			case record.InProgress():
+				app.idempotencyKeyInUseResponse(w, r)
+			default:
+				for key, value := range record.Header {
+					w.Header()[key] = value
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(record.Status)
+				w.Write(record.Body)
+			}
+			return
+		}
+
+		irw := &idempotencyResponseWriter{wrapped: w}
+		completed := false
+
+		// The key has to be released or completed even if the client has gone.
+		ctx := tracing.Detach(r.Context())
+
+		// Release the key if the handler fails, panics or is cancelled, so the
+		// client can retry.
+		defer func() {
+			if completed {
+				return
+			}
+			if err := app.models.Idempotency.Release(ctx, record); err != nil {
+				app.logError(r, err)
+			}
+		}()
+
+		next.ServeHTTP(irw, r)
+
+		if irw.statusCode == 0 || irw.statusCode >= 500 || irw.statusCode == statusClientClosedRequest {
+			return
+		}
+
+		record.Status = irw.statusCode
+		record.Header = irw.Header().Clone()
+		// A replay is a new request, so it keeps its own request ID.
+		delete(record.Header, "X-Request-Id")
+		record.Body = irw.body.Bytes()
+
+		if err := app.models.Idempotency.Complete(ctx, record); err != nil {
+			app.logError(r, err)
+			return
+		}
+
+		completed = true
+	})
+}
+
+// purgeIdempotencyKeys deletes expired idempotency keys every purge interval, until
+// stop is closed.
+func (app *application) purgeIdempotencyKeys(stop <-chan struct{}) {
+	ticker := time.NewTicker(app.config.idempotency.purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := app.models.Idempotency.DeleteExpired(context.Background())
+		if err != nil {
+			app.logger.Error("failed to delete expired idempotency keys", "error", err)
+			continue
+		}
+		if deleted > 0 {
+			app.logger.Info("deleted expired idempotency keys", "count", deleted)
+		}
+	}
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Origin")
@@ -209,7 +673,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 				w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
 				// Since we're allowing Authorization, Allow-Origin should be checked against a
 				// list of trusted origins. Never use `*` in this case.
-				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, X-Request-ID")
 
 				// Write headers along with 200 OK status and return from the middleware with no further action
 				w.WriteHeader(http.StatusOK)
@@ -225,6 +689,7 @@ type metricsResponseWriter struct {
 	wrapped       http.ResponseWriter
 	statusCode    int
 	headerWritten bool
+	bytesWritten  int
 }
 
 func newMetricsResponseWriter(w http.ResponseWriter) *metricsResponseWriter {
@@ -246,21 +711,26 @@ func (mrw *metricsResponseWriter) WriteHeader(statusCode int) {
 
 func (mrw *metricsResponseWriter) Write(b []byte) (int, error) {
 	mrw.headerWritten = true
-	return mrw.wrapped.Write(b)
+
+	n, err := mrw.wrapped.Write(b)
+	mrw.bytesWritten += n
+	return n, err
 }
 
 func (mrw *metricsResponseWriter) Unwrap() http.ResponseWriter {
 	return mrw.wrapped
 }
 
-func (app *application) metrics(next http.Handler) http.Handler {
-	var (
-		totalRequestsReceived           = expvar.NewInt("total_requests_received")
-		totalResponsesSent              = expvar.NewInt("total_responses_sent")
-		totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
-		totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
-	)
+// The request metrics are published once for the whole process, so routes() can be
+// called more than once (as the handler tests do).
+var (
+	totalRequestsReceived           = expvar.NewInt("total_requests_received")
+	totalResponsesSent              = expvar.NewInt("total_responses_sent")
+	totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
+	totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
+)
 
+func (app *application) metrics(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
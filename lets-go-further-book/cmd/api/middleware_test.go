@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/data"
+)
+
+func TestIdempotency(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := newTestUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	user, err := app.models.Users.GetByEmail(context.Background(), "writer@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie := func(title string) map[string]any {
+		return map[string]any{"title": title, "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+	}
+
+	type movieResponse struct {
+		Movie struct {
+			ID int64 `json:"id"`
+		} `json:"movie"`
+		Code string `json:"code"`
+	}
+
+	create := func(t *testing.T, key string, body any) (int, http.Header, movieResponse) {
+		var resp movieResponse
+		code, header := ts.doWithHeader(t, http.MethodPost, "/v1/movies", token, http.Header{"Idempotency-Key": {key}}, body, &resp)
+		return code, header, resp
+	}
+
+	// reserve holds key for body as if a request with it were still running.
+	reserve := func(t *testing.T, key string, body any) {
+		js, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprint := sha256.Sum256(js)
+
+		reserved, err := app.models.Idempotency.Reserve(context.Background(), &data.IdempotencyRecord{
+			Key:            key,
+			UserID:         user.ID,
+			OrganizationID: defaultOrganizationID,
+			Method:         http.MethodPost,
+			Path:           "/v1/movies",
+			Fingerprint:    fingerprint[:],
+			Expiry:         time.Now().Add(time.Hour),
+		}, app.config.idempotency.lockTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, reserved, true)
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		code, header, first := create(t, "replay", movie("Moana"))
+		assert.Equal(t, code, http.StatusCreated)
+		assert.Equal(t, header.Get("Idempotent-Replayed"), "")
+
+		code, header, retry := create(t, "replay", movie("Moana"))
+		assert.Equal(t, code, http.StatusCreated)
+		assert.Equal(t, header.Get("Idempotent-Replayed"), "true")
+		assert.Equal(t, retry.Movie.ID, first.Movie.ID)
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		code, _, _ := create(t, "mismatch", movie("Moana"))
+		assert.Equal(t, code, http.StatusCreated)
+
+		code, _, resp := create(t, "mismatch", movie("Akira"))
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+		assert.Equal(t, resp.Code, errCodeIdempotencyKeyMismatch)
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		reserve(t, "conflict", movie("Moana"))
+
+		code, _, resp := create(t, "conflict", movie("Moana"))
+		assert.Equal(t, code, http.StatusConflict)
+		assert.Equal(t, resp.Code, errCodeIdempotencyKeyInUse)
+	})
+
+	t.Run("Other organization", func(t *testing.T) {
+		code, _, first := create(t, "organizations", movie("Moana"))
+		assert.Equal(t, code, http.StatusCreated)
+
+		acme := newTestOrganization(t, ts, token, "Acme")
+
+		var resp movieResponse
+		header := xOrganization(acme)
+		header.Set("Idempotency-Key", "organizations")
+		code, header = ts.doWithHeader(t, http.MethodPost, "/v1/movies", token, header, movie("Moana"), &resp)
+		assert.Equal(t, code, http.StatusCreated)
+		assert.Equal(t, header.Get("Idempotent-Replayed"), "")
+		assert.Equal(t, resp.Movie.ID != first.Movie.ID, true)
+
+		created, err := app.models.Movies.ForOrganization(acme).Get(context.Background(), resp.Movie.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, created.Title, "Moana")
+	})
+
+	t.Run("Crashed request", func(t *testing.T) {
+		app.config.idempotency.lockTimeout = time.Millisecond
+		defer func() { app.config.idempotency.lockTimeout = time.Minute }()
+
+		reserve(t, "crashed", movie("Moana"))
+		time.Sleep(10 * time.Millisecond)
+
+		code, header, _ := create(t, "crashed", movie("Moana"))
+		assert.Equal(t, code, http.StatusCreated)
+		assert.Equal(t, header.Get("Idempotent-Replayed"), "")
+	})
+
+	waitForBackgroundTasks(t, app)
+}
+
+func TestReadYourWrites(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.db.readYourWritesWindow = time.Minute
+
+	// Nothing connects to these; the handler below doesn't use the database.
+	db, err := sql.Open("postgres", "postgres://localhost/greenlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	app.models = data.NewModels(db, db, data.Timeouts{})
+
+	tests := []struct {
+		name      string
+		method    string
+		status    int
+		wantWrite bool
+	}{
+		{"Read", http.MethodGet, http.StatusOK, false},
+		{"Failed validation", http.MethodPost, http.StatusUnprocessableEntity, false},
+		{"Server error", http.MethodPatch, http.StatusInternalServerError, false},
+		{"Successful write", http.MethodPost, http.StatusCreated, true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &data.User{ID: int64(i + 1)}
+
+			handler := app.readYourWrites(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+
+			r := httptest.NewRequest(tt.method, "/v1/movies", nil)
+			handler.ServeHTTP(httptest.NewRecorder(), app.contextSetUser(r, user))
+
+			assert.Equal(t, app.recentWrites.within(user.ID, time.Minute), tt.wantWrite)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"greenlight.bagerbach.com/internal/migrate"
+	"greenlight.bagerbach.com/migrations"
+)
+
+const migrateUsage = "usage: api [flags] migrate up|down [N]|status|force VERSION"
+
+// runMigrateCommand runs the migrate subcommand, applying the migrations embedded
+// in the binary:
+//
+//	migrate up             apply all pending migrations
+//	migrate down [N]       revert the last N migrations (default 1)
+//	migrate status         show the current version and pending migrations
+//	migrate force VERSION  set the version after fixing a failed migration by hand
+func runMigrateCommand(db *sql.DB, logger *slog.Logger, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch command := args[0]; {
+	case command == "up" && len(args) == 1:
+		return migrateUp(ctx, migrator, logger)
+
+	case command == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("migrate down: N must be a positive integer")
+			}
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			logger.Info("reverted migration", "version", m.Version, "name", m.Name)
+		}
+		if err == nil && len(reverted) == 0 {
+			logger.Info("no migrations to revert")
+		}
+		return err
+
+	case command == "status" && len(args) == 1:
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		if status.Version == migrate.NilVersion {
+			fmt.Println("version: none")
+		} else {
+			fmt.Printf("version: %d (dirty: %t)\n", status.Version, status.Dirty)
+		}
+
+		fmt.Printf("pending: %d\n", len(status.Pending))
+		for _, m := range status.Pending {
+			fmt.Printf("  %06d_%s\n", m.Version, m.Name)
+		}
+		return nil
+
+	case command == "force" && len(args) == 2:
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("migrate force: VERSION must be an integer (-1 for none)")
+		}
+
+		if err := migrator.Force(ctx, version); err != nil {
+			return err
+		}
+		logger.Info("forced migration version", "version", version)
+		return nil
+	}
+
+	return errors.New(migrateUsage)
+}
+
+// migrateUp applies the pending migrations. It's also run at startup when
+// -migrate-on-start is set; the migrator's advisory lock makes that safe with
+// several replicas starting at once.
+func migrateUp(ctx context.Context, migrator *migrate.Migrator, logger *slog.Logger) error {
+	applied, err := migrator.Up(ctx)
+	for _, m := range applied {
+		logger.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	if err == nil && len(applied) == 0 {
+		logger.Info("database schema is up to date")
+	}
+
+	return err
+}
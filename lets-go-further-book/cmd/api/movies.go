@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -8,15 +9,24 @@ import (
 
 	"greenlight.bagerbach.com/internal/data"
 	"greenlight.bagerbach.com/internal/validator"
+	"greenlight.bagerbach.com/internal/webhook"
 )
 
+type createMovieInput struct {
+	Title   string       `json:"title"`
+	Year    int32        `json:"year"`
+	Runtime data.Runtime `json:"runtime"`
+	Genres  []string     `json:"genres"`
+}
+
+// movies returns the movie model for the organization the request was resolved
+// to by requireOrganizationPermission.
+func (app *application) movies(r *http.Request) data.MovieModelInterface {
+	return app.models.Movies.ForOrganization(app.contextGetOrganizationID(r))
+}
+
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
-	}
+	var input createMovieInput
 
 	if err := app.readJSON(w, r, &input); err != nil {
 		app.badRequestResponse(w, r, err)
@@ -37,15 +47,17 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := app.models.Movies.Insert(movie); err != nil {
+	if err := app.movies(r).Insert(r.Context(), movie); err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.publishEvent(r.Context(), movie.OrganizationID, webhook.EventMovieCreated, envelope{"movie": movie})
+
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
 
-	if err := app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers); err != nil {
+	if err := app.writeResponse(w, r, http.StatusCreated, envelope{"movie": movie}, headers); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
@@ -57,7 +69,19 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	v := validator.New()
+
+	fields := data.Fields{
+		Requested: app.readCSV(r.URL.Query(), "fields", []string{}),
+		Safelist:  data.MovieFieldSafelist,
+	}
+
+	if data.ValidateFields(v, fields); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.movies(r).Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -68,11 +92,26 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil); err != nil {
+	selected, err := app.selectFields(movie, fields.Requested)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"movie": selected}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// Pointers' zero-value is nil, so turning these into pointers lets us do partial updates
+// (whereas e.g. the string zero-value is "" - you wouldn't know if it was or wasn't supplied!)
+type updateMovieInput struct {
+	Title   *string       `json:"title"`
+	Year    *int32        `json:"year"`
+	Runtime *data.Runtime `json:"runtime"`
+	Genres  []string      `json:"genres"`
+}
+
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
@@ -80,7 +119,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.movies(r).Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -101,14 +140,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	// Pointers' zero-value is nil, so turning these into pointers lets us do partial updates
-	// (whereas e.g. the string zero-value is "" - you wouldn't know if it was or wasn't supplied!)
-	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
-	}
+	var input updateMovieInput
 
 	if err := app.readJSON(w, r, &input); err != nil {
 		app.badRequestResponse(w, r, err)
@@ -135,7 +167,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Update(movie)
+	err = app.movies(r).Update(r.Context(), movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -146,7 +178,9 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil); err != nil {
+	app.publishEvent(r.Context(), movie.OrganizationID, webhook.EventMovieUpdated, envelope{"movie": movie})
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
@@ -158,7 +192,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	err = app.movies(r).Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -169,7 +203,10 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil); err != nil {
+	app.publishEvent(r.Context(), app.contextGetOrganizationID(r), webhook.EventMovieDeleted, envelope{"movie": envelope{"id": id}})
+	app.deletePoster(r.Context(), id)
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
@@ -179,6 +216,7 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		Title  string
 		Genres []string
 		data.Filters
+		Fields data.Fields
 	}
 
 	v := validator.New()
@@ -191,22 +229,292 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{
-		"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime",
+	input.Filters.SortSafelist = data.MovieSortSafelist
+
+	input.Fields.Requested = app.readCSV(qs, "fields", []string{})
+	input.Fields.Safelist = data.MovieFieldSafelist
+
+	data.ValidateFilters(v, input.Filters)
+	data.ValidateFields(v, input.Fields)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
 
-	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+	movies, metadata, err := app.movies(r).GetAll(r.Context(), input.Title, input.Genres, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	selected, err := app.selectFields(movies, input.Fields.Requested)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"movies": selected, "metadata": metadata}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+const maxBatchOperations = 100
+
+// A single entry in a batch request. "create" and "update" use the movie fields
+// (as pointers, so updates stay partial like updateMovieHandler); "update" and
+// "delete" use ID, and "update" checks Version when it's supplied.
+type batchOperation struct {
+	Op      string        `json:"op"`
+	ID      int64         `json:"id"`
+	Version *int32        `json:"version"`
+	Title   *string       `json:"title"`
+	Year    *int32        `json:"year"`
+	Runtime *data.Runtime `json:"runtime"`
+	Genres  []string      `json:"genres"`
+}
+
+func (op batchOperation) applyTo(movie *data.Movie) {
+	if op.Title != nil {
+		movie.Title = *op.Title
+	}
+	if op.Year != nil {
+		movie.Year = *op.Year
+	}
+	if op.Runtime != nil {
+		movie.Runtime = *op.Runtime
+	}
+	if op.Genres != nil {
+		movie.Genres = op.Genres
+	}
+}
+
+type batchResult struct {
+	Index  int         `json:"index"`
+	Op     string      `json:"op"`
+	Status int         `json:"status"`
+	Movie  *data.Movie `json:"movie,omitempty"`
+	Error  *batchError `json:"error,omitempty"`
+}
+
+// batchError is why an operation failed, with the same code and message the
+// equivalent single request would get in its error response. For validation
+// errors, the message maps each invalid field to what's wrong with it.
+type batchError struct {
+	Code    string `json:"code"`
+	Message any    `json:"message"`
+}
+
+// fail sets the result's status and error.
+func (res *batchResult) fail(status int, code string, message any) {
+	res.Status = status
+	res.Error = &batchError{Code: code, Message: message}
+}
+
+func (res batchResult) failed() bool {
+	return res.Status >= 400
+}
+
+// batchMoviesHandler runs a list of create/update/delete operations inside one
+// transaction. By default the first failing operation rolls back the whole batch.
+// With ?continue_on_error=true each operation runs under its own savepoint, so
+// failures are undone individually and the rest of the batch is committed.
+func (app *application) batchMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input []batchOperation
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	continueOnError := app.readBool(r.URL.Query(), "continue_on_error", false, v)
+
+	v.Check(len(input) >= 1, "operations", "must contain at least 1 operation")
+	v.Check(len(input) <= maxBatchOperations, "operations", fmt.Sprintf("must not contain more than %d operations", maxBatchOperations))
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	tx, err := app.models.BeginTx(r.Context())
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	movies := app.movies(r).WithTx(tx)
+	results := make([]batchResult, 0, len(input))
+
+	for i, op := range input {
+		if continueOnError {
+			if err := data.Savepoint(r.Context(), tx, "batch_operation"); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		result, err := app.runBatchOperation(r.Context(), movies, i, op)
+		if err != nil {
+			if !continueOnError {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.logError(r, err)
+			result.fail(http.StatusInternalServerError, errCodeServerError, "The server encountered a problem and could not process this operation")
+		}
+
+		results = append(results, result)
+
+		if !continueOnError {
+			if !result.failed() {
+				continue
+			}
+
+			env := envelope{
+				"error":      fmt.Sprintf("operation %d failed, no changes were applied", i),
+				"code":       errCodeBatchFailed,
+				"request_id": app.contextGetRequestID(r),
+				"results":    results,
+			}
+			if err := app.writeResponse(w, r, result.Status, env, nil); err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if result.failed() {
+			if err := data.RollbackToSavepoint(r.Context(), tx, "batch_operation"); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		// Rolling back to a savepoint keeps it, so it's released either way.
+		if err := data.ReleaseSavepoint(r.Context(), tx, "batch_operation"); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Only announce changes once they've actually been committed.
+	for i, result := range results {
+		if result.failed() {
+			continue
+		}
+
+		switch result.Op {
+		case "create":
+			app.publishEvent(r.Context(), result.Movie.OrganizationID, webhook.EventMovieCreated, envelope{"movie": result.Movie})
+		case "update":
+			app.publishEvent(r.Context(), result.Movie.OrganizationID, webhook.EventMovieUpdated, envelope{"movie": result.Movie})
+		case "delete":
+			app.publishEvent(r.Context(), app.contextGetOrganizationID(r), webhook.EventMovieDeleted, envelope{"movie": envelope{"id": input[i].ID}})
+			app.deletePoster(r.Context(), input[i].ID)
+		}
+	}
 
-	if err := app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil); err != nil {
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"results": results}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// runBatchOperation applies one batch operation using the transaction-bound movies
+// model. Client errors are reported through the result's status and error fields,
+// with the code and message of the equivalent single request; the returned error
+// is only set for unexpected failures.
+func (app *application) runBatchOperation(ctx context.Context, movies data.MovieModelInterface, index int, op batchOperation) (batchResult, error) {
+	result := batchResult{Index: index, Op: op.Op}
+
+	v := validator.New()
+
+	if op.Op == "update" || op.Op == "delete" {
+		v.Check(op.ID > 0, "id", "must be a positive integer")
+	}
+	v.Check(validator.PermittedValue(op.Op, "create", "update", "delete"), "op", "must be one of create, update or delete")
+
+	if !v.Valid() {
+		result.fail(http.StatusUnprocessableEntity, errCodeFailedValidation, v.Errors)
+		return result, nil
+	}
+
+	switch op.Op {
+	case "create":
+		movie := &data.Movie{}
+		op.applyTo(movie)
+
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			result.fail(http.StatusUnprocessableEntity, errCodeFailedValidation, v.Errors)
+			return result, nil
+		}
+
+		if err := movies.Insert(ctx, movie); err != nil {
+			return result, err
+		}
+
+		result.Status = http.StatusCreated
+		result.Movie = movie
+
+	case "update":
+		movie, err := movies.Get(ctx, op.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				result.fail(http.StatusNotFound, errCodeNotFound, "The requested resource could not be found")
+				return result, nil
+			default:
+				return result, err
+			}
+		}
+
+		if op.Version != nil && *op.Version != movie.Version {
+			result.fail(http.StatusConflict, errCodeEditConflict, "unable to update the record due to an edit conflict, please try again")
+			return result, nil
+		}
+
+		op.applyTo(movie)
+
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			result.fail(http.StatusUnprocessableEntity, errCodeFailedValidation, v.Errors)
+			return result, nil
+		}
+
+		if err := movies.Update(ctx, movie); err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				result.fail(http.StatusConflict, errCodeEditConflict, "unable to update the record due to an edit conflict, please try again")
+				return result, nil
+			default:
+				return result, err
+			}
+		}
+
+		result.Status = http.StatusOK
+		result.Movie = movie
+
+	case "delete":
+		if err := movies.Delete(ctx, op.ID); err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				result.fail(http.StatusNotFound, errCodeNotFound, "The requested resource could not be found")
+				return result, nil
+			default:
+				return result, err
+			}
+		}
+
+		result.Status = http.StatusOK
+	}
+
+	return result, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/data"
+)
+
+func TestMoviePermissions(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	reader := newTestUser(t, app, "reader@example.com", "movies:read")
+	writer := newTestUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	nobody := newTestUser(t, app, "nobody@example.com")
+
+	inactive := newTestUser(t, app, "inactive@example.com", "movies:read")
+	user, err := app.models.Users.GetByEmail(context.Background(), "inactive@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Activated = false
+	if err := app.models.Users.Update(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	movie := map[string]any{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+
+	tests := []struct {
+		name     string
+		method   string
+		token    string
+		wantCode int
+	}{
+		{"Anonymous read", http.MethodGet, "", http.StatusUnauthorized},
+		{"Invalid token", http.MethodGet, "ABCDEFGHIJKLMNOPQRSTUVWXYZ", http.StatusUnauthorized},
+		{"Inactive user", http.MethodGet, inactive, http.StatusForbidden},
+		{"Without permissions", http.MethodGet, nobody, http.StatusForbidden},
+		{"Reader reads", http.MethodGet, reader, http.StatusOK},
+		{"Reader writes", http.MethodPost, reader, http.StatusForbidden},
+		{"Writer writes", http.MethodPost, writer, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body any
+			if tt.method == http.MethodPost {
+				body = movie
+			}
+
+			code, _ := ts.do(t, tt.method, "/v1/movies", tt.token, body, nil)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+
+	waitForBackgroundTasks(t, app)
+}
+
+func TestMovieCRUD(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := newTestUser(t, app, "writer@example.com", "movies:read", "movies:write")
+
+	type movieResponse struct {
+		Movie struct {
+			ID      int64    `json:"id"`
+			Title   string   `json:"title"`
+			Year    int32    `json:"year"`
+			Runtime string   `json:"runtime"`
+			Genres  []string `json:"genres"`
+			Version int32    `json:"version"`
+		} `json:"movie"`
+	}
+
+	var created movieResponse
+	code, header := ts.do(t, http.MethodPost, "/v1/movies", token, map[string]any{
+		"title":   "Moana",
+		"year":    2016,
+		"runtime": "107 mins",
+		"genres":  []string{"animation", "adventure"},
+	}, &created)
+	assert.Equal(t, code, http.StatusCreated)
+	assert.Equal(t, header.Get("Location"), fmt.Sprintf("/v1/movies/%d", created.Movie.ID))
+	assert.Equal(t, created.Movie.Version, int32(1))
+
+	code, _ = ts.do(t, http.MethodPost, "/v1/movies", token, map[string]any{"title": "Incomplete"}, nil)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+
+	var shown movieResponse
+	code, _ = ts.do(t, http.MethodGet, header.Get("Location"), token, nil, &shown)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, shown.Movie.Title, "Moana")
+	assert.Equal(t, shown.Movie.Runtime, "107 mins")
+
+	var updated movieResponse
+	code, _ = ts.do(t, http.MethodPatch, header.Get("Location"), token, map[string]any{"year": 2017}, &updated)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, updated.Movie.Year, int32(2017))
+	assert.Equal(t, updated.Movie.Title, "Moana")
+	assert.Equal(t, updated.Movie.Version, int32(2))
+
+	var list struct {
+		Movies []struct {
+			Title string `json:"title"`
+		} `json:"movies"`
+		Metadata data.Metadata `json:"metadata"`
+	}
+	code, _ = ts.do(t, http.MethodGet, "/v1/movies?title=moana&genres=animation", token, nil, &list)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, list.Metadata.TotalRecords, 1)
+	assert.Equal(t, list.Movies[0].Title, "Moana")
+
+	code, _ = ts.do(t, http.MethodDelete, header.Get("Location"), token, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = ts.do(t, http.MethodGet, header.Get("Location"), token, nil, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, _ = ts.do(t, http.MethodDelete, header.Get("Location"), token, nil, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	// Every change was logged for the event stream.
+	oldest, latest, err := app.models.MovieEvents.Bounds(context.Background(), defaultOrganizationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, latest-oldest+1, int64(3))
+
+	waitForBackgroundTasks(t, app)
+}
+
+func TestBatchMovies(t *testing.T) {
+	app := newTestDBApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, token := newTestUserWithPassword(t, app, "writer@example.com", "pa55word1234")
+	if err := app.models.Permissions.AddForMember(context.Background(), defaultOrganizationID, user.ID, "movies:write"); err != nil {
+		t.Fatal(err)
+	}
+
+	type batchResponse struct {
+		Code    string `json:"code"`
+		Results []struct {
+			Status int         `json:"status"`
+			Error  *batchError `json:"error"`
+		} `json:"results"`
+	}
+
+	// outcomes returns the status of each result, with its error code if it failed.
+	outcomes := func(resp batchResponse) string {
+		var outcomes []string
+		for _, result := range resp.Results {
+			outcome := fmt.Sprint(result.Status)
+			if result.Error != nil {
+				outcome += " " + result.Error.Code
+			}
+			outcomes = append(outcomes, outcome)
+		}
+		return fmt.Sprint(outcomes)
+	}
+
+	totalMovies := func(t *testing.T) int {
+		var list struct {
+			Metadata data.Metadata `json:"metadata"`
+		}
+		code, _ := ts.do(t, http.MethodGet, "/v1/movies", token, nil, &list)
+		assert.Equal(t, code, http.StatusOK)
+		return list.Metadata.TotalRecords
+	}
+
+	create := func(title string) map[string]any {
+		return map[string]any{"op": "create", "title": title, "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+	}
+
+	t.Run("Invalid batch", func(t *testing.T) {
+		code, _ := ts.do(t, http.MethodPost, "/v1/movies/batch", token, []any{}, nil)
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("Rolled back on failure", func(t *testing.T) {
+		var resp batchResponse
+		code, _ := ts.do(t, http.MethodPost, "/v1/movies/batch", token, []any{
+			create("Moana"),
+			map[string]any{"op": "update", "id": 999, "title": "Missing"},
+			create("Akira"),
+		}, &resp)
+		assert.Equal(t, code, http.StatusNotFound)
+		assert.Equal(t, resp.Code, errCodeBatchFailed)
+		assert.Equal(t, outcomes(resp), "[201 404 not_found]")
+
+		assert.Equal(t, totalMovies(t), 0)
+	})
+
+	t.Run("Partial failure", func(t *testing.T) {
+		var resp batchResponse
+		code, _ := ts.do(t, http.MethodPost, "/v1/movies/batch?continue_on_error=true", token, []any{
+			create("Moana"),
+			create(""),
+			map[string]any{"op": "delete", "id": 999},
+			map[string]any{"op": "rename"},
+			create("Akira"),
+		}, &resp)
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, outcomes(resp), "[201 422 failed_validation 404 not_found 422 failed_validation 201]")
+		assert.Equal(t, fmt.Sprint(resp.Results[1].Error.Message), "map[title:must be provided]")
+
+		assert.Equal(t, totalMovies(t), 2)
+	})
+
+	waitForBackgroundTasks(t, app)
+}
@@ -0,0 +1,808 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/webhook"
+)
+
+// operation documents what the route table can't tell us about an endpoint. Request
+// and response bodies are given as zero values of the types the handler actually
+// reads and writes, and their schemas are generated by reflecting on those types.
+type operation struct {
+	id      string
+	summary string
+	query   []parameter
+	headers []parameter
+	request any // Zero value of the request body, or nil if there is none
+	// rawRequest replaces request for bodies that aren't JSON or MessagePack,
+	// keyed by content type.
+	rawRequest map[string]map[string]any
+	status     int      // Success status
+	response   envelope // Envelope keys mapped to zero values of their contents
+	// raw replaces response for endpoints that don't reply with an envelope,
+	// keyed by content type.
+	raw map[string]map[string]any
+	// Error statuses beyond those implied by the route (see errorStatuses).
+	errors []int
+	// Statuses other than status that respond with the same body.
+	otherStatuses []int
+	// Statuses other than status that respond with a different envelope.
+	otherResponses map[int]envelope
+	deprecated     bool // Kept for existing clients; the summary says what to use instead
+}
+
+type parameter struct {
+	name        string
+	description string
+	schema      map[string]any
+}
+
+var (
+	stringSchema  = map[string]any{"type": "string"}
+	integerSchema = map[string]any{"type": "integer"}
+	booleanSchema = map[string]any{"type": "boolean"}
+	csvSchema     = map[string]any{"type": "string", "description": "Comma-separated list"}
+	pageParams    = []parameter{
+		{name: "page", description: "Page number, starting at 1", schema: integerSchema},
+		{name: "page_size", description: "Results per page, at most 100", schema: integerSchema},
+	}
+	idempotencyKeyHeader = parameter{
+		name:        "Idempotency-Key",
+		description: "Makes retries safe: the first response for a key is replayed for 24 hours",
+		schema:      stringSchema,
+	}
+	organizationHeader = parameter{
+		name:        "X-Organization",
+		description: "ID of the organization whose data to use, by default the first one the user joined",
+		schema:      integerSchema,
+	}
+)
+
+// graphqlResponseSchema describes GraphQL responses, which aren't enveloped like
+// the others. The same body, without data, comes with a 400 when the query is
+// invalid or too complex.
+var graphqlResponseSchema = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"data": map[string]any{"type": "object", "description": "The fields selected by the query"},
+		"errors": map[string]any{
+			"type": "array",
+			"items": map[string]any{
+				"type":     "object",
+				"required": []string{"message"},
+				"properties": map[string]any{
+					"message":    stringSchema,
+					"locations":  map[string]any{"type": "array", "items": map[string]any{"type": "object"}},
+					"path":       map[string]any{"type": "array"},
+					"extensions": map[string]any{"type": "object", "properties": map[string]any{"code": stringSchema}},
+				},
+			},
+		},
+	},
+}
+
+func enumSchema(values []string) map[string]any {
+	return map[string]any{"type": "string", "enum": values}
+}
+
+// operations describes every route, keyed by "<method> <path>". TestOpenAPI fails
+// when a route is registered without an entry here.
+var operations = map[string]operation{
+	"GET /v1/healthcheck/live": {
+		id:       "liveHealthcheck",
+		summary:  "Report that the application is running, with its version",
+		status:   http.StatusOK,
+		response: envelope{"status": "", "system_info": map[string]string{}},
+	},
+	"GET /v1/healthcheck": {
+		id:         "healthcheck",
+		summary:    "Alias of GET /v1/healthcheck/live",
+		status:     http.StatusOK,
+		response:   envelope{"status": "", "system_info": map[string]string{}},
+		deprecated: true,
+	},
+	"GET /v1/healthcheck/ready": {
+		id:            "readyHealthcheck",
+		summary:       "Check the application's dependencies and whether it can serve traffic",
+		status:        http.StatusOK,
+		otherStatuses: []int{http.StatusServiceUnavailable},
+		response:      envelope{"status": "", "checks": map[string]healthCheck{}, "system_info": map[string]string{}},
+	},
+	"GET /v1/openapi.json": {
+		id:      "getOpenAPIDocument",
+		summary: "This OpenAPI document",
+		status:  http.StatusOK,
+		raw:     map[string]map[string]any{"application/json": {"type": "object"}},
+	},
+	"GET /v1/movies": {
+		id:      "listMovies",
+		summary: "List movies, filtered, sorted and paginated",
+		query: append([]parameter{
+			{name: "title", description: "Full-text search on the title", schema: stringSchema},
+			{name: "genres", description: "Movies having any of these genres", schema: csvSchema},
+			{name: "sort", description: "Sort column, prefixed with - for descending order", schema: enumSchema(data.MovieSortSafelist)},
+			{name: "fields", description: "Sparse fieldset: " + strings.Join(data.MovieFieldSafelist, ", "), schema: csvSchema},
+		}, pageParams...),
+		status:   http.StatusOK,
+		response: envelope{"movies": []data.Movie{}, "metadata": data.Metadata{}},
+		errors:   []int{http.StatusUnprocessableEntity},
+	},
+	"POST /v1/movies": {
+		id:       "createMovie",
+		summary:  "Add a movie",
+		headers:  []parameter{idempotencyKeyHeader},
+		request:  createMovieInput{},
+		status:   http.StatusCreated,
+		response: envelope{"movie": data.Movie{}},
+		errors:   []int{http.StatusConflict},
+	},
+	"GET /v1/movies/:id": {
+		id:       "showMovie",
+		summary:  "Get a movie",
+		query:    []parameter{{name: "fields", description: "Sparse fieldset: " + strings.Join(data.MovieFieldSafelist, ", "), schema: csvSchema}},
+		status:   http.StatusOK,
+		response: envelope{"movie": data.Movie{}},
+		errors:   []int{http.StatusUnprocessableEntity},
+	},
+	"PATCH /v1/movies/:id": {
+		id:       "updateMovie",
+		summary:  "Partially update a movie",
+		headers:  []parameter{{name: "X-Expected-Version", description: "Reject the update with a 409 unless the movie is at this version", schema: integerSchema}},
+		request:  updateMovieInput{},
+		status:   http.StatusOK,
+		response: envelope{"movie": data.Movie{}},
+		errors:   []int{http.StatusConflict},
+	},
+	"DELETE /v1/movies/:id": {
+		id:       "deleteMovie",
+		summary:  "Delete a movie",
+		status:   http.StatusOK,
+		response: envelope{"message": ""},
+	},
+	"GET /v1/movies/:id/poster": {
+		id:      "showMoviePoster",
+		summary: "Get a movie's poster, at its original size or as a thumbnail",
+		query:   []parameter{{name: "size", description: "original, or a JPEG thumbnail 500 or 185 pixels wide", schema: enumSchema(posterSizes)}},
+		status:  http.StatusOK,
+		raw: map[string]map[string]any{"image/*": {
+			"type":        "string",
+			"format":      "binary",
+			"description": "Cacheable for an hour, then revalidated with the ETag or Last-Modified header",
+		}},
+		errors: []int{http.StatusUnprocessableEntity},
+	},
+	"POST /v1/movies/:id/poster": {
+		id:      "uploadMoviePoster",
+		summary: "Set a movie's poster from a JPEG, PNG or GIF image",
+		rawRequest: map[string]map[string]any{"multipart/form-data": {
+			"type":     "object",
+			"required": []string{"poster"},
+			"properties": map[string]any{
+				"poster": map[string]any{"type": "string", "format": "binary"},
+			},
+		}},
+		status:   http.StatusOK,
+		response: envelope{"movie": data.Movie{}},
+		errors:   []int{http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType},
+	},
+	"GET /v1/movies/events": {
+		id:      "streamMovieEvents",
+		summary: "Stream movie.created, movie.updated and movie.deleted events as server-sent events",
+		headers: []parameter{{name: "Last-Event-ID", description: "Resume the stream after this event", schema: integerSchema}},
+		status:  http.StatusOK,
+		raw: map[string]map[string]any{"text/event-stream": {
+			"type":        "string",
+			"description": `Events whose data is {"movie": Movie}. A "reset" event means missed events are no longer available.`,
+		}},
+		errors: []int{http.StatusBadRequest},
+	},
+	"POST /v1/movies/batch": {
+		id:       "batchMovies",
+		summary:  "Create, update and delete movies in one transaction",
+		query:    []parameter{{name: "continue_on_error", description: "Commit the successful operations even if others fail", schema: booleanSchema}},
+		request:  []batchOperation{},
+		status:   http.StatusOK,
+		response: envelope{"results": []batchResult{}},
+		errors:   []int{http.StatusNotFound, http.StatusConflict},
+	},
+	"GET /v1/webhooks": {
+		id:       "listWebhooks",
+		summary:  "List the organization's webhook subscriptions",
+		status:   http.StatusOK,
+		response: envelope{"webhooks": []data.WebhookSubscription{}},
+	},
+	"POST /v1/webhooks": {
+		id:       "createWebhook",
+		summary:  "Subscribe a URL to the organization's events: " + strings.Join(webhook.EventTypes, ", "),
+		request:  createWebhookInput{},
+		status:   http.StatusCreated,
+		response: envelope{"webhook": data.WebhookSubscription{}},
+	},
+	"GET /v1/webhooks/:id": {
+		id:       "showWebhook",
+		summary:  "Get a webhook subscription",
+		status:   http.StatusOK,
+		response: envelope{"webhook": data.WebhookSubscription{}},
+	},
+	"DELETE /v1/webhooks/:id": {
+		id:       "deleteWebhook",
+		summary:  "Delete a webhook subscription",
+		status:   http.StatusOK,
+		response: envelope{"message": ""},
+	},
+	"GET /v1/webhooks/:id/deliveries": {
+		id:       "listWebhookDeliveries",
+		summary:  "List a subscription's delivery attempts, newest first",
+		query:    pageParams,
+		status:   http.StatusOK,
+		response: envelope{"deliveries": []data.WebhookDelivery{}, "metadata": data.Metadata{}},
+		errors:   []int{http.StatusUnprocessableEntity},
+	},
+	"POST /v1/webhooks/:id/test": {
+		id:       "testWebhook",
+		summary:  "Send a webhook.test event to a subscription",
+		status:   http.StatusOK,
+		response: envelope{"delivery": data.WebhookDelivery{}},
+	},
+	"POST /v1/users": {
+		id:       "registerUser",
+		summary:  "Register a user and email them an activation token",
+		headers:  []parameter{idempotencyKeyHeader},
+		request:  registerUserInput{},
+		status:   http.StatusAccepted,
+		response: envelope{"user": data.User{}},
+		errors:   []int{http.StatusConflict},
+	},
+	"PUT /v1/users/activated": {
+		id:       "activateUser",
+		summary:  "Activate a user with their activation token",
+		request:  activateUserInput{},
+		status:   http.StatusOK,
+		response: envelope{"user": data.User{}},
+		errors:   []int{http.StatusConflict},
+	},
+	"PUT /v1/users/email": {
+		id:       "confirmEmailChange",
+		summary:  "Change a user's email to their pending email, with the token sent to it",
+		request:  confirmEmailChangeInput{},
+		status:   http.StatusOK,
+		response: envelope{"user": data.User{}},
+		errors:   []int{http.StatusConflict},
+	},
+	"GET /v1/users/me": {
+		id:       "showCurrentUser",
+		summary:  "Show the authenticated user",
+		status:   http.StatusOK,
+		response: envelope{"user": data.User{}},
+	},
+	"PATCH /v1/users/me": {
+		id:       "updateCurrentUser",
+		summary:  "Update the authenticated user; a new email must be confirmed through the token sent to it, and a new password revokes the user's other authentication tokens",
+		request:  updateCurrentUserInput{},
+		status:   http.StatusOK,
+		response: envelope{"user": data.User{}},
+		errors:   []int{http.StatusConflict},
+	},
+	"DELETE /v1/users/me": {
+		id:       "deleteCurrentUser",
+		summary:  "Delete the authenticated user, with their tokens and permissions",
+		status:   http.StatusOK,
+		response: envelope{"message": ""},
+	},
+	"POST /v1/users/me/totp": {
+		id:       "enrollTOTP",
+		summary:  "Start enabling two-factor authentication with a new TOTP secret",
+		status:   http.StatusCreated,
+		response: envelope{"totp": totpEnrollment{}},
+	},
+	"PUT /v1/users/me/totp": {
+		id:       "confirmTOTP",
+		summary:  "Enable two-factor authentication with a code for the new secret, returning the recovery codes",
+		request:  confirmTOTPInput{},
+		status:   http.StatusOK,
+		response: envelope{"recovery_codes": []string{}},
+		errors:   []int{http.StatusConflict},
+	},
+	"DELETE /v1/users/me/totp": {
+		id:       "disableTOTP",
+		summary:  "Disable two-factor authentication with a TOTP or recovery code",
+		request:  disableTOTPInput{},
+		status:   http.StatusOK,
+		response: envelope{"message": ""},
+	},
+	"GET /v1/roles": {
+		id:       "listRoles",
+		summary:  "List the roles and the permissions each of them grants",
+		status:   http.StatusOK,
+		response: envelope{"roles": []data.Role{}},
+	},
+	"GET /v1/roles/users/:id": {
+		id:       "showUserRoles",
+		summary:  "List a user's roles outside organizations",
+		status:   http.StatusOK,
+		response: envelope{"roles": []string{}},
+	},
+	"PUT /v1/roles/users/:id": {
+		id:       "setUserRoles",
+		summary:  "Replace a user's roles outside organizations; permissions granted to them directly are kept",
+		request:  setUserRolesInput{},
+		status:   http.StatusOK,
+		response: envelope{"roles": []string{}},
+	},
+	"GET /v1/organizations": {
+		id:       "listOrganizations",
+		summary:  "List the organizations the authenticated user is a member of, with their role in each",
+		status:   http.StatusOK,
+		response: envelope{"organizations": []data.Organization{}},
+	},
+	"POST /v1/organizations": {
+		id:       "createOrganization",
+		summary:  "Create an organization, with the authenticated user as its admin",
+		request:  createOrganizationInput{},
+		status:   http.StatusCreated,
+		response: envelope{"organization": data.Organization{}},
+	},
+	"GET /v1/organizations/:id/members": {
+		id:       "listOrganizationMembers",
+		summary:  "List an organization's members; requires roles:manage within it",
+		status:   http.StatusOK,
+		response: envelope{"members": []data.OrganizationMember{}},
+	},
+	"PUT /v1/organizations/:id/members": {
+		id:       "setOrganizationMember",
+		summary:  "Add a user to an organization, or change their role in it; requires roles:manage within it",
+		request:  setOrganizationMemberInput{},
+		status:   http.StatusOK,
+		response: envelope{"members": []data.OrganizationMember{}},
+	},
+	"DELETE /v1/organizations/:id/members/:user_id": {
+		id:       "removeOrganizationMember",
+		summary:  "Remove a user from an organization; requires roles:manage within it",
+		status:   http.StatusOK,
+		response: envelope{"message": ""},
+	},
+	"GET /v1/api-keys": {
+		id:       "listAPIKeys",
+		summary:  "List the authenticated user's API keys, without the keys themselves",
+		status:   http.StatusOK,
+		response: envelope{"api_keys": []data.APIKey{}},
+	},
+	"POST /v1/api-keys": {
+		id:      "createAPIKey",
+		summary: "Create an API key limited to some of the user's permissions; the key is only shown in this response",
+		headers: []parameter{{
+			name:        "X-Organization",
+			description: "ID of the organization whose permissions the key may be given besides the user's own, by default the first one the user joined",
+			schema:      integerSchema,
+		}},
+		request:  createAPIKeyInput{},
+		status:   http.StatusCreated,
+		response: envelope{"api_key": data.APIKey{}},
+	},
+	"DELETE /v1/api-keys/:id": {
+		id:       "deleteAPIKey",
+		summary:  "Revoke one of the authenticated user's API keys",
+		status:   http.StatusOK,
+		response: envelope{"message": ""},
+	},
+	"POST /v1/tokens/authentication": {
+		id:       "createAuthenticationToken",
+		summary:  "Exchange an email and password for a 24-hour authentication token, or a 5-minute MFA token if two-factor authentication is enabled",
+		request:  createAuthenticationTokenInput{},
+		status:   http.StatusCreated,
+		response: envelope{"authentication_token": data.Token{}},
+		otherResponses: map[int]envelope{
+			http.StatusAccepted: {"mfa_token": data.Token{}},
+		},
+		errors: []int{http.StatusUnauthorized},
+	},
+	"POST /v1/graphql": {
+		id:      "graphql",
+		summary: "Run a GraphQL query over the current user and movies, with per-field permissions",
+		request: graphqlInput{},
+		status:  http.StatusOK,
+		raw: map[string]map[string]any{
+			"application/json":    graphqlResponseSchema,
+			"application/msgpack": graphqlResponseSchema,
+		},
+	},
+	"POST /v1/tokens/mfa": {
+		id:       "createMFAAuthenticationToken",
+		summary:  "Exchange an MFA token and a TOTP or recovery code for a 24-hour authentication token; the MFA token is used up even if the code is wrong",
+		request:  createMFAAuthenticationTokenInput{},
+		status:   http.StatusCreated,
+		response: envelope{"authentication_token": data.Token{}},
+		errors:   []int{http.StatusUnauthorized},
+	},
+	"GET /debug/vars": {
+		id:      "debugVars",
+		summary: "Application metrics published through expvar",
+		status:  http.StatusOK,
+		raw:     map[string]map[string]any{"application/json": {"type": "object"}},
+	},
+}
+
+// errorDescriptions covers the statuses written by the helpers in errors.go.
+var errorDescriptions = map[int]string{
+	http.StatusBadRequest:            "The request could not be parsed",
+	http.StatusUnauthorized:          "Missing, invalid or expired authentication token or API key, or invalid credentials",
+	http.StatusForbidden:             "The account is not activated, lacks the required permission, is not a member of the organization, or used an API key to manage itself",
+	http.StatusNotFound:              "The requested resource could not be found",
+	http.StatusNotAcceptable:         "None of the formats in the Accept header can represent the response",
+	http.StatusConflict:              "Edit conflict, or a request with the same idempotency key is in progress",
+	http.StatusRequestEntityTooLarge: "The uploaded file is too large",
+	http.StatusUnsupportedMediaType:  "The request body or uploaded file is not in a supported format",
+	http.StatusUnprocessableEntity:   "Validation failed; error maps each invalid field to a message",
+	http.StatusTooManyRequests:       "Rate limit exceeded",
+	http.StatusInternalServerError:   "The server encountered a problem",
+	http.StatusGatewayTimeout:        "A database query took too long",
+}
+
+// errorStatuses returns the error statuses an operation can respond with: those
+// every request can get, those implied by the route and those listed in the
+// operation itself.
+func errorStatuses(rte route, op operation) []int {
+	statuses := []int{http.StatusNotAcceptable, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusGatewayTimeout}
+
+	if rte.permission != "" || rte.activated {
+		statuses = append(statuses, http.StatusUnauthorized, http.StatusForbidden)
+	}
+	if strings.Contains(rte.path, "/:") {
+		statuses = append(statuses, http.StatusNotFound)
+	}
+	if rte.organization {
+		statuses = append(statuses, http.StatusBadRequest)
+	}
+	if op.request != nil || op.rawRequest != nil {
+		statuses = append(statuses, http.StatusBadRequest, http.StatusUnprocessableEntity)
+	}
+
+	statuses = append(statuses, op.errors...)
+	slices.Sort(statuses)
+	return slices.Compact(statuses)
+}
+
+// openAPIDocument builds an OpenAPI 3.1 document from the route table and the
+// operations described above.
+func (app *application) openAPIDocument() map[string]any {
+	schemas := schemaBuilder{components: map[string]any{
+		"Error": map[string]any{
+			"type":     "object",
+			"required": []string{"error", "code", "request_id"},
+			"properties": map[string]any{
+				"error": map[string]any{
+					"oneOf": []any{
+						stringSchema,
+						map[string]any{"type": "object", "additionalProperties": stringSchema},
+					},
+				},
+				"code":       stringSchema,
+				"request_id": stringSchema,
+			},
+		},
+		"Problem": map[string]any{
+			"type":     "object",
+			"required": []string{"type", "title", "status", "detail", "code", "instance", "request_id"},
+			"properties": map[string]any{
+				"type":       map[string]any{"type": "string", "format": "uri"},
+				"title":      stringSchema,
+				"status":     map[string]any{"type": "integer"},
+				"detail":     stringSchema,
+				"code":       stringSchema,
+				"instance":   stringSchema,
+				"request_id": stringSchema,
+				"errors":     map[string]any{"type": "object", "additionalProperties": stringSchema},
+			},
+		},
+	}}
+
+	responses := map[string]any{}
+	for status, description := range errorDescriptions {
+		responses[errorResponseName(status)] = map[string]any{
+			"description": description,
+			"content": map[string]any{
+				"application/json":         map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}},
+				"application/problem+json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Problem"}},
+			},
+		}
+	}
+
+	paths := map[string]any{}
+
+	for _, rte := range app.router().routes {
+		op, ok := operations[rte.method+" "+rte.path]
+		if !ok {
+			continue
+		}
+
+		path := openAPIPath(rte.path)
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[path] = item
+		}
+
+		item[strings.ToLower(rte.method)] = schemas.operation(rte, op)
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "Greenlight API",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas":   schemas.components,
+			"responses": responses,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]any{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Authorization",
+					"description": `An API key, sent as "ApiKey <key>"`,
+				},
+				"clientCertificate": map[string]any{
+					"type":        "mutualTLS",
+					"description": "A client certificate whose email address (or common name) is a user's email, when client certificates are enabled",
+				},
+			},
+		},
+	}
+}
+
+func (app *application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.writeJSON(w, http.StatusOK, app.openAPIDocument(), nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// openAPIPath turns httprouter's /v1/movies/:id into OpenAPI's /v1/movies/{id}.
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func errorResponseName(status int) string {
+	return strings.ReplaceAll(http.StatusText(status), " ", "")
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+type schemaBuilder struct {
+	components map[string]any
+	// Request bodies are checked by validators rather than by their JSON shape, so
+	// their schemas don't mark any fields as required.
+	request bool
+}
+
+func (b schemaBuilder) operation(rte route, op operation) map[string]any {
+	var parameters []any
+
+	for _, segment := range strings.Split(rte.path, "/") {
+		if strings.HasPrefix(segment, ":") {
+			parameters = append(parameters, map[string]any{
+				"name": segment[1:], "in": "path", "required": true, "schema": integerSchema,
+			})
+		}
+	}
+	for _, p := range op.query {
+		parameters = append(parameters, map[string]any{
+			"name": p.name, "in": "query", "description": p.description, "schema": p.schema,
+		})
+	}
+	headers := op.headers
+	if rte.organization {
+		headers = append([]parameter{organizationHeader}, headers...)
+	}
+	for _, p := range headers {
+		parameters = append(parameters, map[string]any{
+			"name": p.name, "in": "header", "description": p.description, "schema": p.schema,
+		})
+	}
+
+	responses := map[string]any{}
+
+	success := map[string]any{"description": http.StatusText(op.status)}
+	switch {
+	case op.raw != nil:
+		content := map[string]any{}
+		for contentType, schema := range op.raw {
+			content[contentType] = map[string]any{"schema": schema}
+		}
+		success["content"] = content
+	case op.response != nil:
+		success["content"] = b.negotiatedContent(op.response)
+	}
+	responses[strconv.Itoa(op.status)] = success
+
+	for _, status := range op.otherStatuses {
+		other := maps.Clone(success)
+		other["description"] = http.StatusText(status)
+		responses[strconv.Itoa(status)] = other
+	}
+
+	for status, env := range op.otherResponses {
+		responses[strconv.Itoa(status)] = map[string]any{
+			"description": http.StatusText(status),
+			"content":     b.negotiatedContent(env),
+		}
+	}
+
+	for _, status := range errorStatuses(rte, op) {
+		responses[strconv.Itoa(status)] = map[string]any{"$ref": "#/components/responses/" + errorResponseName(status)}
+	}
+
+	doc := map[string]any{
+		"operationId": op.id,
+		"summary":     op.summary,
+		"responses":   responses,
+	}
+
+	if parameters != nil {
+		doc["parameters"] = parameters
+	}
+
+	if op.deprecated {
+		doc["deprecated"] = true
+	}
+
+	if op.rawRequest != nil {
+		content := map[string]any{}
+		for contentType, schema := range op.rawRequest {
+			content[contentType] = map[string]any{"schema": schema}
+		}
+		doc["requestBody"] = map[string]any{"required": true, "content": content}
+	}
+
+	if op.request != nil {
+		request := b
+		request.request = true
+
+		schema := request.schema(reflect.TypeOf(op.request))
+		doc["requestBody"] = map[string]any{
+			"required": true,
+			"content": map[string]any{
+				"application/json":    map[string]any{"schema": schema},
+				"application/msgpack": map[string]any{"schema": schema},
+			},
+		}
+	}
+
+	if rte.permission != "" || rte.activated {
+		doc["security"] = []any{
+			map[string]any{"bearerAuth": []string{}},
+			map[string]any{"clientCertificate": []string{}},
+		}
+	}
+	if rte.permission != "" || rte.fieldPermissions {
+		// Only permission routes accept API keys; the others manage the account.
+		doc["security"] = append(doc["security"].([]any), map[string]any{"apiKey": []string{}})
+	}
+	if rte.permission != "" {
+		doc["x-permission"] = rte.permission
+	}
+
+	return doc
+}
+
+// negotiatedContent describes an envelope in each format writeResponse can encode
+// it in. CSV only applies to envelopes holding a list.
+func (b schemaBuilder) negotiatedContent(env envelope) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+
+	for key, value := range env {
+		properties[key] = b.schema(reflect.TypeOf(value))
+		required = append(required, key)
+	}
+	slices.Sort(required)
+
+	schema := map[string]any{"type": "object", "properties": properties, "required": required}
+
+	content := map[string]any{
+		"application/json":    map[string]any{"schema": schema},
+		"application/msgpack": map[string]any{"schema": schema},
+	}
+	if holdsList(env) {
+		content["text/csv"] = map[string]any{"schema": stringSchema}
+	}
+
+	return content
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	runtimeType = reflect.TypeOf(data.Runtime(0))
+)
+
+// schema generates the JSON schema of t as encoding/json would serialise it. Named
+// structs from other packages (data.Movie, data.User, ...) become components.
+func (b schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case runtimeType:
+		return map[string]any{"type": "string", "pattern": "^[0-9]+ mins$", "examples": []string{"102 mins"}}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" || t.PkgPath() == reflect.TypeOf(application{}).PkgPath() {
+			return b.object(t)
+		}
+
+		if _, ok := b.components[t.Name()]; !ok {
+			// Reserve the name first, in case the type refers to itself.
+			b.components[t.Name()] = map[string]any{}
+			b.components[t.Name()] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		// Interfaces, like batchResult.Error, can hold anything.
+		return map[string]any{}
+	}
+}
+
+func (b schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = b.schema(field.Type)
+
+		if !b.request && !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]any{"type": "object", "properties": properties, "required": required}
+}
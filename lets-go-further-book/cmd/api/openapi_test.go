@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+func TestOpenAPIDescribesEveryRoute(t *testing.T) {
+	app := &application{}
+
+	registered := map[string]bool{}
+
+	for _, rte := range app.router().routes {
+		key := rte.method + " " + rte.path
+		registered[key] = true
+
+		if _, ok := operations[key]; !ok {
+			t.Errorf("route %s is not described in operations (cmd/api/openapi.go)", key)
+		}
+	}
+
+	for key := range operations {
+		if !registered[key] {
+			t.Errorf("operation %s is described but no such route is registered", key)
+		}
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	app := &application{}
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil)
+
+	app.openAPIHandler(rr, r)
+
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, rr.Header().Get("Content-Type"), "application/json")
+
+	var doc struct {
+		OpenAPI string                               `json:"openapi"`
+		Paths   map[string]map[string]map[string]any `json:"paths"`
+	}
+
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, doc.OpenAPI, "3.1.0")
+
+	for _, rte := range app.router().routes {
+		path := openAPIPath(rte.path)
+		op, ok := doc.Paths[path][strings.ToLower(rte.method)]
+		if !ok {
+			t.Errorf("document has no operation for %s %s", rte.method, path)
+			continue
+		}
+
+		permission, _ := op["x-permission"].(string)
+		assert.Equal(t, permission, rte.permission)
+
+		if _, ok := op["responses"].(map[string]any)["500"]; !ok {
+			t.Errorf("%s %s does not document server errors", rte.method, path)
+		}
+	}
+
+	if _, ok := doc.Paths["/v1/movies/{id}"]["patch"]; !ok {
+		t.Error("path parameters are not written in OpenAPI form")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/validator"
+)
+
+// organizationOwnerRole is the role users get in the organizations they create.
+const organizationOwnerRole = "admin"
+
+type createOrganizationInput struct {
+	Name string `json:"name"`
+}
+
+// createOrganizationHandler creates an organization, with the user as its first
+// member, given organizationOwnerRole so they can add the others.
+func (app *application) createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input createOrganizationInput
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	organization := &data.Organization{Name: input.Name}
+
+	v := validator.New()
+
+	if data.ValidateOrganization(v, organization); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := app.models.Organizations.Insert(r.Context(), organization, user.ID, organizationOwnerRole); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusCreated, envelope{"organization": organization}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listOrganizationsHandler lists the organizations the user is a member of. The
+// first is the one used for requests without an X-Organization header.
+func (app *application) listOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	organizations, err := app.models.Organizations.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"organizations": organizations}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOrganizationMembersHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if !app.checkOrganizationPermission(w, r, id, "roles:manage") {
+		return
+	}
+
+	members, err := app.models.Organizations.GetMembers(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"members": members}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+type setOrganizationMemberInput struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// setOrganizationMemberHandler adds a user to the organization, or changes the
+// role of one who's already a member. Without a role, they just have their own
+// permissions in it.
+func (app *application) setOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if !app.checkOrganizationPermission(w, r, id, "roles:manage") {
+		return
+	}
+
+	var input setOrganizationMemberInput
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching user found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.models.Organizations.SetMember(r.Context(), id, user.ID, input.Role); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("role", "unknown role "+input.Role)
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrLastManager):
+			v.AddError("role", "must include roles:manage, as this is the organization's last member with it")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	members, err := app.models.Organizations.GetMembers(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"members": members}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) removeOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	userID, err := app.readInt64Param(r, "user_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if !app.checkOrganizationPermission(w, r, id, "roles:manage") {
+		return
+	}
+
+	if err := app.models.Organizations.RemoveMember(r.Context(), id, userID); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastManager):
+			v := validator.New()
+			v.AddError("user_id", "must not be the organization's last member with roles:manage")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"message": "member successfully removed"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
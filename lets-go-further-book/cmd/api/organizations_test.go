@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+// newTestOrganization creates an organization through the API, returning its ID.
+// The user creating it becomes its admin.
+func newTestOrganization(t *testing.T, ts *testServer, token, name string) int64 {
+	t.Helper()
+
+	var resp struct {
+		Organization struct {
+			ID   int64  `json:"id"`
+			Role string `json:"role"`
+		} `json:"organization"`
+	}
+	code, _ := ts.do(t, http.MethodPost, "/v1/organizations", token, map[string]string{"name": name}, &resp)
+	assert.Equal(t, code, http.StatusCreated)
+	assert.Equal(t, resp.Organization.Role, "admin")
+
+	return resp.Organization.ID
+}
+
+func xOrganization(id int64) http.Header {
+	return http.Header{"X-Organization": {strconv.FormatInt(id, 10)}}
+}
+
+func TestOrganizationIsolation(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	alice := newTestUser(t, app, "alice@example.com", "movies:read", "movies:write")
+
+	// Bob only has permissions through his role in the organization he creates,
+	// which becomes his default once he leaves the default one.
+	bob := newTestUser(t, app, "bob@example.com")
+	acme := newTestOrganization(t, ts, bob, "Acme")
+
+	bobUser, err := app.models.Users.GetByEmail(context.Background(), "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Organizations.RemoveMember(context.Background(), defaultOrganizationID, bobUser.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	type movieResponse struct {
+		Movie struct {
+			ID    int64  `json:"id"`
+			Title string `json:"title"`
+		} `json:"movie"`
+	}
+
+	var moana, akira movieResponse
+	code, _ := ts.do(t, http.MethodPost, "/v1/movies", alice, map[string]any{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}, &moana)
+	assert.Equal(t, code, http.StatusCreated)
+	code, _ = ts.do(t, http.MethodPost, "/v1/movies", bob, map[string]any{"title": "Akira", "year": 1988, "runtime": "124 mins", "genres": []string{"animation"}}, &akira)
+	assert.Equal(t, code, http.StatusCreated)
+
+	alicesMovie := fmt.Sprintf("/v1/movies/%d", moana.Movie.ID)
+	bobsMovie := fmt.Sprintf("/v1/movies/%d", akira.Movie.ID)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		header   http.Header
+		body     any
+		wantCode int
+	}{
+		{"Show other organization's movie", http.MethodGet, alicesMovie, bob, nil, nil, http.StatusNotFound},
+		{"Update other organization's movie", http.MethodPatch, alicesMovie, bob, nil, map[string]any{"title": "Stolen"}, http.StatusNotFound},
+		{"Delete other organization's movie", http.MethodDelete, alicesMovie, bob, nil, nil, http.StatusNotFound},
+		{"Show other organization's movie the other way", http.MethodGet, bobsMovie, alice, nil, nil, http.StatusNotFound},
+		{"Delete other organization's movie the other way", http.MethodDelete, bobsMovie, alice, nil, nil, http.StatusNotFound},
+		{"Choose organization not a member of", http.MethodGet, bobsMovie, alice, xOrganization(acme), nil, http.StatusForbidden},
+		{"Choose unknown organization", http.MethodGet, "/v1/movies", alice, xOrganization(acme + 1), nil, http.StatusForbidden},
+		{"Choose invalid organization", http.MethodGet, "/v1/movies", alice, http.Header{"X-Organization": {"acme"}}, nil, http.StatusBadRequest},
+		{"Choose left organization", http.MethodGet, alicesMovie, bob, xOrganization(defaultOrganizationID), nil, http.StatusForbidden},
+		{"Choose own organization", http.MethodGet, bobsMovie, bob, xOrganization(acme), nil, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := ts.doWithHeader(t, tt.method, tt.path, tt.token, tt.header, tt.body, nil)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+
+	t.Run("Lists", func(t *testing.T) {
+		for token, want := range map[string]string{alice: "Moana", bob: "Akira"} {
+			var list struct {
+				Movies []struct {
+					Title string `json:"title"`
+				} `json:"movies"`
+			}
+			code, header := ts.do(t, http.MethodGet, "/v1/movies", token, nil, &list)
+			assert.Equal(t, code, http.StatusOK)
+			assert.Equal(t, len(list.Movies), 1)
+			assert.Equal(t, list.Movies[0].Title, want)
+			assert.StringContains(t, fmt.Sprint(header.Values("Vary")), "X-Organization")
+		}
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		events, err := app.models.MovieEvents.GetAfter(context.Background(), acme, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(events), 1)
+		assert.Equal(t, events[0].Movie.Title, "Akira")
+	})
+
+	// Nothing bob tried changed alice's movie.
+	var shown movieResponse
+	code, _ = ts.do(t, http.MethodGet, alicesMovie, alice, nil, &shown)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, shown.Movie.Title, "Moana")
+
+	waitForBackgroundTasks(t, app)
+}
+
+func TestOrganizationMembers(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	admin := newTestUser(t, app, "admin@example.com")
+	carol := newTestUser(t, app, "carol@example.com")
+
+	acme := newTestOrganization(t, ts, admin, "Acme")
+	members := fmt.Sprintf("/v1/organizations/%d/members", acme)
+
+	carolUser, err := app.models.Users.GetByEmail(context.Background(), "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie := map[string]any{"title": "Akira", "year": 1988, "runtime": "124 mins", "genres": []string{"animation"}}
+
+	// Carol isn't a member yet.
+	code, _ := ts.doWithHeader(t, http.MethodGet, "/v1/movies", carol, xOrganization(acme), nil, nil)
+	assert.Equal(t, code, http.StatusForbidden)
+	code, _ = ts.do(t, http.MethodGet, members, carol, nil, nil)
+	assert.Equal(t, code, http.StatusForbidden)
+
+	tests := []struct {
+		name     string
+		token    string
+		body     map[string]string
+		wantCode int
+	}{
+		{"Not an admin", carol, map[string]string{"email": "carol@example.com", "role": "admin"}, http.StatusForbidden},
+		{"Unknown user", admin, map[string]string{"email": "dave@example.com", "role": "viewer"}, http.StatusUnprocessableEntity},
+		{"Unknown role", admin, map[string]string{"email": "carol@example.com", "role": "owner"}, http.StatusUnprocessableEntity},
+		{"Valid", admin, map[string]string{"email": "carol@example.com", "role": "viewer"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := ts.do(t, http.MethodPut, members, tt.token, tt.body, nil)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+
+	var list struct {
+		Members []struct {
+			Email string `json:"email"`
+			Role  string `json:"role"`
+		} `json:"members"`
+	}
+	code, _ = ts.do(t, http.MethodGet, members, admin, nil, &list)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, fmt.Sprint(list.Members), "[{admin@example.com admin} {carol@example.com viewer}]")
+
+	// Carol's role only grants her permissions within the organization.
+	code, _ = ts.doWithHeader(t, http.MethodGet, "/v1/movies", carol, xOrganization(acme), nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+	code, _ = ts.doWithHeader(t, http.MethodPost, "/v1/movies", carol, xOrganization(acme), movie, nil)
+	assert.Equal(t, code, http.StatusForbidden)
+	code, _ = ts.do(t, http.MethodGet, "/v1/movies", carol, nil, nil)
+	assert.Equal(t, code, http.StatusForbidden)
+
+	var organizations struct {
+		Organizations []struct {
+			Name string `json:"name"`
+			Role string `json:"role"`
+		} `json:"organizations"`
+	}
+	code, _ = ts.do(t, http.MethodGet, "/v1/organizations", carol, nil, &organizations)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, fmt.Sprint(organizations.Organizations), "[{Default } {Acme viewer}]")
+
+	code, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("%s/%d", members, carolUser.ID), admin, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = ts.do(t, http.MethodDelete, fmt.Sprintf("%s/%d", members, carolUser.ID), admin, nil, nil)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, _ = ts.doWithHeader(t, http.MethodGet, "/v1/movies", carol, xOrganization(acme), nil, nil)
+	assert.Equal(t, code, http.StatusForbidden)
+}
+
+func TestOrganizationLastManager(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	admin := newTestUser(t, app, "admin@example.com")
+	newTestUser(t, app, "carol@example.com")
+
+	acme := newTestOrganization(t, ts, admin, "Acme")
+	members := fmt.Sprintf("/v1/organizations/%d/members", acme)
+
+	adminUser, err := app.models.Users.GetByEmail(context.Background(), "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := fmt.Sprintf("%s/%d", members, adminUser.ID)
+
+	var resp struct {
+		Error map[string]string `json:"error"`
+	}
+
+	// The admin is the only member who can manage the others.
+	code, _ := ts.do(t, http.MethodPut, members, admin, map[string]string{"email": "admin@example.com", "role": "viewer"}, &resp)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, resp.Error["role"], "last member with it")
+
+	code, _ = ts.do(t, http.MethodDelete, self, admin, nil, &resp)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, resp.Error["user_id"], "last member with roles:manage")
+
+	// Once Carol is an admin too, either of them can step down.
+	code, _ = ts.do(t, http.MethodPut, members, admin, map[string]string{"email": "carol@example.com", "role": "admin"}, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = ts.do(t, http.MethodPut, members, admin, map[string]string{"email": "admin@example.com", "role": "viewer"}, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = ts.do(t, http.MethodDelete, self, admin, nil, nil)
+	assert.Equal(t, code, http.StatusForbidden)
+}
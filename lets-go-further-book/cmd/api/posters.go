@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/images"
+	"greenlight.bagerbach.com/internal/storage"
+	"greenlight.bagerbach.com/internal/tracing"
+	"greenlight.bagerbach.com/internal/validator"
+	"greenlight.bagerbach.com/internal/webhook"
+)
+
+// posterThumbnails are the widths, in pixels, posters are resized to. Each is
+// stored as a JPEG alongside the original.
+var posterThumbnails = []struct {
+	size  string
+	width int
+}{
+	{"w500", 500},
+	{"w185", 185},
+}
+
+// posterSizes holds the values of the size query string parameter of
+// showMoviePosterHandler.
+var posterSizes = []string{"original", "w500", "w185"}
+
+// Every upload of a movie's poster has its files stored under a key of its own, so
+// that they're all in place before the movie's row is switched over to them.
+func posterKey(movieID int64, upload, size string) string {
+	return fmt.Sprintf("posters/%d/%s/%s", movieID, upload, size)
+}
+
+// posterPrefix holds every upload of a movie's poster.
+func posterPrefix(movieID int64) string {
+	return fmt.Sprintf("posters/%d", movieID)
+}
+
+// uploadMoviePosterHandler sets a movie's poster from the "poster" field of a
+// multipart/form-data body, replacing any it already had. The image's format is
+// sniffed from its content, and thumbnails are rendered from it up front.
+func (app *application) uploadMoviePosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.movies(r).Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	poster, err := app.readPoster(w, r)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.Is(err, http.ErrNotMultipart):
+			app.unsupportedMediaTypeResponse(w, r, errors.New("body must be multipart/form-data"))
+		case errors.As(err, &maxBytesError), errors.Is(err, errPosterTooLarge):
+			app.contentTooLargeResponse(w, r, fmt.Errorf("poster must not be larger than %d bytes", app.config.posters.maxSize))
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(len(poster) > 0, "poster", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	files, err := app.renderPoster(r.Context(), poster)
+	if err != nil {
+		switch {
+		case errors.Is(err, images.ErrUnsupportedFormat):
+			app.unsupportedMediaTypeResponse(w, r, errors.New("poster must be a JPEG, PNG or GIF image"))
+		case errors.Is(err, images.ErrTooLarge):
+			v.AddError("poster", fmt.Sprintf("must not have more than %d pixels", images.MaxPixels))
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, errInvalidPoster):
+			v.AddError("poster", "must be a valid image")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	upload := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	for _, size := range posterSizes {
+		if err := app.storage.Put(r.Context(), posterKey(movie.ID, upload, size), bytes.NewReader(files[size])); err != nil {
+			app.deletePosterUpload(r.Context(), movie.ID, upload)
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// Until the row is switched over, the poster being replaced is still served.
+	previous, err := app.movies(r).UpdatePoster(r.Context(), movie, upload)
+	if err != nil {
+		app.deletePosterUpload(r.Context(), movie.ID, upload)
+
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if previous != "" {
+		app.deletePosterUpload(r.Context(), movie.ID, previous)
+	}
+
+	app.publishEvent(r.Context(), movie.OrganizationID, webhook.EventMovieUpdated, envelope{"movie": movie})
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+var errInvalidPoster = errors.New("invalid poster image")
+
+// renderPoster decodes a poster and returns the files to store for it, by size.
+// Decoding and resizing hold the whole image in memory several times over, so at
+// most posters-max-concurrent posters are rendered at once; the others wait for
+// their turn, or until ctx is done.
+func (app *application) renderPoster(ctx context.Context, poster []byte) (map[string][]byte, error) {
+	select {
+	case app.posterSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-app.posterSlots }()
+
+	img, _, err := images.Decode(poster)
+	if err != nil {
+		if errors.Is(err, images.ErrUnsupportedFormat) || errors.Is(err, images.ErrTooLarge) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %w", errInvalidPoster, err)
+	}
+
+	return posterFiles(ctx, poster, img)
+}
+
+// posterFiles returns the files stored for a poster, by size: the image as it was
+// uploaded, and its thumbnails.
+func posterFiles(ctx context.Context, poster []byte, img image.Image) (map[string][]byte, error) {
+	// Resizing a large image takes a while, so it gets a span of its own.
+	_, span := tracing.Start(ctx, "posterFiles")
+	defer span.End()
+
+	files := map[string][]byte{"original": poster}
+
+	// Every thumbnail is scaled from the same copy of the full image.
+	src := images.Flatten(img)
+
+	for _, thumbnail := range posterThumbnails {
+		b, err := images.EncodeJPEG(images.Resize(src, thumbnail.width))
+		if err != nil {
+			return nil, err
+		}
+		files[thumbnail.size] = b
+	}
+
+	return files, nil
+}
+
+var errPosterTooLarge = errors.New("poster too large")
+
+// readPoster returns the contents of the "poster" field of a multipart/form-data
+// body, or nothing if there is no such field. Other fields are skipped.
+func (app *application) readPoster(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	// Leave room for the boundaries and part headers around the image.
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.posters.maxSize+64<<10)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				return nil, err
+			}
+			return nil, errors.New("body contains badly-formed multipart data")
+		}
+
+		if part.FormName() != "poster" {
+			continue
+		}
+
+		poster, err := io.ReadAll(io.LimitReader(part, app.config.posters.maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(poster)) > app.config.posters.maxSize {
+			return nil, errPosterTooLarge
+		}
+
+		return poster, nil
+	}
+}
+
+// showMoviePosterHandler serves a movie's poster, at its original size or as one
+// of the thumbnails. Clients may cache it for an hour, and revalidate it after
+// that with the ETag or Last-Modified header, which change with every upload.
+func (app *application) showMoviePosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	size := app.readString(r.URL.Query(), "size", "original")
+	if v.Check(validator.PermittedValue(size, posterSizes...), "size", "must be one of original, w500 or w185"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.movies(r).Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if movie.PosterUpdatedAt == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	f, err := app.storage.Get(r.Context(), posterKey(movie.ID, movie.PosterUpload, size))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	poster, err := io.ReadAll(f)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(poster))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%s-%s"`, movie.ID, size, movie.PosterUpload))
+
+	// ServeContent answers conditional and range requests.
+	http.ServeContent(w, r, "", *movie.PosterUpdatedAt, bytes.NewReader(poster))
+}
+
+// deletePoster removes a deleted movie's poster files, if it had any, in the
+// background.
+func (app *application) deletePoster(ctx context.Context, movieID int64) {
+	ctx = tracing.Detach(ctx)
+
+	app.background(fmt.Sprintf("delete poster of movie %d", movieID), func() {
+		if err := app.storage.DeleteAll(ctx, posterPrefix(movieID)); err != nil {
+			app.logger.ErrorContext(ctx, "failed to delete poster", "movie_id", movieID, "error", err)
+		}
+	})
+}
+
+// deletePosterUpload removes the files of one upload of a movie's poster in the
+// background: one that has been replaced, or one that never became the poster.
+func (app *application) deletePosterUpload(ctx context.Context, movieID int64, upload string) {
+	ctx = tracing.Detach(ctx)
+
+	app.background(fmt.Sprintf("delete poster upload %s of movie %d", upload, movieID), func() {
+		for _, size := range posterSizes {
+			if err := app.storage.Delete(ctx, posterKey(movieID, upload, size)); err != nil {
+				app.logger.ErrorContext(ctx, "failed to delete poster", "movie_id", movieID, "upload", upload, "size", size, "error", err)
+			}
+		}
+	})
+}
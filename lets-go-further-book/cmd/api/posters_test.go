@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/storage"
+)
+
+// testPoster returns a PNG image of the given size.
+func testPoster(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadPoster sends content as the poster field of a multipart/form-data body,
+// returning the response status.
+func uploadPoster(t *testing.T, ts *testServer, urlPath, token string, content []byte) int {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("poster", "poster.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+urlPath, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+
+	return rs.StatusCode
+}
+
+// getPoster fetches a poster with the given request headers, returning the
+// response and its body.
+func getPoster(t *testing.T, ts *testServer, urlPath, token string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+urlPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	body, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs, body
+}
+
+func TestMoviePoster(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	writer := newTestUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	reader := newTestUser(t, app, "reader@example.com", "movies:read")
+
+	var created struct {
+		Movie struct {
+			ID int64 `json:"id"`
+		} `json:"movie"`
+	}
+	code, _ := ts.do(t, http.MethodPost, "/v1/movies", writer, map[string]any{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}, &created)
+	assert.Equal(t, code, http.StatusCreated)
+
+	poster := fmt.Sprintf("/v1/movies/%d/poster", created.Movie.ID)
+
+	rs, _ := getPoster(t, ts, poster, reader, nil)
+	assert.Equal(t, rs.StatusCode, http.StatusNotFound)
+
+	original := testPoster(t, 1000, 1500)
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		content  []byte
+		wantCode int
+	}{
+		{"Without movies:write", poster, reader, original, http.StatusForbidden},
+		{"Unknown movie", fmt.Sprintf("/v1/movies/%d/poster", created.Movie.ID+1), writer, original, http.StatusNotFound},
+		{"Not an image", poster, writer, []byte("<html><body>Moana</body></html>"), http.StatusUnsupportedMediaType},
+		{"Corrupt image", poster, writer, original[:100], http.StatusUnprocessableEntity},
+		{"Empty", poster, writer, []byte{}, http.StatusUnprocessableEntity},
+		{"Too large", poster, writer, make([]byte, app.config.posters.maxSize+1), http.StatusRequestEntityTooLarge},
+		{"Valid", poster, writer, original, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, uploadPoster(t, ts, tt.path, tt.token, tt.content), tt.wantCode)
+		})
+	}
+
+	t.Run("Sizes", func(t *testing.T) {
+		sizes := []struct {
+			size            string
+			wantContentType string
+			wantWidth       int
+			wantHeight      int
+		}{
+			{"", "image/png", 1000, 1500},
+			{"original", "image/png", 1000, 1500},
+			{"w500", "image/jpeg", 500, 750},
+			{"w185", "image/jpeg", 185, 278},
+		}
+
+		for _, tt := range sizes {
+			rs, body := getPoster(t, ts, poster+"?size="+tt.size, reader, http.Header{"Accept": {"image/*"}})
+			assert.Equal(t, rs.StatusCode, http.StatusOK)
+			assert.Equal(t, rs.Header.Get("Content-Type"), tt.wantContentType)
+			assert.Equal(t, rs.Header.Get("Cache-Control"), "private, max-age=3600")
+
+			config, _, err := image.DecodeConfig(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, config.Width, tt.wantWidth)
+			assert.Equal(t, config.Height, tt.wantHeight)
+		}
+
+		rs, _ := getPoster(t, ts, poster+"?size=w1000", reader, nil)
+		assert.Equal(t, rs.StatusCode, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("Conditional", func(t *testing.T) {
+		rs, _ := getPoster(t, ts, poster, reader, nil)
+		etag, lastModified := rs.Header.Get("ETag"), rs.Header.Get("Last-Modified")
+		assert.StringContains(t, etag, fmt.Sprintf(`"%d-original-`, created.Movie.ID))
+
+		rs, body := getPoster(t, ts, poster, reader, http.Header{"If-None-Match": {etag}})
+		assert.Equal(t, rs.StatusCode, http.StatusNotModified)
+		assert.Equal(t, len(body), 0)
+
+		rs, _ = getPoster(t, ts, poster, reader, http.Header{"If-Modified-Since": {lastModified}})
+		assert.Equal(t, rs.StatusCode, http.StatusNotModified)
+	})
+
+	t.Run("Not an edit", func(t *testing.T) {
+		ctx := context.Background()
+
+		_, latest, err := app.models.MovieEvents.Bounds(ctx, defaultOrganizationID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, uploadPoster(t, ts, poster, writer, original), http.StatusOK)
+		waitForBackgroundTasks(t, app)
+
+		// No movie.updated event is recorded, so event streams and webhooks aren't
+		// told about it.
+		_, after, err := app.models.MovieEvents.Bounds(ctx, defaultOrganizationID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, after, latest)
+
+		// The version is the same, so an edit based on it still goes ahead.
+		movie := fmt.Sprintf("/v1/movies/%d", created.Movie.ID)
+		code, _ := ts.doWithHeader(t, http.MethodPatch, movie, writer, http.Header{"X-Expected-Version": {"1"}}, map[string]any{"title": "Vaiana"}, nil)
+		assert.Equal(t, code, http.StatusOK)
+	})
+
+	t.Run("Other organization", func(t *testing.T) {
+		outsider := newTestUser(t, app, "outsider@example.com")
+		acme := newTestOrganization(t, ts, outsider, "Acme")
+
+		rs, _ := getPoster(t, ts, poster, outsider, xOrganization(acme))
+		assert.Equal(t, rs.StatusCode, http.StatusNotFound)
+	})
+
+	// upload returns the upload whose files are the movie's poster.
+	upload := func(t *testing.T) string {
+		t.Helper()
+
+		movie, err := app.models.Movies.ForOrganization(defaultOrganizationID).Get(context.Background(), created.Movie.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return movie.PosterUpload
+	}
+
+	t.Run("Replaced", func(t *testing.T) {
+		rs, _ := getPoster(t, ts, poster, reader, nil)
+		etag := rs.Header.Get("ETag")
+		previous := upload(t)
+
+		assert.Equal(t, uploadPoster(t, ts, poster, writer, testPoster(t, 300, 450)), http.StatusOK)
+		waitForBackgroundTasks(t, app)
+
+		assert.Equal(t, upload(t) != previous, true)
+
+		rs, body := getPoster(t, ts, poster, reader, nil)
+		assert.Equal(t, rs.StatusCode, http.StatusOK)
+		assert.Equal(t, rs.Header.Get("ETag") != etag, true)
+
+		config, _, err := image.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, config.Width, 300)
+
+		for _, size := range posterSizes {
+			_, err := app.storage.Get(context.Background(), posterKey(created.Movie.ID, previous, size))
+			if !errors.Is(err, storage.ErrNotFound) {
+				t.Errorf("got error %v getting replaced poster %s; want storage.ErrNotFound", err, size)
+			}
+		}
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		current := upload(t)
+
+		code, _ := ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/movies/%d", created.Movie.ID), writer, nil, nil)
+		assert.Equal(t, code, http.StatusOK)
+		waitForBackgroundTasks(t, app)
+
+		for _, size := range posterSizes {
+			_, err := app.storage.Get(context.Background(), posterKey(created.Movie.ID, current, size))
+			if !errors.Is(err, storage.ErrNotFound) {
+				t.Errorf("got error %v getting deleted poster %s; want storage.ErrNotFound", err, size)
+			}
+		}
+	})
+}
+
+func TestRenderPosterWaitsForASlot(t *testing.T) {
+	app := newTestApplication(t)
+	poster := testPoster(t, 300, 450)
+
+	for range app.config.posters.maxConcurrent {
+		app.posterSlots <- struct{}{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := app.renderPoster(ctx, poster)
+	assert.Equal(t, errors.Is(err, context.DeadlineExceeded), true)
+
+	<-app.posterSlots
+
+	files, err := app.renderPoster(context.Background(), poster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(files), len(posterSizes))
+
+	// The slot was given back.
+	assert.Equal(t, len(app.posterSlots), app.config.posters.maxConcurrent-1)
+}
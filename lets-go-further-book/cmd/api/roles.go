@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/validator"
+)
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"roles": roles}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	names, err := app.models.Roles.GetAllForUser(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"roles": names}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+type setUserRolesInput struct {
+	Roles []string `json:"roles"`
+}
+
+// setUserRolesHandler replaces a user's roles. Permissions granted to the user
+// directly are left alone. These only apply outside organizations, e.g. to manage
+// roles; within one, the user's role in it applies instead.
+func (app *application) setUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input setUserRolesInput
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Roles != nil, "roles", "must be provided")
+	v.Check(validator.Unique(input.Roles), "roles", "must not contain duplicate values")
+	for _, name := range input.Roles {
+		known := slices.ContainsFunc(roles, func(role *data.Role) bool {
+			return role.Name == name
+		})
+		v.Check(known, "roles", "unknown role "+name)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := app.models.Roles.SetForUser(r.Context(), id, input.Roles...); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	names, err := app.models.Roles.GetAllForUser(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"roles": names}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+func TestRegisteredUsersGetTheDefaultRole(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.users.defaultRole = "editor"
+	ts := newTestServer(t, app.routes())
+
+	user := map[string]string{"name": "Alice", "email": "alice@example.com", "password": "pa55word1234"}
+	code, _ := ts.do(t, http.MethodPost, "/v1/users", "", user, nil)
+	assert.Equal(t, code, http.StatusAccepted)
+	waitForBackgroundTasks(t, app)
+
+	alice, err := app.models.Users.GetByEmail(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	organizations, err := app.models.Organizations.GetAllForUser(context.Background(), alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(organizations), 1)
+	assert.Equal(t, organizations[0].ID, int64(defaultOrganizationID))
+	assert.Equal(t, organizations[0].Role, "editor")
+
+	permissions, err := app.models.Permissions.GetAllForMember(context.Background(), defaultOrganizationID, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, permissions.Include("movies:write"), true)
+
+	// The role is only hers within the organization.
+	roles, err := app.models.Roles.GetAllForUser(context.Background(), alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(roles), 0)
+}
+
+func TestSetUserRoles(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	admin := newTestUser(t, app, "admin@example.com", "roles:manage")
+	bob := newTestUser(t, app, "bob@example.com", "movies:read")
+
+	bobUser, err := app.models.Users.GetByEmail(context.Background(), "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobRoles := fmt.Sprintf("/v1/roles/users/%d", bobUser.ID)
+
+	movie := map[string]any{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+
+	code, _ := ts.do(t, http.MethodPost, "/v1/movies", bob, movie, nil)
+	assert.Equal(t, code, http.StatusForbidden)
+
+	tests := []struct {
+		name     string
+		token    string
+		urlPath  string
+		roles    []string
+		wantCode int
+	}{
+		{"Without roles:manage", bob, bobRoles, []string{"admin"}, http.StatusForbidden},
+		{"Unknown role", admin, bobRoles, []string{"superuser"}, http.StatusUnprocessableEntity},
+		{"Duplicate role", admin, bobRoles, []string{"editor", "editor"}, http.StatusUnprocessableEntity},
+		{"Unknown user", admin, "/v1/roles/users/999", []string{"editor"}, http.StatusNotFound},
+		{"Valid", admin, bobRoles, []string{"admin"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := ts.do(t, http.MethodPut, tt.urlPath, tt.token, map[string]any{"roles": tt.roles}, nil)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+
+	var resp struct {
+		Roles []string `json:"roles"`
+	}
+	code, _ = ts.do(t, http.MethodGet, bobRoles, admin, nil, &resp)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, fmt.Sprint(resp.Roles), "[admin]")
+
+	// Bob now has the permissions of the admin role outside organizations, but not
+	// within them, where only his role and grants in the organization count.
+	code, _ = ts.do(t, http.MethodGet, "/v1/roles", bob, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = ts.do(t, http.MethodPost, "/v1/movies", bob, movie, nil)
+	assert.Equal(t, code, http.StatusForbidden)
+
+	code, _ = ts.do(t, http.MethodPut, bobRoles, admin, map[string]any{"roles": []string{}}, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/roles", bob, nil, nil)
+	assert.Equal(t, code, http.StatusForbidden)
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/movies", bob, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	waitForBackgroundTasks(t, app)
+}
@@ -2,33 +2,211 @@ package main
 
 import (
 	"expvar"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.bagerbach.com/internal/tracing"
 )
 
-func (app *application) routes() http.Handler {
-	router := httprouter.New()
+// route is the description of a registered endpoint, used to build the OpenAPI document.
+type route struct {
+	method       string
+	path         string
+	permission   string // Permission code required by requirePermission, if any
+	activated    bool   // Requires an activated user, whatever their permissions
+	organization bool   // The permission is checked within an organization, by requireOrganizationPermission
+	// Permissions are checked for each field of the response, so API keys are
+	// accepted without a permission for the route as a whole.
+	fieldPermissions bool
+}
+
+// router is an httprouter.Router that keeps a list of its routes.
+//
+// It also works around httprouter refusing to register a static path segment
+// where a wildcard is already in use (e.g. /v1/movies/events next to
+// /v1/movies/:id, or /v1/movies/batch next to /v1/movies/:id/poster): static
+// paths that clash with an existing wildcard route are served from an
+// exact-match table, consulted before the tree. This means the wildcard route
+// has to be registered first.
+type router struct {
+	*httprouter.Router
+	routes []route
+	exact  map[string]http.Handler
+	// NotAcceptable is called for requests whose Accept header doesn't allow the
+	// route's response in any format it can be written in.
+	NotAcceptable http.Handler
+}
+
+func (app *application) newRouter() *router {
+	rt := &router{
+		Router: httprouter.New(),
+		exact:  make(map[string]http.Handler),
+	}
+
+	rt.NotFound = http.HandlerFunc(app.notFoundResponse)
+	rt.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	rt.NotAcceptable = http.HandlerFunc(app.notAcceptableResponse)
+
+	return rt
+}
+
+func (rt *router) handle(rte route, handler http.Handler) {
+	if slices.Contains(rt.routes, rte) {
+		panic(fmt.Sprintf("route %s %s registered twice", rte.method, rte.path))
+	}
+	rt.routes = append(rt.routes, rte)
+
+	name := rte.method + " " + rte.path
+	op := operations[name]
+	next := handler
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := tracing.SpanFromContext(r.Context())
+		span.SetName(name)
+		span.SetAttribute("http.route", rte.path)
+
+		// Content is negotiated before anything else, so that a request we can't
+		// respond to has no side effects.
+		if !op.acceptable(r) {
+			rt.NotAcceptable.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	if rt.clashesWithWildcard(rte) {
+		rt.exact[rte.method+" "+rte.path] = handler
+		return
+	}
+
+	rt.Handler(rte.method, rte.path, handler)
+}
+
+// clashesWithWildcard reports whether one of the routes registered so far for
+// rte's method has a wildcard where rte's path has a static segment, after the
+// same leading segments.
+func (rt *router) clashesWithWildcard(rte route) bool {
+	segments := strings.Split(rte.path, "/")
 
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
-	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	for _, registered := range rt.routes {
+		if registered.method != rte.method || registered.path == rte.path {
+			continue
+		}
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+		for i, segment := range strings.Split(registered.path, "/") {
+			if i >= len(segments) {
+				break
+			}
+			if strings.HasPrefix(segment, ":") {
+				if !strings.HasPrefix(segments[i], ":") {
+					return true
+				}
+				continue
+			}
+			if segment != segments[i] {
+				break
+			}
+		}
+	}
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	return false
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := rt.exact[r.Method+" "+r.URL.Path]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	rt.Router.ServeHTTP(w, r)
+}
+
+// router registers every endpoint. Routes with a permission code are wrapped in
+// requirePermission, or requireOrganizationPermission for an organization's data,
+// and those for any activated user in requireAccountAccess, as they manage the
+// user's own account and can't be used with an API key.
+func (app *application) router() *router {
+	rt := app.newRouter()
+
+	handle := func(method, path, permission string, handler http.HandlerFunc) {
+		if permission != "" {
+			handler = app.requirePermission(permission, handler)
+		}
+		rt.handle(route{method: method, path: path, permission: permission}, handler)
+	}
+	handleOrganization := func(method, path, permission string, handler http.HandlerFunc) {
+		handler = app.requireOrganizationPermission(permission, handler)
+		rt.handle(route{method: method, path: path, permission: permission, organization: true}, handler)
+	}
+	handleActivated := func(method, path string, handler http.HandlerFunc) {
+		rt.handle(route{method: method, path: path, activated: true}, app.requireAccountAccess(handler))
+	}
+
+	handle(http.MethodGet, "/v1/healthcheck/live", "", app.liveHealthcheckHandler)
+	// The original healthcheck endpoint, kept for the clients that still use it.
+	handle(http.MethodGet, "/v1/healthcheck", "", app.liveHealthcheckHandler)
+	handle(http.MethodGet, "/v1/healthcheck/ready", "", app.readyHealthcheckHandler)
+	handle(http.MethodGet, "/v1/openapi.json", "", app.openAPIHandler)
+
+	handleOrganization(http.MethodGet, "/v1/movies", "movies:read", app.listMoviesHandler)
+	handleOrganization(http.MethodPost, "/v1/movies", "movies:write", app.idempotent(app.createMovieHandler))
+	handleOrganization(http.MethodGet, "/v1/movies/:id", "movies:read", app.showMovieHandler)
+	handleOrganization(http.MethodPatch, "/v1/movies/:id", "movies:write", app.updateMovieHandler)
+	handleOrganization(http.MethodDelete, "/v1/movies/:id", "movies:write", app.deleteMovieHandler)
+	handleOrganization(http.MethodGet, "/v1/movies/:id/poster", "movies:read", app.showMoviePosterHandler)
+	handleOrganization(http.MethodPost, "/v1/movies/:id/poster", "movies:write", app.uploadMoviePosterHandler)
+	handleOrganization(http.MethodGet, "/v1/movies/events", "movies:read", app.movieEventsHandler)
+	handleOrganization(http.MethodPost, "/v1/movies/batch", "movies:write", app.batchMoviesHandler)
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	handleOrganization(http.MethodGet, "/v1/webhooks", "webhooks:manage", app.listWebhooksHandler)
+	handleOrganization(http.MethodPost, "/v1/webhooks", "webhooks:manage", app.createWebhookHandler)
+	handleOrganization(http.MethodGet, "/v1/webhooks/:id", "webhooks:manage", app.showWebhookHandler)
+	handleOrganization(http.MethodDelete, "/v1/webhooks/:id", "webhooks:manage", app.deleteWebhookHandler)
+	handleOrganization(http.MethodGet, "/v1/webhooks/:id/deliveries", "webhooks:manage", app.listWebhookDeliveriesHandler)
+	handleOrganization(http.MethodPost, "/v1/webhooks/:id/test", "webhooks:manage", app.testWebhookHandler)
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	handle(http.MethodPost, "/v1/users", "", app.idempotent(app.registerUserHandler))
+	handle(http.MethodPut, "/v1/users/activated", "", app.activateUserHandler)
+	handle(http.MethodPut, "/v1/users/email", "", app.confirmEmailChangeHandler)
+	handleActivated(http.MethodGet, "/v1/users/me", app.showCurrentUserHandler)
+	handleActivated(http.MethodPatch, "/v1/users/me", app.updateCurrentUserHandler)
+	handleActivated(http.MethodDelete, "/v1/users/me", app.deleteCurrentUserHandler)
+	handleActivated(http.MethodPost, "/v1/users/me/totp", app.enrollTOTPHandler)
+	handleActivated(http.MethodPut, "/v1/users/me/totp", app.confirmTOTPHandler)
+	handleActivated(http.MethodDelete, "/v1/users/me/totp", app.disableTOTPHandler)
+
+	handle(http.MethodGet, "/v1/roles", "roles:manage", app.listRolesHandler)
+	handle(http.MethodGet, "/v1/roles/users/:id", "roles:manage", app.showUserRolesHandler)
+	handle(http.MethodPut, "/v1/roles/users/:id", "roles:manage", app.setUserRolesHandler)
+
+	// The member routes check roles:manage within the organization themselves.
+	handleActivated(http.MethodGet, "/v1/organizations", app.listOrganizationsHandler)
+	handleActivated(http.MethodPost, "/v1/organizations", app.createOrganizationHandler)
+	handleActivated(http.MethodGet, "/v1/organizations/:id/members", app.listOrganizationMembersHandler)
+	handleActivated(http.MethodPut, "/v1/organizations/:id/members", app.setOrganizationMemberHandler)
+	handleActivated(http.MethodDelete, "/v1/organizations/:id/members/:user_id", app.removeOrganizationMemberHandler)
+
+	handleActivated(http.MethodGet, "/v1/api-keys", app.listAPIKeysHandler)
+	handleActivated(http.MethodPost, "/v1/api-keys", app.createAPIKeyHandler)
+	handleActivated(http.MethodDelete, "/v1/api-keys/:id", app.deleteAPIKeyHandler)
+
+	// Each field of a GraphQL query checks the permission its REST endpoint needs,
+	// within the organization for movies.
+	rt.handle(route{method: http.MethodPost, path: "/v1/graphql", activated: true, organization: true, fieldPermissions: true}, app.requireActivatedUser(app.graphqlHandler))
+
+	handle(http.MethodPost, "/v1/tokens/authentication", "", app.createAuthenticationTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/mfa", "", app.createMFAAuthenticationTokenHandler)
 
 	// Using /debug/vars, which is conventional for expvar, to display the metrics
 	// and debug information.
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	handle(http.MethodGet, "/debug/vars", "", expvar.Handler().ServeHTTP)
+
+	return rt
+}
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+func (app *application) routes() http.Handler {
+	return app.requestID(app.trace(app.logRequest(app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(app.readYourWrites(app.router())))))))))
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+// TestRouting requests every route's path, with its wildcards filled in, using
+// every method that has routes, against a router holding the same routes as the
+// real one. Each request has to reach the route that matches it most specifically,
+// with static segments winning over wildcards as httprouter has them do, so that
+// a static route served from the exact-match table (like /v1/movies/events) and
+// the wildcard route next to it (/v1/movies/:id) are both reachable, and neither
+// takes the other's requests.
+func TestRouting(t *testing.T) {
+	app := newTestApplication(t)
+	routes := app.router().routes
+
+	rt := app.newRouter()
+	for _, rte := range routes {
+		name := rte.method + " " + rte.path
+		rt.handle(rte, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Route", name)
+		}))
+	}
+
+	// The static routes that clash with a wildcard. A new one works the same way,
+	// but is listed here so that it's added knowingly.
+	var exact []string
+	for name := range rt.exact {
+		exact = append(exact, name)
+	}
+	slices.Sort(exact)
+	assert.Equal(t, strings.Join(exact, ", "), "GET /v1/movies/events, POST /v1/movies/batch")
+
+	var methods, paths []string
+	for _, rte := range routes {
+		if !slices.Contains(methods, rte.method) {
+			methods = append(methods, rte.method)
+		}
+		if path := fillWildcards(rte.path); !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+
+	for _, path := range paths {
+		for _, method := range methods {
+			t.Run(method+" "+path, func(t *testing.T) {
+				want := bestRoute(routes, method, path)
+
+				rr := httptest.NewRecorder()
+				rt.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+
+				assert.Equal(t, rr.Header().Get("X-Route"), want)
+				if want == "" {
+					assert.Equal(t, rr.Code == http.StatusNotFound || rr.Code == http.StatusMethodNotAllowed, true)
+				}
+			})
+		}
+	}
+}
+
+// fillWildcards returns the route path with 1 for each of its parameters.
+func fillWildcards(routePath string) string {
+	segments := strings.Split(routePath, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "1"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// bestRoute returns the name of the route for method that matches path, preferring
+// static segments over wildcards from left to right, or "" if there's none.
+func bestRoute(routes []route, method, path string) string {
+	segments := strings.Split(path, "/")
+
+	var best []string
+	name := ""
+	for _, rte := range routes {
+		pattern := strings.Split(rte.path, "/")
+		if rte.method != method || len(pattern) != len(segments) {
+			continue
+		}
+
+		matches := true
+		for i, segment := range pattern {
+			if !strings.HasPrefix(segment, ":") && segment != segments[i] {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		if best == nil || moreSpecific(pattern, best) {
+			best, name = pattern, rte.method+" "+rte.path
+		}
+	}
+
+	return name
+}
+
+// moreSpecific reports whether pattern has a static segment where other has its
+// first wildcard that pattern doesn't share.
+func moreSpecific(pattern, other []string) bool {
+	for i := range pattern {
+		patternWildcard := strings.HasPrefix(pattern[i], ":")
+		otherWildcard := strings.HasPrefix(other[i], ":")
+		if patternWildcard != otherWildcard {
+			return otherWildcard
+		}
+	}
+	return false
+}
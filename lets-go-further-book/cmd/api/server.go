@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -22,37 +24,70 @@ func (app *application) serve() error {
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
-	// To receive any error returned by the graceful Shutdown() function
-	shutdownError := make(chan error)
+	// Event streams never finish on their own, so end them as soon as Shutdown()
+	// starts instead of letting them hold it up until the timeout.
+	if app.movieEvents != nil {
+		srv.RegisterOnShutdown(app.movieEvents.close)
+	}
 
-	go func() {
-		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-		s := <-quit
+	var certs *certReloader
+	if app.config.tls.certFile != "" {
+		var err error
+		certs, err = newCertReloader(app.config.tls)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = certs.serverConfig()
 
-		app.logger.Info("shutting down server", "signal", s.String())
+		stopWatching := make(chan struct{})
+		defer close(stopWatching)
+		go app.watchCertificates(certs, stopWatching)
+	}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+	stopPurging := make(chan struct{})
+	defer close(stopPurging)
+	go app.purgeIdempotencyKeys(stopPurging)
 
-		err := srv.Shutdown(ctx)
-		if err != nil {
-			shutdownError <- err
-		}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
 
-		app.logger.Info("completing background tasks", "addr", srv.Addr)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(quit)
 
-		app.wg.Wait()        // block until all background goroutines are done (WaitGroup counter = 0)
-		shutdownError <- nil // send nil to shutdownError channel to indicate shutdown complete without issues
-	}()
+	app.logger.Info("starting server", "addr", srv.Addr, "port", app.config.port, "tls", certs != nil)
+
+	return app.run(srv, ln, quit)
+}
+
+// run serves requests on ln until a signal arrives on quit, then shuts the server
+// down gracefully.
+func (app *application) run(srv *http.Server, ln net.Listener, quit <-chan os.Signal) error {
+	// To receive any error returned by the graceful shutdown
+	shutdownError := make(chan error, 1)
 
-	app.logger.Info("starting server", "addr", srv.Addr, "port", app.config.port)
+	go func() {
+		s := <-quit
 
-	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		app.logger.Info("shutting down server", "signal", s.String())
+
+		shutdownError <- app.shutdown(srv)
+	}()
+
+	var err error
+	if srv.TLSConfig != nil {
+		// The certificate comes from TLSConfig, so no files are passed here.
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 
-	err := <-shutdownError
+	err = <-shutdownError
 	if err != nil {
 		return err
 	}
@@ -60,3 +95,62 @@ func (app *application) serve() error {
 	app.logger.Info("server closed", "addr", srv.Addr)
 	return nil
 }
+
+// shutdown stops the server in three phases, each limited by its own setting:
+//
+//  1. The readiness check fails straight away, but requests are still accepted for
+//     the stop delay, giving load balancers time to take us out of rotation.
+//  2. The listeners are closed and in-flight requests get the HTTP timeout to
+//     finish, after which their connections are closed.
+//  3. Background tasks get the background timeout to finish. Those that can give
+//     up early, like webhook deliveries waiting to retry, are told to straight
+//     away. Any still running after that are logged by name, and an error is
+//     returned so we exit without them.
+func (app *application) shutdown(srv *http.Server) error {
+	app.shuttingDown.Store(true)
+
+	if delay := app.config.shutdown.stopDelay; delay > 0 {
+		app.logger.Info("waiting for load balancers to stop sending requests", "delay", delay)
+		time.Sleep(delay)
+	}
+
+	app.logger.Info("draining HTTP connections", "timeout", app.config.shutdown.httpTimeout)
+
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdown.httpTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		app.logger.Error("in-flight requests didn't finish in time, closing their connections", "error", err)
+		srv.Close()
+	} else {
+		app.logger.Info("HTTP connections drained", "duration", time.Since(start))
+	}
+
+	app.logger.Info("completing background tasks", "running", len(app.tasks.list()), "timeout", app.config.shutdown.backgroundTimeout)
+
+	app.tasks.stop()
+
+	start = time.Now()
+
+	var err error
+	if app.tasks.wait(app.config.shutdown.backgroundTimeout) {
+		app.logger.Info("background tasks completed", "duration", time.Since(start))
+	} else {
+		var names []string
+		for _, task := range app.tasks.list() {
+			names = append(names, task.name)
+			app.logger.Error("background task still running", "task", task.name, "running_for", time.Since(task.started).Round(time.Millisecond))
+		}
+		err = fmt.Errorf("%d background tasks didn't finish in time: %s", len(names), strings.Join(names, ", "))
+	}
+
+	// Export what's left of the traces, including those of the background tasks.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	app.tracer.Shutdown(ctx)
+
+	return err
+}
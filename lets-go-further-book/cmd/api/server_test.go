@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/webhook"
+)
+
+// startTestServer runs handler through app.run on a local port, returning its URL,
+// the channel that stops it and the channel run's result arrives on.
+func startTestServer(t *testing.T, app *application, handler http.Handler) (string, chan os.Signal, chan error) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quit := make(chan os.Signal, 1)
+	result := make(chan error, 1)
+
+	go func() {
+		result <- app.run(&http.Server{Handler: handler}, ln, quit)
+	}()
+
+	return "http://" + ln.Addr().String(), quit, result
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsRequestsAndBackgroundTasks(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	app.config.shutdown.httpTimeout = 5 * time.Second
+	app.config.shutdown.backgroundTimeout = 5 * time.Second
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var taskDone atomic.Bool
+
+	url, quit, result := startTestServer(t, app, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.background("test task", func() {
+			<-release
+			time.Sleep(50 * time.Millisecond)
+			taskDone.Store(true)
+		})
+
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		responses <- response{body: string(body), err: err}
+	}()
+
+	<-started
+	quit <- syscall.SIGTERM
+
+	// Only let the request finish once the server has stopped accepting new ones.
+	waitFor(t, "the listener to close", func() bool {
+		conn, err := net.Dial("tcp", url[len("http://"):])
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	})
+	assert.Equal(t, app.shuttingDown.Load(), true)
+
+	close(release)
+
+	res := <-responses
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	assert.Equal(t, res.body, "done")
+
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, taskDone.Load(), true)
+}
+
+func TestShutdownReportsUnfinishedBackgroundTasks(t *testing.T) {
+	var logs bytes.Buffer
+
+	app := &application{logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	app.config.shutdown.httpTimeout = time.Second
+	app.config.shutdown.backgroundTimeout = 50 * time.Millisecond
+
+	hang := make(chan struct{})
+	defer close(hang)
+
+	app.background("finished task", func() {})
+	app.background("hanging task", func() { <-hang })
+
+	_, quit, result := startTestServer(t, app, http.NotFoundHandler())
+
+	quit <- syscall.SIGTERM
+
+	err := <-result
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	assert.Equal(t, err.Error(), "1 background tasks didn't finish in time: hanging task")
+	assert.StringContains(t, logs.String(), `msg="background task still running" task="hanging task"`)
+}
+
+// failingTransport answers every request with a 503, counting them.
+type failingTransport struct {
+	requests atomic.Int32
+}
+
+func (ft *failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ft.requests.Add(1)
+	return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+}
+
+func TestShutdownInterruptsWebhookRetries(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.shutdown.httpTimeout = time.Second
+	app.config.shutdown.backgroundTimeout = 10 * time.Second
+
+	// The second attempt would only be made an hour after the first fails.
+	transport := &failingTransport{}
+	app.webhooks = webhook.Client{HTTP: &http.Client{Transport: transport}, MaxAttempts: 2, Backoff: time.Hour}
+
+	subscription := &data.WebhookSubscription{URL: "https://example.com/hook", Secret: "secret", EventTypes: []string{webhook.EventMovieCreated}}
+	if err := app.models.Webhooks.ForOrganization(defaultOrganizationID).Insert(context.Background(), subscription); err != nil {
+		t.Fatal(err)
+	}
+
+	_, quit, result := startTestServer(t, app, http.NotFoundHandler())
+
+	app.publishEvent(context.Background(), defaultOrganizationID, webhook.EventMovieCreated, envelope{"movie": nil})
+	waitFor(t, "the first delivery attempt", func() bool { return transport.requests.Load() == 1 })
+
+	start := time.Now()
+	quit <- syscall.SIGTERM
+
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, time.Since(start) < 5*time.Second, true)
+	assert.Equal(t, transport.requests.Load(), int32(1))
+	assert.Equal(t, len(app.tasks.list()), 0)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/data/datatest"
+	"greenlight.bagerbach.com/internal/data/mocks"
+	"greenlight.bagerbach.com/internal/storage"
+)
+
+// testMailer records the messages sent through it instead of sending them.
+type testMailer struct {
+	mu   sync.Mutex
+	sent []testMail
+}
+
+type testMail struct {
+	recipient    string
+	templateFile string
+	data         any
+}
+
+func (m *testMailer) Send(ctx context.Context, recipient, templateFile string, data any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, testMail{recipient: recipient, templateFile: templateFile, data: data})
+	return nil
+}
+
+func (m *testMailer) Check(ctx context.Context) error {
+	return nil
+}
+
+// lastTo returns the last message sent to recipient.
+func (m *testMailer) lastTo(t *testing.T, recipient string) testMail {
+	t.Helper()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].recipient == recipient {
+			return m.sent[i]
+		}
+	}
+
+	t.Fatalf("no mail sent to %s", recipient)
+	return testMail{}
+}
+
+// newTestApplication returns an application backed by the in-memory models, with
+// rate limiting switched off.
+func newTestApplication(t *testing.T) *application {
+	app := &application{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		models: mocks.NewModels(),
+		mailer: &testMailer{},
+	}
+	app.config.users.defaultRole = "viewer"
+	app.config.users.defaultOrganization = defaultOrganizationID
+	app.config.posters.maxSize = 1 << 20
+	app.config.posters.maxConcurrent = 2
+	app.config.graphql.maxDepth = 5
+	app.config.graphql.maxRootFields = 10
+	app.config.graphql.maxComplexity = 1000
+	app.config.idempotency.lockTimeout = time.Minute
+
+	files, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.storage = files
+	app.posterSlots = make(chan struct{}, app.config.posters.maxConcurrent)
+
+	return app
+}
+
+// newTestDBApplication is newTestApplication with the PostgreSQL models, for what
+// the in-memory ones can't do, like transactions. It's skipped unless
+// datatest.DSNVariable is set.
+func newTestDBApplication(t *testing.T) *application {
+	app := newTestApplication(t)
+	app.models = data.NewModels(datatest.NewDB(t), nil, data.Timeouts{})
+
+	return app
+}
+
+// defaultOrganizationID is the organization the migrations create, which test
+// users are members of.
+const defaultOrganizationID = 1
+
+// waitForBackgroundTasks waits for the mail and webhook tasks started by the
+// requests made so far.
+func waitForBackgroundTasks(t *testing.T, app *application) {
+	t.Helper()
+
+	if !app.tasks.wait(5 * time.Second) {
+		t.Fatal("background tasks didn't finish")
+	}
+}
+
+// newTestUser creates an activated user directly through the models, as a member
+// of the default organization without a role in it, returning an authentication
+// token for them. They're granted the given permissions both in the organization
+// and outside organizations, like the users that were moved into it.
+func newTestUser(t *testing.T, app *application, email string, permissions ...string) string {
+	t.Helper()
+
+	ctx := context.Background()
+
+	user := &data.User{Name: "Test User", Email: email, Activated: true}
+	if err := app.models.Users.Insert(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.models.Organizations.SetMember(ctx, defaultOrganizationID, user.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.models.Permissions.AddForUser(ctx, user.ID, permissions...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.models.Permissions.AddForMember(ctx, defaultOrganizationID, user.ID, permissions...); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := app.models.Tokens.New(ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token.Plaintext
+}
+
+// newTestUserWithPassword is newTestUser for tests that log in: the user has a
+// password (and the movies:read permission in the default organization), and is
+// returned along with the token.
+func newTestUserWithPassword(t *testing.T, app *application, email, password string) (*data.User, string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	user := &data.User{Name: "Test User", Email: email, Activated: true}
+	if err := user.Password.Set(ctx, password); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.models.Organizations.SetMember(ctx, defaultOrganizationID, user.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.models.Permissions.AddForMember(ctx, defaultOrganizationID, user.ID, "movies:read"); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := app.models.Tokens.New(ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, token.Plaintext
+}
+
+type testServer struct {
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	return &testServer{ts}
+}
+
+// do sends a request with body encoded as JSON (unless it's nil), authenticated
+// with token (unless it's empty), which may also be an API key. It returns the
+// response status and headers, and decodes the JSON response body into dst
+// (unless it's nil).
+func (ts *testServer) do(t *testing.T, method, urlPath, token string, body, dst any) (int, http.Header) {
+	t.Helper()
+
+	return ts.doWithHeader(t, method, urlPath, token, nil, body, dst)
+}
+
+// doWithHeader is do for requests that need headers of their own.
+func (ts *testServer) doWithHeader(t *testing.T, method, urlPath, token string, header http.Header, body, dst any) (int, http.Header) {
+	t.Helper()
+
+	var reqBody io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqBody = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+urlPath, reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case strings.HasPrefix(token, data.APIKeyPrefix):
+		req.Header.Set("Authorization", "ApiKey "+token)
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	respBody, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dst != nil {
+		if err := json.Unmarshal(respBody, dst); err != nil {
+			t.Fatalf("decoding %s: %v", respBody, err)
+		}
+	}
+
+	return rs.StatusCode, rs.Header
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tlsVersions maps the -tls-min-version values to their crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsClientAuthTypes maps the -tls-client-auth values to their crypto/tls
+// constants. Client certificates are always verified against the client CA.
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+// certReloader holds the server certificate and client CA pool, and swaps them
+// for new ones when the files change. Handshakes pick up the current ones through
+// GetConfigForClient, so existing connections are left alone.
+type certReloader struct {
+	config tlsConfig
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	// contents of the files last loaded, to tell whether they've changed.
+	loaded [][]byte
+}
+
+type tlsConfig struct {
+	certFile         string
+	keyFile          string
+	minVersion       string
+	clientCAFile     string
+	clientAuth       string
+	clientCommonName bool
+	reloadInterval   time.Duration
+}
+
+func newCertReloader(config tlsConfig) (*certReloader, error) {
+	cr := &certReloader{config: config}
+
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+func (cr *certReloader) files() []string {
+	files := []string{cr.config.certFile, cr.config.keyFile}
+	if cr.config.clientCAFile != "" {
+		files = append(files, cr.config.clientCAFile)
+	}
+	return files
+}
+
+// reload loads the files again if any of them changed, reporting whether they did.
+// On error the current certificate stays in use.
+func (cr *certReloader) reload() (bool, error) {
+	var contents [][]byte
+	for _, file := range cr.files() {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+		contents = append(contents, b)
+	}
+
+	cr.mu.RLock()
+	unchanged := cr.loaded != nil && equalContents(cr.loaded, contents)
+	cr.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(contents[0], contents[1])
+	if err != nil {
+		return false, err
+	}
+
+	var clientCA *x509.CertPool
+	if cr.config.clientCAFile != "" {
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(contents[2]) {
+			return false, fmt.Errorf("no certificates found in %s", cr.config.clientCAFile)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert, cr.clientCA, cr.loaded = &cert, clientCA, contents
+	cr.mu.Unlock()
+
+	return true, nil
+}
+
+func equalContents(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// serverConfig returns the server's TLS configuration. Like snippetbox it only offers
+// curves with assembly implementations; HTTP/2 has to be listed in NextProtos
+// because net/http can't add it to configs returned by GetConfigForClient.
+func (cr *certReloader) serverConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion:       tlsVersions[cr.config.minVersion],
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		ClientAuth:       tlsClientAuthTypes[cr.config.clientAuth],
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+
+	config := base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cr.mu.RLock()
+		defer cr.mu.RUnlock()
+
+		c := base.Clone()
+		c.Certificates = []tls.Certificate{*cr.cert}
+		c.ClientCAs = cr.clientCA
+		return c, nil
+	}
+
+	return config
+}
+
+// watchCertificates reloads the files every reloadInterval (if it isn't 0) and on SIGHUP,
+// until stop is closed.
+func (app *application) watchCertificates(cr *certReloader, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if cr.config.reloadInterval > 0 {
+		ticker := time.NewTicker(cr.config.reloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+		case <-tick:
+		}
+
+		reloaded, err := cr.reload()
+		switch {
+		case err != nil:
+			app.logger.Error("failed to reload TLS certificate, keeping the current one", "error", err)
+		case reloaded:
+			app.logger.Info("reloaded TLS certificate", "cert_file", cr.config.certFile)
+		}
+	}
+}
+
+// clientCertificateEmail returns the email address identifying the user of a
+// verified client certificate: its first email SAN, or, if commonName is true and
+// it has none, its subject's common name. ok is false if the client didn't present
+// a verified certificate, or it doesn't identify anyone.
+func clientCertificateEmail(r *http.Request, commonName bool) (email string, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0], true
+	}
+
+	if commonName && cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, true
+	}
+
+	return "", false
+}
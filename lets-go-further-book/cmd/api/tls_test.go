@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA if parent
+// is nil.
+func newTestCert(t *testing.T, serial int64, parent *testCert, configure func(*x509.Certificate)) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "Greenlight test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if configure != nil {
+		configure(template)
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	} else {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, path string, contents []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, contents, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCert(t, 1, nil, nil)
+	serverCert := func(serial int64) *testCert {
+		return newTestCert(t, serial, ca, func(c *x509.Certificate) {
+			c.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+			c.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		})
+	}
+	clientCert := newTestCert(t, 3, ca, func(c *x509.Certificate) {
+		c.EmailAddresses = []string{"alice@example.com"}
+		c.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	})
+
+	config := tlsConfig{
+		certFile:     filepath.Join(dir, "cert.pem"),
+		keyFile:      filepath.Join(dir, "key.pem"),
+		clientCAFile: filepath.Join(dir, "ca.pem"),
+		minVersion:   "1.2",
+		clientAuth:   "optional",
+	}
+
+	first := serverCert(10)
+	writeFile(t, config.certFile, first.certPEM)
+	writeFile(t, config.keyFile, first.keyPEM)
+	writeFile(t, config.clientCAFile, ca.certPEM)
+
+	cr, err := newCertReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, _ := clientCertificateEmail(r, false)
+		w.Write([]byte(email))
+	}))
+	ts.TLS = cr.serverConfig()
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// get makes a request on a new connection, returning the serial number of the
+	// server's certificate, the negotiated protocol and the response body.
+	get := func(clientCerts ...tls.Certificate) (int64, string, string) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: clientCerts},
+			ForceAttemptHTTP2: true,
+		}}
+		defer client.CloseIdleConnections()
+
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		body := make([]byte, 64)
+		n, _ := res.Body.Read(body)
+
+		return res.TLS.PeerCertificates[0].SerialNumber.Int64(), res.Proto, string(body[:n])
+	}
+
+	serial, proto, email := get()
+	assert.Equal(t, serial, int64(10))
+	assert.Equal(t, proto, "HTTP/2.0")
+	assert.Equal(t, email, "")
+
+	reloaded, err := cr.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, reloaded, false)
+
+	second := serverCert(20)
+	writeFile(t, config.certFile, second.certPEM)
+	writeFile(t, config.keyFile, second.keyPEM)
+
+	reloaded, err = cr.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, reloaded, true)
+
+	keyPair, err := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _, email = get(keyPair)
+	assert.Equal(t, serial, int64(20))
+	assert.Equal(t, email, "alice@example.com")
+
+	// A broken key pair is rejected and the current certificate kept.
+	writeFile(t, config.keyFile, first.keyPEM)
+
+	if _, err := cr.reload(); err == nil {
+		t.Fatal("expected an error for a mismatched key pair")
+	}
+
+	serial, _, _ = get()
+	assert.Equal(t, serial, int64(20))
+}
+
+func TestClientCertificateEmail(t *testing.T) {
+	withEmail := &x509.Certificate{Subject: pkix.Name{CommonName: "Alice"}, EmailAddresses: []string{"alice@example.com"}}
+	withCommonName := &x509.Certificate{Subject: pkix.Name{CommonName: "bob@example.com"}}
+
+	tests := []struct {
+		name       string
+		cert       *x509.Certificate
+		commonName bool
+		wantEmail  string
+		wantOK     bool
+	}{
+		{"Email SAN", withEmail, false, "alice@example.com", true},
+		{"Email SAN over common name", withEmail, true, "alice@example.com", true},
+		{"Common name only", withCommonName, false, "", false},
+		{"Common name allowed", withCommonName, true, "bob@example.com", true},
+		{"No certificate", nil, true, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.TLS = &tls.ConnectionState{}
+			if tt.cert != nil {
+				r.TLS.VerifiedChains = [][]*x509.Certificate{{tt.cert}}
+			}
+
+			email, ok := clientCertificateEmail(r, tt.commonName)
+			assert.Equal(t, email, tt.wantEmail)
+			assert.Equal(t, ok, tt.wantOK)
+		})
+	}
+}
@@ -9,11 +9,13 @@ import (
 	"greenlight.bagerbach.com/internal/validator"
 )
 
+type createAuthenticationTokenInput struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
+	var input createAuthenticationTokenInput
 
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -31,7 +33,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -42,7 +44,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	match, err := user.Password.Matches(input.Password)
+	match, err := user.Password.Matches(r.Context(), input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -53,13 +55,101 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// With two-factor authentication on, the password only earns a short-lived token
+	// to send along with a TOTP code to createMFAAuthenticationTokenHandler.
+	credential, err := app.models.TOTP.Get(r.Context(), user.ID)
+	switch {
+	case err == nil && credential.Confirmed:
+		mfaToken, err := app.models.Tokens.New(r.Context(), user.ID, 5*time.Minute, data.ScopeMFA)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeResponse(w, r, http.StatusAccepted, envelope{"mfa_token": mfaToken}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	case err != nil && !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+type createMFAAuthenticationTokenInput struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// createMFAAuthenticationTokenHandler is the second step of logging in with
+// two-factor authentication: it exchanges the token issued for the password, and a
+// TOTP or recovery code, for an authentication token.
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input createMFAAuthenticationTokenInput
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.MFAToken != "", "mfa_token", "must be provided")
+	v.Check(len(input.MFAToken) == 26, "mfa_token", "must be 26 characters long")
+	validateSecondFactor(v, input.Code, input.RecoveryCode)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The MFA token is used up before the code is checked, whether or not it's
+	// right: a wrong code means starting over with the password, and concurrent
+	// requests can't each try a code with the same token, so codes can't be
+	// guessed on the strength of a single login.
+	userID, err := app.models.Tokens.Consume(r.Context(), data.ScopeMFA, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.checkSecondFactor(r.Context(), userID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), userID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+func TestCreateAuthenticationToken(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user := map[string]string{"name": "Alice", "email": "alice@example.com", "password": "pa55word1234"}
+	if code, _ := ts.do(t, http.MethodPost, "/v1/users", "", user, nil); code != http.StatusAccepted {
+		t.Fatalf("registering user: got status %d", code)
+	}
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		wantCode int
+	}{
+		{
+			name:     "Valid credentials",
+			email:    "alice@example.com",
+			password: "pa55word1234",
+			wantCode: http.StatusCreated,
+		},
+		{
+			name:     "Wrong password",
+			email:    "alice@example.com",
+			password: "wrongpa55word",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "Unknown email",
+			email:    "bob@example.com",
+			password: "pa55word1234",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "Invalid email",
+			email:    "alice",
+			password: "pa55word1234",
+			wantCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp struct {
+				Token struct {
+					Token string `json:"token"`
+				} `json:"authentication_token"`
+			}
+
+			code, _ := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": tt.email, "password": tt.password}, &resp)
+
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantCode != http.StatusCreated {
+				return
+			}
+
+			// The token authenticates its user.
+			code, _ = ts.do(t, http.MethodGet, "/v1/movies", resp.Token.Token, nil, nil)
+			assert.Equal(t, code, http.StatusForbidden) // Alice isn't activated
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/totp"
+	"greenlight.bagerbach.com/internal/validator"
+)
+
+// totpIssuer is the account issuer shown by authenticator apps.
+const totpIssuer = "Greenlight"
+
+type totpEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"` // Usually shown to the user as a QR code
+}
+
+// enrollTOTPHandler starts turning on two-factor authentication for the user with
+// a new secret. It isn't asked for at login until the user confirms it with a code
+// through confirmTOTPHandler; until then, enrolling again replaces the secret.
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.models.TOTP.Set(r.Context(), user.ID, secret); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v := validator.New()
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	enrollment := totpEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(secret, totpIssuer, user.Email),
+	}
+
+	if err := app.writeResponse(w, r, http.StatusCreated, envelope{"totp": enrollment}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+type confirmTOTPInput struct {
+	Code string `json:"code"`
+}
+
+// confirmTOTPHandler turns two-factor authentication on once the user has entered
+// a code from their authenticator app, and responds with their recovery codes. This
+// is the only time the recovery codes are shown.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input confirmTOTPInput
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if validateSecondFactor(v, input.Code, ""); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	credential, err := app.models.TOTP.Get(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if credential == nil || credential.Confirmed {
+		v.AddError("totp", "no two-factor authentication enrollment to confirm")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	step, ok := totp.Validate(credential.Secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	recoveryCodes, err := data.NewRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.models.TOTP.Confirm(r.Context(), user.ID, step, recoveryCodes); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"recovery_codes": recoveryCodes}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+type disableTOTPInput struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// disableTOTPHandler turns two-factor authentication off, given a TOTP or recovery
+// code, so a stolen authentication token isn't enough to do it.
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input disableTOTPInput
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if validateSecondFactor(v, input.Code, input.RecoveryCode); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	credential, err := app.models.TOTP.Get(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if credential == nil || !credential.Confirmed {
+		v.AddError("totp", "two-factor authentication is not enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ok, err := app.checkSecondFactor(r.Context(), user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := app.models.TOTP.Delete(r.Context(), user.ID); err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// validateSecondFactor checks that exactly one of a TOTP code and a recovery code
+// was given.
+func validateSecondFactor(v *validator.Validator, code, recoveryCode string) {
+	v.Check(code != "" || recoveryCode != "", "code", "must be provided")
+	v.Check(code == "" || recoveryCode == "", "recovery_code", "must not be provided together with code")
+	if code != "" {
+		v.Check(len(code) == totp.Digits, "code", "must be 6 digits long")
+	}
+}
+
+// checkSecondFactor reports whether the code (or, if it's empty, the recovery
+// code) is valid for the user's confirmed TOTP credential. Each TOTP code and
+// recovery code is only accepted once.
+func (app *application) checkSecondFactor(ctx context.Context, userID int64, code, recoveryCode string) (bool, error) {
+	if code == "" {
+		return app.models.TOTP.UseRecoveryCode(ctx, userID, recoveryCode)
+	}
+
+	credential, err := app.models.TOTP.Get(ctx, userID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	step, ok := totp.Validate(credential.Secret, code, time.Now())
+	if !ok || !credential.Confirmed {
+		return false, nil
+	}
+
+	return app.models.TOTP.UseStep(ctx, userID, step)
+}
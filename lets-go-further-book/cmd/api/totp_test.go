@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/totp"
+)
+
+func TestTwoFactorAuthentication(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	_, token := newTestUserWithPassword(t, app, "alice@example.com", "pa55word1234")
+	credentials := map[string]string{"email": "alice@example.com", "password": "pa55word1234"}
+
+	code := func(t *testing.T, secret string, step int64) string {
+		t.Helper()
+
+		c, err := totp.Code(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	type tokenResponse struct {
+		AuthenticationToken struct {
+			Token string `json:"token"`
+		} `json:"authentication_token"`
+		MFAToken struct {
+			Token string `json:"token"`
+		} `json:"mfa_token"`
+	}
+
+	// login sends the password, returning the MFA token it gets in exchange.
+	login := func(t *testing.T) string {
+		t.Helper()
+
+		var resp tokenResponse
+		status, _ := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", credentials, &resp)
+		assert.Equal(t, status, http.StatusAccepted)
+		assert.Equal(t, resp.AuthenticationToken.Token, "")
+		return resp.MFAToken.Token
+	}
+
+	var enrollment struct {
+		TOTP totpEnrollment `json:"totp"`
+	}
+	status, _ := ts.do(t, http.MethodPost, "/v1/users/me/totp", token, nil, &enrollment)
+	assert.Equal(t, status, http.StatusCreated)
+	assert.StringContains(t, enrollment.TOTP.ProvisioningURI, "otpauth://totp/Greenlight:alice@example.com?")
+
+	secret := enrollment.TOTP.Secret
+	now := totp.Step(time.Now())
+
+	// Until it's confirmed, the password is still enough to log in.
+	var resp tokenResponse
+	status, _ = ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", credentials, &resp)
+	assert.Equal(t, status, http.StatusCreated)
+
+	wrongCode := code(t, secret, now+10)
+	status, _ = ts.do(t, http.MethodPut, "/v1/users/me/totp", token, map[string]string{"code": wrongCode}, nil)
+	assert.Equal(t, status, http.StatusUnprocessableEntity)
+
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	status, _ = ts.do(t, http.MethodPut, "/v1/users/me/totp", token, map[string]string{"code": code(t, secret, now)}, &confirmed)
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, len(confirmed.RecoveryCodes), 10)
+
+	status, _ = ts.do(t, http.MethodPost, "/v1/users/me/totp", token, nil, nil)
+	assert.Equal(t, status, http.StatusUnprocessableEntity)
+
+	t.Run("TOTP code", func(t *testing.T) {
+		// exchange sends an MFA token and code, returning the response status and the
+		// authentication token, if there is one.
+		exchange := func(t *testing.T, mfaToken, code string) (int, string) {
+			t.Helper()
+
+			var resp tokenResponse
+			status, _ := ts.do(t, http.MethodPost, "/v1/tokens/mfa", "", map[string]string{"mfa_token": mfaToken, "code": code}, &resp)
+			return status, resp.AuthenticationToken.Token
+		}
+
+		// A wrong code ends the login, so every guess needs the password again.
+		mfaToken := login(t)
+		status, _ := exchange(t, mfaToken, wrongCode)
+		assert.Equal(t, status, http.StatusUnauthorized)
+		status, _ = exchange(t, mfaToken, code(t, secret, now+1))
+		assert.Equal(t, status, http.StatusUnauthorized)
+
+		// Code already used
+		status, _ = exchange(t, login(t), code(t, secret, now))
+		assert.Equal(t, status, http.StatusUnauthorized)
+
+		// Wrong MFA token
+		status, _ = exchange(t, token, code(t, secret, now+1))
+		assert.Equal(t, status, http.StatusUnauthorized)
+
+		mfaToken = login(t)
+		status, authenticationToken := exchange(t, mfaToken, code(t, secret, now+1))
+		assert.Equal(t, status, http.StatusCreated)
+
+		status, _ = ts.do(t, http.MethodGet, "/v1/users/me", authenticationToken, nil, nil)
+		assert.Equal(t, status, http.StatusOK)
+
+		// MFA token already used
+		status, _ = exchange(t, mfaToken, code(t, secret, now+1))
+		assert.Equal(t, status, http.StatusUnauthorized)
+	})
+
+	t.Run("Recovery code", func(t *testing.T) {
+		recoveryCode := confirmed.RecoveryCodes[0]
+
+		status, _ := ts.do(t, http.MethodPost, "/v1/tokens/mfa", "", map[string]string{"mfa_token": login(t), "recovery_code": recoveryCode}, nil)
+		assert.Equal(t, status, http.StatusCreated)
+
+		status, _ = ts.do(t, http.MethodPost, "/v1/tokens/mfa", "", map[string]string{"mfa_token": login(t), "recovery_code": recoveryCode}, nil)
+		assert.Equal(t, status, http.StatusUnauthorized)
+	})
+
+	t.Run("Concurrent codes", func(t *testing.T) {
+		// Every request has a valid recovery code, but they share one MFA token,
+		// which only one of them gets to use.
+		mfaToken := login(t)
+		codes := confirmed.RecoveryCodes[2:]
+
+		statuses := make(chan int, len(codes))
+		var wg sync.WaitGroup
+		for _, recoveryCode := range codes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				status, _ := ts.do(t, http.MethodPost, "/v1/tokens/mfa", "", map[string]string{"mfa_token": mfaToken, "recovery_code": recoveryCode}, nil)
+				statuses <- status
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+
+		created := 0
+		for status := range statuses {
+			if status == http.StatusCreated {
+				created++
+			} else {
+				assert.Equal(t, status, http.StatusUnauthorized)
+			}
+		}
+		assert.Equal(t, created, 1)
+	})
+
+	t.Run("Disable", func(t *testing.T) {
+		status, _ := ts.do(t, http.MethodDelete, "/v1/users/me/totp", token, map[string]string{"code": wrongCode}, nil)
+		assert.Equal(t, status, http.StatusUnprocessableEntity)
+
+		status, _ = ts.do(t, http.MethodDelete, "/v1/users/me/totp", token, map[string]string{"recovery_code": confirmed.RecoveryCodes[1]}, nil)
+		assert.Equal(t, status, http.StatusOK)
+
+		var resp tokenResponse
+		status, _ = ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", credentials, &resp)
+		assert.Equal(t, status, http.StatusCreated)
+		assert.Equal(t, resp.MFAToken.Token, "")
+	})
+}
@@ -2,19 +2,24 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/tracing"
 	"greenlight.bagerbach.com/internal/validator"
 )
 
+type registerUserInput struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
+	var input registerUserInput
 
 	if err := app.readJSON(w, r, &input); err != nil {
 		app.badRequestResponse(w, r, err)
@@ -27,7 +32,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Activated: false,
 	}
 
-	if err := user.Password.Set(input.Password); err != nil {
+	if err := user.Password.Set(r.Context(), input.Password); err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
@@ -39,7 +44,18 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	if err := app.models.Users.Insert(user); err != nil {
+	// The user and their membership of the default organization are created
+	// together, so a failure can't leave a user who belongs nowhere, and can't
+	// register again with the same email address.
+	tx, err := app.models.BeginTx(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	if err := app.models.Users.WithTx(tx).Insert(r.Context(), user); err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
 			v.AddError("email", "a user with this email address already exists")
@@ -50,37 +66,49 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	if err := app.models.Permissions.AddForUser(user.ID, "movies:read"); err != nil {
+	if app.config.users.defaultOrganization != 0 {
+		err := app.models.Organizations.WithTx(tx).SetMember(r.Context(), app.config.users.defaultOrganization, user.ID, app.config.users.defaultRole)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, "activation")
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, "activation")
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
+	ctx := tracing.Detach(r.Context())
+
+	app.background(fmt.Sprintf("send welcome email to user %d", user.ID), func() {
 		data := map[string]interface{}{
 			"activationToken": token.Plaintext,
 			"name":            user.Name,
 		}
 
-		if err := app.mailer.Send(user.Email, "user_welcome.tmpl", data); err != nil {
-			app.logger.Error("failed to send email", "error", err)
+		if err := app.mailer.Send(ctx, user.Email, "user_welcome.tmpl", data); err != nil {
+			app.logger.ErrorContext(ctx, "failed to send email", "error", err)
 		}
 	})
 
-	if err := app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil); err != nil {
+	if err := app.writeResponse(w, r, http.StatusAccepted, envelope{"user": user}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+type activateUserInput struct {
+	TokenPlaintext string `json:"token"`
+}
+
 func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		TokenPlaintext string `json:"token"`
-	}
+	var input activateUserInput
 
 	if err := app.readJSON(w, r, &input); err != nil {
 		app.badRequestResponse(w, r, err)
@@ -94,7 +122,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -108,23 +136,247 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	user.Activated = true
 
-	if err := app.models.Users.Update(user); err != nil {
+	if err := app.models.Users.Update(r.Context(), user); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+
+		}
+		return
+	}
+
+	if err := app.models.Tokens.DeleteAllForUser(r.Context(), user.ID, data.ScopeActivation); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserInput holds the fields to change; nil ones are left alone.
+type updateCurrentUserInput struct {
+	Name            *string `json:"name"`
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	CurrentPassword *string `json:"current_password"`
+}
+
+// updateCurrentUserHandler updates the authenticated user's profile. A new password
+// needs the current one. A new email address isn't used until the user confirms it
+// with the token we email to it, through confirmEmailChangeHandler.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input updateCurrentUserInput
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Password != nil {
+		v.Check(input.CurrentPassword != nil, "current_password", "must be provided to change the password")
+		if data.ValidatePasswordPlaintext(v, *input.Password); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		match, err := user.Password.Matches(r.Context(), *input.CurrentPassword)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !match {
+			v.AddError("current_password", "is incorrect")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		if err := user.Password.Set(r.Context(), *input.Password); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	emailChanged := input.Email != nil && *input.Email != user.Email
+	if emailChanged {
+		if data.ValidateEmail(v, *input.Email); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		_, err := app.models.Users.GetByEmail(r.Context(), *input.Email)
+		switch {
+		case err == nil:
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		case !errors.Is(err, data.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		user.PendingEmail = input.Email
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := app.models.Users.Update(r.Context(), user); err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if input.Password != nil {
+		// Whoever knew the old password may have signed in with it, so every other
+		// session ends. The one making the change stays signed in, unless it was
+		// authenticated by a client certificate rather than a token.
+		current, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := app.models.Tokens.DeleteAllForUserExcept(r.Context(), user.ID, data.ScopeAuthentication, current); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if emailChanged {
+		// Only the token for the latest address should work.
+		if err := app.models.Tokens.DeleteAllForUser(r.Context(), user.ID, data.ScopeEmailChange); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeEmailChange)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		ctx := tracing.Detach(r.Context())
+		recipient := *user.PendingEmail
+
+		app.background(fmt.Sprintf("send email change confirmation to user %d", user.ID), func() {
+			data := map[string]interface{}{
+				"emailChangeToken": token.Plaintext,
+				"name":             user.Name,
+			}
+
+			if err := app.mailer.Send(ctx, recipient, "email_change.tmpl", data); err != nil {
+				app.logger.ErrorContext(ctx, "failed to send email", "error", err)
+			}
+		})
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+type confirmEmailChangeInput struct {
+	TokenPlaintext string `json:"token"`
+}
+
+// confirmEmailChangeHandler makes a user's pending email address their email, given
+// the token sent to that address.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input confirmEmailChangeInput
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
+	if user.PendingEmail == nil {
+		v.AddError("token", "invalid or expired email change token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.Email = *user.PendingEmail
+	user.PendingEmail = nil
+
+	if err := app.models.Users.Update(r.Context(), user); err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	if err := app.models.Tokens.DeleteAllForUser(user.ID, data.ScopeActivation); err != nil {
+	if err := app.models.Tokens.DeleteAllForUser(r.Context(), user.ID, data.ScopeEmailChange); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler deletes the authenticated user's account, along with
+// their tokens and permissions.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if err := app.models.Users.Delete(r.Context(), user.ID); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil); err != nil {
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"message": "user successfully deleted"}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/data"
+)
+
+func TestRegisterUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	newTestUser(t, app, "taken@example.com")
+
+	tests := []struct {
+		name     string
+		user     map[string]string
+		wantCode int
+		wantErr  string
+	}{
+		{
+			name:     "Valid",
+			user:     map[string]string{"name": "Alice", "email": "alice@example.com", "password": "pa55word1234"},
+			wantCode: http.StatusAccepted,
+		},
+		{
+			name:     "Duplicate email",
+			user:     map[string]string{"name": "Bob", "email": "taken@example.com", "password": "pa55word1234"},
+			wantCode: http.StatusUnprocessableEntity,
+			wantErr:  "email",
+		},
+		{
+			name:     "Short password",
+			user:     map[string]string{"name": "Carol", "email": "carol@example.com", "password": "pa55"},
+			wantCode: http.StatusUnprocessableEntity,
+			wantErr:  "password",
+		},
+		{
+			name:     "Missing name",
+			user:     map[string]string{"email": "dave@example.com", "password": "pa55word1234"},
+			wantCode: http.StatusUnprocessableEntity,
+			wantErr:  "name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp struct {
+				User struct {
+					Email     string `json:"email"`
+					Activated bool   `json:"activated"`
+				} `json:"user"`
+				Error map[string]string `json:"error"`
+			}
+
+			code, _ := ts.do(t, http.MethodPost, "/v1/users", "", tt.user, &resp)
+
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantErr != "" {
+				_, ok := resp.Error[tt.wantErr]
+				assert.Equal(t, ok, true)
+				return
+			}
+
+			assert.Equal(t, resp.User.Email, tt.user["email"])
+			assert.Equal(t, resp.User.Activated, false)
+		})
+	}
+}
+
+func TestRegisterUserRollback(t *testing.T) {
+	app := newTestDBApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	// Without the role, the user can't join the default organization, so they
+	// mustn't be created either.
+	app.config.users.defaultRole = "missing"
+
+	user := map[string]string{"name": "Alice", "email": "alice@example.com", "password": "pa55word1234"}
+
+	code, _ := ts.do(t, http.MethodPost, "/v1/users", "", user, nil)
+	assert.Equal(t, code, http.StatusInternalServerError)
+
+	_, err := app.models.Users.GetByEmail(context.Background(), "alice@example.com")
+	assert.Equal(t, errors.Is(err, data.ErrRecordNotFound), true)
+
+	app.config.users.defaultRole = "viewer"
+
+	code, _ = ts.do(t, http.MethodPost, "/v1/users", "", user, nil)
+	assert.Equal(t, code, http.StatusAccepted)
+}
+
+func TestRegisterAndActivateUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user := map[string]string{"name": "Alice", "email": "alice@example.com", "password": "pa55word1234"}
+
+	code, _ := ts.do(t, http.MethodPost, "/v1/users", "", user, nil)
+	assert.Equal(t, code, http.StatusAccepted)
+
+	// The welcome email carrying the activation token is sent in the background.
+	waitForBackgroundTasks(t, app)
+
+	mail := app.mailer.(*testMailer).lastTo(t, "alice@example.com")
+	assert.Equal(t, mail.templateFile, "user_welcome.tmpl")
+	activationToken := mail.data.(map[string]interface{})["activationToken"].(string)
+
+	// Users can't log in to anything requiring activation before they're activated.
+	var tokenResp struct {
+		Token struct {
+			Token string `json:"token"`
+		} `json:"authentication_token"`
+	}
+	code, _ = ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": user["email"], "password": user["password"]}, &tokenResp)
+	assert.Equal(t, code, http.StatusCreated)
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/movies", tokenResp.Token.Token, nil, nil)
+	assert.Equal(t, code, http.StatusForbidden)
+
+	var activateResp struct {
+		User struct {
+			Activated bool `json:"activated"`
+		} `json:"user"`
+	}
+	code, _ = ts.do(t, http.MethodPut, "/v1/users/activated", "", map[string]string{"token": activationToken}, &activateResp)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, activateResp.User.Activated, true)
+
+	// New users are granted movies:read.
+	code, _ = ts.do(t, http.MethodGet, "/v1/movies", tokenResp.Token.Token, nil, nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	// Activation tokens can only be used once.
+	code, _ = ts.do(t, http.MethodPut, "/v1/users/activated", "", map[string]string{"token": activationToken}, nil)
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+}
+
+func TestCurrentUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, token := newTestUserWithPassword(t, app, "alice@example.com", "pa55word1234")
+
+	newTestUser(t, app, "bob@example.com")
+
+	type userResponse struct {
+		User struct {
+			Name         string `json:"name"`
+			Email        string `json:"email"`
+			PendingEmail string `json:"pending_email"`
+		} `json:"user"`
+		Error map[string]string `json:"error"`
+	}
+
+	var resp userResponse
+	code, _ := ts.do(t, http.MethodGet, "/v1/users/me", token, nil, &resp)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, resp.User.Email, "alice@example.com")
+
+	code, _ = ts.do(t, http.MethodGet, "/v1/users/me", "", nil, nil)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	t.Run("Name", func(t *testing.T) {
+		var resp userResponse
+		code, _ := ts.do(t, http.MethodPatch, "/v1/users/me", token, map[string]string{"name": "Alice Smith"}, &resp)
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, resp.User.Name, "Alice Smith")
+	})
+
+	t.Run("Password", func(t *testing.T) {
+		otherSession, err := app.models.Tokens.New(context.Background(), user.ID, time.Hour, data.ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name     string
+			body     map[string]string
+			wantCode int
+			wantErr  string
+		}{
+			{
+				name:     "Without current password",
+				body:     map[string]string{"password": "newpa55word"},
+				wantCode: http.StatusUnprocessableEntity,
+				wantErr:  "current_password",
+			},
+			{
+				name:     "Wrong current password",
+				body:     map[string]string{"password": "newpa55word", "current_password": "wrongpa55word"},
+				wantCode: http.StatusUnprocessableEntity,
+				wantErr:  "current_password",
+			},
+			{
+				name:     "Too short",
+				body:     map[string]string{"password": "short", "current_password": "pa55word1234"},
+				wantCode: http.StatusUnprocessableEntity,
+				wantErr:  "password",
+			},
+			{
+				name:     "Valid",
+				body:     map[string]string{"password": "newpa55word", "current_password": "pa55word1234"},
+				wantCode: http.StatusOK,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var resp userResponse
+				code, _ := ts.do(t, http.MethodPatch, "/v1/users/me", token, tt.body, &resp)
+				assert.Equal(t, code, tt.wantCode)
+				if tt.wantErr != "" {
+					_, ok := resp.Error[tt.wantErr]
+					assert.Equal(t, ok, true)
+				}
+			})
+		}
+
+		credentials := map[string]string{"email": "alice@example.com", "password": "newpa55word"}
+		code, _ := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", credentials, nil)
+		assert.Equal(t, code, http.StatusCreated)
+
+		// Changing the password ends every session but the current one.
+		code, _ = ts.do(t, http.MethodGet, "/v1/users/me", otherSession.Plaintext, nil, nil)
+		assert.Equal(t, code, http.StatusUnauthorized)
+		code, _ = ts.do(t, http.MethodGet, "/v1/users/me", token, nil, nil)
+		assert.Equal(t, code, http.StatusOK)
+	})
+
+	t.Run("Email", func(t *testing.T) {
+		var resp userResponse
+		code, _ := ts.do(t, http.MethodPatch, "/v1/users/me", token, map[string]string{"email": "bob@example.com"}, &resp)
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+		assert.Equal(t, resp.Error["email"], "a user with this email address already exists")
+
+		resp = userResponse{}
+		code, _ = ts.do(t, http.MethodPatch, "/v1/users/me", token, map[string]string{"email": "alice@example.org"}, &resp)
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, resp.User.Email, "alice@example.com")
+		assert.Equal(t, resp.User.PendingEmail, "alice@example.org")
+
+		waitForBackgroundTasks(t, app)
+
+		mail := app.mailer.(*testMailer).lastTo(t, "alice@example.org")
+		assert.Equal(t, mail.templateFile, "email_change.tmpl")
+		changeToken := mail.data.(map[string]interface{})["emailChangeToken"].(string)
+
+		resp = userResponse{}
+		code, _ = ts.do(t, http.MethodPut, "/v1/users/email", "", map[string]string{"token": changeToken}, &resp)
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, resp.User.Email, "alice@example.org")
+		assert.Equal(t, resp.User.PendingEmail, "")
+
+		code, _ = ts.do(t, http.MethodPut, "/v1/users/email", "", map[string]string{"token": changeToken}, nil)
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		code, _ := ts.do(t, http.MethodDelete, "/v1/users/me", token, nil, nil)
+		assert.Equal(t, code, http.StatusOK)
+
+		// The user's tokens were deleted with them.
+		code, _ = ts.do(t, http.MethodGet, "/v1/users/me", token, nil, nil)
+		assert.Equal(t, code, http.StatusUnauthorized)
+
+		permissions, err := app.models.Permissions.GetAllForUser(context.Background(), user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(permissions), 0)
+	})
+}
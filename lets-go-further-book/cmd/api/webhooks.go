@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"greenlight.bagerbach.com/internal/data"
+	"greenlight.bagerbach.com/internal/validator"
+	"greenlight.bagerbach.com/internal/webhook"
+)
+
+type createWebhookInput struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	EventTypes []string `json:"event_types"`
+}
+
+// webhookSubscriptions returns the webhook model for the organization the request
+// was resolved to by requireOrganizationPermission.
+func (app *application) webhookSubscriptions(r *http.Request) data.WebhookModelInterface {
+	return app.models.Webhooks.ForOrganization(app.contextGetOrganizationID(r))
+}
+
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input createWebhookInput
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	subscription := &data.WebhookSubscription{
+		URL:        input.URL,
+		Secret:     input.Secret,
+		EventTypes: input.EventTypes,
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhookSubscription(v, subscription, webhook.EventTypes, webhook.PublicHost); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := app.webhookSubscriptions(r).Insert(r.Context(), subscription); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", subscription.ID))
+
+	if err := app.writeResponse(w, r, http.StatusCreated, envelope{"webhook": subscription}, headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := app.webhookSubscriptions(r).GetAll(r.Context(), "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"webhooks": subscriptions}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := app.readWebhookSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"webhook": subscription}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if err := app.webhookSubscriptions(r).Delete(r.Context(), id); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := app.readWebhookSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	// Deliveries are always listed newest first, so "-id" is the only sort on offer.
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         "-id",
+		SortSafelist: []string{"-id"},
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveries(r.Context(), subscription.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// testWebhookHandler sends a webhook.test event to a subscription straight away,
+// without retries, and responds with the logged result of the attempt.
+func (app *application) testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := app.readWebhookSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	event, err := webhook.NewEvent(webhook.EventTest, envelope{"webhook": envelope{"id": subscription.ID}})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	client := app.webhooks
+	client.MaxAttempts = 1
+
+	delivery, err := app.deliverWebhook(r.Context(), client, subscription, event)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeResponse(w, r, http.StatusOK, envelope{"delivery": delivery}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) readWebhookSubscription(w http.ResponseWriter, r *http.Request) (*data.WebhookSubscription, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	subscription, err := app.webhookSubscriptions(r).Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return subscription, true
+}
+
+// publishEvent delivers an event to every subscription of the organization that is
+// registered for its type. The lookup and the deliveries (with their retries) run
+// as background tasks, so they don't hold up the request and are waited for during
+// graceful shutdown. They stay part of the trace in ctx, but aren't cancelled with
+// it; they are once the HTTP connections have drained at shutdown, so retries still
+// waiting for their turn are given up rather than keeping us from exiting.
+func (app *application) publishEvent(ctx context.Context, organizationID int64, eventType string, payload any) {
+	ctx = app.tasks.context(ctx)
+
+	app.background(fmt.Sprintf("publish %s event", eventType), func() {
+		subscriptions, err := app.models.Webhooks.ForOrganization(organizationID).GetAll(ctx, eventType)
+		if err != nil {
+			app.logger.ErrorContext(ctx, "failed to load webhook subscriptions", "event_type", eventType, "error", err)
+			return
+		}
+
+		if len(subscriptions) == 0 {
+			return
+		}
+
+		event, err := webhook.NewEvent(eventType, payload)
+		if err != nil {
+			app.logger.ErrorContext(ctx, "failed to create webhook event", "event_type", eventType, "error", err)
+			return
+		}
+
+		for _, subscription := range subscriptions {
+			app.background(fmt.Sprintf("deliver %s event to webhook %d", eventType, subscription.ID), func() {
+				_, err := app.deliverWebhook(ctx, app.webhooks, subscription, event)
+				switch {
+				case errors.Is(err, context.Canceled):
+					app.logger.WarnContext(ctx, "webhook delivery given up at shutdown", "webhook_id", subscription.ID, "event_id", event.ID)
+				case err != nil:
+					app.logger.ErrorContext(ctx, "failed to deliver webhook", "webhook_id", subscription.ID, "event_id", event.ID, "error", err)
+				}
+			})
+		}
+	})
+}
+
+// deliverWebhook delivers event to a subscription, recording every attempt in the
+// subscription's delivery log, and returns the log entry of the last attempt.
+func (app *application) deliverWebhook(ctx context.Context, client webhook.Client, subscription *data.WebhookSubscription, event webhook.Event) (*data.WebhookDelivery, error) {
+	var delivery *data.WebhookDelivery
+
+	_, err := client.Deliver(ctx, subscription.URL, subscription.Secret, event, func(attempt webhook.Attempt) {
+		delivery = &data.WebhookDelivery{
+			SubscriptionID: subscription.ID,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			Attempt:        attempt.Number,
+			StatusCode:     attempt.StatusCode,
+			Success:        attempt.Success(),
+			DurationMS:     attempt.Duration.Milliseconds(),
+		}
+		if attempt.Err != nil {
+			delivery.Error = attempt.Err.Error()
+		}
+
+		// An attempt cut short by shutdown is still recorded.
+		if err := app.models.Webhooks.InsertDelivery(context.WithoutCancel(ctx), delivery); err != nil {
+			app.logger.ErrorContext(ctx, "failed to record webhook delivery", "webhook_id", subscription.ID, "event_id", event.ID, "error", err)
+		}
+	})
+
+	return delivery, err
+}
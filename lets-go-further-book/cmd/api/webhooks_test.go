@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/webhook"
+)
+
+// recordingTransport answers every request with a 204, keeping the URLs requested.
+type recordingTransport struct {
+	mu   sync.Mutex
+	urls []string
+}
+
+func (rt *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.urls = append(rt.urls, r.URL.String())
+	return &http.Response{StatusCode: http.StatusNoContent, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+}
+
+func (rt *recordingTransport) requested() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	return slices.Sorted(slices.Values(rt.urls))
+}
+
+func TestCreateWebhook(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := newTestUser(t, app, "admin@example.com", "webhooks:manage")
+
+	tests := []struct {
+		name     string
+		url      string
+		wantCode int
+	}{
+		{"Public host", "https://hooks.example.com/greenlight", http.StatusCreated},
+		{"Loopback address", "http://127.0.0.1:8080/hook", http.StatusUnprocessableEntity},
+		{"Localhost", "http://localhost/hook", http.StatusUnprocessableEntity},
+		{"Private address", "http://10.0.0.5/hook", http.StatusUnprocessableEntity},
+		{"Cloud metadata", "http://169.254.169.254/latest/meta-data/", http.StatusUnprocessableEntity},
+		{"IPv6 loopback", "http://[::1]/hook", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]any{"url": tt.url, "secret": "a-very-secret-webhook-key", "event_types": []string{"movie.created"}}
+
+			code, _ := ts.do(t, http.MethodPost, "/v1/webhooks", token, body, nil)
+			assert.Equal(t, code, tt.wantCode)
+		})
+	}
+}
+
+func TestWebhookOrganizations(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	transport := &recordingTransport{}
+	app.webhooks = webhook.Client{HTTP: &http.Client{Transport: transport}, MaxAttempts: 1}
+
+	alice := newTestUser(t, app, "alice@example.com", "movies:write", "webhooks:manage")
+
+	// Bob manages webhooks in the organization he creates, as its admin.
+	bob := newTestUser(t, app, "bob@example.com")
+	acme := newTestOrganization(t, ts, bob, "Acme")
+
+	subscribe := func(token string, header http.Header, url string) string {
+		t.Helper()
+
+		var resp struct {
+			Webhook struct {
+				ID int64 `json:"id"`
+			} `json:"webhook"`
+		}
+		body := map[string]any{"url": url, "secret": "a-very-secret-webhook-key", "event_types": []string{"movie.created"}}
+		code, _ := ts.doWithHeader(t, http.MethodPost, "/v1/webhooks", token, header, body, &resp)
+		assert.Equal(t, code, http.StatusCreated)
+
+		return fmt.Sprintf("/v1/webhooks/%d", resp.Webhook.ID)
+	}
+
+	alicesWebhook := subscribe(alice, nil, "https://alice.example.com/hook")
+	bobsWebhook := subscribe(bob, xOrganization(acme), "https://bob.example.com/hook")
+
+	t.Run("Listed in their own organization only", func(t *testing.T) {
+		var resp struct {
+			Webhooks []struct {
+				URL string `json:"url"`
+			} `json:"webhooks"`
+		}
+		code, _ := ts.doWithHeader(t, http.MethodGet, "/v1/webhooks", bob, xOrganization(acme), nil, &resp)
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, len(resp.Webhooks), 1)
+		assert.Equal(t, resp.Webhooks[0].URL, "https://bob.example.com/hook")
+	})
+
+	t.Run("Not found from another organization", func(t *testing.T) {
+		code, _ := ts.doWithHeader(t, http.MethodGet, alicesWebhook, bob, xOrganization(acme), nil, nil)
+		assert.Equal(t, code, http.StatusNotFound)
+
+		code, _ = ts.doWithHeader(t, http.MethodDelete, alicesWebhook, bob, xOrganization(acme), nil, nil)
+		assert.Equal(t, code, http.StatusNotFound)
+
+		code, _ = ts.do(t, http.MethodPost, bobsWebhook+"/test", alice, nil, nil)
+		assert.Equal(t, code, http.StatusNotFound)
+	})
+
+	t.Run("Events delivered within the organization", func(t *testing.T) {
+		movie := map[string]any{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+
+		code, _ := ts.do(t, http.MethodPost, "/v1/movies", alice, movie, nil)
+		assert.Equal(t, code, http.StatusCreated)
+
+		waitForBackgroundTasks(t, app)
+		assert.Equal(t, strings.Join(transport.requested(), " "), "https://alice.example.com/hook")
+	})
+}
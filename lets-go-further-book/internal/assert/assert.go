@@ -0,0 +1,24 @@
+package assert
+
+import (
+	"strings"
+	"testing"
+)
+
+func Equal[T comparable](t *testing.T, got, want T) {
+	// Marks this as a helper, so failures are reported at the caller's line
+	// rather than in here.
+	t.Helper()
+
+	if got != want {
+		t.Errorf("got %v | want %v", got, want)
+	}
+}
+
+func StringContains(t *testing.T, s, substr string) {
+	t.Helper()
+
+	if !strings.Contains(s, substr) {
+		t.Errorf("expected %q to contain %q", s, substr)
+	}
+}
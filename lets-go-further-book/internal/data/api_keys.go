@@ -0,0 +1,245 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.bagerbach.com/internal/tracing"
+	"greenlight.bagerbach.com/internal/validator"
+)
+
+// APIKeyPrefix starts every API key, so they're easy to recognise (by secret
+// scanners, for one).
+const APIKeyPrefix = "glk_"
+
+// APIKey is a long-lived credential for machine clients, sent in an
+// "Authorization: ApiKey <key>" header. It only grants the permissions it was
+// created with, and only as long as its owner still has them.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Plaintext   string      `json:"key,omitempty"` // Only known, and shown, when the key is created
+	Prefix      string      `json:"prefix"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry,omitempty"`
+	LastUsedAt  *time.Time  `json:"last_used_at,omitempty"`
+}
+
+// Generate sets a new random key, along with its prefix and hash.
+func (k *APIKey) Generate() error {
+	randomBytes := make([]byte, 20)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return err
+	}
+
+	k.Plaintext = APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	k.Prefix = k.Plaintext[:len(APIKeyPrefix)+6]
+	k.Hash = HashAPIKey(k.Plaintext)
+
+	return nil
+}
+
+// Expired reports whether the key has an expiry that has passed.
+func (k *APIKey) Expired() bool {
+	return k.Expiry != nil && !k.Expiry.After(time.Now())
+}
+
+func HashAPIKey(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+// ValidateAPIKey checks a new key. Its permissions must be a subset of
+// ownerPermissions.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, ownerPermissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range key.Permissions {
+		v.Check(ownerPermissions.Include(code), "permissions", "you don't have the permission "+code)
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(strings.HasPrefix(plaintext, APIKeyPrefix), "key", "must start with "+APIKeyPrefix)
+	v.Check(len(plaintext) == len(APIKeyPrefix)+32, "key", "must be 36 characters long")
+}
+
+type APIKeyModelInterface interface {
+	Insert(ctx context.Context, key *APIKey) error
+	GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error)
+	GetForKey(ctx context.Context, plaintext string) (*APIKey, *User, error)
+	Delete(ctx context.Context, id, userID int64) error
+}
+
+type APIKeyModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Insert stores a key generated with Generate.
+func (m APIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	ctx, span := tracing.Start(ctx, "APIKeyModel.Insert")
+	defer span.End()
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []interface{}{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAllForUser returns the user's keys, expired ones included, oldest first.
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	ctx, span := tracing.Start(ctx, "APIKeyModel.GetAllForUser")
+	defer span.End()
+
+	query := `
+		SELECT id, created_at, user_id, name, prefix, permissions, expiry, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetForKey returns the unexpired key with the given plaintext and its owner,
+// recording that it was used.
+func (m APIKeyModel) GetForKey(ctx context.Context, plaintext string) (*APIKey, *User, error) {
+	ctx, span := tracing.Start(ctx, "APIKeyModel.GetForKey")
+	defer span.End()
+
+	query := `
+		WITH key AS (
+			UPDATE api_keys
+			SET last_used_at = NOW()
+			WHERE hash = $1 AND (expiry IS NULL OR expiry > NOW())
+			RETURNING id, created_at, user_id, name, prefix, permissions, expiry, last_used_at
+		)
+		SELECT key.id, key.created_at, key.user_id, key.name, key.prefix, key.permissions, key.expiry, key.last_used_at,
+			users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.pending_email, users.version
+		FROM key
+		INNER JOIN users ON users.id = key.user_id`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	var (
+		key  APIKey
+		user User
+	)
+
+	err := m.DB.QueryRowContext(ctx, query, HashAPIKey(plaintext)).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.PendingEmail,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &key, &user, nil
+}
+
+// Delete revokes one of the user's keys.
+func (m APIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	ctx, span := tracing.Start(ctx, "APIKeyModel.Delete")
+	defer span.End()
+
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package data
+
+import (
+	"greenlight.bagerbach.com/internal/validator"
+)
+
+// Fields is a sparse fieldset, the subset of a resource's JSON keys a client asked
+// for with the "fields" query string parameter. Like Filters.SortSafelist, each
+// resource supplies its own safelist of keys that may be requested.
+type Fields struct {
+	Requested []string
+	Safelist  []string
+}
+
+func ValidateFields(v *validator.Validator, f Fields) {
+	for _, field := range f.Requested {
+		v.Check(validator.PermittedValue(field, f.Safelist...), "fields", "invalid field: "+field)
+	}
+}
+
+// MovieFieldSafelist holds the JSON keys of Movie that can be requested as a sparse fieldset.
+var MovieFieldSafelist = []string{"id", "title", "year", "runtime", "genres", "version", "poster_updated_at"}
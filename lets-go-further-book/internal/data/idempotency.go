@@ -0,0 +1,181 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"greenlight.bagerbach.com/internal/tracing"
+)
+
+// IdempotencyRecord stores the response to a request sent with an Idempotency-Key
+// header, so retries of that request can be answered without running it again.
+type IdempotencyRecord struct {
+	Key            string
+	UserID         int64
+	OrganizationID int64 // 0 for requests outside organizations
+	Method         string
+	Path           string
+	Fingerprint    []byte
+	Status         int // 0 while the original request is still in progress
+	Header         map[string][]string
+	Body           []byte
+	Expiry         time.Time
+	// When the key was reserved, which tells this reservation apart from a later
+	// one of the same key once its lock has timed out.
+	LockedAt time.Time
+}
+
+func (r *IdempotencyRecord) InProgress() bool {
+	return r.Status == 0
+}
+
+type IdempotencyModelInterface interface {
+	Reserve(ctx context.Context, record *IdempotencyRecord, lockTimeout time.Duration) (bool, error)
+	Complete(ctx context.Context, record *IdempotencyRecord) error
+	Release(ctx context.Context, record *IdempotencyRecord) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type IdempotencyModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Reserve claims the record's key for a new request. It returns true if the key was
+// free, its previous record had expired, or the request holding it has been in
+// progress for longer than lockTimeout (so has presumably crashed). Otherwise it
+// returns false and fills record with the stored fingerprint, and the stored
+// response if there is one.
+func (m IdempotencyModel) Reserve(ctx context.Context, record *IdempotencyRecord, lockTimeout time.Duration) (bool, error) {
+	ctx, span := tracing.Start(ctx, "IdempotencyModel.Reserve")
+	defer span.End()
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	args := []interface{}{record.Key, record.UserID, record.OrganizationID, record.Method, record.Path}
+
+	deleteExpired := `
+		DELETE FROM idempotency_keys
+		WHERE key = $1 AND user_id = $2 AND organization_id = $3 AND method = $4 AND path = $5
+		AND (expiry < NOW() OR (status IS NULL AND locked_at < NOW() - make_interval(secs => $6)))`
+
+	if _, err := m.DB.ExecContext(ctx, deleteExpired, append(args, lockTimeout.Seconds())...); err != nil {
+		return false, err
+	}
+
+	// The primary key makes this atomic: of several concurrent requests with the same
+	// key, exactly one inserts the row and the others fall through to the SELECT.
+	insert := `
+		INSERT INTO idempotency_keys (key, user_id, organization_id, method, path, fingerprint, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT DO NOTHING
+		RETURNING locked_at`
+
+	err := m.DB.QueryRowContext(ctx, insert, append(args, record.Fingerprint, record.Expiry)...).Scan(&record.LockedAt)
+	switch {
+	case err == nil:
+		return true, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return false, err
+	}
+
+	query := `
+		SELECT fingerprint, status, headers, body, expiry
+		FROM idempotency_keys
+		WHERE key = $1 AND user_id = $2 AND organization_id = $3 AND method = $4 AND path = $5`
+
+	var (
+		status sql.NullInt64
+		header []byte
+	)
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&record.Fingerprint, &status, &header, &record.Body, &record.Expiry)
+	if err != nil {
+		switch {
+		// The other request released the key between our INSERT and SELECT.
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrEditConflict
+		default:
+			return false, err
+		}
+	}
+
+	record.Status = int(status.Int64)
+
+	if header != nil {
+		if err := json.Unmarshal(header, &record.Header); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// Complete stores the response for a reserved key. It does nothing if the
+// reservation timed out and the key was reserved again in the meantime.
+func (m IdempotencyModel) Complete(ctx context.Context, record *IdempotencyRecord) error {
+	ctx, span := tracing.Start(ctx, "IdempotencyModel.Complete")
+	defer span.End()
+
+	header, err := json.Marshal(record.Header)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET status = $1, headers = $2, body = $3
+		WHERE key = $4 AND user_id = $5 AND organization_id = $6 AND method = $7 AND path = $8 AND locked_at = $9`
+
+	args := []interface{}{record.Status, header, record.Body, record.Key, record.UserID, record.OrganizationID, record.Method, record.Path, record.LockedAt}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Release frees a reserved key without storing a response, so the client can retry.
+// Like Complete, it leaves a later reservation of the key alone.
+func (m IdempotencyModel) Release(ctx context.Context, record *IdempotencyRecord) error {
+	ctx, span := tracing.Start(ctx, "IdempotencyModel.Release")
+	defer span.End()
+
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE key = $1 AND user_id = $2 AND organization_id = $3 AND method = $4 AND path = $5 AND locked_at = $6`
+
+	args := []interface{}{record.Key, record.UserID, record.OrganizationID, record.Method, record.Path, record.LockedAt}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// DeleteExpired removes every record past its expiry, which Reserve would otherwise
+// only do for keys that are used again. It returns the number of records deleted.
+func (m IdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	ctx, span := tracing.Start(ctx, "IdempotencyModel.DeleteExpired")
+	defer span.End()
+
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expiry < NOW()`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,81 @@
+package mocks
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+type APIKeyModel struct {
+	store *store
+}
+
+func (m *APIKeyModel) Insert(ctx context.Context, key *data.APIKey) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	key.ID = m.store.nextID("api_keys")
+	key.CreatedAt = time.Now()
+
+	stored := *key
+	stored.Plaintext = ""
+	stored.Permissions = slices.Clone(key.Permissions)
+	m.store.apiKeys[key.ID] = stored
+	return nil
+}
+
+func (m *APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*data.APIKey, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	keys := []*data.APIKey{}
+	for _, id := range slices.Sorted(maps.Keys(m.store.apiKeys)) {
+		if key := m.store.apiKeys[id]; key.UserID == userID {
+			keys = append(keys, &key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (m *APIKeyModel) GetForKey(ctx context.Context, plaintext string) (*data.APIKey, *data.User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	hash := data.HashAPIKey(plaintext)
+
+	for id, key := range m.store.apiKeys {
+		if !bytes.Equal(key.Hash, hash) || key.Expired() {
+			continue
+		}
+
+		user, ok := m.store.users[key.UserID]
+		if !ok {
+			break
+		}
+
+		now := time.Now()
+		key.LastUsedAt = &now
+		m.store.apiKeys[id] = key
+
+		return &key, &user, nil
+	}
+
+	return nil, nil, data.ErrRecordNotFound
+}
+
+func (m *APIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if key, ok := m.store.apiKeys[id]; !ok || key.UserID != userID {
+		return data.ErrRecordNotFound
+	}
+
+	delete(m.store.apiKeys, id)
+	return nil
+}
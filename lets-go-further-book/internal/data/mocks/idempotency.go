@@ -0,0 +1,82 @@
+package mocks
+
+import (
+	"context"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+// idempotencyKey is the primary key of the idempotency_keys table.
+type idempotencyKey struct {
+	key            string
+	userID         int64
+	organizationID int64
+	method         string
+	path           string
+}
+
+func keyOf(record *data.IdempotencyRecord) idempotencyKey {
+	return idempotencyKey{record.Key, record.UserID, record.OrganizationID, record.Method, record.Path}
+}
+
+type IdempotencyModel struct {
+	store *store
+}
+
+func (m *IdempotencyModel) Reserve(ctx context.Context, record *data.IdempotencyRecord, lockTimeout time.Duration) (bool, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	stored, ok := m.store.idempotency[keyOf(record)]
+	stale := stored.InProgress() && time.Since(stored.LockedAt) > lockTimeout
+	if !ok || stored.Expiry.Before(time.Now()) || stale {
+		record.LockedAt = time.Now()
+		m.store.idempotency[keyOf(record)] = *record
+		return true, nil
+	}
+
+	record.Fingerprint = stored.Fingerprint
+	record.Status = stored.Status
+	record.Header = stored.Header
+	record.Body = stored.Body
+
+	return false, nil
+}
+
+func (m *IdempotencyModel) Complete(ctx context.Context, record *data.IdempotencyRecord) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if stored, ok := m.store.idempotency[keyOf(record)]; ok && stored.LockedAt.Equal(record.LockedAt) {
+		stored.Status = record.Status
+		stored.Header = record.Header
+		stored.Body = record.Body
+		m.store.idempotency[keyOf(record)] = stored
+	}
+	return nil
+}
+
+func (m *IdempotencyModel) Release(ctx context.Context, record *data.IdempotencyRecord) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if stored, ok := m.store.idempotency[keyOf(record)]; ok && stored.LockedAt.Equal(record.LockedAt) {
+		delete(m.store.idempotency, keyOf(record))
+	}
+	return nil
+}
+
+func (m *IdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var deleted int64
+	for key, stored := range m.store.idempotency {
+		if stored.Expiry.Before(time.Now()) {
+			delete(m.store.idempotency, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
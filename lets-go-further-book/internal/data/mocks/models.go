@@ -0,0 +1,99 @@
+// Package mocks implements the data models in memory, so handlers can be tested
+// without PostgreSQL. The models returned by NewModels share their data like the
+// tables do: UserModel.GetForToken finds the tokens created through TokenModel,
+// and MovieModel appends to the log read by MovieEventModel.
+package mocks
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+type store struct {
+	mu sync.Mutex
+
+	lastID        map[string]int64 // The last ID handed out for each table
+	movies        map[int64]data.Movie
+	movieEvents   []data.MovieEvent
+	users         map[int64]data.User
+	tokens        []data.Token
+	permissions   map[int64]data.Permissions
+	roles         []data.Role
+	userRoles     map[int64][]string
+	organizations []data.Organization
+	members       []member // In the order the users joined
+	totp          map[int64]data.TOTPCredential
+	recoveryCodes map[int64][][]byte
+	apiKeys       map[int64]data.APIKey
+	idempotency   map[idempotencyKey]data.IdempotencyRecord
+	webhooks      map[int64]data.WebhookSubscription
+	deliveries    []data.WebhookDelivery
+}
+
+// NewModels returns an empty set of in-memory models, apart from the roles and
+// the Default organization (ID 1) added by the migrations. BeginTx returns a
+// transaction that does nothing, which their WithTx methods ignore, and Ping and
+// Stats report on a database that isn't there.
+func NewModels() data.Models {
+	s := &store{
+		lastID:        map[string]int64{"organizations": 1},
+		movies:        make(map[int64]data.Movie),
+		users:         make(map[int64]data.User),
+		permissions:   make(map[int64]data.Permissions),
+		roles:         slices.Clone(defaultRoles),
+		userRoles:     make(map[int64][]string),
+		organizations: []data.Organization{{ID: 1, CreatedAt: time.Now(), Name: "Default"}},
+		totp:          make(map[int64]data.TOTPCredential),
+		recoveryCodes: make(map[int64][][]byte),
+		apiKeys:       make(map[int64]data.APIKey),
+		idempotency:   make(map[idempotencyKey]data.IdempotencyRecord),
+		webhooks:      make(map[int64]data.WebhookSubscription),
+	}
+
+	// The models returned by data.NewModels are replaced, keeping its connection
+	// pool for BeginTx.
+	models := data.NewModels(newDB(), nil, data.Timeouts{})
+	models.Movies = &MovieModel{store: s}
+	models.Users = &UserModel{store: s}
+	models.Tokens = &TokenModel{store: s}
+	models.Permissions = &PermissionModel{store: s}
+	models.Idempotency = &IdempotencyModel{store: s}
+	models.Webhooks = &WebhookModel{store: s}
+	models.MovieEvents = &MovieEventModel{store: s}
+	models.TOTP = &TOTPModel{store: s}
+	models.APIKeys = &APIKeyModel{store: s}
+	models.Roles = &RoleModel{store: s}
+	models.Organizations = &OrganizationModel{store: s}
+
+	return models
+}
+
+// nextID returns the next value of table's ID sequence. The caller must hold s.mu.
+func (s *store) nextID(table string) int64 {
+	s.lastID[table]++
+	return s.lastID[table]
+}
+
+// paginate returns the page of records selected by filters, along with its
+// metadata, the same way the SQL models' LIMIT and OFFSET do.
+func paginate[T any](records []T, filters data.Filters) ([]T, data.Metadata) {
+	if len(records) == 0 {
+		return []T{}, data.Metadata{}
+	}
+
+	metadata := data.Metadata{
+		CurrentPage:  filters.Page,
+		PageSize:     filters.PageSize,
+		FirstPage:    1,
+		LastPage:     (len(records) + filters.PageSize - 1) / filters.PageSize,
+		TotalRecords: len(records),
+	}
+
+	start := min((filters.Page-1)*filters.PageSize, len(records))
+	end := min(start+filters.PageSize, len(records))
+
+	return records[start:end], metadata
+}
@@ -0,0 +1,44 @@
+package mocks
+
+import (
+	"context"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+type MovieEventModel struct {
+	store *store
+}
+
+func (m *MovieEventModel) Bounds(ctx context.Context, organizationID int64) (oldest, latest int64, err error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	events := m.store.movieEvents
+	if len(events) == 0 {
+		return 0, 0, nil
+	}
+
+	for _, event := range events {
+		if event.Movie.OrganizationID == organizationID {
+			latest = event.ID
+		}
+	}
+
+	return events[0].ID, latest, nil
+}
+
+func (m *MovieEventModel) GetAfter(ctx context.Context, organizationID, id int64, limit int) ([]*data.MovieEvent, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	events := []*data.MovieEvent{}
+	for _, event := range m.store.movieEvents {
+		if event.ID > id && event.Movie.OrganizationID == organizationID && len(events) < limit {
+			event.Movie = copyMovie(*event.Movie)
+			events = append(events, &event)
+		}
+	}
+
+	return events, nil
+}
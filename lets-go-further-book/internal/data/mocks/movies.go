@@ -0,0 +1,194 @@
+package mocks
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+// MovieModel only sees the movies of its organization, like the SQL model.
+type MovieModel struct {
+	store          *store
+	organizationID int64
+}
+
+// WithTx returns the model itself: the in-memory models don't have transactions,
+// so nothing is rolled back.
+func (m *MovieModel) WithTx(tx *sql.Tx) data.MovieModelInterface {
+	return m
+}
+
+func (m *MovieModel) ForOrganization(organizationID int64) data.MovieModelInterface {
+	return &MovieModel{store: m.store, organizationID: organizationID}
+}
+
+func (m *MovieModel) Insert(ctx context.Context, movie *data.Movie) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	movie.ID = m.store.nextID("movies")
+	movie.OrganizationID = m.organizationID
+	movie.CreatedAt = time.Now()
+	movie.Version = 1
+
+	m.save("movie.created", movie)
+	return nil
+}
+
+func (m *MovieModel) Get(ctx context.Context, id int64) (*data.Movie, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	movie, ok := m.get(id)
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return copyMovie(movie), nil
+}
+
+func (m *MovieModel) Update(ctx context.Context, movie *data.Movie) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	stored, ok := m.get(movie.ID)
+	if !ok || stored.Version != movie.Version {
+		return data.ErrEditConflict
+	}
+
+	movie.OrganizationID = stored.OrganizationID
+	movie.Version++
+
+	m.save("movie.updated", movie)
+	return nil
+}
+
+func (m *MovieModel) UpdatePoster(ctx context.Context, movie *data.Movie, upload string) (string, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	stored, ok := m.get(movie.ID)
+	if !ok {
+		return "", data.ErrRecordNotFound
+	}
+
+	previous := stored.PosterUpload
+
+	now := time.Now().Truncate(time.Second)
+	stored.PosterUpdatedAt, stored.PosterUpload = &now, upload
+	movie.PosterUpdatedAt, movie.PosterUpload = &now, upload
+
+	// Like the version, the event log is left alone: a new poster isn't an edit.
+	m.store.movies[movie.ID] = stored
+	return previous, nil
+}
+
+func (m *MovieModel) Delete(ctx context.Context, id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	movie, ok := m.get(id)
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+
+	delete(m.store.movies, id)
+	m.logEvent("movie.deleted", &movie)
+	return nil
+}
+
+// GetAll matches title against whole words of the titles, ignoring case, which is
+// close enough to the full-text search of the SQL model.
+func (m *MovieModel) GetAll(ctx context.Context, title string, genres []string, filters data.Filters) ([]*data.Movie, data.Metadata, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	words := strings.Fields(strings.ToLower(title))
+
+	var movies []*data.Movie
+	for _, movie := range m.store.movies {
+		if movie.OrganizationID != m.organizationID {
+			continue
+		}
+		titleWords := strings.Fields(strings.ToLower(movie.Title))
+		if !containsAll(titleWords, words) {
+			continue
+		}
+		if len(genres) > 0 && !slices.ContainsFunc(genres, func(genre string) bool {
+			return slices.Contains(movie.Genres, genre)
+		}) {
+			continue
+		}
+		movies = append(movies, copyMovie(movie))
+	}
+
+	column, descending := strings.CutPrefix(filters.Sort, "-")
+	slices.SortFunc(movies, func(a, b *data.Movie) int {
+		var c int
+		switch column {
+		case "title":
+			c = cmp.Compare(a.Title, b.Title)
+		case "year":
+			c = cmp.Compare(a.Year, b.Year)
+		case "runtime":
+			c = cmp.Compare(a.Runtime, b.Runtime)
+		default:
+			c = cmp.Compare(a.ID, b.ID)
+		}
+		if descending {
+			c = -c
+		}
+		return cmp.Or(c, cmp.Compare(a.ID, b.ID))
+	})
+
+	movies, metadata := paginate(movies, filters)
+	return movies, metadata, nil
+}
+
+// get returns the movie with the given ID, if it belongs to the model's
+// organization. The caller must hold the store's lock.
+func (m *MovieModel) get(id int64) (data.Movie, bool) {
+	movie, ok := m.store.movies[id]
+	if !ok || movie.OrganizationID != m.organizationID {
+		return data.Movie{}, false
+	}
+
+	return movie, true
+}
+
+// save stores a copy of movie and logs the change like the movies table trigger
+// does. The caller must hold the store's lock.
+func (m *MovieModel) save(eventType string, movie *data.Movie) {
+	m.store.movies[movie.ID] = *copyMovie(*movie)
+	m.logEvent(eventType, movie)
+}
+
+func (m *MovieModel) logEvent(eventType string, movie *data.Movie) {
+	m.store.movieEvents = append(m.store.movieEvents, data.MovieEvent{
+		ID:        m.store.nextID("movie_events"),
+		CreatedAt: time.Now(),
+		Type:      eventType,
+		Movie:     copyMovie(*movie),
+	})
+}
+
+// copyMovie returns a copy of movie that doesn't share its genres, so callers can't
+// change the stored movie.
+func copyMovie(movie data.Movie) *data.Movie {
+	movie.Genres = slices.Clone(movie.Genres)
+	return &movie
+}
+
+func containsAll(haystack, needles []string) bool {
+	for _, needle := range needles {
+		if !slices.Contains(haystack, needle) {
+			return false
+		}
+	}
+	return true
+}
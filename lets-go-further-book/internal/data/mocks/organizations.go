@@ -0,0 +1,185 @@
+package mocks
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+type member struct {
+	organizationID int64
+	userID         int64
+	role           string
+	permissions    data.Permissions // Granted with PermissionModel.AddForMember
+}
+
+type OrganizationModel struct {
+	store *store
+}
+
+// WithTx returns the model itself: the in-memory models don't have transactions,
+// so nothing is rolled back.
+func (m *OrganizationModel) WithTx(tx *sql.Tx) data.OrganizationModelInterface {
+	return m
+}
+
+func (m *OrganizationModel) Insert(ctx context.Context, organization *data.Organization, ownerID int64, ownerRole string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, ok := m.store.users[ownerID]; !ok {
+		return data.ErrRecordNotFound
+	}
+	if _, ok := m.store.role(ownerRole); !ok {
+		return data.ErrRecordNotFound
+	}
+
+	organization.ID = m.store.nextID("organizations")
+	organization.CreatedAt = time.Now()
+	organization.Role = ownerRole
+
+	m.store.organizations = append(m.store.organizations, data.Organization{
+		ID:        organization.ID,
+		CreatedAt: organization.CreatedAt,
+		Name:      organization.Name,
+	})
+	m.store.members = append(m.store.members, member{organizationID: organization.ID, userID: ownerID, role: ownerRole})
+
+	return nil
+}
+
+func (m *OrganizationModel) Get(ctx context.Context, id int64) (*data.Organization, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	organization, ok := m.store.organization(id)
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return &organization, nil
+}
+
+func (m *OrganizationModel) GetAllForUser(ctx context.Context, userID int64) ([]*data.Organization, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	organizations := []*data.Organization{}
+	for _, member := range m.store.members {
+		if member.userID != userID {
+			continue
+		}
+		organization, _ := m.store.organization(member.organizationID)
+		organization.Role = member.role
+		organizations = append(organizations, &organization)
+	}
+
+	return organizations, nil
+}
+
+func (m *OrganizationModel) GetMembers(ctx context.Context, organizationID int64) ([]*data.OrganizationMember, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	members := []*data.OrganizationMember{}
+	for _, member := range m.store.members {
+		if member.organizationID != organizationID {
+			continue
+		}
+		user := m.store.users[member.userID]
+		members = append(members, &data.OrganizationMember{
+			UserID: user.ID,
+			Name:   user.Name,
+			Email:  user.Email,
+			Role:   member.role,
+		})
+	}
+
+	return members, nil
+}
+
+func (m *OrganizationModel) SetMember(ctx context.Context, organizationID, userID int64, role string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, ok := m.store.organization(organizationID); !ok {
+		return data.ErrRecordNotFound
+	}
+	if _, ok := m.store.users[userID]; !ok {
+		return data.ErrRecordNotFound
+	}
+	if _, ok := m.store.role(role); role != "" && !ok {
+		return data.ErrRecordNotFound
+	}
+
+	if i, ok := m.store.member(organizationID, userID); ok {
+		before := m.store.managers(organizationID)
+		previous := m.store.members[i].role
+		m.store.members[i].role = role
+		if before > 0 && m.store.managers(organizationID) == 0 {
+			m.store.members[i].role = previous
+			return data.ErrLastManager
+		}
+		return nil
+	}
+
+	m.store.members = append(m.store.members, member{organizationID: organizationID, userID: userID, role: role})
+	return nil
+}
+
+func (m *OrganizationModel) RemoveMember(ctx context.Context, organizationID, userID int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	i, ok := m.store.member(organizationID, userID)
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+
+	before := m.store.managers(organizationID)
+	removed := m.store.members[i]
+	m.store.members = slices.Delete(m.store.members, i, i+1)
+	if before > 0 && m.store.managers(organizationID) == 0 {
+		m.store.members = slices.Insert(m.store.members, i, removed)
+		return data.ErrLastManager
+	}
+	return nil
+}
+
+// organization returns the organization with the given ID. The caller must hold
+// s.mu.
+func (s *store) organization(id int64) (data.Organization, bool) {
+	i := slices.IndexFunc(s.organizations, func(organization data.Organization) bool {
+		return organization.ID == id
+	})
+	if i < 0 {
+		return data.Organization{}, false
+	}
+
+	return s.organizations[i], true
+}
+
+// managers returns the number of the organization's members with roles:manage in
+// it. The caller must hold s.mu.
+func (s *store) managers(organizationID int64) int {
+	count := 0
+	for _, member := range s.members {
+		role, _ := s.role(member.role)
+		if member.organizationID == organizationID && (role.Permissions.Include("roles:manage") || member.permissions.Include("roles:manage")) {
+			count++
+		}
+	}
+	return count
+}
+
+// member returns the index of the user's membership of the organization in
+// s.members. The caller must hold s.mu.
+func (s *store) member(organizationID, userID int64) (int, bool) {
+	i := slices.IndexFunc(s.members, func(member member) bool {
+		return member.organizationID == organizationID && member.userID == userID
+	})
+	return i, i >= 0
+}
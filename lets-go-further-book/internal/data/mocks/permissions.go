@@ -0,0 +1,85 @@
+package mocks
+
+import (
+	"context"
+	"slices"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+type PermissionModel struct {
+	store *store
+}
+
+// GetAllForUser returns the permissions granted to the user directly, followed by
+// those of their roles.
+func (m *PermissionModel) GetAllForUser(ctx context.Context, userID int64) (data.Permissions, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	permissions := slices.Clone(m.store.permissions[userID])
+	for _, name := range m.store.userRoles[userID] {
+		role, _ := m.store.role(name)
+		for _, code := range role.Permissions {
+			if !permissions.Include(code) {
+				permissions = append(permissions, code)
+			}
+		}
+	}
+
+	return permissions, nil
+}
+
+// GetAllForMember returns the permissions of the user's role in the organization,
+// followed by those granted to them in it.
+func (m *PermissionModel) GetAllForMember(ctx context.Context, organizationID, userID int64) (data.Permissions, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	i, ok := m.store.member(organizationID, userID)
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	role, _ := m.store.role(m.store.members[i].role)
+	permissions := slices.Clone(role.Permissions)
+	for _, code := range m.store.members[i].permissions {
+		if !permissions.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	return permissions, nil
+}
+
+// AddForUser grants any code, where the SQL model only grants the codes in the
+// permissions table.
+func (m *PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for _, code := range codes {
+		if !m.store.permissions[userID].Include(code) {
+			m.store.permissions[userID] = append(m.store.permissions[userID], code)
+		}
+	}
+	return nil
+}
+
+// AddForMember grants any code, like AddForUser.
+func (m *PermissionModel) AddForMember(ctx context.Context, organizationID, userID int64, codes ...string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	i, ok := m.store.member(organizationID, userID)
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+
+	for _, code := range codes {
+		if !m.store.members[i].permissions.Include(code) {
+			m.store.members[i].permissions = append(m.store.members[i].permissions, code)
+		}
+	}
+	return nil
+}
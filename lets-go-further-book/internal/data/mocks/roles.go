@@ -0,0 +1,90 @@
+package mocks
+
+import (
+	"context"
+	"slices"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+// defaultRoles are the roles created by the migrations.
+var defaultRoles = []data.Role{
+	{Name: "viewer", Permissions: data.Permissions{"movies:read"}},
+	{Name: "editor", Permissions: data.Permissions{"movies:read", "movies:write"}},
+	{Name: "admin", Permissions: data.Permissions{"movies:read", "movies:write", "roles:manage", "webhooks:manage"}},
+}
+
+type RoleModel struct {
+	store *store
+}
+
+func (m *RoleModel) GetAll(ctx context.Context) ([]*data.Role, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	roles := []*data.Role{}
+	for _, role := range m.store.roles {
+		role.Permissions = slices.Clone(role.Permissions)
+		roles = append(roles, &role)
+	}
+
+	return roles, nil
+}
+
+func (m *RoleModel) Get(ctx context.Context, name string) (*data.Role, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	role, ok := m.store.role(name)
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	role.Permissions = slices.Clone(role.Permissions)
+	return &role, nil
+}
+
+func (m *RoleModel) GetAllForUser(ctx context.Context, userID int64) ([]string, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, ok := m.store.users[userID]; !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return slices.Clone(m.store.userRoles[userID]), nil
+}
+
+func (m *RoleModel) SetForUser(ctx context.Context, userID int64, names ...string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, ok := m.store.users[userID]; !ok {
+		return data.ErrRecordNotFound
+	}
+
+	var roles []string
+	for _, role := range m.store.roles {
+		if slices.Contains(names, role.Name) {
+			roles = append(roles, role.Name)
+		}
+	}
+	if len(roles) != len(names) {
+		return data.ErrRecordNotFound
+	}
+
+	m.store.userRoles[userID] = roles
+	return nil
+}
+
+// role returns the named role. The caller must hold s.mu.
+func (s *store) role(name string) (data.Role, bool) {
+	i := slices.IndexFunc(s.roles, func(role data.Role) bool {
+		return role.Name == name
+	})
+	if i < 0 {
+		return data.Role{}, false
+	}
+
+	return s.roles[i], true
+}
@@ -0,0 +1,88 @@
+package mocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"slices"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+type TokenModel struct {
+	store *store
+}
+
+// New creates a token in the same format as the real model, so it passes
+// data.ValidateTokenPlaintext.
+func (m *TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, err
+	}
+
+	token := &data.Token{
+		Plaintext: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes),
+		UserID:    userID,
+		Expiry:    time.Now().Add(ttl),
+		Scope:     scope,
+	}
+
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	err := m.Insert(ctx, token)
+	return token, err
+}
+
+func (m *TokenModel) Insert(ctx context.Context, token *data.Token) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.tokens = append(m.store.tokens, *token)
+	return nil
+}
+
+func (m *TokenModel) Consume(ctx context.Context, scope, tokenPlaintext string) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	i := slices.IndexFunc(m.store.tokens, func(token data.Token) bool {
+		return bytes.Equal(token.Hash, hash[:]) && token.Scope == scope && token.Expiry.After(time.Now())
+	})
+	if i < 0 {
+		return 0, data.ErrRecordNotFound
+	}
+
+	userID := m.store.tokens[i].UserID
+	m.store.tokens = slices.Delete(m.store.tokens, i, i+1)
+
+	return userID, nil
+}
+
+func (m *TokenModel) DeleteAllForUser(ctx context.Context, userID int64, scope string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.tokens = slices.DeleteFunc(m.store.tokens, func(token data.Token) bool {
+		return token.UserID == userID && token.Scope == scope
+	})
+	return nil
+}
+
+func (m *TokenModel) DeleteAllForUserExcept(ctx context.Context, userID int64, scope, tokenPlaintext string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	m.store.tokens = slices.DeleteFunc(m.store.tokens, func(token data.Token) bool {
+		return token.UserID == userID && token.Scope == scope && !bytes.Equal(token.Hash, hash[:])
+	})
+	return nil
+}
@@ -0,0 +1,103 @@
+package mocks
+
+import (
+	"bytes"
+	"context"
+	"slices"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+type TOTPModel struct {
+	store *store
+}
+
+func (m *TOTPModel) Get(ctx context.Context, userID int64) (*data.TOTPCredential, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	credential, ok := m.store.totp[userID]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return &credential, nil
+}
+
+func (m *TOTPModel) Set(ctx context.Context, userID int64, secret string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if m.store.totp[userID].Confirmed {
+		return data.ErrEditConflict
+	}
+
+	m.store.totp[userID] = data.TOTPCredential{UserID: userID, Secret: secret}
+	return nil
+}
+
+func (m *TOTPModel) Confirm(ctx context.Context, userID int64, step int64, recoveryCodes []string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	credential, ok := m.store.totp[userID]
+	if !ok || credential.Confirmed {
+		return data.ErrEditConflict
+	}
+
+	credential.Confirmed = true
+	credential.LastUsedStep = step
+	m.store.totp[userID] = credential
+
+	m.store.recoveryCodes[userID] = nil
+	for _, code := range recoveryCodes {
+		m.store.recoveryCodes[userID] = append(m.store.recoveryCodes[userID], data.HashRecoveryCode(code))
+	}
+
+	return nil
+}
+
+func (m *TOTPModel) UseStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	credential, ok := m.store.totp[userID]
+	if !ok || !credential.Confirmed || credential.LastUsedStep >= step {
+		return false, nil
+	}
+
+	credential.LastUsedStep = step
+	m.store.totp[userID] = credential
+	return true, nil
+}
+
+func (m *TOTPModel) UseRecoveryCode(ctx context.Context, userID int64, code string) (bool, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	hash := data.HashRecoveryCode(code)
+	codes := m.store.recoveryCodes[userID]
+
+	i := slices.IndexFunc(codes, func(stored []byte) bool {
+		return bytes.Equal(stored, hash)
+	})
+	if i < 0 {
+		return false, nil
+	}
+
+	m.store.recoveryCodes[userID] = slices.Delete(codes, i, i+1)
+	return true, nil
+}
+
+func (m *TOTPModel) Delete(ctx context.Context, userID int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, ok := m.store.totp[userID]; !ok {
+		return data.ErrRecordNotFound
+	}
+
+	delete(m.store.totp, userID)
+	delete(m.store.recoveryCodes, userID)
+	return nil
+}
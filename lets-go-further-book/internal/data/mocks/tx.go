@@ -0,0 +1,48 @@
+package mocks
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+)
+
+// newDB returns a connection pool whose transactions do nothing, so handlers can
+// call Models.BeginTx and hand the transaction to the in-memory models' WithTx
+// methods, which ignore it. Queries fail: the models never make any.
+func newDB() *sql.DB {
+	return sql.OpenDB(connector{})
+}
+
+type connector struct{}
+
+func (c connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return conn{}, nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return c
+}
+
+func (c connector) Open(name string) (driver.Conn, error) {
+	return conn{}, nil
+}
+
+type conn struct{}
+
+func (conn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("mocks: the in-memory models have no database to query")
+}
+
+func (conn) Close() error {
+	return nil
+}
+
+func (conn) Begin() (driver.Tx, error) {
+	return tx{}, nil
+}
+
+type tx struct{}
+
+func (tx) Commit() error   { return nil }
+func (tx) Rollback() error { return nil }
@@ -0,0 +1,127 @@
+package mocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"maps"
+	"slices"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+type UserModel struct {
+	store *store
+}
+
+// WithTx returns the model itself: the in-memory models don't have transactions,
+// so nothing is rolled back.
+func (m *UserModel) WithTx(tx *sql.Tx) data.UserModelInterface {
+	return m
+}
+
+func (m *UserModel) Insert(ctx context.Context, user *data.User) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if m.emailTaken(user.Email, 0) {
+		return data.ErrDuplicateEmail
+	}
+
+	user.ID = m.store.nextID("users")
+	user.CreatedAt = time.Now()
+	user.Version = 1
+
+	m.store.users[user.ID] = *user
+	return nil
+}
+
+func (m *UserModel) GetByEmail(ctx context.Context, email string) (*data.User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for _, user := range m.store.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+func (m *UserModel) Update(ctx context.Context, user *data.User) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if m.emailTaken(user.Email, user.ID) {
+		return data.ErrDuplicateEmail
+	}
+
+	stored, ok := m.store.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return data.ErrEditConflict
+	}
+
+	user.Version++
+
+	m.store.users[user.ID] = *user
+	return nil
+}
+
+func (m *UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*data.User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	for _, token := range m.store.tokens {
+		if bytes.Equal(token.Hash, tokenHash[:]) && token.Scope == tokenScope && token.Expiry.After(time.Now()) {
+			if user, ok := m.store.users[token.UserID]; ok {
+				return &user, nil
+			}
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+// Delete deletes the user along with their tokens, permissions, roles, TOTP
+// credentials and API keys, like the foreign keys do.
+func (m *UserModel) Delete(ctx context.Context, id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, ok := m.store.users[id]; !ok {
+		return data.ErrRecordNotFound
+	}
+
+	delete(m.store.users, id)
+	delete(m.store.permissions, id)
+	delete(m.store.userRoles, id)
+	delete(m.store.totp, id)
+	delete(m.store.recoveryCodes, id)
+	m.store.tokens = slices.DeleteFunc(m.store.tokens, func(token data.Token) bool {
+		return token.UserID == id
+	})
+	maps.DeleteFunc(m.store.apiKeys, func(_ int64, key data.APIKey) bool {
+		return key.UserID == id
+	})
+	m.store.members = slices.DeleteFunc(m.store.members, func(member member) bool {
+		return member.userID == id
+	})
+
+	return nil
+}
+
+// emailTaken reports whether a user other than the one with the given ID has the
+// email address. The caller must hold the store's lock.
+func (m *UserModel) emailTaken(email string, id int64) bool {
+	for _, user := range m.store.users {
+		if user.Email == email && user.ID != id {
+			return true
+		}
+	}
+	return false
+}
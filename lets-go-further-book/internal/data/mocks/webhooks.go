@@ -0,0 +1,116 @@
+package mocks
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"greenlight.bagerbach.com/internal/data"
+)
+
+// WebhookModel only sees the subscriptions of its organization, like the SQL model.
+type WebhookModel struct {
+	store          *store
+	organizationID int64
+}
+
+func (m *WebhookModel) ForOrganization(organizationID int64) data.WebhookModelInterface {
+	return &WebhookModel{store: m.store, organizationID: organizationID}
+}
+
+func (m *WebhookModel) Insert(ctx context.Context, subscription *data.WebhookSubscription) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	subscription.ID = m.store.nextID("webhooks")
+	subscription.OrganizationID = m.organizationID
+	subscription.CreatedAt = time.Now()
+	subscription.Version = 1
+
+	m.store.webhooks[subscription.ID] = *copySubscription(*subscription)
+	return nil
+}
+
+func (m *WebhookModel) Get(ctx context.Context, id int64) (*data.WebhookSubscription, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	subscription, ok := m.store.webhooks[id]
+	if !ok || subscription.OrganizationID != m.organizationID {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return copySubscription(subscription), nil
+}
+
+func (m *WebhookModel) GetAll(ctx context.Context, eventType string) ([]*data.WebhookSubscription, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	subscriptions := []*data.WebhookSubscription{}
+	for _, id := range slices.Sorted(maps.Keys(m.store.webhooks)) {
+		subscription := m.store.webhooks[id]
+		if subscription.OrganizationID != m.organizationID {
+			continue
+		}
+		if eventType == "" || slices.Contains(subscription.EventTypes, eventType) {
+			subscriptions = append(subscriptions, copySubscription(subscription))
+		}
+	}
+
+	return subscriptions, nil
+}
+
+func (m *WebhookModel) Delete(ctx context.Context, id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if subscription, ok := m.store.webhooks[id]; !ok || subscription.OrganizationID != m.organizationID {
+		return data.ErrRecordNotFound
+	}
+
+	delete(m.store.webhooks, id)
+	m.store.deliveries = slices.DeleteFunc(m.store.deliveries, func(delivery data.WebhookDelivery) bool {
+		return delivery.SubscriptionID == id
+	})
+	return nil
+}
+
+func (m *WebhookModel) InsertDelivery(ctx context.Context, delivery *data.WebhookDelivery) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	delivery.ID = m.store.nextID("webhook_deliveries")
+	delivery.CreatedAt = time.Now()
+
+	m.store.deliveries = append(m.store.deliveries, *delivery)
+	return nil
+}
+
+// GetDeliveries returns the newest deliveries first, which is the only order the
+// SQL model supports.
+func (m *WebhookModel) GetDeliveries(ctx context.Context, subscriptionID int64, filters data.Filters) ([]*data.WebhookDelivery, data.Metadata, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var deliveries []*data.WebhookDelivery
+	for _, delivery := range m.store.deliveries {
+		if delivery.SubscriptionID == subscriptionID {
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+
+	slices.SortFunc(deliveries, func(a, b *data.WebhookDelivery) int {
+		return cmp.Compare(b.ID, a.ID)
+	})
+
+	deliveries, metadata := paginate(deliveries, filters)
+	return deliveries, metadata, nil
+}
+
+func copySubscription(subscription data.WebhookSubscription) *data.WebhookSubscription {
+	subscription.EventTypes = slices.Clone(subscription.EventTypes)
+	return &subscription
+}
@@ -1,8 +1,12 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 var (
@@ -10,18 +14,166 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// DBTX is the set of methods shared by *sql.DB and *sql.Tx. Models that hold a
+// DBTX can run the same queries either against the pool or inside a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// inTx runs fn inside a transaction: db itself, if it's one already, or a new one
+// that's committed if fn succeeds.
+func inTx(ctx context.Context, db DBTX, fn func(tx DBTX) error) error {
+	pool, ok := db.(*sql.DB)
+	if !ok {
+		return fn(db)
+	}
+
+	tx, err := pool.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Timeouts limit how long the models' queries can take, on top of any deadline
+// the caller's context already has. A zero timeout sets no limit of its own.
+type Timeouts struct {
+	Read  time.Duration // Queries that only read
+	Write time.Duration // Statements, or transactions, that write
+}
+
+func (t Timeouts) read(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Read)
+}
+
+func (t Timeouts) write(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Write)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Interrupted reports whether err means a query was stopped because its context
+// was cancelled or timed out, rather than failing by itself. PostgreSQL reports a
+// query cancelled on our behalf as query_canceled, as it does for one that ran
+// into the server's statement_timeout.
+func Interrupted(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Name() == "query_canceled"
+	}
+
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Models groups the data models. Their methods take the caller's context, so a
+// query is cancelled along with the request that made it, and its spans join the
+// request's trace.
+//
+// The models are held as interfaces, so handlers can be tested against the
+// in-memory models in the mocks package instead of PostgreSQL.
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies        MovieModelInterface
+	Users         UserModelInterface
+	Tokens        TokenModelInterface
+	Permissions   PermissionModelInterface
+	Idempotency   IdempotencyModelInterface
+	Webhooks      WebhookModelInterface
+	MovieEvents   MovieEventModelInterface
+	TOTP          TOTPModelInterface
+	APIKeys       APIKeyModelInterface
+	Roles         RoleModelInterface
+	Organizations OrganizationModelInterface
+	db            *sql.DB
+	replica       *sql.DB
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels returns the models for db. If replica isn't nil, movie and permission
+// reads go to it instead, except those made with a context from UsePrimary.
+func NewModels(db, replica *sql.DB, timeouts Timeouts) Models {
+	var replicaDB DBTX
+	if replica != nil {
+		replicaDB = replica
+	}
+
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:        MovieModel{DB: db, Replica: replicaDB, Timeouts: timeouts},
+		Users:         UserModel{DB: db, Timeouts: timeouts},
+		Tokens:        TokenModel{DB: db, Timeouts: timeouts},
+		Permissions:   PermissionModel{DB: db, Replica: replicaDB, Timeouts: timeouts},
+		Idempotency:   IdempotencyModel{DB: db, Timeouts: timeouts},
+		Webhooks:      WebhookModel{DB: db, Timeouts: timeouts},
+		MovieEvents:   MovieEventModel{DB: db, Timeouts: timeouts},
+		TOTP:          TOTPModel{DB: db, Timeouts: timeouts},
+		APIKeys:       APIKeyModel{DB: db, Timeouts: timeouts},
+		Roles:         RoleModel{DB: db, Timeouts: timeouts},
+		Organizations: OrganizationModel{DB: db, Timeouts: timeouts},
+		db:            db,
+		replica:       replica,
 	}
 }
+
+// BeginTx starts a new transaction. Pass it to a model's WithTx method to run that
+// model's queries inside it, and always finish with Commit or Rollback.
+func (m Models) BeginTx(ctx context.Context) (*sql.Tx, error) {
+	return m.db.BeginTx(ctx, nil)
+}
+
+// Ping checks that a connection to the database can be established.
+func (m Models) Ping(ctx context.Context) error {
+	return m.db.PingContext(ctx)
+}
+
+// Stats returns the connection pool statistics.
+func (m Models) Stats() sql.DBStats {
+	return m.db.Stats()
+}
+
+// HasReplica reports whether some reads go to a replica.
+func (m Models) HasReplica() bool {
+	return m.replica != nil
+}
+
+// PingReplica checks that a connection to the replica can be established. It
+// must only be called if HasReplica is true, as must ReplicaStats.
+func (m Models) PingReplica(ctx context.Context) error {
+	return m.replica.PingContext(ctx)
+}
+
+// ReplicaStats returns the replica's connection pool statistics.
+func (m Models) ReplicaStats() sql.DBStats {
+	return m.replica.Stats()
+}
+
+// Savepoint marks a point inside tx that RollbackToSavepoint can return to, so a
+// single failed statement doesn't abort the whole transaction.
+func Savepoint(ctx context.Context, tx *sql.Tx, name string) error {
+	_, err := tx.ExecContext(ctx, "SAVEPOINT "+name)
+	return err
+}
+
+func RollbackToSavepoint(ctx context.Context, tx *sql.Tx, name string) error {
+	_, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name)
+	return err
+}
+
+// ReleaseSavepoint forgets a savepoint once it's no longer needed, keeping the
+// changes made since it was set. Savepoints with the same name otherwise stack
+// up until the end of the transaction.
+func ReleaseSavepoint(ctx context.Context, tx *sql.Tx, name string) error {
+	_, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"greenlight.bagerbach.com/internal/tracing"
+)
+
+// MovieEventsChannel is the PostgreSQL notification channel the movies table
+// trigger notifies with the ID of every new movie event.
+const MovieEventsChannel = "movie_events"
+
+// MovieEvent is an entry in the movie_events log, which a trigger on the movies
+// table appends to for every insert, update and delete. Only the most recent
+// events are retained.
+//
+// An organization's events become visible in ID order: the trigger holds an
+// advisory lock for the movie's organization until its transaction commits, so
+// none of the organization's events can be committed while one of its events with
+// a lower ID is still pending. Reading the organization's events after the last ID
+// seen never skips one. Events of different organizations may commit out of order.
+type MovieEvent struct {
+	ID        int64
+	CreatedAt time.Time
+	Type      string
+	Movie     *Movie
+}
+
+type MovieEventModelInterface interface {
+	Bounds(ctx context.Context, organizationID int64) (oldest, latest int64, err error)
+	GetAfter(ctx context.Context, organizationID, id int64, limit int) ([]*MovieEvent, error)
+}
+
+type MovieEventModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Bounds returns the ID of the oldest retained event, of any organization, and that
+// of the organization's newest, or zeros when there are none. Events are only
+// retained up to a number of them all, so the oldest of every organization is
+// dropped at once, but only the organization's newest is a safe place to start
+// reading its events from: another's may have committed before it.
+func (m MovieEventModel) Bounds(ctx context.Context, organizationID int64) (oldest, latest int64, err error) {
+	ctx, span := tracing.Start(ctx, "MovieEventModel.Bounds")
+	defer span.End()
+
+	query := `
+		SELECT coalesce(min(id), 0), coalesce(max(id) FILTER (WHERE (movie->>'organization_id')::bigint = $1), 0)
+		FROM movie_events`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, organizationID).Scan(&oldest, &latest)
+	return oldest, latest, err
+}
+
+// GetAfter returns up to limit of the organization's events with an ID greater
+// than id, oldest first.
+func (m MovieEventModel) GetAfter(ctx context.Context, organizationID, id int64, limit int) ([]*MovieEvent, error) {
+	ctx, span := tracing.Start(ctx, "MovieEventModel.GetAfter")
+	defer span.End()
+
+	query := `
+		SELECT id, created_at, type, movie
+		FROM movie_events
+		WHERE id > $1 AND (movie->>'organization_id')::bigint = $2
+		ORDER BY id
+		LIMIT $3`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id, organizationID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*MovieEvent{}
+
+	for rows.Next() {
+		var (
+			event MovieEvent
+			row   []byte
+		)
+
+		if err := rows.Scan(&event.ID, &event.CreatedAt, &event.Type, &row); err != nil {
+			return nil, err
+		}
+
+		event.Movie, err = movieFromRow(row)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// movieFromRow decodes a movies row as serialised by to_jsonb(), where the runtime
+// is a plain integer rather than Runtime's "<n> mins" JSON form.
+func movieFromRow(row []byte) (*Movie, error) {
+	var columns struct {
+		ID              int64      `json:"id"`
+		CreatedAt       time.Time  `json:"created_at"`
+		OrganizationID  int64      `json:"organization_id"`
+		Title           string     `json:"title"`
+		Year            int32      `json:"year"`
+		Runtime         int32      `json:"runtime"`
+		Genres          []string   `json:"genres"`
+		Version         int32      `json:"version"`
+		PosterUpdatedAt *time.Time `json:"poster_updated_at"`
+		PosterUpload    string     `json:"poster_upload"`
+	}
+
+	if err := json.Unmarshal(row, &columns); err != nil {
+		return nil, err
+	}
+
+	return &Movie{
+		ID:              columns.ID,
+		CreatedAt:       columns.CreatedAt,
+		OrganizationID:  columns.OrganizationID,
+		Title:           columns.Title,
+		Year:            columns.Year,
+		Runtime:         Runtime(columns.Runtime),
+		Genres:          columns.Genres,
+		Version:         columns.Version,
+		PosterUpdatedAt: columns.PosterUpdatedAt,
+		PosterUpload:    columns.PosterUpload,
+	}, nil
+}
@@ -8,19 +8,26 @@ import (
 	"time"
 
 	"github.com/lib/pq"
+	"greenlight.bagerbach.com/internal/tracing"
 	"greenlight.bagerbach.com/internal/validator"
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`                // Unique identifier for the movie
-	CreatedAt time.Time `json:"-"`                 // Time when the movie was added to our db
-	Title     string    `json:"title"`             // The title of the movie
-	Year      int32     `json:"year,omitempty"`    // The release year of the movie
-	Runtime   Runtime   `json:"runtime,omitempty"` // The runtime of the movie in minutes
-	Genres    []string  `json:"genres,omitempty"`  // The genres of the movie
-	Version   int32     `json:"version"`           // The version of the movie: starts at 1 and increments each time the movie is updated
+	ID              int64      `json:"id"`                          // Unique identifier for the movie
+	CreatedAt       time.Time  `json:"-"`                           // Time when the movie was added to our db
+	OrganizationID  int64      `json:"-"`                           // The organization the movie belongs to
+	Title           string     `json:"title"`                       // The title of the movie
+	Year            int32      `json:"year,omitempty"`              // The release year of the movie
+	Runtime         Runtime    `json:"runtime,omitempty"`           // The runtime of the movie in minutes
+	Genres          []string   `json:"genres,omitempty"`            // The genres of the movie
+	Version         int32      `json:"version"`                     // The version of the movie: starts at 1 and increments each time the movie is updated
+	PosterUpdatedAt *time.Time `json:"poster_updated_at,omitempty"` // When the movie's poster was last uploaded, or nil if it has none
+	PosterUpload    string     `json:"-"`                           // The upload whose files are the movie's poster
 }
 
+// MovieSortSafelist holds the values the movie list can be sorted by.
+var MovieSortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
 func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Title != "", "title", "must be provided")
 	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
@@ -38,19 +45,54 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 }
 
+type MovieModelInterface interface {
+	WithTx(tx *sql.Tx) MovieModelInterface
+	ForOrganization(organizationID int64) MovieModelInterface
+	Insert(ctx context.Context, movie *Movie) error
+	Get(ctx context.Context, id int64) (*Movie, error)
+	Update(ctx context.Context, movie *Movie) error
+	Delete(ctx context.Context, id int64) error
+	GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
+	UpdatePoster(ctx context.Context, movie *Movie, upload string) (string, error)
+}
+
+// MovieModel only sees the movies of one organization, set with ForOrganization:
+// every query is limited to OrganizationID, and movies are inserted into it. The
+// model returned by NewModels has none, so it finds no movies at all.
 type MovieModel struct {
-	DB *sql.DB
+	DB DBTX
+	// Replica serves Get and GetAll, if set. See UsePrimary.
+	Replica        DBTX
+	Timeouts       Timeouts
+	OrganizationID int64
+}
+
+// WithTx returns a copy of the model whose queries, reads included, run inside tx
+// instead of directly against the connection pool.
+func (m MovieModel) WithTx(tx *sql.Tx) MovieModelInterface {
+	return MovieModel{DB: tx, Timeouts: m.Timeouts, OrganizationID: m.OrganizationID}
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+// ForOrganization returns a copy of the model limited to the organization's movies.
+func (m MovieModel) ForOrganization(organizationID int64) MovieModelInterface {
+	m.OrganizationID = organizationID
+	return m
+}
+
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
+	ctx, span := tracing.Start(ctx, "MovieModel.Insert")
+	defer span.End()
+
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (organization_id, title, year, runtime, genres)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id, created_at, version`
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	movie.OrganizationID = m.OrganizationID
+
+	args := []interface{}{movie.OrganizationID, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
 	// Need to use QueryRow(Context) because of the RETURNING clause (which returns the id, created_at and version)
@@ -58,29 +100,37 @@ func (m MovieModel) Insert(movie *Movie) error {
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	ctx, span := tracing.Start(ctx, "MovieModel.Get")
+	defer span.End()
+
 	if id < 1 {
 		return nil, errors.New("invalid id")
 	}
 
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		SELECT id, created_at, organization_id, title, year, runtime, genres, version, poster_updated_at, poster_upload
 		FROM movies
-		WHERE id = $1`
+		WHERE id = $1 AND organization_id = $2`
 
 	var movie Movie
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	db := reader(ctx, m.DB, m.Replica)
+
+	ctx, cancel := m.Timeouts.read(ctx)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := db.QueryRowContext(ctx, query, id, m.OrganizationID).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
+		&movie.OrganizationID,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.PosterUpdatedAt,
+		&movie.PosterUpload,
 	)
 
 	if err != nil {
@@ -94,16 +144,19 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
+	ctx, span := tracing.Start(ctx, "MovieModel.Update")
+	defer span.End()
+
 	query := `
 		UPDATE movies
 		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		WHERE id = $5 AND version = $6 AND organization_id = $7
 		RETURNING version`
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version, m.OrganizationID}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
@@ -121,19 +174,65 @@ func (m MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
-func (m MovieModel) Delete(id int64) error {
+// UpdatePoster makes upload the movie's poster, recording that it has just been
+// uploaded, and returns the upload it replaced, if any, whose files can then be
+// deleted. Like the poster itself, this isn't an edit of the movie, so its version
+// stays the same, and no movie.updated event is recorded for it.
+func (m MovieModel) UpdatePoster(ctx context.Context, movie *Movie, upload string) (string, error) {
+	ctx, span := tracing.Start(ctx, "MovieModel.UpdatePoster")
+	defer span.End()
+
+	// The row is locked while it's read, so two uploads can't both replace the
+	// same one and leave the other's files behind.
+	query := `
+		WITH previous AS (
+			SELECT id, poster_upload
+			FROM movies
+			WHERE id = $1 AND organization_id = $2
+			FOR UPDATE
+		)
+		UPDATE movies
+		SET poster_upload = $3, poster_updated_at = NOW()
+		FROM previous
+		WHERE movies.id = previous.id
+		RETURNING movies.poster_updated_at, previous.poster_upload`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	var previous string
+
+	err := m.DB.QueryRowContext(ctx, query, movie.ID, m.OrganizationID, upload).Scan(&movie.PosterUpdatedAt, &previous)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	movie.PosterUpload = upload
+
+	return previous, nil
+}
+
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
+	ctx, span := tracing.Start(ctx, "MovieModel.Delete")
+	defer span.End()
+
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
 	query := `
 		DELETE FROM movies
-		WHERE id = $1`
+		WHERE id = $1 AND organization_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := m.DB.ExecContext(ctx, query, id, m.OrganizationID)
 	if err != nil {
 		return err
 	}
@@ -150,21 +249,27 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	ctx, span := tracing.Start(ctx, "MovieModel.GetAll")
+	defer span.End()
+
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT count(*) OVER(), id, created_at, organization_id, title, year, runtime, genres, version, poster_updated_at, poster_upload
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres && $2 OR $2 = '{}')
+		WHERE organization_id = $1
+		AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $2) OR $2 = '')
+		AND (genres && $3 OR $3 = '{}')
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	db := reader(ctx, m.DB, m.Replica)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.read(ctx)
 	defer cancel()
 
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []interface{}{m.OrganizationID, title, pq.Array(genres), filters.limit(), filters.offset()}
 
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -180,11 +285,14 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&totalRecords,
 			&movie.ID,
 			&movie.CreatedAt,
+			&movie.OrganizationID,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.PosterUpdatedAt,
+			&movie.PosterUpload,
 		)
 
 		if err != nil {
@@ -0,0 +1,169 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/data/datatest"
+)
+
+func TestMovieModelOrganizations(t *testing.T) {
+	models := NewModels(datatest.NewDB(t), nil, Timeouts{})
+	ctx := context.Background()
+
+	owner := &User{Name: "Bob", Email: "bob@example.com", Activated: true}
+	if err := owner.Password.Set(ctx, "pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Users.Insert(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+
+	acme := &Organization{Name: "Acme"}
+	if err := models.Organizations.Insert(ctx, acme, owner.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The migrations create the Default organization, with ID 1.
+	defaultMovies := models.Movies.ForOrganization(1)
+	acmeMovies := models.Movies.ForOrganization(acme.ID)
+
+	moana := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	if err := defaultMovies.Insert(ctx, moana); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, moana.OrganizationID, int64(1))
+
+	up := &Movie{Title: "Up", Year: 2009, Runtime: 96, Genres: []string{"animation"}}
+	if err := acmeMovies.Insert(ctx, up); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, up.OrganizationID, acme.ID)
+
+	filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: MovieSortSafelist}
+
+	t.Run("Get", func(t *testing.T) {
+		movie, err := defaultMovies.Get(ctx, moana.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, movie.Title, "Moana")
+
+		_, err = acmeMovies.Get(ctx, moana.ID)
+		assert.Equal(t, errors.Is(err, ErrRecordNotFound), true)
+
+		// The model returned by NewModels has no organization, so it finds nothing.
+		_, err = models.Movies.Get(ctx, moana.ID)
+		assert.Equal(t, errors.Is(err, ErrRecordNotFound), true)
+	})
+
+	t.Run("GetAll", func(t *testing.T) {
+		movies, metadata, err := acmeMovies.GetAll(ctx, "", []string{}, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, metadata.TotalRecords, 1)
+		assert.Equal(t, movies[0].ID, up.ID)
+
+		movies, metadata, err = defaultMovies.GetAll(ctx, "", []string{}, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, metadata.TotalRecords, 1)
+		assert.Equal(t, movies[0].ID, moana.ID)
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		events, err := models.MovieEvents.GetAfter(ctx, acme.ID, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(events), 1)
+		assert.Equal(t, events[0].Type, "movie.created")
+		assert.Equal(t, events[0].Movie.ID, up.ID)
+
+		oldest, latest, err := models.MovieEvents.Bounds(ctx, acme.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, latest, events[0].ID)
+		assert.Equal(t, oldest < latest, true)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		changed := *moana
+		changed.Title = "Vaiana"
+
+		err := acmeMovies.Update(ctx, &changed)
+		assert.Equal(t, errors.Is(err, ErrEditConflict), true)
+
+		movie, err := defaultMovies.Get(ctx, moana.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, movie.Title, "Moana")
+		assert.Equal(t, movie.Version, moana.Version)
+	})
+
+	t.Run("UpdatePoster", func(t *testing.T) {
+		_, latest, err := models.MovieEvents.Bounds(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = acmeMovies.UpdatePoster(ctx, &Movie{ID: moana.ID}, "1")
+		assert.Equal(t, errors.Is(err, ErrRecordNotFound), true)
+
+		movie, err := defaultMovies.Get(ctx, moana.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, movie.PosterUpdatedAt == nil, true)
+
+		previous, err := defaultMovies.UpdatePoster(ctx, movie, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, previous, "")
+
+		previous, err = defaultMovies.UpdatePoster(ctx, movie, "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, previous, "1")
+
+		movie, err = defaultMovies.Get(ctx, moana.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, movie.PosterUpload, "2")
+		assert.Equal(t, movie.PosterUpdatedAt != nil, true)
+		assert.Equal(t, movie.Version, moana.Version)
+
+		// The movies trigger only records updates that make a new version.
+		_, after, err := models.MovieEvents.Bounds(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, after, latest)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		err := acmeMovies.Delete(ctx, moana.ID)
+		assert.Equal(t, errors.Is(err, ErrRecordNotFound), true)
+
+		if _, err := defaultMovies.Get(ctx, moana.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := defaultMovies.Delete(ctx, moana.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := acmeMovies.Get(ctx, up.ID); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,350 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+
+	"greenlight.bagerbach.com/internal/tracing"
+	"greenlight.bagerbach.com/internal/validator"
+)
+
+// ErrLastManager is returned for a change to an organization's members that would
+// leave none of them able to manage the rest.
+var ErrLastManager = errors.New("last member with roles:manage")
+
+// Organization is a tenant: its movies can only be seen and changed by its
+// members, with the permissions they have in it. See PermissionModel.GetAllForMember.
+type Organization struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	// Role is the user's role in the organization, when listed by GetAllForUser.
+	Role string `json:"role,omitempty"`
+}
+
+// OrganizationMember is a user's membership of an organization. Within it, they
+// have the permissions of their role and those granted to them in it, not their
+// own.
+type OrganizationMember struct {
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	Role   string `json:"role,omitempty"`
+}
+
+func ValidateOrganization(v *validator.Validator, organization *Organization) {
+	v.Check(organization.Name != "", "name", "must be provided")
+	v.Check(len(organization.Name) <= 500, "name", "must not be more than 500 bytes long")
+}
+
+type OrganizationModelInterface interface {
+	WithTx(tx *sql.Tx) OrganizationModelInterface
+	Insert(ctx context.Context, organization *Organization, ownerID int64, ownerRole string) error
+	Get(ctx context.Context, id int64) (*Organization, error)
+	GetAllForUser(ctx context.Context, userID int64) ([]*Organization, error)
+	GetMembers(ctx context.Context, organizationID int64) ([]*OrganizationMember, error)
+	SetMember(ctx context.Context, organizationID, userID int64, role string) error
+	RemoveMember(ctx context.Context, organizationID, userID int64) error
+}
+
+type OrganizationModel struct {
+	DB       DBTX
+	Timeouts Timeouts
+}
+
+// WithTx returns a copy of the model whose queries run inside tx.
+func (m OrganizationModel) WithTx(tx *sql.Tx) OrganizationModelInterface {
+	return OrganizationModel{DB: tx, Timeouts: m.Timeouts}
+}
+
+// Insert creates the organization, with the owner as its first member, given the
+// named role. It returns ErrRecordNotFound if there is no such role.
+func (m OrganizationModel) Insert(ctx context.Context, organization *Organization, ownerID int64, ownerRole string) error {
+	ctx, span := tracing.Start(ctx, "OrganizationModel.Insert")
+	defer span.End()
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	return inTx(ctx, m.DB, func(tx DBTX) error {
+		return insertOrganization(ctx, tx, organization, ownerID, ownerRole)
+	})
+}
+
+func insertOrganization(ctx context.Context, db DBTX, organization *Organization, ownerID int64, ownerRole string) error {
+	query := `
+		INSERT INTO organizations (name)
+		VALUES ($1)
+		RETURNING id, created_at`
+
+	err := db.QueryRowContext(ctx, query, organization.Name).Scan(&organization.ID, &organization.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := setMember(ctx, db, organization.ID, ownerID, ownerRole); err != nil {
+		return err
+	}
+
+	organization.Role = ownerRole
+	return nil
+}
+
+func (m OrganizationModel) Get(ctx context.Context, id int64) (*Organization, error) {
+	ctx, span := tracing.Start(ctx, "OrganizationModel.Get")
+	defer span.End()
+
+	query := `
+		SELECT id, created_at, name
+		FROM organizations
+		WHERE id = $1`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	var organization Organization
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&organization.ID, &organization.CreatedAt, &organization.Name)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &organization, nil
+}
+
+// GetAllForUser returns the organizations the user is a member of, along with
+// their role in each, in the order they joined them.
+func (m OrganizationModel) GetAllForUser(ctx context.Context, userID int64) ([]*Organization, error) {
+	ctx, span := tracing.Start(ctx, "OrganizationModel.GetAllForUser")
+	defer span.End()
+
+	query := `
+		SELECT organizations.id, organizations.created_at, organizations.name, coalesce(roles.name, '')
+		FROM organizations
+		INNER JOIN organization_members ON organization_members.organization_id = organizations.id
+		LEFT JOIN roles ON roles.id = organization_members.role_id
+		WHERE organization_members.user_id = $1
+		ORDER BY organization_members.created_at, organizations.id`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	organizations := []*Organization{}
+
+	for rows.Next() {
+		var organization Organization
+		err := rows.Scan(&organization.ID, &organization.CreatedAt, &organization.Name, &organization.Role)
+		if err != nil {
+			return nil, err
+		}
+		organizations = append(organizations, &organization)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return organizations, nil
+}
+
+// GetMembers returns the organization's members, in the order they joined.
+func (m OrganizationModel) GetMembers(ctx context.Context, organizationID int64) ([]*OrganizationMember, error) {
+	ctx, span := tracing.Start(ctx, "OrganizationModel.GetMembers")
+	defer span.End()
+
+	query := `
+		SELECT users.id, users.name, users.email, coalesce(roles.name, '')
+		FROM organization_members
+		INNER JOIN users ON users.id = organization_members.user_id
+		LEFT JOIN roles ON roles.id = organization_members.role_id
+		WHERE organization_members.organization_id = $1
+		ORDER BY organization_members.created_at, users.id`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, organizationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*OrganizationMember{}
+
+	for rows.Next() {
+		var member OrganizationMember
+		if err := rows.Scan(&member.UserID, &member.Name, &member.Email, &member.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, &member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// SetMember adds the user to the organization with the named role, or changes
+// their role if they're already a member. An empty role leaves them with just
+// their own permissions. It returns ErrRecordNotFound if there is no such
+// organization, user or role.
+// SetMember adds the user to the organization with the named role, or changes
+// their role if they're a member already. It returns ErrRecordNotFound if there is
+// no such organization, user or role, and ErrLastManager if they were the last
+// member with roles:manage and the role doesn't have it.
+func (m OrganizationModel) SetMember(ctx context.Context, organizationID, userID int64, role string) error {
+	ctx, span := tracing.Start(ctx, "OrganizationModel.SetMember")
+	defer span.End()
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	return changeMembers(ctx, m.DB, organizationID, func(tx DBTX) error {
+		return setMember(ctx, tx, organizationID, userID, role)
+	})
+}
+
+func setMember(ctx context.Context, db DBTX, organizationID, userID int64, role string) error {
+	query := `
+		INSERT INTO organization_members (organization_id, user_id, role_id)
+		SELECT $1, $2, roles.id
+		FROM (SELECT 1) AS member
+		LEFT JOIN roles ON roles.name = $3
+		WHERE $3 = '' OR roles.id IS NOT NULL
+		ON CONFLICT (organization_id, user_id) DO UPDATE SET role_id = EXCLUDED.role_id`
+
+	result, err := db.ExecContext(ctx, query, organizationID, userID, role)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Name() == "foreign_key_violation" {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RemoveMember returns ErrRecordNotFound if the user isn't a member of the
+// organization, and ErrLastManager if they're its last member with roles:manage.
+func (m OrganizationModel) RemoveMember(ctx context.Context, organizationID, userID int64) error {
+	ctx, span := tracing.Start(ctx, "OrganizationModel.RemoveMember")
+	defer span.End()
+
+	query := `
+		DELETE FROM organization_members
+		WHERE organization_id = $1 AND user_id = $2`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	return changeMembers(ctx, m.DB, organizationID, func(tx DBTX) error {
+		result, err := tx.ExecContext(ctx, query, organizationID, userID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		return nil
+	})
+}
+
+// changeMembers makes a change to the organization's members with change, unless
+// it would take roles:manage away from the last of them to have it. The
+// organization is locked meanwhile, so two changes can't each leave the other's
+// member as the last manager and then both go ahead. An organization without any
+// managers to begin with, like the Default one can be, can still be changed.
+func changeMembers(ctx context.Context, db DBTX, organizationID int64, change func(tx DBTX) error) error {
+	return inTx(ctx, db, func(tx DBTX) error {
+		lock := `
+			SELECT id FROM organizations
+			WHERE id = $1
+			FOR UPDATE`
+
+		var id int64
+		if err := tx.QueryRowContext(ctx, lock, organizationID).Scan(&id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+
+		before, err := countManagers(ctx, tx, organizationID)
+		if err != nil {
+			return err
+		}
+
+		if err := change(tx); err != nil {
+			return err
+		}
+
+		after, err := countManagers(ctx, tx, organizationID)
+		if err != nil {
+			return err
+		}
+
+		if before > 0 && after == 0 {
+			return ErrLastManager
+		}
+
+		return nil
+	})
+}
+
+// countManagers returns the number of the organization's members with
+// roles:manage in it, through their role or granted to them directly.
+func countManagers(ctx context.Context, db DBTX, organizationID int64) (int, error) {
+	query := `
+		SELECT count(*) FROM organization_members
+		WHERE organization_id = $1 AND (
+			role_id IN (
+				SELECT roles_permissions.role_id FROM roles_permissions
+				INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+				WHERE permissions.code = 'roles:manage'
+			) OR EXISTS (
+				SELECT 1 FROM organization_members_permissions
+				INNER JOIN permissions ON permissions.id = organization_members_permissions.permission_id
+				WHERE organization_members_permissions.organization_id = organization_members.organization_id
+				AND organization_members_permissions.user_id = organization_members.user_id
+				AND permissions.code = 'roles:manage'
+			)
+		)`
+
+	var count int
+	err := db.QueryRowContext(ctx, query, organizationID).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+	"greenlight.bagerbach.com/internal/data/datatest"
+)
+
+func TestOrganizationModelLastManager(t *testing.T) {
+	models := NewModels(datatest.NewDB(t), nil, Timeouts{})
+	ctx := context.Background()
+
+	newUser := func(t *testing.T, email string) *User {
+		t.Helper()
+
+		user := &User{Name: "Test User", Email: email, Activated: true}
+		if err := user.Password.Set(ctx, "pa55word1234"); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Users.Insert(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+
+	bob := newUser(t, "bob@example.com")
+	carol := newUser(t, "carol@example.com")
+
+	acme := &Organization{Name: "Acme"}
+	if err := models.Organizations.Insert(ctx, acme, bob.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := models.Organizations.SetMember(ctx, acme.ID, bob.ID, "viewer")
+	assert.Equal(t, errors.Is(err, ErrLastManager), true)
+
+	err = models.Organizations.RemoveMember(ctx, acme.ID, bob.ID)
+	assert.Equal(t, errors.Is(err, ErrLastManager), true)
+
+	// Granted directly, roles:manage counts as much as through a role.
+	if err := models.Organizations.SetMember(ctx, acme.ID, carol.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Permissions.AddForMember(ctx, acme.ID, carol.ID, "roles:manage"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := models.Organizations.RemoveMember(ctx, acme.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Organizations.RemoveMember(ctx, acme.ID, carol.ID)
+	assert.Equal(t, errors.Is(err, ErrLastManager), true)
+}
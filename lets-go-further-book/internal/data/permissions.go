@@ -3,9 +3,11 @@ package data
 import (
 	"context"
 	"database/sql"
-	"time"
+	"errors"
 
 	"github.com/lib/pq"
+
+	"greenlight.bagerbach.com/internal/tracing"
 )
 
 type Permissions []string
@@ -19,22 +21,43 @@ func (p Permissions) Include(code string) bool {
 	return false
 }
 
+type PermissionModelInterface interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	GetAllForMember(ctx context.Context, organizationID, userID int64) (Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+	AddForMember(ctx context.Context, organizationID, userID int64, codes ...string) error
+}
+
 type PermissionModel struct {
 	DB *sql.DB
+	// Replica serves GetAllForUser and GetAllForMember, if set. See UsePrimary.
+	Replica  DBTX
+	Timeouts Timeouts
 }
 
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// GetAllForUser returns the user's effective permissions outside organizations:
+// those granted to them directly and those of their roles.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	ctx, span := tracing.Start(ctx, "PermissionModel.GetAllForUser")
+	defer span.End()
+
 	query := `
 		SELECT permissions.code FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-		INNER JOIN users ON users.id = users_permissions.user_id
-		WHERE users.id = $1
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	db := reader(ctx, m.DB, m.Replica)
+
+	ctx, cancel := m.Timeouts.read(ctx)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, userID)
+	rows, err := db.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -57,15 +80,91 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+// GetAllForMember returns the user's effective permissions within the
+// organization: those of their role in it and those granted to them in it with
+// AddForMember. Their permissions outside organizations don't count. It returns
+// ErrRecordNotFound if they aren't a member.
+func (m PermissionModel) GetAllForMember(ctx context.Context, organizationID, userID int64) (Permissions, error) {
+	ctx, span := tracing.Start(ctx, "PermissionModel.GetAllForMember")
+	defer span.End()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM organization_members
+			WHERE organization_id = $1 AND user_id = $2
+		), ARRAY (
+			SELECT permissions.code FROM permissions
+			INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+			INNER JOIN organization_members ON organization_members.role_id = roles_permissions.role_id
+			WHERE organization_members.organization_id = $1 AND organization_members.user_id = $2
+			UNION
+			SELECT permissions.code FROM permissions
+			INNER JOIN organization_members_permissions ON organization_members_permissions.permission_id = permissions.id
+			WHERE organization_members_permissions.organization_id = $1 AND organization_members_permissions.user_id = $2
+		)
+	`
+
+	db := reader(ctx, m.DB, m.Replica)
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	var (
+		member      bool
+		permissions Permissions
+	)
+
+	err := db.QueryRowContext(ctx, query, organizationID, userID).Scan(&member, pq.Array(&permissions))
+	if err != nil {
+		return nil, err
+	}
+
+	if !member {
+		return nil, ErrRecordNotFound
+	}
+
+	return permissions, nil
+}
+
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, span := tracing.Start(ctx, "PermissionModel.AddForUser")
+	defer span.End()
+
 	query := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// AddForMember grants permissions to a member of an organization, within it. It
+// returns ErrRecordNotFound if the user isn't a member.
+func (m PermissionModel) AddForMember(ctx context.Context, organizationID, userID int64, codes ...string) error {
+	ctx, span := tracing.Start(ctx, "PermissionModel.AddForMember")
+	defer span.End()
+
+	query := `
+		INSERT INTO organization_members_permissions
+		SELECT $1, $2, permissions.id FROM permissions WHERE permissions.code = ANY($3)
+		ON CONFLICT DO NOTHING
+	`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, organizationID, userID, pq.Array(codes))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Name() == "foreign_key_violation" {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package data
+
+import "context"
+
+type primaryContextKey struct{}
+
+// UsePrimary returns a copy of ctx that sends the models' reads to the primary
+// database instead of the replica. It's used for a while after a user writes
+// something, so they read their own writes even if the replica lags behind.
+func UsePrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+// reader returns the database a read made with ctx should go to: the replica,
+// unless there isn't one or ctx came from UsePrimary.
+func reader(ctx context.Context, primary, replica DBTX) DBTX {
+	if replica == nil || ctx.Value(primaryContextKey{}) != nil {
+		return primary
+	}
+	return replica
+}
@@ -0,0 +1,177 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+
+	"greenlight.bagerbach.com/internal/tracing"
+)
+
+// Role is a named bundle of permission codes. Users have the permissions of all
+// their roles, as well as any granted to them directly.
+type Role struct {
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+type RoleModelInterface interface {
+	GetAll(ctx context.Context) ([]*Role, error)
+	Get(ctx context.Context, name string) (*Role, error)
+	GetAllForUser(ctx context.Context, userID int64) ([]string, error)
+	SetForUser(ctx context.Context, userID int64, names ...string) error
+}
+
+type RoleModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+const selectRolesQuery = `
+	SELECT roles.name, array_remove(array_agg(permissions.code ORDER BY permissions.code), NULL)
+	FROM roles
+	LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+	LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id`
+
+// GetAll returns every role, in the order they were created.
+func (m RoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	ctx, span := tracing.Start(ctx, "RoleModel.GetAll")
+	defer span.End()
+
+	query := selectRolesQuery + `
+		GROUP BY roles.id
+		ORDER BY roles.id`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name, pq.Array(&role.Permissions)); err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (m RoleModel) Get(ctx context.Context, name string) (*Role, error) {
+	ctx, span := tracing.Start(ctx, "RoleModel.Get")
+	defer span.End()
+
+	query := selectRolesQuery + `
+		WHERE roles.name = $1
+		GROUP BY roles.id`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	var role Role
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(&role.Name, pq.Array(&role.Permissions))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &role, nil
+}
+
+// GetAllForUser returns the names of the user's roles, or ErrRecordNotFound if
+// there is no such user.
+func (m RoleModel) GetAllForUser(ctx context.Context, userID int64) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "RoleModel.GetAllForUser")
+	defer span.End()
+
+	query := `
+		SELECT array_remove(array_agg(roles.name ORDER BY roles.id), NULL)
+		FROM users
+		LEFT JOIN users_roles ON users_roles.user_id = users.id
+		LEFT JOIN roles ON roles.id = users_roles.role_id
+		WHERE users.id = $1
+		GROUP BY users.id`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	var names []string
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(pq.Array(&names))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return names, nil
+}
+
+// SetForUser replaces the user's roles with the named ones. It returns
+// ErrRecordNotFound if there is no such user or any of the roles doesn't exist.
+func (m RoleModel) SetForUser(ctx context.Context, userID int64, names ...string) error {
+	ctx, span := tracing.Start(ctx, "RoleModel.SetForUser")
+	defer span.End()
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRecordNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users_roles WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)`
+
+	result, err := tx.ExecContext(ctx, query, userID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected != int64(len(names)) {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
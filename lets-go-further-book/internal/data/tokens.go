@@ -6,14 +6,21 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
+	"greenlight.bagerbach.com/internal/tracing"
 	"greenlight.bagerbach.com/internal/validator"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeEmailChange    = "email-change"
+	// ScopeMFA tokens are issued for a correct password when the user has two-factor
+	// authentication enabled, and are exchanged for an authentication token
+	// together with a TOTP code.
+	ScopeMFA = "mfa"
 )
 
 type Token struct {
@@ -56,42 +63,115 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 characters long")
 }
 
+type TokenModelInterface interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	Consume(ctx context.Context, scope, tokenPlaintext string) (int64, error)
+	DeleteAllForUser(ctx context.Context, userID int64, scope string) error
+	DeleteAllForUserExcept(ctx context.Context, userID int64, scope, tokenPlaintext string) error
+}
+
 type TokenModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Timeouts Timeouts
 }
 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	ctx, span := tracing.Start(ctx, "TokenModel.New")
+	defer span.End()
+
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
+	ctx, span := tracing.Start(ctx, "TokenModel.Insert")
+	defer span.End()
+
 	query := `
 		INSERT INTO tokens (hash, user_id, expiry, scope)
 		VALUES ($1, $2, $3, $4)
 	`
 	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
-func (m TokenModel) DeleteAllForUser(userID int64, scope string) error {
+// Consume deletes an unexpired token and returns the ID of the user it belongs to,
+// or ErrRecordNotFound. Of several concurrent requests with the same token, only
+// one gets to use it.
+func (m TokenModel) Consume(ctx context.Context, scope, tokenPlaintext string) (int64, error) {
+	ctx, span := tracing.Start(ctx, "TokenModel.Consume")
+	defer span.End()
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id`
+
+	args := []interface{}{hash[:], scope, time.Now()}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	var userID int64
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
+
+func (m TokenModel) DeleteAllForUser(ctx context.Context, userID int64, scope string) error {
+	ctx, span := tracing.Start(ctx, "TokenModel.DeleteAllForUser")
+	defer span.End()
+
 	query := `
 		DELETE FROM tokens
 		WHERE user_id = $1 AND scope = $2
 	`
 	args := []interface{}{userID, scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// DeleteAllForUserExcept is DeleteAllForUser, but keeps the token tokenPlaintext,
+// e.g. the one the user is currently authenticated with.
+func (m TokenModel) DeleteAllForUserExcept(ctx context.Context, userID int64, scope, tokenPlaintext string) error {
+	ctx, span := tracing.Start(ctx, "TokenModel.DeleteAllForUserExcept")
+	defer span.End()
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND hash <> $3
+	`
+	args := []interface{}{userID, scope, hash[:]}
+
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
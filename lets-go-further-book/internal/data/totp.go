@@ -0,0 +1,263 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"greenlight.bagerbach.com/internal/tracing"
+)
+
+// TOTPCredential is a user's time-based one-time password secret. Codes are only
+// asked for at login once the user has confirmed they can generate them.
+type TOTPCredential struct {
+	UserID       int64
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64 // Codes for this time step or earlier are refused
+}
+
+// NewRecoveryCodes returns the one-time codes that stand in for a TOTP code when a
+// user loses their authenticator, formatted like "abcde-fghij".
+func NewRecoveryCodes() ([]string, error) {
+	codes := make([]string, 10)
+
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+		if _, err := rand.Read(randomBytes); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	return codes, nil
+}
+
+// HashRecoveryCode returns the hash a recovery code is stored as. Case and dashes
+// don't matter.
+func HashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(code, "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+type TOTPModelInterface interface {
+	Get(ctx context.Context, userID int64) (*TOTPCredential, error)
+	Set(ctx context.Context, userID int64, secret string) error
+	Confirm(ctx context.Context, userID int64, step int64, recoveryCodes []string) error
+	UseStep(ctx context.Context, userID int64, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int64, code string) (bool, error)
+	Delete(ctx context.Context, userID int64) error
+}
+
+type TOTPModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+func (m TOTPModel) Get(ctx context.Context, userID int64) (*TOTPCredential, error) {
+	ctx, span := tracing.Start(ctx, "TOTPModel.Get")
+	defer span.End()
+
+	query := `
+		SELECT user_id, secret, confirmed, last_used_step
+		FROM totp_credentials
+		WHERE user_id = $1`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	var credential TOTPCredential
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&credential.UserID,
+		&credential.Secret,
+		&credential.Confirmed,
+		&credential.LastUsedStep,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &credential, nil
+}
+
+// Set stores a new, unconfirmed secret for the user, replacing any unconfirmed
+// one. It returns ErrEditConflict if the user already has a confirmed secret.
+func (m TOTPModel) Set(ctx context.Context, userID int64, secret string) error {
+	ctx, span := tracing.Start(ctx, "TOTPModel.Set")
+	defer span.End()
+
+	query := `
+		INSERT INTO totp_credentials (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+		WHERE NOT totp_credentials.confirmed`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Confirm enables the user's secret after they have entered a code for step, and
+// replaces their recovery codes. It returns ErrEditConflict if there is no
+// unconfirmed secret.
+func (m TOTPModel) Confirm(ctx context.Context, userID int64, step int64, recoveryCodes []string) error {
+	ctx, span := tracing.Start(ctx, "TOTPModel.Confirm")
+	defer span.End()
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE totp_credentials
+		SET confirmed = true, last_used_step = $2
+		WHERE user_id = $1 AND NOT confirmed`
+
+	result, err := tx.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)", userID, HashRecoveryCode(code)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseStep records that a code for step was accepted, returning false if one for
+// the same step or a later one already was, so the code must be refused.
+func (m TOTPModel) UseStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	ctx, span := tracing.Start(ctx, "TOTPModel.UseStep")
+	defer span.End()
+
+	query := `
+		UPDATE totp_credentials
+		SET last_used_step = $2
+		WHERE user_id = $1 AND confirmed AND last_used_step < $2`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// UseRecoveryCode deletes the recovery code if the user has it, reporting whether
+// they did.
+func (m TOTPModel) UseRecoveryCode(ctx context.Context, userID int64, code string) (bool, error) {
+	ctx, span := tracing.Start(ctx, "TOTPModel.UseRecoveryCode")
+	defer span.End()
+
+	query := `
+		DELETE FROM recovery_codes
+		WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, HashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// Delete removes the user's secret and recovery codes, switching two-factor
+// authentication off.
+func (m TOTPModel) Delete(ctx context.Context, userID int64) error {
+	ctx, span := tracing.Start(ctx, "TOTPModel.Delete")
+	defer span.End()
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM totp_credentials WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
+	"greenlight.bagerbach.com/internal/tracing"
 	"greenlight.bagerbach.com/internal/validator"
 )
 
@@ -24,7 +25,10 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	// PendingEmail is the address the user asked to change their email to, until
+	// they confirm it with the token sent there.
+	PendingEmail *string `json:"pending_email,omitempty"`
+	Version      int     `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
@@ -37,7 +41,11 @@ type password struct {
 }
 
 // Set sets the password hash and plaintext
-func (p *password) Set(plaintextPassword string) error {
+func (p *password) Set(ctx context.Context, plaintextPassword string) error {
+	// Hashing is deliberately slow, so it gets a span of its own.
+	ctx, span := tracing.Start(ctx, "bcrypt.GenerateFromPassword")
+	defer span.End()
+
 	// Generates a bcrypt hash of a password using specific cost parameters (12 here)
 	// The higher the cost, the slower (more computationally expensive) the hash generation will be
 	// Need to strike a balance between security and performance
@@ -55,7 +63,10 @@ func (p *password) Set(plaintextPassword string) error {
 }
 
 // Checks if the provided plaintext password matches the hashed password
-func (p *password) Matches(plaintextPassword string) (bool, error) {
+func (p *password) Matches(ctx context.Context, plaintextPassword string) (bool, error) {
+	ctx, span := tracing.Start(ctx, "bcrypt.CompareHashAndPassword")
+	defer span.End()
+
 	// Use the bcrypt package to compare the hashed password with the plaintext password
 	// Works by re-hashing the provided plaintext password (using same salt and cost) and comparing the result
 	// to the hashed password.
@@ -102,11 +113,29 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
+type UserModelInterface interface {
+	WithTx(tx *sql.Tx) UserModelInterface
+	Insert(ctx context.Context, user *User) error
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+	Delete(ctx context.Context, id int64) error
+}
+
 type UserModel struct {
-	DB *sql.DB
+	DB       DBTX
+	Timeouts Timeouts
 }
 
-func (m UserModel) Insert(user *User) error {
+// WithTx returns a copy of the model whose queries run inside tx.
+func (m UserModel) WithTx(tx *sql.Tx) UserModelInterface {
+	return UserModel{DB: tx, Timeouts: m.Timeouts}
+}
+
+func (m UserModel) Insert(ctx context.Context, user *User) error {
+	ctx, span := tracing.Start(ctx, "UserModel.Insert")
+	defer span.End()
+
 	query := `
 		INSERT INTO users (name, email, password_hash, activated)
 		VALUES ($1, $2, $3, $4)
@@ -114,7 +143,7 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
 	if err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version); err != nil {
@@ -129,13 +158,16 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, span := tracing.Start(ctx, "UserModel.GetByEmail")
+	defer span.End()
+
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, created_at, name, email, password_hash, activated, pending_email, version
 		FROM users
 		WHERE email = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.read(ctx)
 	defer cancel()
 
 	var user User
@@ -146,6 +178,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.PendingEmail,
 		&user.Version,
 	); err != nil {
 		switch {
@@ -159,16 +192,19 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
+	ctx, span := tracing.Start(ctx, "UserModel.Update")
+	defer span.End()
+
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, password_hash = $3, activated = $4, pending_email = $5, version = version + 1
+		WHERE id = $6 AND version = $7
 		RETURNING version`
 
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.ID, user.Version}
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.PendingEmail, user.ID, user.Version}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.write(ctx)
 	defer cancel()
 
 	if err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version); err != nil {
@@ -176,7 +212,7 @@ func (m UserModel) Update(user *User) error {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrRecordNotFound
+			return ErrEditConflict
 		default:
 			return err
 		}
@@ -185,11 +221,14 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	ctx, span := tracing.Start(ctx, "UserModel.GetForToken")
+	defer span.End()
+
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.pending_email, users.version
 		FROM users
 		INNER JOIN tokens ON users.id = tokens.user_id
 		WHERE tokens.hash = $1
@@ -201,7 +240,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.Timeouts.read(ctx)
 	defer cancel()
 
 	if err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -211,6 +250,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.PendingEmail,
 		&user.Version,
 	); err != nil {
 		switch {
@@ -223,3 +263,33 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	return &user, nil
 }
+
+// Delete deletes a user. Their tokens and permissions go with them, through the
+// foreign keys' ON DELETE CASCADE.
+func (m UserModel) Delete(ctx context.Context, id int64) error {
+	ctx, span := tracing.Start(ctx, "UserModel.Delete")
+	defer span.End()
+
+	query := `
+		DELETE FROM users
+		WHERE id = $1`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
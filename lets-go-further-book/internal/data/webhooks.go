@@ -0,0 +1,304 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.bagerbach.com/internal/tracing"
+	"greenlight.bagerbach.com/internal/validator"
+)
+
+type WebhookSubscription struct {
+	ID             int64     `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	OrganizationID int64     `json:"-"`
+	URL            string    `json:"url"`
+	Secret         string    `json:"-"` // Never sent back to clients once registered
+	EventTypes     []string  `json:"event_types"`
+	Version        int32     `json:"version"`
+}
+
+// ValidateWebhookSubscription checks a subscription, refusing URLs whose host
+// publicHost rejects, as deliveries there would reach internal services.
+func ValidateWebhookSubscription(v *validator.Validator, subscription *WebhookSubscription, permittedEventTypes []string, publicHost func(host string) bool) {
+	v.Check(subscription.URL != "", "url", "must be provided")
+	v.Check(len(subscription.URL) <= 2048, "url", "must not be more than 2048 bytes long")
+
+	u, err := url.Parse(subscription.URL)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an absolute http or https URL")
+	v.Check(err != nil || publicHost(u.Hostname()), "url", "must not point to a private or local address")
+
+	v.Check(subscription.Secret != "", "secret", "must be provided")
+	v.Check(len(subscription.Secret) >= 16, "secret", "must be at least 16 bytes long")
+	v.Check(len(subscription.Secret) <= 256, "secret", "must not be more than 256 bytes long")
+
+	v.Check(subscription.EventTypes != nil, "event_types", "must be provided")
+	v.Check(len(subscription.EventTypes) >= 1, "event_types", "must contain at least 1 event type")
+	v.Check(validator.Unique(subscription.EventTypes), "event_types", "must not contain duplicate values")
+
+	for _, eventType := range subscription.EventTypes {
+		v.Check(validator.PermittedValue(eventType, permittedEventTypes...), "event_types", "invalid event type: "+eventType)
+	}
+}
+
+// WebhookDelivery is the log entry of a single delivery attempt.
+type WebhookDelivery struct {
+	ID             int64     `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	SubscriptionID int64     `json:"subscription_id"`
+	EventID        string    `json:"event_id"`
+	EventType      string    `json:"event_type"`
+	Attempt        int       `json:"attempt"`
+	StatusCode     int       `json:"status_code,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Success        bool      `json:"success"`
+	DurationMS     int64     `json:"duration_ms"`
+}
+
+type WebhookModelInterface interface {
+	ForOrganization(organizationID int64) WebhookModelInterface
+	Insert(ctx context.Context, subscription *WebhookSubscription) error
+	Get(ctx context.Context, id int64) (*WebhookSubscription, error)
+	GetAll(ctx context.Context, eventType string) ([]*WebhookSubscription, error)
+	Delete(ctx context.Context, id int64) error
+	InsertDelivery(ctx context.Context, delivery *WebhookDelivery) error
+	GetDeliveries(ctx context.Context, subscriptionID int64, filters Filters) ([]*WebhookDelivery, Metadata, error)
+}
+
+// WebhookModel only sees the subscriptions of one organization, set with
+// ForOrganization, like MovieModel, and a subscription only receives the events of
+// its organization's movies. The delivery methods aren't limited: callers get the
+// subscription first.
+type WebhookModel struct {
+	DB             *sql.DB
+	Timeouts       Timeouts
+	OrganizationID int64
+}
+
+// ForOrganization returns a copy of the model limited to the organization's
+// subscriptions.
+func (m WebhookModel) ForOrganization(organizationID int64) WebhookModelInterface {
+	m.OrganizationID = organizationID
+	return m
+}
+
+func (m WebhookModel) Insert(ctx context.Context, subscription *WebhookSubscription) error {
+	ctx, span := tracing.Start(ctx, "WebhookModel.Insert")
+	defer span.End()
+
+	query := `
+		INSERT INTO webhook_subscriptions (organization_id, url, secret, event_types)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version`
+
+	subscription.OrganizationID = m.OrganizationID
+
+	args := []interface{}{subscription.OrganizationID, subscription.URL, subscription.Secret, pq.Array(subscription.EventTypes)}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&subscription.ID, &subscription.CreatedAt, &subscription.Version)
+}
+
+func (m WebhookModel) Get(ctx context.Context, id int64) (*WebhookSubscription, error) {
+	ctx, span := tracing.Start(ctx, "WebhookModel.Get")
+	defer span.End()
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, organization_id, url, secret, event_types, version
+		FROM webhook_subscriptions
+		WHERE id = $1 AND organization_id = $2`
+
+	var subscription WebhookSubscription
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, m.OrganizationID).Scan(
+		&subscription.ID,
+		&subscription.CreatedAt,
+		&subscription.OrganizationID,
+		&subscription.URL,
+		&subscription.Secret,
+		pq.Array(&subscription.EventTypes),
+		&subscription.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &subscription, nil
+}
+
+// GetAll returns every subscription of the organization, or only those registered for eventType if it
+// isn't empty.
+func (m WebhookModel) GetAll(ctx context.Context, eventType string) ([]*WebhookSubscription, error) {
+	ctx, span := tracing.Start(ctx, "WebhookModel.GetAll")
+	defer span.End()
+
+	query := `
+		SELECT id, created_at, organization_id, url, secret, event_types, version
+		FROM webhook_subscriptions
+		WHERE organization_id = $1 AND ($2 = ANY(event_types) OR $2 = '')
+		ORDER BY id`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, m.OrganizationID, eventType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []*WebhookSubscription{}
+
+	for rows.Next() {
+		var subscription WebhookSubscription
+		err := rows.Scan(
+			&subscription.ID,
+			&subscription.CreatedAt,
+			&subscription.OrganizationID,
+			&subscription.URL,
+			&subscription.Secret,
+			pq.Array(&subscription.EventTypes),
+			&subscription.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		subscriptions = append(subscriptions, &subscription)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+func (m WebhookModel) Delete(ctx context.Context, id int64) error {
+	ctx, span := tracing.Start(ctx, "WebhookModel.Delete")
+	defer span.End()
+
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM webhook_subscriptions
+		WHERE id = $1 AND organization_id = $2`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, m.OrganizationID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m WebhookModel) InsertDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	ctx, span := tracing.Start(ctx, "WebhookModel.InsertDelivery")
+	defer span.End()
+
+	query := `
+		INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, attempt, status_code, error, success, duration_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`
+
+	args := []interface{}{
+		delivery.SubscriptionID,
+		delivery.EventID,
+		delivery.EventType,
+		delivery.Attempt,
+		delivery.StatusCode,
+		delivery.Error,
+		delivery.Success,
+		delivery.DurationMS,
+	}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&delivery.ID, &delivery.CreatedAt)
+}
+
+// GetDeliveries returns the delivery log of a subscription, newest first.
+func (m WebhookModel) GetDeliveries(ctx context.Context, subscriptionID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	ctx, span := tracing.Start(ctx, "WebhookModel.GetDeliveries")
+	defer span.End()
+
+	query := `
+		SELECT count(*) OVER(), id, created_at, subscription_id, event_id, event_type, attempt, status_code, error, success, duration_ms
+		FROM webhook_deliveries
+		WHERE subscription_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, subscriptionID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.SubscriptionID,
+			&delivery.EventID,
+			&delivery.EventType,
+			&delivery.Attempt,
+			&delivery.StatusCode,
+			&delivery.Error,
+			&delivery.Success,
+			&delivery.DurationMS,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return deliveries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
@@ -0,0 +1,780 @@
+// Package graphql executes GraphQL (https://spec.graphql.org) queries against a
+// schema of Go resolver functions. It supports what clients need to read data:
+// query operations with variables, aliases, arguments, named and inline
+// fragments, the @skip and @include directives and __typename. Mutations,
+// subscriptions, interfaces, unions, input objects and introspection aren't
+// supported.
+//
+// Every query is checked against the schema and against depth, width and
+// complexity limits before any resolver runs, so a single request can't be made to do an
+// unbounded amount of work.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidQuery is wrapped by the errors of queries that can't be parsed, or
+	// that aren't valid against the schema.
+	ErrInvalidQuery = errors.New("invalid query")
+	// ErrTooComplex is wrapped by the errors of queries over the depth, root
+	// field or complexity limit.
+	ErrTooComplex = errors.New("query too complex")
+)
+
+// Schema is the set of types a query can select fields from, starting at Query.
+type Schema struct {
+	Query *Object
+	// MaxDepth is how deeply fields can be nested, counting the fields of Query
+	// as depth 1.
+	MaxDepth int
+	// MaxRootFields is how many fields of Query can be selected, counting each
+	// alias of a field separately, so a query can't call the resolvers of Query
+	// any number of times.
+	MaxRootFields int
+	// MaxComplexity is the highest total cost of the fields of a query. See
+	// Field.Complexity.
+	MaxComplexity int
+}
+
+// Object is an object type: a set of fields, which are selected by name.
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+// Field is a field of an Object.
+type Field struct {
+	// Type is the object type of the field's value, or nil for fields holding a
+	// scalar, or a list of them, which have no fields of their own to select.
+	Type *Object
+	// List is set if the field holds a list of Type.
+	List bool
+	// Args maps the name of each argument the field takes to its type, such as
+	// "Int", "[String!]" or "ID!". The scalars Int, Float, String, Boolean and ID
+	// are supported.
+	Args map[string]string
+	// Resolve returns the field's value, given the value of the object the field
+	// belongs to and the field's arguments, which are int64, float64, string, bool
+	// or []any. Arguments that weren't given are missing from args. Without
+	// Resolve, the value is the struct field with the same name in its json tag, or
+	// the map entry with the same key.
+	//
+	// Errors are reported in the result, at the field's path, and the field is
+	// null. Return an *Error to control its message and extensions.
+	Resolve func(ctx context.Context, source any, args map[string]any) (any, error)
+	// Complexity returns the cost of selecting the field, given its arguments and
+	// the total cost of the fields selected from its value. Without it, the cost is
+	// 1 plus that of the fields selected from it. List fields should multiply the
+	// latter by the number of items they can return.
+	Complexity func(args map[string]any, childComplexity int) int
+}
+
+// Request is a query to execute, as sent by the client.
+type Request struct {
+	Query string
+	// OperationName picks the operation to execute when the query holds several.
+	OperationName string
+	Variables     map[string]any
+}
+
+// Result is the outcome of executing a Request.
+type Result struct {
+	// Data is the selected fields, in the order they were selected. It's nil if
+	// the query couldn't be executed at all, in which case Errors say why.
+	Data   any
+	Errors []*Error
+}
+
+// Error is a GraphQL error, as sent to the client.
+type Error struct {
+	Message    string         `json:"message"`
+	Locations  []Location     `json:"locations,omitempty"`
+	Path       []any          `json:"path,omitempty"`
+	Extensions map[string]any `json:"extensions,omitempty"`
+
+	err error
+}
+
+// Location is a position in the query, counted in characters from 1.
+type Location struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Execute runs the request's query against the schema. Queries that aren't valid
+// or are over the limits get a Result with no Data.
+func (s *Schema) Execute(ctx context.Context, req Request) *Result {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return &Result{Errors: []*Error{asError(err)}}
+	}
+
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return &Result{Errors: []*Error{asError(err)}}
+	}
+
+	variables, err := coerceVariables(op, req.Variables)
+	if err != nil {
+		return &Result{Errors: []*Error{asError(err)}}
+	}
+
+	e := &executor{
+		schema:    s,
+		doc:       doc,
+		operation: op,
+		variables: variables,
+		arguments: make(map[*field]map[string]any),
+	}
+
+	complexity, err := e.analyze(s.Query, op.selectionSet, 1)
+	if err != nil {
+		return &Result{Errors: []*Error{asError(err)}}
+	}
+	if complexity > s.MaxComplexity {
+		return &Result{Errors: []*Error{{
+			Message: fmt.Sprintf("the query has a complexity of %d, more than the maximum of %d", complexity, s.MaxComplexity),
+			err:     ErrTooComplex,
+		}}}
+	}
+
+	data := e.executeSelectionSet(ctx, s.Query, nil, op.selectionSet, nil)
+
+	return &Result{Data: data, Errors: e.errors}
+}
+
+func asError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Message: err.Error(), err: ErrInvalidQuery}
+}
+
+func invalid(format string, args ...any) *Error {
+	return &Error{Message: fmt.Sprintf(format, args...), err: ErrInvalidQuery}
+}
+
+func (d *document) operation(name string) (*operation, error) {
+	var op *operation
+
+	switch {
+	case name != "":
+		i := slices.IndexFunc(d.operations, func(op *operation) bool { return op.name == name })
+		if i < 0 {
+			return nil, invalid("unknown operation %q", name)
+		}
+		op = d.operations[i]
+	case len(d.operations) > 1:
+		return nil, invalid("an operation name is required when the document has several operations")
+	default:
+		op = d.operations[0]
+	}
+
+	if op.kind != "query" {
+		return nil, invalid("%s operations aren't supported", op.kind)
+	}
+
+	return op, nil
+}
+
+func coerceVariables(op *operation, values map[string]any) (map[string]any, error) {
+	variables := make(map[string]any)
+	defined := make(map[string]bool)
+
+	for _, definition := range op.variables {
+		if defined[definition.name] {
+			return nil, invalid("there can be only one variable named $%s", definition.name)
+		}
+		defined[definition.name] = true
+
+		value, ok := values[definition.name]
+		if !ok {
+			if definition.defaultValue == nil {
+				if strings.HasSuffix(definition.typ, "!") {
+					return nil, invalid("variable $%s of type %s must be provided", definition.name, definition.typ)
+				}
+				continue
+			}
+			value = definition.defaultValue
+		}
+
+		coerced, err := coerce(value, definition.typ, nil)
+		if err != nil {
+			return nil, invalid("variable $%s: %s", definition.name, err)
+		}
+		variables[definition.name] = coerced
+	}
+
+	return variables, nil
+}
+
+// coerce converts a value from the query or the variables to typ. Variables in
+// it are replaced by their value, or null if they weren't given.
+func coerce(value any, typ string, variables map[string]any) (any, error) {
+	if v, ok := value.(variable); ok {
+		value = variables[string(v)]
+	}
+
+	if inner, ok := strings.CutSuffix(typ, "!"); ok {
+		if value == nil {
+			return nil, errors.New("must not be null")
+		}
+		return coerce(value, inner, variables)
+	}
+
+	if value == nil {
+		return nil, nil
+	}
+
+	if inner, ok := strings.CutPrefix(typ, "["); ok {
+		inner = strings.TrimSuffix(inner, "]")
+
+		list, ok := value.([]any)
+		if !ok {
+			// A single value is accepted where a list is expected.
+			list = []any{value}
+		}
+
+		coerced := make([]any, len(list))
+		for i, item := range list {
+			c, err := coerce(item, inner, variables)
+			if err != nil {
+				return nil, err
+			}
+			coerced[i] = c
+		}
+		return coerced, nil
+	}
+
+	switch typ {
+	case "Int":
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case float64:
+			// Numbers in the variables come from JSON as float64.
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				return int64(v), nil
+			}
+		}
+		return nil, fmt.Errorf("%s is not an Int", describe(value))
+	case "Float":
+		switch v := value.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+		return nil, fmt.Errorf("%s is not a Float", describe(value))
+	case "String":
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("%s is not a String", describe(value))
+	case "Boolean":
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("%s is not a Boolean", describe(value))
+	case "ID":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				return strconv.FormatInt(int64(v), 10), nil
+			}
+		}
+		return nil, fmt.Errorf("%s is not an ID", describe(value))
+	}
+
+	return nil, fmt.Errorf("unknown type %s", typ)
+}
+
+func describe(value any) string {
+	switch v := value.(type) {
+	case enum:
+		return string(v)
+	case string:
+		return strconv.Quote(v)
+	case []any:
+		return "a list"
+	case map[string]any:
+		return "an object"
+	}
+	return fmt.Sprint(value)
+}
+
+type executor struct {
+	schema    *Schema
+	doc       *document
+	operation *operation
+	// variables holds the values of the operation's variables. Those that weren't
+	// given and have no default are missing.
+	variables map[string]any
+	// arguments holds the coerced arguments of every field, once analyze has
+	// checked them.
+	arguments map[*field]map[string]any
+	errors    []*Error
+}
+
+// fieldGroup is the fields of a selection set that share a response key. They're
+// resolved once, with the fields selected from each merged.
+type fieldGroup struct {
+	key    string
+	fields []*field
+}
+
+// collectFields flattens a selection set's fragments, grouping the fields by
+// response key in the order they were selected. When skip is set, fields
+// excluded by @skip or @include are left out.
+func (e *executor) collectFields(obj *Object, selectionSet []selection, skip bool, groups []*fieldGroup, visiting []string) ([]*fieldGroup, error) {
+	for _, s := range selectionSet {
+		switch s := s.(type) {
+		case *field:
+			if skip && e.skipped(s.directives) {
+				continue
+			}
+
+			i := slices.IndexFunc(groups, func(g *fieldGroup) bool { return g.key == s.responseKey() })
+			if i < 0 {
+				groups = append(groups, &fieldGroup{key: s.responseKey(), fields: []*field{s}})
+				continue
+			}
+			if groups[i].fields[0].name != s.name {
+				return nil, errorAt(s.pos, "fields %s and %s can't both be selected as %q", groups[i].fields[0].name, s.name, s.responseKey())
+			}
+			groups[i].fields = append(groups[i].fields, s)
+
+		case *fragmentSpread:
+			if skip && e.skipped(s.directives) {
+				continue
+			}
+
+			f, ok := e.doc.fragments[s.name]
+			if !ok {
+				return nil, errorAt(s.pos, "unknown fragment %q", s.name)
+			}
+			if slices.Contains(visiting, s.name) {
+				return nil, errorAt(s.pos, "fragment %q spreads itself", s.name)
+			}
+			if f.typeCondition != obj.Name {
+				return nil, errorAt(s.pos, "fragment %q on %s can't be spread on %s", s.name, f.typeCondition, obj.Name)
+			}
+
+			var err error
+			groups, err = e.collectFields(obj, f.selectionSet, skip, groups, append(visiting, s.name))
+			if err != nil {
+				return nil, err
+			}
+
+		case *inlineFragment:
+			if skip && e.skipped(s.directives) {
+				continue
+			}
+
+			if s.typeCondition != "" && s.typeCondition != obj.Name {
+				return nil, errorAt(s.pos, "fragment on %s can't be spread on %s", s.typeCondition, obj.Name)
+			}
+
+			var err error
+			groups, err = e.collectFields(obj, s.selectionSet, skip, groups, visiting)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// skipped reports whether the directives exclude the selection. They've been
+// checked by analyze.
+func (e *executor) skipped(directives []*directive) bool {
+	for _, d := range directives {
+		condition, _ := coerce(d.arguments["if"], "Boolean!", e.variables)
+		if (d.name == "skip") == (condition == true) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *executor) checkDirectives(directives []*directive) error {
+	for _, d := range directives {
+		if d.name != "skip" && d.name != "include" {
+			return errorAt(d.pos, "unknown directive @%s", d.name)
+		}
+		for name := range d.arguments {
+			if name != "if" {
+				return errorAt(d.pos, "unknown argument %q of directive @%s", name, d.name)
+			}
+		}
+		if _, err := coerce(d.arguments["if"], "Boolean!", e.variables); err != nil {
+			return errorAt(d.pos, "argument \"if\" of directive @%s: %s", d.name, err)
+		}
+	}
+	return nil
+}
+
+// analyze checks that a selection set is valid against obj, and within the depth
+// and root field limits, returning its complexity. Fields excluded by @skip or
+// @include are counted all the same.
+func (e *executor) analyze(obj *Object, selectionSet []selection, depth int) (int, error) {
+	if err := e.checkSelectionDirectives(selectionSet, nil); err != nil {
+		return 0, err
+	}
+
+	groups, err := e.collectFields(obj, selectionSet, false, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if depth == 1 && len(groups) > e.schema.MaxRootFields {
+		return 0, &Error{
+			Message:   fmt.Sprintf("the query selects more than %d fields of %s", e.schema.MaxRootFields, obj.Name),
+			Locations: []Location{groups[e.schema.MaxRootFields].fields[0].pos},
+			err:       ErrTooComplex,
+		}
+	}
+
+	complexity := 0
+
+	for _, g := range groups {
+		f := g.fields[0]
+
+		if depth > e.schema.MaxDepth {
+			return 0, &Error{
+				Message:   fmt.Sprintf("the query is nested more than %d fields deep", e.schema.MaxDepth),
+				Locations: []Location{f.pos},
+				err:       ErrTooComplex,
+			}
+		}
+
+		if f.name == "__typename" {
+			if len(f.arguments) > 0 || f.selectionSet != nil {
+				return 0, errorAt(f.pos, "field __typename takes no arguments or selection set")
+			}
+			continue
+		}
+
+		definition, ok := obj.Fields[f.name]
+		if !ok {
+			return 0, errorAt(f.pos, "unknown field %q on type %s", f.name, obj.Name)
+		}
+
+		var args map[string]any
+		for _, f := range g.fields {
+			coerced, err := e.coerceArguments(definition, f)
+			if err != nil {
+				return 0, err
+			}
+			if args != nil && !reflect.DeepEqual(args, coerced) {
+				return 0, errorAt(f.pos, "field %q is selected as %q more than once with different arguments", f.name, g.key)
+			}
+			args = coerced
+		}
+
+		childComplexity := 0
+
+		var children []selection
+		for _, f := range g.fields {
+			children = append(children, f.selectionSet...)
+		}
+
+		switch {
+		case definition.Type == nil && children != nil:
+			return 0, errorAt(f.pos, "field %q on type %s is a scalar and can't have a selection set", f.name, obj.Name)
+		case definition.Type != nil && children == nil:
+			return 0, errorAt(f.pos, "field %q on type %s must have a selection set", f.name, obj.Name)
+		case definition.Type != nil:
+			childComplexity, err = e.analyze(definition.Type, children, depth+1)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if definition.Complexity != nil {
+			complexity += definition.Complexity(args, childComplexity)
+		} else {
+			complexity += 1 + childComplexity
+		}
+
+		// Checked as we go, so that the totals can't grow large enough to overflow.
+		if complexity > e.schema.MaxComplexity {
+			return complexity, nil
+		}
+	}
+
+	return complexity, nil
+}
+
+// checkSelectionDirectives checks the directives used in a selection set,
+// including those in the fragments it spreads, but not in its fields' own
+// selection sets, which analyze checks in turn.
+func (e *executor) checkSelectionDirectives(selectionSet []selection, visiting []string) error {
+	for _, s := range selectionSet {
+		switch s := s.(type) {
+		case *field:
+			if err := e.checkDirectives(s.directives); err != nil {
+				return err
+			}
+		case *fragmentSpread:
+			if err := e.checkDirectives(s.directives); err != nil {
+				return err
+			}
+			// Unknown and cyclic fragments are reported by collectFields.
+			if f, ok := e.doc.fragments[s.name]; ok && !slices.Contains(visiting, s.name) {
+				if err := e.checkSelectionDirectives(f.selectionSet, append(visiting, s.name)); err != nil {
+					return err
+				}
+			}
+		case *inlineFragment:
+			if err := e.checkDirectives(s.directives); err != nil {
+				return err
+			}
+			if err := e.checkSelectionDirectives(s.selectionSet, visiting); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *executor) coerceArguments(definition *Field, f *field) (map[string]any, error) {
+	if args, ok := e.arguments[f]; ok {
+		return args, nil
+	}
+
+	for name := range f.arguments {
+		if _, ok := definition.Args[name]; !ok {
+			return nil, errorAt(f.pos, "unknown argument %q of field %q", name, f.name)
+		}
+	}
+
+	args := make(map[string]any)
+	for name, typ := range definition.Args {
+		value, given := f.arguments[name]
+		if v, ok := value.(variable); ok {
+			if !e.defined(string(v)) {
+				return nil, errorAt(f.pos, "variable $%s is not defined by the operation", v)
+			}
+			if _, ok := e.variables[string(v)]; !ok {
+				given = false
+			}
+		}
+		if !given {
+			if strings.HasSuffix(typ, "!") {
+				return nil, errorAt(f.pos, "argument %q of field %q is required", name, f.name)
+			}
+			continue
+		}
+
+		coerced, err := coerce(value, typ, e.variables)
+		if err != nil {
+			return nil, errorAt(f.pos, "argument %q of field %q: %s", name, f.name, err)
+		}
+		args[name] = coerced
+	}
+
+	e.arguments[f] = args
+	return args, nil
+}
+
+func (e *executor) defined(name string) bool {
+	return slices.ContainsFunc(e.operation.variables, func(definition *variableDefinition) bool {
+		return definition.name == name
+	})
+}
+
+// executeSelectionSet resolves the fields selected from source, an object of
+// type obj. Field errors are recorded, leaving the field null.
+func (e *executor) executeSelectionSet(ctx context.Context, obj *Object, source any, selectionSet []selection, path []any) *response {
+	// The selection set has been analyzed, so this can't fail.
+	groups, _ := e.collectFields(obj, selectionSet, true, nil, nil)
+
+	resp := &response{}
+
+	for _, g := range groups {
+		f := g.fields[0]
+		fieldPath := append(slices.Clip(path), g.key)
+
+		if f.name == "__typename" {
+			resp.add(g.key, obj.Name)
+			continue
+		}
+
+		definition := obj.Fields[f.name]
+
+		var value any
+		var err error
+		if definition.Resolve != nil {
+			value, err = definition.Resolve(ctx, source, e.arguments[f])
+		} else {
+			value = defaultResolve(source, f.name)
+		}
+		if err != nil {
+			e.addError(err, f, fieldPath)
+			resp.add(g.key, nil)
+			continue
+		}
+
+		var children []selection
+		for _, f := range g.fields {
+			children = append(children, f.selectionSet...)
+		}
+
+		resp.add(g.key, e.complete(ctx, definition, value, children, fieldPath))
+	}
+
+	return resp
+}
+
+// complete turns a resolved value into its part of the response, executing the
+// selection set on it if it's an object or a list of objects.
+func (e *executor) complete(ctx context.Context, definition *Field, value any, selectionSet []selection, path []any) any {
+	if definition.Type == nil || isNil(value) {
+		return value
+	}
+
+	if !definition.List {
+		return e.executeSelectionSet(ctx, definition.Type, value, selectionSet, path)
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice {
+		e.errors = append(e.errors, &Error{Message: "expected a list", Path: path})
+		return nil
+	}
+
+	list := make([]any, v.Len())
+	for i := range list {
+		item := v.Index(i).Interface()
+		if isNil(item) {
+			continue
+		}
+		list[i] = e.executeSelectionSet(ctx, definition.Type, item, selectionSet, append(slices.Clip(path), i))
+	}
+
+	return list
+}
+
+func (e *executor) addError(err error, f *field, path []any) {
+	gqlErr := &Error{Message: err.Error(), err: err}
+
+	var resolverErr *Error
+	if errors.As(err, &resolverErr) {
+		copied := *resolverErr
+		gqlErr = &copied
+	}
+
+	gqlErr.Locations = []Location{f.pos}
+	gqlErr.Path = path
+
+	e.errors = append(e.errors, gqlErr)
+}
+
+func isNil(value any) bool {
+	if value == nil {
+		return true
+	}
+
+	switch v := reflect.ValueOf(value); v.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// defaultResolve returns the struct field of source whose json tag has the given
+// name, or the entry of a map with that key.
+func defaultResolve(source any, name string) any {
+	v := reflect.ValueOf(source)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		if value := v.MapIndex(reflect.ValueOf(name)); value.IsValid() {
+			return value.Interface()
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := range t.NumField() {
+			tagName, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if tagName == "" {
+				tagName = t.Field(i).Name
+			}
+			if tagName == name && t.Field(i).IsExported() {
+				return v.Field(i).Interface()
+			}
+		}
+	}
+
+	return nil
+}
+
+// response is a JSON object whose keys stay in the order they were selected in,
+// as the spec requires.
+type response struct {
+	keys   []string
+	values []any
+}
+
+func (r *response) add(key string, value any) {
+	r.keys = append(r.keys, key)
+	r.values = append(r.values, value)
+}
+
+func (r *response) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	for i, key := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(r.values[i])
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,335 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+type testBook struct {
+	ID      int64    `json:"id"`
+	Title   string   `json:"title"`
+	Authors []string `json:"authors,omitempty"`
+	Secret  string   `json:"-"`
+}
+
+var testBooks = []*testBook{
+	{ID: 1, Title: "Dune", Authors: []string{"Frank Herbert"}},
+	{ID: 2, Title: "Good Omens", Authors: []string{"Terry Pratchett", "Neil Gaiman"}},
+	{ID: 3, Title: "Hyperion", Authors: []string{"Dan Simmons"}},
+}
+
+func testSchema() *Schema {
+	book := &Object{
+		Name: "Book",
+		Fields: map[string]*Field{
+			"id":      {},
+			"title":   {},
+			"authors": {},
+			"secret":  {},
+			"loud": {
+				Args: map[string]string{"times": "Int"},
+				Resolve: func(ctx context.Context, source any, args map[string]any) (any, error) {
+					title := source.(*testBook).Title
+					times, _ := args["times"].(int64)
+					for range times {
+						title += "!"
+					}
+					return title, nil
+				},
+			},
+		},
+	}
+	book.Fields["related"] = &Field{
+		Type: book,
+		List: true,
+		Resolve: func(ctx context.Context, source any, args map[string]any) (any, error) {
+			return testBooks, nil
+		},
+	}
+
+	return &Schema{
+		Query: &Object{
+			Name: "Query",
+			Fields: map[string]*Field{
+				"book": {
+					Type: book,
+					Args: map[string]string{"id": "Int!"},
+					Resolve: func(ctx context.Context, source any, args map[string]any) (any, error) {
+						for _, b := range testBooks {
+							if b.ID == args["id"].(int64) {
+								return b, nil
+							}
+						}
+						return nil, &Error{Message: "not found", Extensions: map[string]any{"code": "not_found"}}
+					},
+				},
+				"books": {
+					Type: book,
+					List: true,
+					Args: map[string]string{"first": "Int", "ids": "[Int!]"},
+					Resolve: func(ctx context.Context, source any, args map[string]any) (any, error) {
+						books := testBooks
+						if ids, ok := args["ids"].([]any); ok {
+							books = nil
+							for _, id := range ids {
+								books = append(books, testBooks[id.(int64)-1])
+							}
+						}
+						if first, ok := args["first"].(int64); ok && int(first) < len(books) {
+							books = books[:first]
+						}
+						return books, nil
+					},
+					Complexity: func(args map[string]any, childComplexity int) int {
+						first, ok := args["first"].(int64)
+						if !ok {
+							first = 10
+						}
+						return 1 + int(first)*childComplexity
+					},
+				},
+				"greeting": {
+					Args: map[string]string{"name": "String"},
+					Resolve: func(ctx context.Context, source any, args map[string]any) (any, error) {
+						name, ok := args["name"].(string)
+						if !ok {
+							name = "world"
+						}
+						return "Hello, " + name, nil
+					},
+				},
+				"broken": {
+					Resolve: func(ctx context.Context, source any, args map[string]any) (any, error) {
+						return nil, errors.New("broken resolver")
+					},
+				},
+			},
+		},
+		MaxDepth:      3,
+		MaxRootFields: 5,
+		MaxComplexity: 50,
+	}
+}
+
+func execute(t *testing.T, req Request) (string, []*Error) {
+	t.Helper()
+
+	result := testSchema().Execute(context.Background(), req)
+	if result.Data == nil {
+		return "", result.Errors
+	}
+
+	js, err := json.Marshal(result.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(js), result.Errors
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		variables map[string]any
+		want      string
+	}{
+		{
+			name:  "Shorthand query",
+			query: `{ greeting }`,
+			want:  `{"greeting":"Hello, world"}`,
+		},
+		{
+			name:  "Fields keep their order",
+			query: `query { book(id: 2) { title id } greeting(name: "Ada") }`,
+			want:  `{"book":{"title":"Good Omens","id":2},"greeting":"Hello, Ada"}`,
+		},
+		{
+			name:  "Aliases",
+			query: `{ first: book(id: 1) { title } third: book(id: 3) { name: title } }`,
+			want:  `{"first":{"title":"Dune"},"third":{"name":"Hyperion"}}`,
+		},
+		{
+			name:  "Lists",
+			query: `{ books(first: 2) { id authors } }`,
+			want:  `{"books":[{"id":1,"authors":["Frank Herbert"]},{"id":2,"authors":["Terry Pratchett","Neil Gaiman"]}]}`,
+		},
+		{
+			name:  "Fields without json tags are null",
+			query: `{ book(id: 1) { secret } }`,
+			want:  `{"book":{"secret":null}}`,
+		},
+		{
+			name:      "Variables",
+			query:     `query Find($id: Int!, $times: Int = 2) { book(id: $id) { loud(times: $times) } }`,
+			operation: "Find",
+			variables: map[string]any{"id": 3.0},
+			want:      `{"book":{"loud":"Hyperion!!"}}`,
+		},
+		{
+			name:      "List variables",
+			query:     `query ($ids: [Int!]) { books(ids: $ids) { id } }`,
+			variables: map[string]any{"ids": []any{3.0, 1.0}},
+			want:      `{"books":[{"id":3},{"id":1}]}`,
+		},
+		{
+			name:  "Single value for a list",
+			query: `{ books(ids: 2) { id } }`,
+			want:  `{"books":[{"id":2}]}`,
+		},
+		{
+			name:  "Optional variable not given",
+			query: `query ($name: String) { greeting(name: $name) }`,
+			want:  `{"greeting":"Hello, world"}`,
+		},
+		{
+			name:      "Operation name",
+			query:     `query A { greeting } query B { book(id: 1) { id } }`,
+			operation: "B",
+			want:      `{"book":{"id":1}}`,
+		},
+		{
+			name: "Fragments",
+			query: `
+				query { book(id: 1) { ...Names ... on Book { id } ... { loud } } }
+				fragment Names on Book { title authors }
+			`,
+			want: `{"book":{"title":"Dune","authors":["Frank Herbert"],"id":1,"loud":"Dune"}}`,
+		},
+		{
+			name:  "Merged selections",
+			query: `{ book(id: 1) { title } book(id: 1) { id title } }`,
+			want:  `{"book":{"title":"Dune","id":1}}`,
+		},
+		{
+			name:      "Directives",
+			query:     `query ($yes: Boolean!) { book(id: 1) { id @skip(if: $yes) title @include(if: $yes) authors @include(if: false) } }`,
+			variables: map[string]any{"yes": true},
+			want:      `{"book":{"title":"Dune"}}`,
+		},
+		{
+			name:  "Typename",
+			query: `{ __typename book(id: 1) { __typename } }`,
+			want:  `{"__typename":"Query","book":{"__typename":"Book"}}`,
+		},
+		{
+			name: "Comments, commas and strings",
+			query: `# Find a book
+				{ greeting(name: "\"Tab\"\té"), other: greeting(name: """
+					Block
+					  string
+				""") }`,
+			want: `{"greeting":"Hello, \"Tab\"\té","other":"Hello, Block\n  string"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := execute(t, Request{Query: tt.query, OperationName: tt.operation, Variables: tt.variables})
+			if len(errs) > 0 {
+				t.Fatalf("unexpected error: %s", errs[0])
+			}
+			assert.Equal(t, got, tt.want)
+		})
+	}
+}
+
+func TestExecuteFieldErrors(t *testing.T) {
+	got, errs := execute(t, Request{Query: `{ greeting broken book(id: 9) { id } other: book(id: 1) { id } }`})
+
+	assert.Equal(t, got, `{"greeting":"Hello, world","broken":null,"book":null,"other":{"id":1}}`)
+	assert.Equal(t, len(errs), 2)
+
+	assert.Equal(t, errs[0].Message, "broken resolver")
+	assert.Equal(t, fmt.Sprint(errs[0].Path), "[broken]")
+	assert.Equal(t, fmt.Sprint(errs[0].Locations), "[{1 12}]")
+
+	assert.Equal(t, errs[1].Message, "not found")
+	assert.Equal(t, fmt.Sprint(errs[1].Path), "[book]")
+	assert.Equal(t, errs[1].Extensions["code"], any("not_found"))
+}
+
+func TestExecuteInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]any
+		wantErr   error
+		wantMsg   string
+	}{
+		{"Syntax error", `{ book(id: 1) { id }`, nil, ErrInvalidQuery, "unexpected end of document"},
+		{"Unknown field", `{ book(id: 1) { isbn } }`, nil, ErrInvalidQuery, `unknown field "isbn" on type Book`},
+		{"Missing selection set", `{ book(id: 1) }`, nil, ErrInvalidQuery, `field "book" on type Query must have a selection set`},
+		{"Selection set on scalar", `{ greeting { length } }`, nil, ErrInvalidQuery, `field "greeting" on type Query is a scalar and can't have a selection set`},
+		{"Unknown argument", `{ book(isbn: 1) { id } }`, nil, ErrInvalidQuery, `unknown argument "isbn" of field "book"`},
+		{"Missing argument", `{ book { id } }`, nil, ErrInvalidQuery, `argument "id" of field "book" is required`},
+		{"Wrong argument type", `{ book(id: "1") { id } }`, nil, ErrInvalidQuery, `argument "id" of field "book": "1" is not an Int`},
+		{"Undefined variable", `{ book(id: $id) { id } }`, nil, ErrInvalidQuery, "variable $id is not defined by the operation"},
+		{"Missing variable", `query ($id: Int!) { book(id: $id) { id } }`, nil, ErrInvalidQuery, "variable $id of type Int! must be provided"},
+		{"Wrong variable type", `query ($id: Int!) { book(id: $id) { id } }`, map[string]any{"id": 1.5}, ErrInvalidQuery, "variable $id: 1.5 is not an Int"},
+		{"Conflicting aliases", `{ x: greeting x: broken }`, nil, ErrInvalidQuery, `fields greeting and broken can't both be selected as "x"`},
+		{"Unknown fragment", `{ ...Missing }`, nil, ErrInvalidQuery, `unknown fragment "Missing"`},
+		{"Fragment cycle", `{ book(id: 1) { ...A } } fragment A on Book { related { ...A } }`, nil, ErrTooComplex, "the query is nested more than 3 fields deep"},
+		{"Direct fragment cycle", `{ book(id: 1) { ...A } } fragment A on Book { ...A }`, nil, ErrInvalidQuery, `fragment "A" spreads itself`},
+		{"Wrong fragment type", `{ ... on Book { id } }`, nil, ErrInvalidQuery, "fragment on Book can't be spread on Query"},
+		{"Unknown directive", `{ greeting @deprecated }`, nil, ErrInvalidQuery, "unknown directive @deprecated"},
+		{"Mutation", `mutation { greeting }`, nil, ErrInvalidQuery, "mutation operations aren't supported"},
+		{"Ambiguous operation", `query A { greeting } query B { greeting }`, nil, ErrInvalidQuery, "an operation name is required when the document has several operations"},
+		{"Too deep", `{ book(id: 1) { related { related { id } } } }`, nil, ErrTooComplex, "the query is nested more than 3 fields deep"},
+		{"Too complex", `{ books { id title authors loud related { id } } }`, nil, ErrTooComplex, "the query has a complexity of 61, more than the maximum of 50"},
+		{"Too complex by aliases", `{ a: books { id title } b: books { id title } c: books { id title } }`, nil, ErrTooComplex, "the query has a complexity of 63, more than the maximum of 50"},
+		{"Too many root fields", `{ a: greeting b: greeting c: greeting d: greeting e: greeting f: greeting }`, nil, ErrTooComplex, "the query selects more than 5 fields of Query"},
+		{"Too deeply nested", `{ greeting(name: ` + nested(100) + `) }`, nil, ErrInvalidQuery, "values are nested too deeply"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := execute(t, Request{Query: tt.query, Variables: tt.variables})
+			assert.Equal(t, got, "")
+			assert.Equal(t, len(errs), 1)
+			assert.Equal(t, errors.Is(errs[0], tt.wantErr), true)
+			assert.Equal(t, errs[0].Message, tt.wantMsg)
+		})
+	}
+}
+
+func nested(n int) string {
+	s := "1"
+	for range n {
+		s = "[" + s + "]"
+	}
+	return s
+}
+
+func FuzzExecute(f *testing.F) {
+	f.Add(`{ book(id: 1) { id title } }`)
+	f.Add(`query Q($id: Int! = 2) { book(id: $id) { ...F } } fragment F on Book { id related { id } }`)
+	f.Add(`{ books { id title authors } greeting(name: "Bob") broken }`)
+	f.Add(`{ x: greeting @skip(if: true) ... on Query { greeting @include(if: false) } }`)
+	f.Add(`{ greeting(name: "é\"\\") }`)
+	f.Add(`{ book(id: 1) { ...A } } fragment A on Book { ...A }`)
+	f.Add(`{ greeting(name: [[[[1]]]]) } # comment`)
+
+	schema := testSchema()
+
+	f.Fuzz(func(t *testing.T, query string) {
+		result := schema.Execute(context.Background(), Request{Query: query})
+
+		if result.Data == nil {
+			if len(result.Errors) == 0 {
+				t.Fatalf("%q: no data and no errors", query)
+			}
+			return
+		}
+
+		if _, err := json.Marshal(result.Data); err != nil {
+			t.Fatalf("%q: data can't be encoded: %v", query, err)
+		}
+	})
+}
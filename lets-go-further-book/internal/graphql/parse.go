@@ -0,0 +1,849 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxNesting bounds how deeply selection sets and values can be nested while
+// parsing, so a small malicious query can't exhaust the stack. Depth limits
+// proper are applied to the parsed query by Schema.Execute.
+const maxNesting = 64
+
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	kind         string // "query", "mutation" or "subscription"
+	name         string
+	variables    []*variableDefinition
+	selectionSet []selection
+}
+
+type variableDefinition struct {
+	name         string
+	typ          string // As written, e.g. "[String!]!"
+	defaultValue any    // nil if there's none
+}
+
+type fragment struct {
+	name          string
+	typeCondition string
+	selectionSet  []selection
+	pos           Location
+}
+
+// selection is a *field, *fragmentSpread or *inlineFragment.
+type selection any
+
+type field struct {
+	alias        string
+	name         string
+	arguments    map[string]any
+	directives   []*directive
+	selectionSet []selection
+	pos          Location
+}
+
+// responseKey is the key the field's value is given in the response.
+func (f *field) responseKey() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type fragmentSpread struct {
+	name       string
+	directives []*directive
+	pos        Location
+}
+
+type inlineFragment struct {
+	typeCondition string // Empty if there's none
+	directives    []*directive
+	selectionSet  []selection
+	pos           Location
+}
+
+type directive struct {
+	name      string
+	arguments map[string]any
+	pos       Location
+}
+
+// Values in the query are int64, float64, string, bool, nil, []any,
+// map[string]any, variable or enum.
+type (
+	variable string
+	enum     string
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string // The punctuator or name as written, or the decoded string
+	pos   Location
+}
+
+// parser is a recursive descent parser over the query's tokens, which it reads
+// one at a time.
+type parser struct {
+	src     string
+	offset  int
+	line    int
+	lineEnd int // Offset of the start of the current line
+	tok     token
+	nesting int
+}
+
+func parse(src string) (*document, error) {
+	p := &parser{src: src, line: 1}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	doc := &document{fragments: make(map[string]*fragment)}
+
+	for p.tok.kind != tokenEOF {
+		switch {
+		case p.peek("{"):
+			selectionSet, err := p.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{kind: "query", selectionSet: selectionSet})
+		case p.peekName("query"), p.peekName("mutation"), p.peekName("subscription"):
+			op, err := p.parseOperation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peekName("fragment"):
+			f, err := p.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := doc.fragments[f.name]; exists {
+				return nil, errorAt(f.pos, "there can be only one fragment named %q", f.name)
+			}
+			doc.fragments[f.name] = f
+		default:
+			return nil, p.unexpected()
+		}
+	}
+
+	if len(doc.operations) == 0 {
+		return nil, errorAt(p.tok.pos, "the document has no operations")
+	}
+
+	return doc, nil
+}
+
+func (p *parser) parseOperation() (*operation, error) {
+	op := &operation{kind: p.tok.value}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind == tokenName {
+		op.name = p.tok.value
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek("(") {
+		variables, err := p.parseVariableDefinitions()
+		if err != nil {
+			return nil, err
+		}
+		op.variables = variables
+	}
+
+	// Directives on operations are allowed by the grammar, but none apply to them.
+	if p.peek("@") {
+		return nil, errorAt(p.tok.pos, "directives aren't supported on operations")
+	}
+
+	selectionSet, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selectionSet = selectionSet
+
+	return op, nil
+}
+
+func (p *parser) parseVariableDefinitions() ([]*variableDefinition, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var definitions []*variableDefinition
+	for !p.peek(")") {
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		typ, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+
+		definition := &variableDefinition{name: name, typ: typ}
+
+		if p.peek("=") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			value, err := p.parseValue(true)
+			if err != nil {
+				return nil, err
+			}
+			definition.defaultValue = value
+		}
+
+		definitions = append(definitions, definition)
+	}
+
+	return definitions, p.next()
+}
+
+func (p *parser) parseType() (string, error) {
+	var typ string
+
+	if p.peek("[") {
+		if err := p.next(); err != nil {
+			return "", err
+		}
+		inner, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.parseName()
+		if err != nil {
+			return "", err
+		}
+		typ = name
+	}
+
+	if p.peek("!") {
+		typ += "!"
+		return typ, p.next()
+	}
+
+	return typ, nil
+}
+
+func (p *parser) parseFragment() (*fragment, error) {
+	f := &fragment{pos: p.tok.pos}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.peekName("on") {
+		return nil, p.unexpected()
+	}
+	name, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	f.name = name
+
+	if !p.peekName("on") {
+		return nil, p.unexpected()
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	typeCondition, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	f.typeCondition = typeCondition
+
+	if p.peek("@") {
+		return nil, errorAt(p.tok.pos, "directives aren't supported on fragment definitions")
+	}
+
+	selectionSet, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	f.selectionSet = selectionSet
+
+	return f, nil
+}
+
+func (p *parser) parseSelectionSet() ([]selection, error) {
+	pos := p.tok.pos
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	if p.nesting++; p.nesting > maxNesting {
+		return nil, errorAt(pos, "selection sets are nested too deeply")
+	}
+	defer func() { p.nesting-- }()
+
+	var selections []selection
+	for !p.peek("}") {
+		s, err := p.parseSelection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+
+	if len(selections) == 0 {
+		return nil, errorAt(pos, "selection sets must not be empty")
+	}
+
+	return selections, p.next()
+}
+
+func (p *parser) parseSelection() (selection, error) {
+	pos := p.tok.pos
+
+	if !p.peek("...") {
+		return p.parseField()
+	}
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind == tokenName && p.tok.value != "on" {
+		spread := &fragmentSpread{name: p.tok.value, pos: pos}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		directives, err := p.parseDirectives()
+		if err != nil {
+			return nil, err
+		}
+		spread.directives = directives
+		return spread, nil
+	}
+
+	inline := &inlineFragment{pos: pos}
+
+	if p.peekName("on") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		typeCondition, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		inline.typeCondition = typeCondition
+	}
+
+	directives, err := p.parseDirectives()
+	if err != nil {
+		return nil, err
+	}
+	inline.directives = directives
+
+	selectionSet, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	inline.selectionSet = selectionSet
+
+	return inline, nil
+}
+
+func (p *parser) parseField() (*field, error) {
+	f := &field{pos: p.tok.pos}
+
+	name, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	f.name = name
+
+	if p.peek(":") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		f.alias, f.name = f.name, name
+	}
+
+	if p.peek("(") {
+		arguments, err := p.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+		f.arguments = arguments
+	}
+
+	directives, err := p.parseDirectives()
+	if err != nil {
+		return nil, err
+	}
+	f.directives = directives
+
+	if p.peek("{") {
+		selectionSet, err := p.parseSelectionSet()
+		if err != nil {
+			return nil, err
+		}
+		f.selectionSet = selectionSet
+	}
+
+	return f, nil
+}
+
+func (p *parser) parseArguments() (map[string]any, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	arguments := make(map[string]any)
+	for !p.peek(")") {
+		pos := p.tok.pos
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.parseValue(false)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := arguments[name]; exists {
+			return nil, errorAt(pos, "there can be only one argument named %q", name)
+		}
+		arguments[name] = value
+	}
+
+	if len(arguments) == 0 {
+		return nil, errorAt(p.tok.pos, "argument lists must not be empty")
+	}
+
+	return arguments, p.next()
+}
+
+func (p *parser) parseDirectives() ([]*directive, error) {
+	var directives []*directive
+
+	for p.peek("@") {
+		d := &directive{pos: p.tok.pos}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		d.name = name
+
+		if p.peek("(") {
+			arguments, err := p.parseArguments()
+			if err != nil {
+				return nil, err
+			}
+			d.arguments = arguments
+		}
+
+		directives = append(directives, d)
+	}
+
+	return directives, nil
+}
+
+// parseValue parses a value literal. Variables aren't allowed in constant values,
+// like the default values of variables.
+func (p *parser) parseValue(constant bool) (any, error) {
+	tok := p.tok
+
+	if p.nesting++; p.nesting > maxNesting {
+		return nil, errorAt(tok.pos, "values are nested too deeply")
+	}
+	defer func() { p.nesting-- }()
+
+	switch {
+	case tok.kind == tokenInt:
+		i, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			return nil, errorAt(tok.pos, "integer %s is out of range", tok.value)
+		}
+		return i, p.next()
+	case tok.kind == tokenFloat:
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, errorAt(tok.pos, "float %s is out of range", tok.value)
+		}
+		return f, p.next()
+	case tok.kind == tokenString:
+		return tok.value, p.next()
+	case tok.kind == tokenName:
+		var value any
+		switch tok.value {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		case "null":
+			value = nil
+		default:
+			value = enum(tok.value)
+		}
+		return value, p.next()
+	case p.peek("$") && !constant:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		return variable(name), nil
+	case p.peek("["):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []any{}
+		for !p.peek("]") {
+			value, err := p.parseValue(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, p.next()
+	case p.peek("{"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		object := map[string]any{}
+		for !p.peek("}") {
+			pos := p.tok.pos
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			value, err := p.parseValue(constant)
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := object[name]; exists {
+				return nil, errorAt(pos, "there can be only one input field named %q", name)
+			}
+			object[name] = value
+		}
+		return object, p.next()
+	}
+
+	return nil, p.unexpected()
+}
+
+func (p *parser) parseName() (string, error) {
+	if p.tok.kind != tokenName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.next()
+}
+
+func (p *parser) peek(punctuator string) bool {
+	return p.tok.kind == tokenPunctuator && p.tok.value == punctuator
+}
+
+func (p *parser) peekName(name string) bool {
+	return p.tok.kind == tokenName && p.tok.value == name
+}
+
+func (p *parser) expect(punctuator string) error {
+	if !p.peek(punctuator) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+func (p *parser) unexpected() error {
+	switch p.tok.kind {
+	case tokenEOF:
+		return errorAt(p.tok.pos, "unexpected end of document")
+	case tokenString:
+		return errorAt(p.tok.pos, "unexpected string %q", p.tok.value)
+	default:
+		return errorAt(p.tok.pos, "unexpected %q", p.tok.value)
+	}
+}
+
+// next reads the next token into p.tok, skipping whitespace, commas and comments.
+func (p *parser) next() error {
+	for p.offset < len(p.src) {
+		c := p.src[p.offset]
+		switch {
+		case c == '\n':
+			p.offset++
+			p.line++
+			p.lineEnd = p.offset
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			p.offset++
+		case c == '#':
+			for p.offset < len(p.src) && p.src[p.offset] != '\n' {
+				p.offset++
+			}
+		case strings.HasPrefix(p.src[p.offset:], "\uFEFF"): // Byte order mark
+			p.offset += len("\uFEFF")
+		default:
+			return p.scan()
+		}
+	}
+
+	p.tok = token{kind: tokenEOF, pos: p.pos()}
+	return nil
+}
+
+func (p *parser) pos() Location {
+	return Location{Line: p.line, Column: utf8.RuneCountInString(p.src[p.lineEnd:p.offset]) + 1}
+}
+
+func (p *parser) scan() error {
+	pos := p.pos()
+	rest := p.src[p.offset:]
+	c := rest[0]
+
+	switch {
+	case strings.HasPrefix(rest, "..."):
+		p.offset += 3
+		p.tok = token{kind: tokenPunctuator, value: "...", pos: pos}
+	case strings.ContainsRune("!$&():=@[]{}|", rune(c)):
+		p.offset++
+		p.tok = token{kind: tokenPunctuator, value: string(c), pos: pos}
+	case c == '_' || isLetter(c):
+		end := 1
+		for end < len(rest) && (rest[end] == '_' || isLetter(rest[end]) || isDigit(rest[end])) {
+			end++
+		}
+		p.offset += end
+		p.tok = token{kind: tokenName, value: rest[:end], pos: pos}
+	case c == '-' || isDigit(c):
+		return p.scanNumber(pos)
+	case c == '"':
+		if strings.HasPrefix(rest, `"""`) {
+			return p.scanBlockString(pos)
+		}
+		return p.scanString(pos)
+	default:
+		r, _ := utf8.DecodeRuneInString(rest)
+		return errorAt(pos, "unexpected character %q", r)
+	}
+
+	return nil
+}
+
+func (p *parser) scanNumber(pos Location) error {
+	rest := p.src[p.offset:]
+	end := 0
+	kind := tokenInt
+
+	if rest[end] == '-' {
+		end++
+	}
+
+	digits := func() int {
+		start := end
+		for end < len(rest) && isDigit(rest[end]) {
+			end++
+		}
+		return end - start
+	}
+
+	n := digits()
+	if n == 0 || (n > 1 && rest[end-n] == '0') {
+		return errorAt(pos, "invalid number %q", rest[:max(end, 1)])
+	}
+	if end < len(rest) && rest[end] == '.' {
+		end++
+		kind = tokenFloat
+		if digits() == 0 {
+			return errorAt(pos, "invalid number %q", rest[:end])
+		}
+	}
+	if end < len(rest) && (rest[end] == 'e' || rest[end] == 'E') {
+		end++
+		kind = tokenFloat
+		if end < len(rest) && (rest[end] == '+' || rest[end] == '-') {
+			end++
+		}
+		if digits() == 0 {
+			return errorAt(pos, "invalid number %q", rest[:end])
+		}
+	}
+	if end < len(rest) && (rest[end] == '_' || rest[end] == '.' || isLetter(rest[end])) {
+		return errorAt(pos, "invalid number %q", rest[:end+1])
+	}
+
+	p.offset += end
+	p.tok = token{kind: kind, value: rest[:end], pos: pos}
+	return nil
+}
+
+func (p *parser) scanString(pos Location) error {
+	var b strings.Builder
+	i := p.offset + 1
+
+	for i < len(p.src) {
+		c := p.src[i]
+		switch {
+		case c == '"':
+			p.offset = i + 1
+			p.tok = token{kind: tokenString, value: b.String(), pos: pos}
+			return nil
+		case c == '\n' || c == '\r':
+			return errorAt(pos, "unterminated string")
+		case c == '\\':
+			if i+1 >= len(p.src) {
+				return errorAt(pos, "unterminated string")
+			}
+			switch e := p.src[i+1]; e {
+			case '"', '\\', '/':
+				b.WriteByte(e)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if i+6 > len(p.src) {
+					return errorAt(pos, "invalid unicode escape in string")
+				}
+				r, err := strconv.ParseUint(p.src[i+2:i+6], 16, 32)
+				if err != nil {
+					return errorAt(pos, "invalid unicode escape in string")
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				return errorAt(pos, "invalid escape sequence \\%c in string", e)
+			}
+			i += 2
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	return errorAt(pos, "unterminated string")
+}
+
+// scanBlockString reads a """triple-quoted""" string, whose common indentation
+// and leading and trailing blank lines are removed.
+func (p *parser) scanBlockString(pos Location) error {
+	start := p.offset + 3
+
+	end := start
+	for {
+		i := strings.Index(p.src[end:], `"""`)
+		if i < 0 {
+			return errorAt(pos, "unterminated string")
+		}
+		end += i
+		if p.src[end-1] != '\\' {
+			break
+		}
+		end += 3
+	}
+
+	raw := strings.ReplaceAll(p.src[start:end], `\"""`, `"""`)
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = ""
+			}
+		}
+	}
+
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	// Keep the line count right for the positions of the tokens that follow.
+	p.line += strings.Count(p.src[p.offset:end], "\n")
+	if i := strings.LastIndex(p.src[p.offset:end], "\n"); i >= 0 {
+		p.lineEnd = p.offset + i + 1
+	}
+
+	p.offset = end + 3
+	p.tok = token{kind: tokenString, value: strings.Join(lines, "\n"), pos: pos}
+	return nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func errorAt(pos Location, format string, args ...any) *Error {
+	return &Error{
+		Message:   fmt.Sprintf(format, args...),
+		Locations: []Location{pos},
+		err:       ErrInvalidQuery,
+	}
+}
@@ -0,0 +1,120 @@
+// Package images decodes uploaded images and renders smaller versions of them,
+// using only the standard library's JPEG, PNG and GIF support.
+package images
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif" // Registers the GIF decoder with image.Decode
+	"image/jpeg"
+	_ "image/png" // Registers the PNG decoder with image.Decode
+	"net/http"
+	"slices"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("images: unsupported format")
+	ErrTooLarge          = errors.New("images: too many pixels")
+)
+
+// MaxPixels limits the size of the images Decode accepts: decoding allocates
+// memory for every pixel, however small the compressed file is.
+const MaxPixels = 40_000_000
+
+// ContentTypes are the formats Decode accepts.
+var ContentTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+// Decode decodes b, returning its content type. The format is sniffed from the
+// data itself, rather than trusting the name or content type the client gave it.
+func Decode(b []byte) (image.Image, string, error) {
+	contentType := http.DetectContentType(b)
+	if !slices.Contains(ContentTypes, contentType) {
+		return nil, "", ErrUnsupportedFormat
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return nil, "", ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return img, contentType, nil
+}
+
+// Flatten returns a copy of img as RGBA, with transparent areas flattened onto
+// white, as the thumbnails made from it with Resize are meant to be encoded as
+// JPEGs. It copies every pixel, so an image is flattened once for all its sizes.
+func Flatten(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+
+	return dst
+}
+
+// Resize scales src down to width pixels wide, keeping its aspect ratio. Each
+// pixel of the result is the average of the pixels it covers in src, which keeps
+// detail that sampling single pixels would alias away. Images no wider than width
+// are returned as they are.
+func Resize(src *image.RGBA, width int) *image.RGBA {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if srcWidth <= width {
+		return src
+	}
+
+	height := max((srcHeight*width+srcWidth/2)/srcWidth, 1)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := max((y+1)*srcHeight/height, y0+1)
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := max((x+1)*srcWidth/width, x0+1)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(bounds.Min.X+x0, bounds.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					sum[0] += int(src.Pix[i])
+					sum[1] += int(src.Pix[i+1])
+					sum[2] += int(src.Pix[i+2])
+					sum[3] += int(src.Pix[i+3])
+					i += 4
+				}
+			}
+
+			n := (x1 - x0) * (y1 - y0)
+			j := dst.PixOffset(x, y)
+			for c := range sum {
+				dst.Pix[j+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+
+	return dst
+}
+
+// EncodeJPEG encodes img at a quality that keeps posters sharp without making
+// their thumbnails much bigger than they need to be.
+func EncodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,100 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	img, contentType, err := Decode(encodePNG(t, image.NewGray(image.Rect(0, 0, 30, 20))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, contentType, "image/png")
+	assert.Equal(t, img.Bounds().Dx(), 30)
+
+	_, _, err = Decode([]byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"))
+	assert.Equal(t, errors.Is(err, ErrUnsupportedFormat), true)
+
+	// A GIF header claiming to be 65535x65535 is refused before any pixels are
+	// allocated.
+	header := []byte("GIF89a")
+	header = binary.LittleEndian.AppendUint16(header, 65535)
+	header = binary.LittleEndian.AppendUint16(header, 65535)
+	header = append(header, 0, 0, 0)
+
+	_, _, err = Decode(header)
+	assert.Equal(t, errors.Is(err, ErrTooLarge), true)
+}
+
+func TestResize(t *testing.T) {
+	// Alternating black and white columns average out to grey.
+	src := image.NewGray(image.Rect(0, 0, 1000, 1500))
+	for x := 0; x < 1000; x += 2 {
+		for y := 0; y < 1500; y++ {
+			src.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+
+	dst := Resize(Flatten(src), 185)
+	assert.Equal(t, dst.Bounds().Dx(), 185)
+	assert.Equal(t, dst.Bounds().Dy(), 278)
+
+	r, _, _, a := dst.At(92, 139).RGBA()
+	assert.Equal(t, r>>8 > 100 && r>>8 < 155, true)
+	assert.Equal(t, a>>8, uint32(255))
+
+	// Smaller images aren't scaled up.
+	dst = Resize(Flatten(image.NewGray(image.Rect(0, 0, 100, 150))), 185)
+	assert.Equal(t, dst.Bounds().Dx(), 100)
+
+	// Part of an image is scaled on its own.
+	halves := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(halves, image.Rect(100, 0, 200, 100), image.Black, image.Point{}, draw.Src)
+	dst = Resize(halves.SubImage(image.Rect(100, 0, 200, 100)).(*image.RGBA), 50)
+	assert.Equal(t, dst.Bounds().Dy(), 50)
+	assert.Equal(t, dst.RGBAAt(0, 0), color.RGBA{0, 0, 0, 255})
+}
+
+func TestFlatten(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(10, 10, 20, 20))
+	src.SetNRGBA(10, 10, color.NRGBA{255, 0, 0, 255})
+
+	// The result starts at the origin, and transparency is flattened onto white.
+	dst := Flatten(src)
+	assert.Equal(t, dst.Bounds(), image.Rect(0, 0, 10, 10))
+	assert.Equal(t, dst.RGBAAt(0, 0), color.RGBA{255, 0, 0, 255})
+	assert.Equal(t, dst.RGBAAt(5, 5), color.RGBA{255, 255, 255, 255})
+}
+
+func TestEncodeJPEG(t *testing.T) {
+	b, err := EncodeJPEG(Resize(Flatten(image.NewGray(image.Rect(0, 0, 400, 600))), 185))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, contentType, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, contentType, "image/jpeg")
+	assert.Equal(t, img.Bounds().Dy(), 278)
+}
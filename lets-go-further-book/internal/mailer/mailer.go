@@ -2,16 +2,25 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"text/template"
 	"time"
 
 	"github.com/go-mail/mail/v2"
+	"greenlight.bagerbach.com/internal/tracing"
 )
 
 //go:embed "templates"
 var templateFS embed.FS
 
+// MailerInterface is implemented by Mailer. Handler tests replace it with a fake
+// that records the messages instead of sending them.
+type MailerInterface interface {
+	Send(ctx context.Context, recipient, templateFile string, data any) error
+	Check(ctx context.Context) error
+}
+
 type Mailer struct {
 	dialer *mail.Dialer
 	sender string
@@ -27,7 +36,17 @@ func New(host string, port int, username, password, sender string) Mailer {
 	}
 }
 
-func (m Mailer) Send(recipient, templateFile string, data any) error {
+// Send renders templateFile with data and sends it to recipient. ctx is only used
+// to trace the send as part of the request that triggered it.
+func (m Mailer) Send(ctx context.Context, recipient, templateFile string, data any) (err error) {
+	_, span := tracing.Start(ctx, "Mailer.Send")
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+	span.SetKind(tracing.KindClient)
+	span.SetAttribute("mail.template", templateFile)
+
 	tmpl, err := template.ParseFS(templateFS, "templates/"+templateFile)
 	if err != nil {
 		return err
@@ -69,3 +88,25 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 
 	return nil
 }
+
+// Check connects (and authenticates, if configured) to the SMTP server without
+// sending anything. The dialer can't be cancelled, so if ctx is done first Check
+// returns early and leaves the dial to time out in the background.
+func (m Mailer) Check(ctx context.Context) error {
+	errs := make(chan error, 1)
+
+	go func() {
+		conn, err := m.dialer.Dial()
+		if err == nil {
+			err = conn.Close()
+		}
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
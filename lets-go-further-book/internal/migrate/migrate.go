@@ -0,0 +1,305 @@
+// Package migrate applies numbered SQL migrations (NNNNNN_name.up.sql and
+// NNNNNN_name.down.sql) to PostgreSQL. It keeps track of the current version in
+// the same schema_migrations table as the golang-migrate CLI, so databases that
+// were migrated with that tool carry on where it left off.
+//
+// Every command holds a PostgreSQL advisory lock while it runs, so replicas that
+// start at the same time apply each migration only once.
+package migrate
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// NilVersion is the version of a database without any migrations applied.
+const NilVersion int64 = -1
+
+// lockID identifies our advisory lock. Any constant works, as long as nothing else
+// using the database takes the same one.
+const lockID int64 = 7_146_286_331_027_145_216
+
+var (
+	ErrDirty     = errors.New("migrate: database is dirty, fix it by hand and use force to set the version")
+	ErrNoVersion = errors.New("migrate: unknown version")
+	ErrNoDown    = errors.New("migrate: missing down migration")
+)
+
+var fileNameRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Load reads the migrations in the root of fsys, ordered by version.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		matches := fileNameRX.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: %s: %w", entry.Name(), err)
+		}
+
+		contents, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = m
+		}
+		if m.Name != matches[2] {
+			return nil, fmt.Errorf("migrate: version %d is used by both %s and %s", version, m.Name, matches[2])
+		}
+
+		if matches[3] == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migrate: version %d (%s) has no up migration", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+
+	return migrations, nil
+}
+
+// Status describes the state of the database.
+type Status struct {
+	Version int64 // NilVersion if no migration has been applied
+	Dirty   bool  // A migration failed halfway through
+	Pending []Migration
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Up applies every pending migration, returning the ones it applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		version, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if migration.Version <= version {
+				continue
+			}
+
+			if err := apply(ctx, conn, migration.Up, migration.Version); err != nil {
+				return fmt.Errorf("migrate: %d_%s.up.sql: %w", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down reverts the most recent steps migrations, returning the ones it reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		version, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if migration.Version > version {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("%w for version %d", ErrNoDown, migration.Version)
+			}
+
+			previous := NilVersion
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+
+			if err := apply(ctx, conn, migration.Down, previous); err != nil {
+				return fmt.Errorf("migrate: %d_%s.down.sql: %w", migration.Version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Status reports the current version and the migrations not yet applied.
+func (m *Migrator) Status(ctx context.Context) (Status, error) {
+	var status Status
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		var err error
+		status.Version, status.Dirty, err = readVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if migration.Version > status.Version {
+				status.Pending = append(status.Pending, migration)
+			}
+		}
+
+		return nil
+	})
+
+	return status, err
+}
+
+// Force sets the version without running any migrations and clears the dirty flag,
+// after a failed migration has been cleaned up by hand.
+func (m *Migrator) Force(ctx context.Context, version int64) error {
+	if version != NilVersion && !slices.ContainsFunc(m.migrations, func(migration Migration) bool {
+		return migration.Version == version
+	}) {
+		return fmt.Errorf("%w %d", ErrNoVersion, version)
+	}
+
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		return setVersion(ctx, conn, version)
+	})
+}
+
+// locked runs fn on a single connection holding the advisory lock, creating the
+// schema_migrations table first if needed.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockID)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// currentVersion is readVersion for commands that change the schema, which
+// refuse to run on a dirty database.
+func currentVersion(ctx context.Context, conn *sql.Conn) (int64, error) {
+	version, dirty, err := readVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, ErrDirty
+	}
+
+	return version, nil
+}
+
+func readVersion(ctx context.Context, conn *sql.Conn) (version int64, dirty bool, err error) {
+	err = conn.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NilVersion, false, nil
+	}
+
+	return version, dirty, err
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func setVersion(ctx context.Context, db execer, version int64) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+		return err
+	}
+	if version == NilVersion {
+		return nil
+	}
+
+	_, err := db.ExecContext(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)", version)
+	return err
+}
+
+// apply runs a migration and records the version it leaves the database at, in
+// one transaction, so a failed migration leaves nothing behind. None of our
+// migrations use statements that can't run inside a transaction.
+func apply(ctx context.Context, conn *sql.Conn, query string, version int64) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	if err := setVersion(ctx, tx, version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
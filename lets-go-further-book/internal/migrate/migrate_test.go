@@ -0,0 +1,87 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"greenlight.bagerbach.com/internal/assert"
+	embedded "greenlight.bagerbach.com/migrations"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000010_add_posters.up.sql":     {Data: []byte("ALTER TABLE movies ADD poster text;")},
+		"000010_add_posters.down.sql":   {Data: []byte("ALTER TABLE movies DROP poster;")},
+		"000002_add_indexes.up.sql":     {Data: []byte("CREATE INDEX ...;")},
+		"000001_create_movies.up.sql":   {Data: []byte("CREATE TABLE movies ();")},
+		"000001_create_movies.down.sql": {Data: []byte("DROP TABLE movies;")},
+		"migrations.go":                 {Data: []byte("package migrations")},
+		"README.md":                     {Data: []byte("# Migrations")},
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(migrations), 3)
+
+	assert.Equal(t, migrations[0].Version, int64(1))
+	assert.Equal(t, migrations[0].Name, "create_movies")
+	assert.Equal(t, migrations[0].Down, "DROP TABLE movies;")
+
+	assert.Equal(t, migrations[1].Version, int64(2))
+	assert.Equal(t, migrations[1].Down, "")
+
+	assert.Equal(t, migrations[2].Version, int64(10))
+	assert.Equal(t, migrations[2].Up, "ALTER TABLE movies ADD poster text;")
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		wantErr string
+	}{
+		{
+			name: "Missing up migration",
+			fsys: fstest.MapFS{
+				"000001_create_movies.down.sql": {Data: []byte("DROP TABLE movies;")},
+			},
+			wantErr: "version 1 (create_movies) has no up migration",
+		},
+		{
+			name: "Duplicate version",
+			fsys: fstest.MapFS{
+				"000001_create_movies.up.sql": {Data: []byte("CREATE TABLE movies ();")},
+				"000001_create_users.up.sql":  {Data: []byte("CREATE TABLE users ();")},
+			},
+			wantErr: "version 1 is used by both create_movies and create_users",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.fsys)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			assert.StringContains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := Load(embedded.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range migrations {
+		assert.Equal(t, m.Version, int64(i+1))
+		if m.Down == "" {
+			t.Errorf("migration %d (%s) has no down migration", m.Version, m.Name)
+		}
+	}
+}
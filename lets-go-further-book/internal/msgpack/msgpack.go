@@ -0,0 +1,341 @@
+// Package msgpack implements the subset of MessagePack (https://msgpack.org) needed
+// to carry the same data as our JSON responses: nil, booleans, numbers, strings,
+// binary, arrays and maps with string keys. Extension types are not supported.
+//
+// Rather than reflecting over Go structs, values are converted from and to JSON,
+// so json struct tags and custom marshalers (like data.Runtime) apply unchanged.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+var (
+	ErrShortBuffer     = errors.New("msgpack: unexpected end of data")
+	ErrTrailingData    = errors.New("msgpack: data contains more than one value")
+	ErrUnsupportedType = errors.New("msgpack: unsupported type")
+)
+
+// maxDepth bounds nesting while decoding, so a small malicious body can't exhaust the stack.
+const maxDepth = 100
+
+// FromJSON converts a single JSON document into its MessagePack encoding.
+func FromJSON(js []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Marshal encodes v as MessagePack, using its JSON representation.
+func Marshal(v any) ([]byte, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromJSON(js)
+}
+
+// ToJSON converts exactly one MessagePack value into JSON. Binary values become
+// base64 strings, the same way encoding/json represents []byte.
+func ToJSON(b []byte) ([]byte, error) {
+	d := decoder{data: b}
+
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.pos != len(d.data) {
+		return nil, ErrTrailingData
+	}
+
+	return json.Marshal(v)
+}
+
+func encode(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			encodeInt(buf, i)
+			return nil
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			buf.WriteByte(0xcf)
+			buf.Write(binary.BigEndian.AppendUint64(nil, u))
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+	case string:
+		encodeLength(buf, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []any:
+		encodeLength(buf, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, elem := range v {
+			if err := encode(buf, elem); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		encodeLength(buf, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		// Sort keys so the same value always produces the same bytes.
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if err := encode(buf, key); err != nil {
+				return err
+			}
+			if err := encode(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+	}
+
+	return nil
+}
+
+func encodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(int16(i))))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(int32(i))))
+	default:
+		buf.WriteByte(0xd3)
+		buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+}
+
+// encodeLength writes the header for a string, array or map of length n, using the
+// fix format when n fits in fixMax and the 8, 16 or 32-bit formats otherwise. Arrays
+// and maps have no 8-bit format, which is signalled by passing 0 for code8.
+func encodeLength(buf *bytes.Buffer, n int, fixBase byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fixBase | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(code32)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, ErrShortBuffer
+	}
+
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (d *decoder) decode(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errors.New("msgpack: maximum nesting depth exceeded")
+	}
+
+	head, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := head[0]
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0xa0 && c <= 0xbf:
+		return d.str(int(c & 0x1f))
+	case c >= 0x90 && c <= 0x9f:
+		return d.array(int(c&0x0f), depth)
+	case c >= 0x80 && c <= 0x8f:
+		return d.object(int(c&0x0f), depth)
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (c - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign-extend from the encoded width.
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+	case 0xca:
+		u, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(u))), nil
+	case 0xcb:
+		u, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(u), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return slices.Clone(b), nil
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(int(n), depth)
+	}
+
+	return nil, fmt.Errorf("%w: format 0x%02x", ErrUnsupportedType, c)
+}
+
+func (d *decoder) str(n int) (string, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *decoder) array(n int, depth int) ([]any, error) {
+	// Every element takes at least one byte, which stops a forged length from
+	// allocating more than the data could possibly hold.
+	if n > len(d.data)-d.pos {
+		return nil, ErrShortBuffer
+	}
+
+	arr := make([]any, 0, n)
+	for range n {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (d *decoder) object(n int, depth int) (map[string]any, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, ErrShortBuffer
+	}
+
+	obj := make(map[string]any, n)
+	for range n {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: map keys must be strings", ErrUnsupportedType)
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		obj[k] = v
+	}
+	return obj, nil
+}
@@ -0,0 +1,192 @@
+package msgpack
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+func TestFromJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		js   string
+		want string // Hex encoding
+	}{
+		{"Nil", `null`, "c0"},
+		{"False", `false`, "c2"},
+		{"True", `true`, "c3"},
+		{"Positive fixint", `127`, "7f"},
+		{"Negative fixint", `-32`, "e0"},
+		{"Int 8", `-33`, "d0df"},
+		{"Int 16", `300`, "d1012c"},
+		{"Int 32", `-70000`, "d2fffeee90"},
+		{"Int 64", `5000000000`, "d3000000012a05f200"},
+		{"Uint 64", `18446744073709551615`, "cfffffffffffffffff"},
+		{"Float", `1.5`, "cb3ff8000000000000"},
+		{"Fixstr", `"abc"`, "a3616263"},
+		{"Str 8", `"` + strings.Repeat("a", 32) + `"`, "d920" + strings.Repeat("61", 32)},
+		{"Fixarray", `[1, "a"]`, "9201a161"},
+		{"Fixmap with sorted keys", `{"b": 2, "a": 1}`, "82a16101a16202"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := FromJSON([]byte(tt.js))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, hex.EncodeToString(b), tt.want)
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []string{
+		`null`,
+		`{"movie":{"genres":["animation","adventure"],"id":1,"runtime":"107 mins","title":"Moana","version":1,"year":2016}}`,
+		`{"metadata":{},"movies":[]}`,
+		`[-1,-129,-40000,-3000000000,255,65535,4294967295,18446744073709551615]`,
+		`[0.25,-1.5e+100]`,
+		`"` + strings.Repeat("x", 70000) + `"`,
+		`[` + strings.Repeat(`1,`, 20) + `1]`,
+	}
+
+	for _, js := range tests {
+		b, err := FromJSON([]byte(js))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ToJSON(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, string(got), js)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	v := struct {
+		Title  string   `json:"title"`
+		Genres []string `json:"genres,omitempty"`
+	}{Title: "Moana"}
+
+	b, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js, err := ToJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, string(js), `{"title":"Moana"}`)
+}
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		data string // Hex encoding
+		want string
+	}{
+		{"Uint 8", "ccff", `255`},
+		{"Uint 16", "cdffff", `65535`},
+		{"Float 32", "ca3fc00000", `1.5`},
+		{"Binary", "c403010203", `"AQID"`},
+		{"Array 16", "dc0002c2c3", `[false,true]`},
+		{"Map 16", "de0001a161c0", `{"a":null}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			js, err := ToJSON(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, string(js), tt.want)
+		})
+	}
+}
+
+func TestToJSONErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string // Hex encoding
+		wantErr error
+	}{
+		{"Empty", "", ErrShortBuffer},
+		{"Truncated string", "a3616263"[:6], ErrShortBuffer},
+		{"Truncated int", "d1ff", ErrShortBuffer},
+		{"Forged array length", "ddffffffff", ErrShortBuffer},
+		{"Forged map length", "dfffffffff01", ErrShortBuffer},
+		{"Trailing data", "c0c0", ErrTrailingData},
+		{"Integer map key", "810102", ErrUnsupportedType},
+		{"Extension type", "d40100", ErrUnsupportedType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ToJSON(b)
+			assert.Equal(t, errors.Is(err, tt.wantErr), true)
+		})
+	}
+
+	t.Run("Too deep", func(t *testing.T) {
+		b := []byte(strings.Repeat("\x91", maxDepth+1) + "\xc0")
+
+		_, err := ToJSON(b)
+		assert.StringContains(t, err.Error(), "maximum nesting depth exceeded")
+	})
+}
+
+func TestFromJSONErrors(t *testing.T) {
+	_, err := FromJSON([]byte(`{"title": `))
+	if err == nil {
+		t.Fatal("expected an error for invalid JSON")
+	}
+}
+
+func FuzzToJSON(f *testing.F) {
+	for _, seed := range []string{"c0", "ccff", "ca3fc00000", "c403010203", "dc0002c2c3", "de0001a161c0", "82a161c3a162cb3ff8000000000000", "ddffffffff", "810102", "d40100"} {
+		b, err := hex.DecodeString(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		js, err := ToJSON(b)
+		if err != nil {
+			return
+		}
+
+		if !json.Valid(js) {
+			t.Fatalf("%x decoded to invalid JSON %s", b, js)
+		}
+
+		// Request bodies go through ToJSON before they're decoded like JSON ones,
+		// so whatever it accepts has to be JSON the package can encode back.
+		if _, err := FromJSON(js); err != nil {
+			t.Fatalf("%x decoded to %s, which didn't encode: %v", b, js, err)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+// Package storage keeps uploaded files, such as movie posters, outside the
+// database. Files are addressed by slash-separated keys like "posters/1/42/w500".
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"greenlight.bagerbach.com/internal/tracing"
+)
+
+var ErrNotFound = errors.New("storage: file not found")
+
+// Storage is implemented by Local. Other backends, like an object store, only
+// need to implement these four methods.
+type Storage interface {
+	// Put stores the contents of r under key, replacing any file already there.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns the file stored under key, or ErrNotFound. The caller must
+	// close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the file stored under key. Deleting a file that doesn't
+	// exist isn't an error.
+	Delete(ctx context.Context, key string) error
+	// DeleteAll removes every file stored under prefix, such as all of a movie's
+	// posters under "posters/1".
+	DeleteAll(ctx context.Context, prefix string) error
+}
+
+// Local stores files in a directory on the local filesystem.
+type Local struct {
+	dir string
+}
+
+// NewLocal returns a Local storing files under dir, creating it if needed.
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Local{dir: dir}, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+
+	return filepath.Join(l.dir, name), nil
+}
+
+// Put writes to a temporary file first and renames it into place, so readers
+// never see a partly written file.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) error {
+	_, span := tracing.Start(ctx, "storage.Put")
+	defer span.End()
+	span.SetAttribute("storage.key", key)
+
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	// Both are no-ops once the file has been closed and renamed.
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	_, span := tracing.Start(ctx, "storage.Get")
+	defer span.End()
+	span.SetAttribute("storage.key", key)
+
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	_, span := tracing.Start(ctx, "storage.Delete")
+	defer span.End()
+	span.SetAttribute("storage.key", key)
+
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (l *Local) DeleteAll(ctx context.Context, prefix string) error {
+	_, span := tracing.Start(ctx, "storage.DeleteAll")
+	defer span.End()
+	span.SetAttribute("storage.prefix", prefix)
+
+	path, err := l.path(prefix)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(key string) string {
+		t.Helper()
+
+		f, err := l.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if err := l.Put(ctx, "posters/1/original", strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, read("posters/1/original"), "first")
+
+	if err := l.Put(ctx, "posters/1/original", strings.NewReader("second")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, read("posters/1/original"), "second")
+
+	if err := l.Delete(ctx, "posters/1/original"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.Get(ctx, "posters/1/original")
+	assert.Equal(t, errors.Is(err, ErrNotFound), true)
+
+	// Deleting it again is fine.
+	if err := l.Delete(ctx, "posters/1/original"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalDeleteAll(t *testing.T) {
+	ctx := context.Background()
+
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"posters/1/a/original", "posters/1/b/original", "posters/10/a/original"} {
+		if err := l.Put(ctx, key, strings.NewReader("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := l.DeleteAll(ctx, "posters/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"posters/1/a/original", "posters/1/b/original"} {
+		_, err := l.Get(ctx, key)
+		assert.Equal(t, errors.Is(err, ErrNotFound), true)
+	}
+
+	f, err := l.Get(ctx, "posters/10/a/original")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Deleting them again is fine.
+	if err := l.DeleteAll(ctx, "posters/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"", "..", "posters/../.."} {
+		if err := l.DeleteAll(ctx, prefix); err == nil {
+			t.Errorf("DeleteAll(%q) succeeded", prefix)
+		}
+	}
+}
+
+func TestLocalRejectsKeysOutsideItsDirectory(t *testing.T) {
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../escape", "/etc/passwd", "posters/../../escape", ""} {
+		err := l.Put(context.Background(), key, strings.NewReader("x"))
+		if err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Package toml reads configuration files written in a subset of TOML: tables,
+// comments and single-line key/value pairs whose values are strings, integers,
+// floats, booleans or arrays of those. Nested tables, inline tables, multi-line
+// strings and dates aren't supported.
+package toml
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseFile reads the configuration file at path. See Parse.
+func ParseFile(path string) (map[string]any, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return values, nil
+}
+
+// Parse reads a configuration file. The returned map is keyed by "table.key", or
+// just "key" for keys set before the first table. Values are string, int64,
+// float64, bool or []any.
+func Parse(r io.Reader) (map[string]any, error) {
+	values := make(map[string]any)
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header %q", n, line)
+			}
+
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if !isBareKey(table) {
+				return nil, fmt.Errorf("line %d: invalid table name %q", n, table)
+			}
+			continue
+		}
+
+		key, rawValue, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+
+		key = strings.TrimSpace(key)
+		if !isBareKey(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", n, key)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+
+		if _, exists := values[key]; exists {
+			return nil, fmt.Errorf("line %d: %s is set more than once", n, key)
+		}
+
+		value, err := parseValue(strings.TrimSpace(rawValue))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+
+		values[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// stripComment removes a trailing # comment, leaving # characters inside strings
+// alone.
+func stripComment(line string) string {
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+func isBareKey(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseValue(s string) (any, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case s[0] == '"':
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		value, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", s)
+		}
+		return value, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' || strings.Contains(s[1:len(s)-1], "'") {
+			return nil, fmt.Errorf("invalid literal string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s[0] == '[':
+		return parseArray(s)
+	}
+
+	number := strings.ReplaceAll(s, "_", "")
+	if i, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("invalid value %s (strings must be quoted)", s)
+}
+
+func parseArray(s string) ([]any, error) {
+	if s[len(s)-1] != ']' {
+		return nil, fmt.Errorf("unterminated array")
+	}
+
+	items := []any{}
+	rest := strings.TrimSpace(s[1 : len(s)-1])
+
+	for rest != "" {
+		end := itemEnd(rest)
+
+		item, err := parseValue(strings.TrimSpace(rest[:end]))
+		if err != nil {
+			return nil, err
+		}
+		if _, nested := item.([]any); nested {
+			return nil, fmt.Errorf("nested arrays are not supported")
+		}
+		items = append(items, item)
+
+		rest = strings.TrimSpace(strings.TrimPrefix(rest[end:], ","))
+	}
+
+	return items, nil
+}
+
+// itemEnd returns the index of the comma ending the first item of an array, or
+// len(s) if it's the last one.
+func itemEnd(s string) int {
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			return i
+		}
+	}
+
+	return len(s)
+}
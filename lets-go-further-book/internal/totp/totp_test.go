@@ -0,0 +1,87 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+// The SHA1 test vectors from RFC 6238 appendix B. They have 8 digits; our 6 digit
+// codes are their last 6.
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		code, err := Code(secret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, code, tt.want[2:])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	code, err := Code(secret, Step(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		code   string
+		at     time.Time
+		wantOK bool
+	}{
+		{"Current period", code, now, true},
+		{"One period late", code, now.Add(Period), true},
+		{"One period early", code, now.Add(-Period), true},
+		{"Two periods late", code, now.Add(2 * Period), false},
+		{"Wrong code", "000000", now, code == "000000"},
+		{"Wrong length", code[:5], now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(secret, tt.code, tt.at)
+			assert.Equal(t, ok, tt.wantOK)
+			if ok {
+				assert.Equal(t, step, Step(now))
+			}
+		})
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(ProvisioningURI("JBSWY3DPEHPK3PXP", "Greenlight", "alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, u.Scheme, "otpauth")
+	assert.Equal(t, u.Host, "totp")
+	assert.Equal(t, u.Path, "/Greenlight:alice@example.com")
+	assert.Equal(t, u.Query().Get("secret"), "JBSWY3DPEHPK3PXP")
+	assert.Equal(t, u.Query().Get("issuer"), "Greenlight")
+	assert.Equal(t, u.Query().Get("digits"), "6")
+}
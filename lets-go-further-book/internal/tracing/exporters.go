@@ -0,0 +1,172 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector using the JSON encoding
+// of OTLP over HTTP.
+type OTLPExporter struct {
+	Endpoint string // Full URL of the traces endpoint, e.g. http://localhost:4318/v1/traces
+	Service  string // Reported as the service.name resource attribute
+	Client   *http.Client
+}
+
+func NewOTLPExporter(endpoint, service string, timeout time.Duration) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint: endpoint,
+		Service:  service,
+		Client:   &http.Client{Timeout: timeout},
+	}
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, spans []SpanData) error {
+	body, err := json.Marshal(otlpRequest(e.Service, spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("tracing: collector responded with %s", res.Status)
+	}
+
+	return nil
+}
+
+// otlpRequest builds an ExportTraceServiceRequest. The protobuf JSON mapping
+// encodes IDs as hex and 64-bit integers as strings.
+func otlpRequest(service string, spans []SpanData) map[string]any {
+	otlpSpans := make([]map[string]any, 0, len(spans))
+
+	for _, s := range spans {
+		span := map[string]any{
+			"traceId":           s.TraceID.String(),
+			"spanId":            s.SpanID.String(),
+			"name":              s.Name,
+			"kind":              int(s.Kind),
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+		}
+
+		if s.ParentSpanID != (SpanID{}) {
+			span["parentSpanId"] = s.ParentSpanID.String()
+		}
+
+		if s.Error != "" {
+			span["status"] = map[string]any{"code": 2, "message": s.Error}
+		}
+
+		otlpSpans = append(otlpSpans, span)
+	}
+
+	return map[string]any{
+		"resourceSpans": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": otlpAttributes([]Attribute{{Key: "service.name", Value: service}}),
+				},
+				"scopeSpans": []any{
+					map[string]any{
+						"scope": map[string]any{"name": "greenlight.bagerbach.com/internal/tracing"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attributes []Attribute) []map[string]any {
+	out := make([]map[string]any, 0, len(attributes))
+
+	for _, a := range attributes {
+		var value map[string]any
+
+		switch v := a.Value.(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+
+		out = append(out, map[string]any{"key": a.Key, "value": value})
+	}
+
+	return out
+}
+
+// WriterExporter writes each span as a line of JSON, for looking at traces
+// locally without running a collector.
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+func (e *WriterExporter) Export(ctx context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.w)
+
+	for _, s := range spans {
+		attributes := make(map[string]any, len(s.Attributes))
+		for _, a := range s.Attributes {
+			attributes[a.Key] = a.Value
+		}
+
+		line := map[string]any{
+			"trace_id":   s.TraceID.String(),
+			"span_id":    s.SpanID.String(),
+			"name":       s.Name,
+			"start":      s.Start,
+			"duration":   s.End.Sub(s.Start).String(),
+			"attributes": attributes,
+		}
+		if s.ParentSpanID != (SpanID{}) {
+			line["parent_span_id"] = s.ParentSpanID.String()
+		}
+		if s.Error != "" {
+			line["error"] = s.Error
+		}
+
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,406 @@
+// Package tracing records spans and propagates them between services using the
+// W3C Trace Context traceparent header. Finished spans are batched and handed to
+// an Exporter, which either sends them to an OpenTelemetry collector over
+// OTLP/HTTP or writes them out as JSON lines.
+//
+// A nil *Tracer and a nil *Span are valid and do nothing, so code can be
+// instrumented unconditionally and tracing switched off by not creating a Tracer.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidTraceparent = errors.New("tracing: invalid traceparent header")
+
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	var flags byte
+	if sc.Sampled {
+		flags = 1
+	}
+
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a traceparent header value. Versions other than 00 are
+// accepted as long as they start with the fields version 00 defines, as the spec
+// asks.
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, ErrInvalidTraceparent
+	}
+
+	version := parts[0]
+	if len(version) != 2 || !isLowerHex(version) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return sc, ErrInvalidTraceparent
+	}
+
+	if len(parts[1]) != 32 || !isLowerHex(parts[1]) || len(parts[2]) != 16 || !isLowerHex(parts[2]) {
+		return sc, ErrInvalidTraceparent
+	}
+	hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	hex.Decode(sc.SpanID[:], []byte(parts[2]))
+
+	var flags [1]byte
+	if len(parts[3]) != 2 || !isLowerHex(parts[3]) {
+		return sc, ErrInvalidTraceparent
+	}
+	hex.Decode(flags[:], []byte(parts[3]))
+	sc.Sampled = flags[0]&1 == 1
+
+	if !sc.IsValid() {
+		return sc, ErrInvalidTraceparent
+	}
+
+	return sc, nil
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Extract reads the span context sent by the caller, if there is a valid one.
+func Extract(header http.Header) (SpanContext, bool) {
+	sc, err := ParseTraceparent(header.Get("traceparent"))
+	return sc, err == nil
+}
+
+// Inject adds a traceparent header for the span in ctx, so the receiver can
+// continue the trace.
+func Inject(ctx context.Context, header http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		header.Set("traceparent", span.SpanContext().Traceparent())
+	}
+}
+
+type contextKey string
+
+const (
+	spanContextKey   = contextKey("span")
+	remoteContextKey = contextKey("remote")
+)
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey, span)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey).(*Span)
+	return span
+}
+
+// ContextWithRemoteSpanContext stores a span context extracted from an incoming
+// request, which the next span started from ctx uses as its parent.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteContextKey, sc)
+}
+
+// Detach returns a context that carries the span from ctx but none of its
+// deadline or cancellation, for work that outlives the request that started it.
+func Detach(ctx context.Context) context.Context {
+	return ContextWithSpan(context.Background(), SpanFromContext(ctx))
+}
+
+// Start starts a span as a child of the span in ctx, using the same Tracer. If
+// ctx has no span it returns a nil span, so nothing is recorded.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	return parent.tracer.Start(ctx, name)
+}
+
+type Kind int
+
+// Span kinds, numbered as in the OTLP protocol.
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	parent SpanID
+
+	mu         sync.Mutex
+	name       string
+	kind       Kind
+	start      time.Time
+	attributes []Attribute
+	err        string
+	ended      bool
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+func (s *Span) SetKind(kind Kind) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kind = kind
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, Attribute{Key: key, Value: value})
+}
+
+// RecordError marks the span as failed.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export. Calls after the first do
+// nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+
+	data := SpanData{
+		Name:         s.name,
+		TraceID:      s.sc.TraceID,
+		SpanID:       s.sc.SpanID,
+		ParentSpanID: s.parent,
+		Kind:         s.kind,
+		Start:        s.start,
+		End:          time.Now(),
+		Attributes:   s.attributes,
+		Error:        s.err,
+	}
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.tracer.enqueue(data)
+	}
+}
+
+// SpanData is a finished span, as passed to an Exporter.
+type SpanData struct {
+	Name         string
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Kind         Kind
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attribute
+	Error        string
+}
+
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+const (
+	maxQueueSize  = 2048
+	flushInterval = 5 * time.Second
+)
+
+// Tracer starts spans and exports them in the background, at most every
+// flushInterval. If the exporter can't keep up, spans beyond maxQueueSize are
+// dropped rather than held in memory.
+type Tracer struct {
+	exporter Exporter
+	onError  func(error)
+
+	mu      sync.Mutex
+	queue   []SpanData
+	dropped int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a Tracer that sends finished spans to exporter. Export errors are
+// passed to onError.
+func New(exporter Exporter, onError func(error)) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		onError:  onError,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+// Start starts a span. Its parent is the span in ctx or, failing that, a remote
+// span context stored with ContextWithRemoteSpanContext. Without either it starts
+// a new trace.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   KindInternal,
+		start:  time.Now(),
+	}
+
+	var parent SpanContext
+	if s := SpanFromContext(ctx); s != nil {
+		parent = s.sc
+	} else if remote, ok := ctx.Value(remoteContextKey).(SpanContext); ok {
+		parent = remote
+	}
+
+	if parent.IsValid() {
+		span.sc.TraceID = parent.TraceID
+		span.sc.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = true
+	}
+	rand.Read(span.sc.SpanID[:])
+
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) enqueue(data SpanData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.queue) >= maxQueueSize {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, data)
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flush(context.Background())
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *Tracer) flush(ctx context.Context) {
+	t.mu.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 && t.onError != nil {
+		t.onError(fmt.Errorf("tracing: dropped %d spans", dropped))
+	}
+
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := t.exporter.Export(ctx, spans); err != nil && t.onError != nil {
+		t.onError(err)
+	}
+}
+
+// Shutdown stops the background exporter and exports any spans still queued.
+func (t *Tracer) Shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	close(t.stop)
+	<-t.done
+
+	t.flush(ctx)
+}
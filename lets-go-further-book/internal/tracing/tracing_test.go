@@ -0,0 +1,184 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+		sampled bool
+	}{
+		{
+			name:    "Sampled",
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			sampled: true,
+		},
+		{
+			name:  "Not sampled",
+			value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		},
+		{
+			name:    "Future version with extra fields",
+			value:   "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			sampled: true,
+		},
+		{
+			name:    "Version 00 with extra fields",
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			wantErr: true,
+		},
+		{
+			name:    "Invalid version",
+			value:   "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantErr: true,
+		},
+		{
+			name:    "Uppercase",
+			value:   "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01",
+			wantErr: true,
+		},
+		{
+			name:    "Zero trace ID",
+			value:   "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			wantErr: true,
+		},
+		{
+			name:    "Zero span ID",
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			wantErr: true,
+		},
+		{
+			name:    "Short trace ID",
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+			wantErr: true,
+		},
+		{
+			name:    "Empty",
+			value:   "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseTraceparent(tt.value)
+
+			assert.Equal(t, err != nil, tt.wantErr)
+			if tt.wantErr {
+				return
+			}
+
+			assert.Equal(t, sc.TraceID.String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+			assert.Equal(t, sc.SpanID.String(), "00f067aa0ba902b7")
+			assert.Equal(t, sc.Sampled, tt.sampled)
+		})
+	}
+}
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (e *recordingExporter) Export(ctx context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestStart(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := New(exporter, nil)
+
+	remote, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := ContextWithRemoteSpanContext(context.Background(), remote)
+	ctx, server := tracer.Start(ctx, "server")
+	_, child := Start(ctx, "child")
+
+	header := http.Header{}
+	Inject(ctx, header)
+
+	child.End()
+	server.End()
+	tracer.Shutdown(context.Background())
+
+	assert.Equal(t, len(exporter.spans), 2)
+
+	childData, serverData := exporter.spans[0], exporter.spans[1]
+	assert.Equal(t, serverData.TraceID, remote.TraceID)
+	assert.Equal(t, serverData.ParentSpanID, remote.SpanID)
+	assert.Equal(t, childData.TraceID, remote.TraceID)
+	assert.Equal(t, childData.ParentSpanID, serverData.SpanID)
+	assert.Equal(t, header.Get("traceparent"), server.SpanContext().Traceparent())
+}
+
+func TestStartWithoutTracer(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "server")
+	span.SetAttribute("key", "value")
+	span.End()
+
+	_, child := Start(ctx, "child")
+	child.End()
+
+	header := http.Header{}
+	Inject(ctx, header)
+
+	assert.Equal(t, span == nil, true)
+	assert.Equal(t, child == nil, true)
+	assert.Equal(t, header.Get("traceparent"), "")
+}
+
+func TestUnsampledSpansAreNotExported(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := New(exporter, nil)
+
+	remote, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := ContextWithRemoteSpanContext(context.Background(), remote)
+	_, span := tracer.Start(ctx, "server")
+	span.End()
+	tracer.Shutdown(context.Background())
+
+	assert.Equal(t, len(exporter.spans), 0)
+}
+
+func FuzzParseTraceparent(f *testing.F) {
+	f.Add("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	f.Add("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	f.Add("ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	f.Add(" 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00 ")
+	f.Add("00--")
+
+	f.Fuzz(func(t *testing.T, value string) {
+		sc, err := ParseTraceparent(value)
+		if err != nil {
+			return
+		}
+
+		// Whatever is accepted, whichever version it claims to be, is forwarded as
+		// version 00, which has to parse back to the same span context.
+		parsed, err := ParseTraceparent(sc.Traceparent())
+		if err != nil {
+			t.Fatalf("%q parsed, but its traceparent %q didn't: %v", value, sc.Traceparent(), err)
+		}
+		assert.Equal(t, parsed, sc)
+	})
+}
@@ -0,0 +1,293 @@
+// Package webhook signs and delivers webhook events to subscriber URLs.
+//
+// Each delivery is a JSON POST carrying the event, with the headers:
+//
+//	X-Greenlight-Event:     the event type, e.g. movie.created
+//	X-Greenlight-Delivery:  the event ID, the same across retries
+//	X-Greenlight-Timestamp: unix time the attempt was signed at
+//	X-Greenlight-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// Receivers should recompute the signature with their secret (see Verify) and
+// reject stale timestamps to guard against replays.
+//
+// Subscriber URLs are chosen by users, so deliveries are only made to public
+// addresses: the check is done on the address actually dialed, after DNS
+// resolution, so a host that later resolves to a private address is refused too.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"greenlight.bagerbach.com/internal/tracing"
+)
+
+const (
+	EventMovieCreated = "movie.created"
+	EventMovieUpdated = "movie.updated"
+	EventMovieDeleted = "movie.deleted"
+	EventTest         = "webhook.test"
+)
+
+// EventTypes lists the events a subscription can register for.
+var EventTypes = []string{EventMovieCreated, EventMovieUpdated, EventMovieDeleted}
+
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+func NewEvent(eventType string, data any) (Event, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		ID:        hex.EncodeToString(randomBytes),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}, nil
+}
+
+// Sign returns the value of the X-Greenlight-Signature header for body.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature headers of a delivery against body, comparing in
+// constant time.
+func Verify(secret string, header http.Header, body []byte) bool {
+	unix, err := strconv.ParseInt(header.Get("X-Greenlight-Timestamp"), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	expected := Sign(secret, time.Unix(unix, 0), body)
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Greenlight-Signature")))
+}
+
+// Attempt describes a single delivery attempt.
+type Attempt struct {
+	Number     int
+	StatusCode int // 0 when no response was received
+	Err        error
+	Duration   time.Duration
+}
+
+func (a Attempt) Success() bool {
+	return a.Err == nil && a.StatusCode >= 200 && a.StatusCode < 300
+}
+
+// retryable reports whether a failed attempt is worth repeating. Client errors are
+// permanent, except for timeouts and rate limiting.
+func (a Attempt) retryable() bool {
+	switch {
+	case a.StatusCode == 0:
+		return true
+	case a.StatusCode >= 500:
+		return true
+	default:
+		return a.StatusCode == http.StatusRequestTimeout || a.StatusCode == http.StatusTooManyRequests
+	}
+}
+
+// ErrNonPublicAddress is the error of attempts to deliver to an address that isn't
+// on the public internet.
+var ErrNonPublicAddress = errors.New("webhook: destination is not a public address")
+
+// nonPublicPrefixes are the ranges PublicAddress refuses beyond the loopback,
+// private, link-local (which holds the 169.254.169.254 cloud metadata endpoint),
+// multicast and unspecified addresses the netip package already recognizes.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "This network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // Carrier-grade NAT, used by some cloud metadata endpoints
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // Reserved, and the broadcast address
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, which can reach private IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),  // Documentation
+	netip.MustParsePrefix("fec0::/10"),      // Deprecated site-local
+}
+
+// PublicAddress reports whether addr is a public unicast address that webhooks may
+// be delivered to.
+func PublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PublicHost reports whether a URL's host could be public, for validating
+// subscriptions before any delivery is made. Names are only resolved when
+// delivering, so this catches literal addresses and localhost.
+func PublicHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return PublicAddress(addr)
+	}
+
+	return true
+}
+
+// dialPublic is the net.Dialer Control function of the delivery client, called
+// with each address resolved for the URL's host just before connecting to it.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !PublicAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrNonPublicAddress, addrPort.Addr())
+	}
+
+	return nil
+}
+
+type Client struct {
+	HTTP        *http.Client
+	MaxAttempts int
+	// Backoff is the wait before the second attempt, doubled for every attempt after.
+	Backoff time.Duration
+}
+
+// New returns a client that only delivers to public addresses. Proxies aren't
+// used, as the address check would then apply to the proxy instead.
+func New(timeout time.Duration, maxAttempts int, backoff time.Duration) Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   dialPublic,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return Client{
+		HTTP:        &http.Client{Timeout: timeout, Transport: transport},
+		MaxAttempts: maxAttempts,
+		Backoff:     backoff,
+	}
+}
+
+// Deliver posts event to url, retrying with exponential backoff until an attempt
+// succeeds, fails permanently or MaxAttempts is reached. onAttempt, if not nil, is
+// called after every attempt, e.g. to record a delivery log. The returned Attempt is
+// the last one made; if ctx is done while waiting to retry, it's returned with
+// ctx's error. Each attempt is traced as a child of the span in ctx, and carries a
+// traceparent header so the receiver can continue the trace.
+func (c Client) Deliver(ctx context.Context, url, secret string, event Event, onAttempt func(Attempt)) (Attempt, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return Attempt{}, err
+	}
+
+	var attempt Attempt
+
+	for n := 1; n <= max(c.MaxAttempts, 1); n++ {
+		if n > 1 {
+			timer := time.NewTimer(c.Backoff << (n - 2))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return attempt, ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		attempt = c.send(ctx, url, secret, event, body)
+		attempt.Number = n
+
+		if onAttempt != nil {
+			onAttempt(attempt)
+		}
+
+		if attempt.Success() || !attempt.retryable() {
+			break
+		}
+	}
+
+	return attempt, nil
+}
+
+func (c Client) send(ctx context.Context, url, secret string, event Event, body []byte) Attempt {
+	ctx, span := tracing.Start(ctx, "webhook.deliver")
+	defer span.End()
+	span.SetKind(tracing.KindClient)
+	span.SetAttribute("webhook.event_type", event.Type)
+	span.SetAttribute("webhook.delivery_id", event.ID)
+
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		span.RecordError(err)
+		return Attempt{Err: err}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Greenlight-Webhooks/1.0")
+	req.Header.Set("X-Greenlight-Event", event.Type)
+	req.Header.Set("X-Greenlight-Delivery", event.ID)
+	req.Header.Set("X-Greenlight-Timestamp", strconv.FormatInt(start.Unix(), 10))
+	req.Header.Set("X-Greenlight-Signature", Sign(secret, start, body))
+	tracing.Inject(ctx, req.Header)
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return Attempt{Err: err, Duration: time.Since(start)}
+	}
+	defer res.Body.Close()
+
+	// Drain (a bounded amount of) the body so the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	attempt := Attempt{StatusCode: res.StatusCode, Duration: time.Since(start)}
+	if !attempt.Success() {
+		attempt.Err = fmt.Errorf("receiver responded with %s", strings.ToLower(http.StatusText(res.StatusCode)))
+		span.RecordError(attempt.Err)
+	}
+	span.SetAttribute("http.response.status_code", res.StatusCode)
+
+	return attempt
+}
@@ -0,0 +1,292 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"greenlight.bagerbach.com/internal/assert"
+)
+
+const testSecret = "a-very-secret-webhook-key"
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"type":"movie.created"}`)
+	signedAt := time.Now()
+
+	tests := []struct {
+		name         string
+		signedWith   string
+		timestamp    time.Time
+		receivedBody []byte
+		want         bool
+	}{
+		{
+			name:         "Valid",
+			signedWith:   testSecret,
+			timestamp:    signedAt,
+			receivedBody: body,
+			want:         true,
+		},
+		{
+			name:         "Wrong secret",
+			signedWith:   "another-secret-entirely",
+			timestamp:    signedAt,
+			receivedBody: body,
+			want:         false,
+		},
+		{
+			name:         "Tampered body",
+			signedWith:   testSecret,
+			timestamp:    signedAt,
+			receivedBody: []byte(`{"type":"movie.deleted"}`),
+			want:         false,
+		},
+		{
+			name:         "Tampered timestamp",
+			signedWith:   testSecret,
+			timestamp:    signedAt.Add(-time.Hour),
+			receivedBody: body,
+			want:         false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			header.Set("X-Greenlight-Timestamp", strconv.FormatInt(tt.timestamp.Unix(), 10))
+			header.Set("X-Greenlight-Signature", Sign(tt.signedWith, signedAt, body))
+
+			assert.Equal(t, Verify(testSecret, header, tt.receivedBody), tt.want)
+		})
+	}
+}
+
+// newReceiver starts a stand-in webhook receiver that checks every delivery's
+// signature and responds with the given status codes in turn, repeating the last.
+func newReceiver(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if !Verify(testSecret, r.Header, body) {
+			t.Errorf("delivery %d has an invalid signature", n)
+		}
+
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, r.Header.Get("X-Greenlight-Event"), event.Type)
+		assert.Equal(t, r.Header.Get("X-Greenlight-Delivery"), event.ID)
+
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts, &calls
+}
+
+// newTestClient returns a client that, unlike New's, delivers to the test
+// receivers on the loopback address.
+func newTestClient(maxAttempts int, backoff time.Duration) Client {
+	client := New(time.Second, maxAttempts, backoff)
+	client.HTTP = &http.Client{Timeout: time.Second}
+	return client
+}
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+		wantSuccess  bool
+	}{
+		{
+			name:         "Delivered first time",
+			statuses:     []int{http.StatusOK},
+			wantAttempts: 1,
+			wantSuccess:  true,
+		},
+		{
+			name:         "Retried after server errors",
+			statuses:     []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusNoContent},
+			wantAttempts: 3,
+			wantSuccess:  true,
+		},
+		{
+			name:         "Retried when rate limited",
+			statuses:     []int{http.StatusTooManyRequests, http.StatusOK},
+			wantAttempts: 2,
+			wantSuccess:  true,
+		},
+		{
+			name:         "Gives up after max attempts",
+			statuses:     []int{http.StatusServiceUnavailable},
+			wantAttempts: 4,
+			wantSuccess:  false,
+		},
+		{
+			name:         "Client errors are not retried",
+			statuses:     []int{http.StatusGone, http.StatusOK},
+			wantAttempts: 1,
+			wantSuccess:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, calls := newReceiver(t, tt.statuses...)
+
+			client := newTestClient(4, time.Millisecond)
+
+			event, err := NewEvent(EventMovieCreated, map[string]any{"movie": map[string]any{"id": 1}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var logged []Attempt
+			last, err := client.Deliver(context.Background(), ts.URL, testSecret, event, func(a Attempt) {
+				logged = append(logged, a)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, int(calls.Load()), tt.wantAttempts)
+			assert.Equal(t, len(logged), tt.wantAttempts)
+			assert.Equal(t, last.Number, tt.wantAttempts)
+			assert.Equal(t, last.Success(), tt.wantSuccess)
+		})
+	}
+}
+
+func TestDeliverUnreachable(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL
+	ts.Close()
+
+	client := newTestClient(2, time.Millisecond)
+
+	event, err := NewEvent(EventTest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := client.Deliver(context.Background(), url, testSecret, event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, last.Number, 2)
+	assert.Equal(t, last.StatusCode, 0)
+	assert.Equal(t, last.Success(), false)
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.215.14", true},
+		{"2606:2800:21f:cb07:6820:80da:af6b:8b2c", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"fd00:ec2::254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			assert.Equal(t, PublicAddress(netip.MustParseAddr(tt.addr)), tt.want)
+		})
+	}
+}
+
+func TestPublicHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"93.184.215.14", true},
+		{"localhost", false},
+		{"LOCALHOST.", false},
+		{"api.localhost", false},
+		{"127.0.0.1", false},
+		{"[::1]", false},
+		{"169.254.169.254", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			assert.Equal(t, PublicHost(tt.host), tt.want)
+		})
+	}
+}
+
+func TestDeliverRefusesPrivateAddresses(t *testing.T) {
+	ts, calls := newReceiver(t, http.StatusOK)
+
+	event, err := NewEvent(EventTest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second URL names the receiver by a host that resolves to it, as a DNS
+	// rebinding attack would.
+	for _, url := range []string{ts.URL, strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)} {
+		last, err := New(time.Second, 1, 0).Deliver(context.Background(), url, testSecret, event, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, errors.Is(last.Err, ErrNonPublicAddress), true)
+		assert.Equal(t, last.Success(), false)
+	}
+
+	assert.Equal(t, int(calls.Load()), 0)
+}
+
+func TestDeliverCancelled(t *testing.T) {
+	ts, calls := newReceiver(t, http.StatusServiceUnavailable)
+
+	event, err := NewEvent(EventTest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := newTestClient(3, time.Hour)
+
+	last, err := client.Deliver(ctx, ts.URL, testSecret, event, func(Attempt) { cancel() })
+	assert.Equal(t, errors.Is(err, context.Canceled), true)
+	assert.Equal(t, last.Number, 1)
+	assert.Equal(t, int(calls.Load()), 1)
+}
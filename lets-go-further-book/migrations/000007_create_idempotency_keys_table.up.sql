@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key text NOT NULL,
+    -- 0 for anonymous requests, so there is no foreign key to users
+    user_id bigint NOT NULL,
+    method text NOT NULL,
+    path text NOT NULL,
+    fingerprint bytea NOT NULL,
+    -- NULL while the original request is still being processed
+    status integer,
+    headers jsonb,
+    body bytea,
+    expiry timestamp(0) with time zone NOT NULL,
+    -- When the key was reserved; a request still in progress after the lock
+    -- timeout is assumed to have crashed, and the key can be reserved again
+    locked_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (key, user_id, method, path)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expiry_idx ON idempotency_keys (expiry);
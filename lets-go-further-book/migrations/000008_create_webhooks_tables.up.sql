@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    url text NOT NULL,
+    -- Kept in plaintext, as it's needed to sign every delivery
+    secret text NOT NULL,
+    event_types text[] NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS webhook_subscriptions_event_types_idx ON webhook_subscriptions USING GIN (event_types);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    subscription_id bigint NOT NULL REFERENCES webhook_subscriptions ON DELETE CASCADE,
+    event_id text NOT NULL,
+    event_type text NOT NULL,
+    attempt integer NOT NULL,
+    status_code integer NOT NULL,
+    error text NOT NULL,
+    success bool NOT NULL,
+    duration_ms integer NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_id_idx ON webhook_deliveries (subscription_id, id);
+
+INSERT INTO permissions (code) VALUES ('webhooks:manage');
@@ -0,0 +1,41 @@
+CREATE TABLE IF NOT EXISTS movie_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    type text NOT NULL,
+    movie jsonb NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION record_movie_event() RETURNS trigger AS $$
+DECLARE
+    event_id bigint;
+BEGIN
+    -- Readers resume after the last event ID they saw, which only works if IDs
+    -- become visible in order. Sequence values are handed out at insert time, not
+    -- commit time, so without this a transaction could commit event 8 while event
+    -- 7's is still open, and a reader that sees 8 would skip 7 for good. Holding
+    -- this lock until commit serializes the transactions that change movies.
+    PERFORM pg_advisory_xact_lock(7146286331027145217);
+
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO movie_events (type, movie) VALUES ('movie.deleted', to_jsonb(OLD)) RETURNING id INTO event_id;
+    ELSIF TG_OP = 'UPDATE' THEN
+        INSERT INTO movie_events (type, movie) VALUES ('movie.updated', to_jsonb(NEW)) RETURNING id INTO event_id;
+    ELSE
+        INSERT INTO movie_events (type, movie) VALUES ('movie.created', to_jsonb(NEW)) RETURNING id INTO event_id;
+    END IF;
+
+    -- Only the most recent 1000 events are kept for clients resuming a stream.
+    DELETE FROM movie_events WHERE id <= event_id - 1000;
+
+    -- The notification only carries the event ID; listeners read the event itself
+    -- from movie_events. Notifications are delivered when the transaction commits,
+    -- so rolled back changes are never announced.
+    PERFORM pg_notify('movie_events', event_id::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER movies_record_event
+AFTER INSERT OR UPDATE OR DELETE ON movies
+FOR EACH ROW EXECUTE FUNCTION record_movie_event();
@@ -0,0 +1,2 @@
+-- The new address of a user who asked to change their email, until they confirm it
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email citext;
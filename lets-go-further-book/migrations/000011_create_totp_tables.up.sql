@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS totp_credentials (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    secret text NOT NULL,
+    -- false until the user proves their authenticator app has the secret
+    confirmed bool NOT NULL DEFAULT false,
+    -- The last time step a code was accepted for, so no code is accepted twice
+    last_used_step bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    hash bytea NOT NULL,
+    PRIMARY KEY (user_id, hash)
+);
@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO permissions (code) VALUES ('roles:manage');
+
+INSERT INTO roles (name) VALUES ('viewer'), ('editor'), ('admin');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE (roles.name, permissions.code) IN (
+    ('viewer', 'movies:read'),
+    ('editor', 'movies:read'),
+    ('editor', 'movies:write'),
+    ('admin', 'movies:read'),
+    ('admin', 'movies:write'),
+    ('admin', 'webhooks:manage'),
+    ('admin', 'roles:manage')
+);
+
+-- Existing users keep the permissions granted to them directly, which still count
+-- alongside those of their roles.
@@ -0,0 +1,32 @@
+-- Back to the single lock of 000009, from before movies had an organization.
+CREATE OR REPLACE FUNCTION record_movie_event() RETURNS trigger AS $$
+DECLARE
+    event_id bigint;
+BEGIN
+    PERFORM pg_advisory_xact_lock(7146286331027145217);
+
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO movie_events (type, movie) VALUES ('movie.deleted', to_jsonb(OLD)) RETURNING id INTO event_id;
+    ELSIF TG_OP = 'UPDATE' THEN
+        INSERT INTO movie_events (type, movie) VALUES ('movie.updated', to_jsonb(NEW)) RETURNING id INTO event_id;
+    ELSE
+        INSERT INTO movie_events (type, movie) VALUES ('movie.created', to_jsonb(NEW)) RETURNING id INTO event_id;
+    END IF;
+
+    DELETE FROM movie_events WHERE id <= event_id - 1000;
+
+    PERFORM pg_notify('movie_events', event_id::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DELETE FROM idempotency_keys WHERE organization_id <> 0;
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key, user_id, method, path);
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS organization_id;
+ALTER TABLE webhook_subscriptions DROP COLUMN IF EXISTS organization_id;
+ALTER TABLE movies DROP COLUMN IF EXISTS organization_id;
+DROP TABLE IF EXISTS organization_members_permissions;
+DROP TABLE IF EXISTS organization_members;
+DROP TABLE IF EXISTS organizations;
@@ -0,0 +1,112 @@
+CREATE TABLE IF NOT EXISTS organizations (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS organization_members (
+    organization_id bigint NOT NULL REFERENCES organizations ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    -- The role's permissions only apply within the organization, along with those
+    -- in organization_members_permissions.
+    role_id bigint REFERENCES roles ON DELETE SET NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (organization_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS organization_members_user_id_idx ON organization_members (user_id);
+
+-- Permissions granted to a member besides those of their role. Global grants, in
+-- users_permissions and users_roles, don't apply within organizations.
+CREATE TABLE IF NOT EXISTS organization_members_permissions (
+    organization_id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (organization_id, user_id, permission_id),
+    FOREIGN KEY (organization_id, user_id) REFERENCES organization_members ON DELETE CASCADE
+);
+
+-- Everything so far belongs to a single organization, which every existing user is
+-- a member of. Being the first row, it gets ID 1, the default of the new column
+-- below (adding it with a default doesn't fire the movies trigger for every row).
+INSERT INTO organizations (name) VALUES ('Default');
+
+-- Users keep the permissions they had in it: their role in it is the one of their
+-- roles with the most permissions, and whatever else they had, directly or through
+-- their other roles, is granted to them in it.
+INSERT INTO organization_members (organization_id, user_id, role_id)
+SELECT 1, users.id, (
+    SELECT users_roles.role_id FROM users_roles
+    WHERE users_roles.user_id = users.id
+    ORDER BY (SELECT count(*) FROM roles_permissions WHERE roles_permissions.role_id = users_roles.role_id) DESC, users_roles.role_id
+    LIMIT 1
+)
+FROM users;
+
+INSERT INTO organization_members_permissions (organization_id, user_id, permission_id)
+SELECT 1, users_permissions.user_id, users_permissions.permission_id
+FROM users_permissions
+UNION
+SELECT 1, users_roles.user_id, roles_permissions.permission_id
+FROM users_roles
+INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+EXCEPT
+SELECT 1, organization_members.user_id, roles_permissions.permission_id
+FROM organization_members
+INNER JOIN roles_permissions ON roles_permissions.role_id = organization_members.role_id
+WHERE organization_members.organization_id = 1;
+
+ALTER TABLE movies ADD COLUMN organization_id bigint NOT NULL DEFAULT 1 REFERENCES organizations ON DELETE CASCADE;
+ALTER TABLE movies ALTER COLUMN organization_id DROP DEFAULT;
+
+CREATE INDEX IF NOT EXISTS movies_organization_id_idx ON movies (organization_id);
+
+-- Event streams only read their own organization's events, so IDs only have to
+-- become visible in order within an organization. The trigger now takes a lock per
+-- organization rather than one for every movie: writes to one organization's
+-- movies, batches included, are still serialized until they commit, but those of
+-- different organizations no longer wait for each other. Organization IDs past the
+-- range of an integer share their lock with another organization, which only costs
+-- throughput. A transaction changing several organizations' movies takes each of
+-- their locks, and may deadlock with one taking them in another order, in which
+-- case PostgreSQL aborts one of the two.
+CREATE OR REPLACE FUNCTION record_movie_event() RETURNS trigger AS $$
+DECLARE
+    event_id bigint;
+    organization_id bigint;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        organization_id := OLD.organization_id;
+    ELSE
+        organization_id := NEW.organization_id;
+    END IF;
+
+    PERFORM pg_advisory_xact_lock(1664231729, (organization_id % 2147483647)::integer);
+
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO movie_events (type, movie) VALUES ('movie.deleted', to_jsonb(OLD)) RETURNING id INTO event_id;
+    ELSIF TG_OP = 'UPDATE' THEN
+        INSERT INTO movie_events (type, movie) VALUES ('movie.updated', to_jsonb(NEW)) RETURNING id INTO event_id;
+    ELSE
+        INSERT INTO movie_events (type, movie) VALUES ('movie.created', to_jsonb(NEW)) RETURNING id INTO event_id;
+    END IF;
+
+    DELETE FROM movie_events WHERE id <= event_id - 1000;
+
+    PERFORM pg_notify('movie_events', event_id::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Subscriptions only receive the events of their organization's movies.
+ALTER TABLE webhook_subscriptions ADD COLUMN organization_id bigint NOT NULL DEFAULT 1 REFERENCES organizations ON DELETE CASCADE;
+ALTER TABLE webhook_subscriptions ALTER COLUMN organization_id DROP DEFAULT;
+
+CREATE INDEX IF NOT EXISTS webhook_subscriptions_organization_id_idx ON webhook_subscriptions (organization_id);
+
+-- An Idempotency-Key used in one organization says nothing about requests to
+-- another. Requests outside organizations, like registration, have 0.
+ALTER TABLE idempotency_keys ADD COLUMN organization_id bigint NOT NULL DEFAULT 0;
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key, user_id, organization_id, method, path);
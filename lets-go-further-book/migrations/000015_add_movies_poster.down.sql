@@ -0,0 +1,9 @@
+DROP TRIGGER IF EXISTS movies_record_update ON movies;
+DROP TRIGGER IF EXISTS movies_record_event ON movies;
+
+CREATE TRIGGER movies_record_event
+AFTER INSERT OR UPDATE OR DELETE ON movies
+FOR EACH ROW EXECUTE FUNCTION record_movie_event();
+
+ALTER TABLE movies DROP COLUMN IF EXISTS poster_upload;
+ALTER TABLE movies DROP COLUMN IF EXISTS poster_updated_at;
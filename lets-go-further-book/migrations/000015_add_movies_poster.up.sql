@@ -0,0 +1,20 @@
+-- The poster files themselves are kept in file storage. This is NULL for movies
+-- without one.
+ALTER TABLE movies ADD COLUMN poster_updated_at timestamp(0) with time zone;
+-- Each upload's files are stored under a key of their own, and this says which
+-- upload is the movie's poster. It's empty for movies without one.
+ALTER TABLE movies ADD COLUMN poster_upload text NOT NULL DEFAULT '';
+
+-- A new poster isn't an edit of the movie, and doesn't make a new version of it,
+-- so it isn't announced to event streams and webhooks as movie.updated either.
+-- Only updates that change the version are recorded.
+DROP TRIGGER IF EXISTS movies_record_event ON movies;
+
+CREATE TRIGGER movies_record_event
+AFTER INSERT OR DELETE ON movies
+FOR EACH ROW EXECUTE FUNCTION record_movie_event();
+
+CREATE TRIGGER movies_record_update
+AFTER UPDATE ON movies
+FOR EACH ROW WHEN (OLD.version IS DISTINCT FROM NEW.version)
+EXECUTE FUNCTION record_movie_event();